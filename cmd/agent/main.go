@@ -2,7 +2,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"time"
 
 	"github.com/aylei/kubectl-debug/pkg/agent"
 )
@@ -10,13 +14,36 @@ import (
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	var configFile string
+	var idleTimeout time.Duration
+	var validateConfig bool
 	flag.StringVar(&configFile, "config.file", "", "Config file location.")
+	flag.DurationVar(&idleTimeout, "idle.timeout", 0, "Exit when there is no debug session for this long, overrides the config file.")
+	flag.BoolVar(&validateConfig, "validate-config", false, "Validate the config file and exit.")
 	flag.Parse()
 
+	if validateConfig {
+		content, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			log.Fatalf("error reading config %v", err)
+		}
+		problems := agent.ValidateConfig(content)
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", configFile, problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("%s is valid\n", configFile)
+		return
+	}
+
 	config, err := agent.LoadFile(configFile)
 	if err != nil {
 		log.Fatalf("error reading config %v", err)
 	}
+	if idleTimeout > 0 {
+		config.IdleTimeout = idleTimeout
+	}
 
 	server, err := agent.NewServer(config)
 	if err != nil {
@@ -0,0 +1,240 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aylei/kubectl-debug/pkg/nsenter"
+)
+
+const (
+	defaultCaptureInterface = "any"
+	defaultCaptureSnaplen   = 262144
+
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+
+	pcapngSectionHeader        = 0x0a0d0d0a
+	pcapngInterfaceDescription = 0x00000001
+	pcapngEnhancedPacket       = 0x00000006
+	pcapngByteOrderMagic       = 0x1a2b3c4d
+	pcapngOptionIfName         = 2
+	pcapngOptionIfTsresol      = 9
+)
+
+// errCaptureLimit stops the capture once the byte limit is reached
+var errCaptureLimit = errors.New("capture byte limit reached")
+
+// ServeCapture captures the packets in the network namespace of the target container with
+// tcpdump and streams them as pcapng, till the duration or the byte limit is reached
+func (s *Server) ServeCapture(w http.ResponseWriter, req *http.Request) {
+	iface := req.FormValue("interface")
+	if len(iface) < 1 {
+		iface = defaultCaptureInterface
+	}
+	filter := req.FormValue("filter")
+	duration := s.config.CaptureMaxDuration
+	if d := req.FormValue("duration"); len(d) > 0 {
+		parsed, err := time.ParseDuration(d)
+		if err != nil || parsed < 0 {
+			http.Error(w, "invalid duration", 400)
+			return
+		}
+		if parsed > 0 && (duration <= 0 || parsed < duration) {
+			duration = parsed
+		}
+	}
+	maxBytes := s.config.CaptureMaxBytes
+	if b := req.FormValue("maxBytes"); len(b) > 0 {
+		parsed, err := strconv.ParseInt(b, 10, 64)
+		if err != nil || parsed < 0 {
+			http.Error(w, "invalid byte limit", 400)
+			return
+		}
+		if parsed > 0 && (maxBytes <= 0 || parsed < maxBytes) {
+			maxBytes = parsed
+		}
+	}
+	snaplen := defaultCaptureSnaplen
+	if sl := req.FormValue("snaplen"); len(sl) > 0 {
+		parsed, err := strconv.Atoi(sl)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "invalid snaplen", 400)
+			return
+		}
+		snaplen = parsed
+	}
+
+	detail := fmt.Sprintf("interface %s filter %q duration %v bytes %d", iface, filter, duration, maxBytes)
+	s.serveTool(w, req, "capture", detail, false,
+		func(ctx context.Context, target ContainerInfo, in io.Reader, out, errOut io.Writer) error {
+			if duration > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, duration)
+				defer cancel()
+			}
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			args := []string{"-i", iface, "-U", "-w", "-", "-s", strconv.Itoa(snaplen)}
+			if len(filter) > 0 {
+				// the filter is never parsed as an option, e.g. -w writing a file of the node
+				args = append(args, "--", filter)
+			}
+			enter := &nsenter.NetNSEnter{Target: target.Pid}
+			cmd, err := enter.Command(ctx, "tcpdump", args...)
+			if err != nil {
+				return err
+			}
+			cmd.Stderr = errOut
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				return err
+			}
+			if err := cmd.Start(); err != nil {
+				return err
+			}
+			convErr := pcapToPcapng(stdout, out, iface, maxBytes)
+			if convErr != nil {
+				// stop the capture at the byte limit or when the client is gone
+				cancel()
+			}
+			waitErr := cmd.Wait()
+			switch {
+			case convErr == errCaptureLimit:
+				fmt.Fprintf(errOut, "capture stopped at the limit of %d bytes\n", maxBytes)
+				return nil
+			case convErr != nil:
+				return convErr
+			case ctx.Err() == nil && waitErr != nil:
+				return fmt.Errorf("tcpdump failed: %v", waitErr)
+			}
+			return nil
+		})
+}
+
+// pcapToPcapng converts the pcap stream of tcpdump to pcapng, the output
+// stays a valid capture when the byte limit is reached
+func pcapToPcapng(in io.Reader, out io.Writer, iface string, maxBytes int64) error {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(in, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// tcpdump failed before capturing, its error is on stderr
+			return nil
+		}
+		return err
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint32(header)
+	if magic != pcapMagicMicros && magic != pcapMagicNanos {
+		order = binary.BigEndian
+		magic = order.Uint32(header)
+	}
+	var tsresol byte
+	switch magic {
+	case pcapMagicMicros:
+		tsresol = 6
+	case pcapMagicNanos:
+		tsresol = 9
+	default:
+		return fmt.Errorf("unexpected pcap magic %x", header[:4])
+	}
+	snaplen := order.Uint32(header[16:])
+	linktype := order.Uint32(header[20:])
+
+	var written int64
+	write := func(block []byte) error {
+		if maxBytes > 0 && written+int64(len(block)) > maxBytes {
+			return errCaptureLimit
+		}
+		written += int64(len(block))
+		_, err := out.Write(block)
+		return err
+	}
+	if err := write(pcapngHeader(iface, uint16(linktype), snaplen, tsresol)); err != nil {
+		return err
+	}
+
+	record := make([]byte, 16)
+	var scale uint64 = 1000000
+	if tsresol == 9 {
+		scale = 1000000000
+	}
+	for {
+		if _, err := io.ReadFull(in, record); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+		ts := uint64(order.Uint32(record))*scale + uint64(order.Uint32(record[4:]))
+		captured := order.Uint32(record[8:])
+		original := order.Uint32(record[12:])
+		if captured > snaplen && snaplen > 0 {
+			return fmt.Errorf("invalid pcap record of %d bytes", captured)
+		}
+		padded := (captured + 3) &^ 3
+		length := 32 + padded
+		block := make([]byte, length)
+		le := binary.LittleEndian
+		le.PutUint32(block, pcapngEnhancedPacket)
+		le.PutUint32(block[4:], length)
+		le.PutUint32(block[8:], 0)
+		le.PutUint32(block[12:], uint32(ts>>32))
+		le.PutUint32(block[16:], uint32(ts))
+		le.PutUint32(block[20:], captured)
+		le.PutUint32(block[24:], original)
+		if _, err := io.ReadFull(in, block[28:28+captured]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+		le.PutUint32(block[length-4:], length)
+		if err := write(block); err != nil {
+			return err
+		}
+	}
+}
+
+// pcapngHeader returns the section header and the interface description blocks
+func pcapngHeader(iface string, linktype uint16, snaplen uint32, tsresol byte) []byte {
+	le := binary.LittleEndian
+	shb := make([]byte, 28)
+	le.PutUint32(shb, pcapngSectionHeader)
+	le.PutUint32(shb[4:], 28)
+	le.PutUint32(shb[8:], pcapngByteOrderMagic)
+	le.PutUint16(shb[12:], 1)
+	le.PutUint16(shb[14:], 0)
+	// unknown section length
+	le.PutUint64(shb[16:], 0xffffffffffffffff)
+	le.PutUint32(shb[24:], 28)
+
+	option := func(code uint16, value []byte) []byte {
+		opt := make([]byte, 4+(len(value)+3)&^3)
+		le.PutUint16(opt, code)
+		le.PutUint16(opt[2:], uint16(len(value)))
+		copy(opt[4:], value)
+		return opt
+	}
+	var options []byte
+	options = append(options, option(pcapngOptionIfName, []byte(iface))...)
+	options = append(options, option(pcapngOptionIfTsresol, []byte{tsresol})...)
+	// end of options
+	options = append(options, 0, 0, 0, 0)
+
+	length := uint32(20 + len(options))
+	idb := make([]byte, length)
+	le.PutUint32(idb, pcapngInterfaceDescription)
+	le.PutUint32(idb[4:], length)
+	le.PutUint16(idb[8:], linktype)
+	le.PutUint32(idb[12:], snaplen)
+	copy(idb[16:], options)
+	le.PutUint32(idb[length-4:], length)
+	return append(shb, idb...)
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testPcap returns a pcap stream of packets of the given sizes, captured at 1.000002s
+func testPcap(order binary.ByteOrder, magic uint32, sizes ...int) []byte {
+	var buf bytes.Buffer
+	header := make([]byte, 24)
+	order.PutUint32(header, magic)
+	order.PutUint16(header[4:], 2)
+	order.PutUint16(header[6:], 4)
+	order.PutUint32(header[16:], 65535)
+	order.PutUint32(header[20:], 1)
+	buf.Write(header)
+	for _, size := range sizes {
+		record := make([]byte, 16)
+		order.PutUint32(record, 1)
+		order.PutUint32(record[4:], 2)
+		order.PutUint32(record[8:], uint32(size))
+		order.PutUint32(record[12:], uint32(size))
+		buf.Write(record)
+		buf.Write(bytes.Repeat([]byte{0xab}, size))
+	}
+	return buf.Bytes()
+}
+
+// pcapngPackets checks the block lengths of a pcapng stream and returns
+// the timestamps and the captured lengths of its packets
+func pcapngPackets(t *testing.T, data []byte) ([]uint64, []uint32) {
+	le := binary.LittleEndian
+	var timestamps []uint64
+	var lengths []uint32
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block of %d bytes", len(data))
+		}
+		blockType, length := le.Uint32(data), le.Uint32(data[4:])
+		if length%4 != 0 || int(length) > len(data) || le.Uint32(data[length-4:]) != length {
+			t.Fatalf("invalid block of type %x and length %d", blockType, length)
+		}
+		if blockType == pcapngEnhancedPacket {
+			timestamps = append(timestamps, uint64(le.Uint32(data[12:]))<<32|uint64(le.Uint32(data[16:])))
+			lengths = append(lengths, le.Uint32(data[20:]))
+		}
+		data = data[length:]
+	}
+	return timestamps, lengths
+}
+
+func TestPcapToPcapng(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       []byte
+		maxBytes int64
+		wantTs   uint64
+		wantLens []uint32
+		wantErr  error
+		wantFail bool
+	}{
+		{
+			name:     "little endian micros",
+			in:       testPcap(binary.LittleEndian, pcapMagicMicros, 60, 1, 0),
+			wantTs:   1000002,
+			wantLens: []uint32{60, 1, 0},
+		},
+		{
+			name:     "big endian nanos",
+			in:       testPcap(binary.BigEndian, pcapMagicNanos, 42),
+			wantTs:   1000000002,
+			wantLens: []uint32{42},
+		},
+		{
+			name: "tcpdump failed before the header",
+			in:   nil,
+		},
+		{
+			name:     "truncated record",
+			in:       testPcap(binary.LittleEndian, pcapMagicMicros, 60, 60)[:24+16+60+10],
+			wantTs:   1000002,
+			wantLens: []uint32{60},
+		},
+		{
+			name:     "byte limit",
+			in:       testPcap(binary.LittleEndian, pcapMagicMicros, 60, 60, 60),
+			maxBytes: int64(len(pcapngHeader("eth0", 1, 65535, 6))) + 2*(32+60),
+			wantTs:   1000002,
+			wantLens: []uint32{60, 60},
+			wantErr:  errCaptureLimit,
+			wantFail: true,
+		},
+		{
+			name:     "invalid magic",
+			in:       make([]byte, 24),
+			wantFail: true,
+		},
+		{
+			name:     "record larger than the snaplen",
+			in:       testPcap(binary.LittleEndian, pcapMagicMicros, 70000),
+			wantFail: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := pcapToPcapng(bytes.NewReader(tt.in), &out, "eth0", tt.maxBytes)
+			if (err != nil) != tt.wantFail || (tt.wantErr != nil && err != tt.wantErr) {
+				t.Fatalf("pcapToPcapng() error = %v", err)
+			}
+			if tt.maxBytes > 0 && int64(out.Len()) > tt.maxBytes {
+				t.Errorf("wrote %d bytes over the limit of %d", out.Len(), tt.maxBytes)
+			}
+			timestamps, lengths := pcapngPackets(t, out.Bytes())
+			if len(lengths) != len(tt.wantLens) {
+				t.Fatalf("packets of %v bytes, want %v", lengths, tt.wantLens)
+			}
+			for i := range lengths {
+				if lengths[i] != tt.wantLens[i] || timestamps[i] != tt.wantTs {
+					t.Errorf("packet %d of %d bytes at %d, want %d bytes at %d", i, lengths[i], timestamps[i], tt.wantLens[i], tt.wantTs)
+				}
+			}
+		})
+	}
+}
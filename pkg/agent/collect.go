@@ -0,0 +1,471 @@
+package agent
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aylei/kubectl-debug/pkg/nsenter"
+)
+
+// CollectorConfig is a command run in the namespaces of the target by kubectl debug collect
+type CollectorConfig struct {
+	Name    string   `yaml:"name"`
+	Command []string `yaml:"command"`
+	// namespaces of the target to enter, default to net, pid, uts and ipc. The command
+	// and /proc are the ones of the agent unless the mount namespace is entered.
+	Namespaces []string `yaml:"namespaces,omitempty"`
+}
+
+// collectFunc writes the result of a collector run against the target
+type collectFunc func(ctx context.Context, target ContainerInfo, out io.Writer) error
+
+type collector struct {
+	name    string
+	collect collectFunc
+}
+
+var (
+	// builtinCollectors read the target from the agent, so the target needs no tools
+	builtinCollectors = []collector{
+		{"processes", collectProcesses},
+		{"sockets", collectSockets},
+		{"status", collectProcFile("status")},
+		{"limits", collectProcFile("limits")},
+		{"environ", collectEnviron},
+		{"cgroup", collectCgroup},
+		{"mounts", collectProcFile("mountinfo")},
+		{"dns", collectDNS},
+	}
+
+	defaultCollectorNamespaces = []string{"net", "pid", "uts", "ipc"}
+
+	// the values of the environment variables matching are redacted
+	secretEnvPattern = regexp.MustCompile(`(?i)secret|passw|token|key|credential|auth|private|cookie|dsn`)
+
+	tcpStates = map[string]string{
+		"01": "ESTABLISHED", "02": "SYN_SENT", "03": "SYN_RECV", "04": "FIN_WAIT1",
+		"05": "FIN_WAIT2", "06": "TIME_WAIT", "07": "CLOSE", "08": "CLOSE_WAIT",
+		"09": "LAST_ACK", "0A": "LISTEN", "0B": "CLOSING",
+	}
+)
+
+// ServeCollect runs the collectors against the target container and streams their
+// results as a tar archive, a failed collector doesn't fail the others
+func (s *Server) ServeCollect(w http.ResponseWriter, req *http.Request) {
+	collectors := s.collectors()
+	if names := req.FormValue("collectors"); len(names) > 0 {
+		var err error
+		collectors, err = selectCollectors(collectors, strings.Split(names, ","))
+		if err != nil {
+			http.Error(w, strings.ReplaceAll(err.Error(), ":", "-"), 400)
+			return
+		}
+	}
+	var names []string
+	for _, c := range collectors {
+		names = append(names, c.name)
+	}
+	s.serveTool(w, req, "collect", strings.Join(names, ","), false,
+		func(ctx context.Context, target ContainerInfo, in io.Reader, out, errOut io.Writer) error {
+			tw := tar.NewWriter(out)
+			for _, c := range collectors {
+				var buf bytes.Buffer
+				collectCtx, cancel := context.WithTimeout(ctx, s.config.CollectTimeout)
+				err := c.collect(collectCtx, target, &buf)
+				cancel()
+				if err != nil {
+					fmt.Fprintf(errOut, "collector %s failed: %v\n", c.name, err)
+					fmt.Fprintf(&buf, "\ncollector failed: %v\n", err)
+				}
+				hdr := &tar.Header{
+					Name:    c.name + ".txt",
+					Mode:    0644,
+					Size:    int64(buf.Len()),
+					ModTime: time.Now(),
+				}
+				if err := tw.WriteHeader(hdr); err != nil {
+					return err
+				}
+				if _, err := tw.Write(buf.Bytes()); err != nil {
+					return err
+				}
+			}
+			return tw.Close()
+		})
+}
+
+// collectors returns the builtin collectors and the configured ones,
+// a configured collector replaces the builtin one of the same name
+func (s *Server) collectors() []collector {
+	configured := map[string]CollectorConfig{}
+	for _, c := range s.config.Collectors {
+		configured[c.Name] = c
+	}
+	var collectors []collector
+	for _, c := range builtinCollectors {
+		if cfg, ok := configured[c.name]; ok {
+			c = collector{name: cfg.Name, collect: commandCollector(cfg)}
+			delete(configured, c.name)
+		}
+		collectors = append(collectors, c)
+	}
+	for _, cfg := range s.config.Collectors {
+		if _, ok := configured[cfg.Name]; ok {
+			collectors = append(collectors, collector{name: cfg.Name, collect: commandCollector(cfg)})
+		}
+	}
+	return collectors
+}
+
+func selectCollectors(collectors []collector, names []string) ([]collector, error) {
+	byName := map[string]collector{}
+	for _, c := range collectors {
+		byName[c.name] = c
+	}
+	var selected []collector
+	for _, name := range names {
+		c, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown collector %s", name)
+		}
+		selected = append(selected, c)
+	}
+	return selected, nil
+}
+
+// commandCollector runs the command of the collector in the namespaces of the target
+func commandCollector(cfg CollectorConfig) collectFunc {
+	return func(ctx context.Context, target ContainerInfo, out io.Writer) error {
+		if len(cfg.Command) < 1 {
+			return fmt.Errorf("collector %s has no command", cfg.Name)
+		}
+		namespaces := cfg.Namespaces
+		if len(namespaces) < 1 {
+			namespaces = defaultCollectorNamespaces
+		}
+		enter := &nsenter.NSEnter{Target: target.Pid, Namespaces: namespaces}
+		cmd, err := enter.Command(ctx, cfg.Command[0], cfg.Command[1:]...)
+		if err != nil {
+			return err
+		}
+		cmd.Stdout = out
+		cmd.Stderr = out
+		return cmd.Run()
+	}
+}
+
+// collectProcFile copies a file of /proc/<pid> of the target
+func collectProcFile(name string) collectFunc {
+	return func(ctx context.Context, target ContainerInfo, out io.Writer) error {
+		f, err := os.Open(fmt.Sprintf("/proc/%d/%s", target.Pid, name))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(out, f)
+		return err
+	}
+}
+
+// targetProcesses returns the host pids of the processes in the pid namespace of the target
+func targetProcesses(target ContainerInfo) ([]int, error) {
+	ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", target.Pid))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if link, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", pid)); err == nil && link == ns {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// procStatus parses /proc/<pid>/status
+func procStatus(pid int) (map[string]string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	status := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			status[parts[0]] = strings.TrimSpace(parts[1])
+		}
+	}
+	return status, nil
+}
+
+// collectProcesses lists the processes of the target like ps, with the pids
+// seen in the container and on the host
+func collectProcesses(ctx context.Context, target ContainerInfo, out io.Writer) error {
+	pids, err := targetProcesses(target)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PID\tHOST PID\tHOST PPID\tSTATE\tRSS\tTHREADS\tCOMMAND")
+	for _, pid := range pids {
+		status, err := procStatus(pid)
+		if err != nil {
+			// the process exited
+			continue
+		}
+		nsPid := strconv.Itoa(pid)
+		if fields := strings.Fields(status["NSpid"]); len(fields) > 0 {
+			nsPid = fields[len(fields)-1]
+		}
+		command := "[" + status["Name"] + "]"
+		if cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil && len(cmdline) > 0 {
+			command = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", nsPid, pid, status["PPid"], status["State"],
+			status["VmRSS"], status["Threads"], command)
+	}
+	return w.Flush()
+}
+
+// collectSockets lists the tcp and udp sockets of the network namespace of the target
+// like ss -tuanp, the sockets are mapped to the processes of the target holding them
+func collectSockets(ctx context.Context, target ContainerInfo, out io.Writer) error {
+	owners := map[string]string{}
+	if pids, err := targetProcesses(target); err == nil {
+		for _, pid := range pids {
+			fds, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+			if err != nil {
+				continue
+			}
+			for _, fd := range fds {
+				link, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%s", pid, fd.Name()))
+				if err == nil && strings.HasPrefix(link, "socket:[") {
+					owners[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = strconv.Itoa(pid)
+				}
+			}
+		}
+	}
+
+	counts := map[string]int{}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROTO\tLOCAL\tREMOTE\tSTATE\tHOST PID")
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/net/%s", target.Pid, proto))
+		if os.IsNotExist(err) {
+			// ipv6 is disabled
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		lines := strings.Split(string(data), "\n")
+		for _, line := range lines[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 10 {
+				continue
+			}
+			state := tcpStates[fields[3]]
+			if strings.HasPrefix(proto, "udp") {
+				state = "UNCONN"
+				if fields[3] == "01" {
+					state = "ESTABLISHED"
+				}
+			}
+			counts[proto+" "+state]++
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", proto, decodeSocketAddress(fields[1]),
+				decodeSocketAddress(fields[2]), state, owners[fields[9]])
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	var keys []string
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintln(out, "\nSUMMARY")
+	for _, key := range keys {
+		fmt.Fprintf(out, "%s: %d\n", key, counts[key])
+	}
+	return nil
+}
+
+// decodeSocketAddress decodes an address of /proc/net/tcp, the ip is
+// hex encoded in 32 bit words of the host byte order, i.e. little endian
+func decodeSocketAddress(address string) string {
+	parts := strings.SplitN(address, ":", 2)
+	if len(parts) != 2 {
+		return address
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil || (len(parts[0]) != 8 && len(parts[0]) != 32) {
+		return address
+	}
+	ip := make(net.IP, len(parts[0])/2)
+	for i := 0; i < len(ip); i += 4 {
+		word, err := strconv.ParseUint(parts[0][i*2:i*2+8], 16, 32)
+		if err != nil {
+			return address
+		}
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = byte(word), byte(word>>8), byte(word>>16), byte(word>>24)
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// collectEnviron writes the environment of the target, the values of the
+// variables looking like secrets are redacted
+func collectEnviron(ctx context.Context, target ContainerInfo, out io.Writer) error {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", target.Pid))
+	if err != nil {
+		return err
+	}
+	for _, env := range strings.Split(string(data), "\x00") {
+		if len(env) < 1 {
+			continue
+		}
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) == 2 && secretEnvPattern.MatchString(parts[0]) {
+			env = parts[0] + "=<redacted>"
+		}
+		fmt.Fprintln(out, env)
+	}
+	return nil
+}
+
+// collectCgroup writes the cgroups of the target with their cpu, memory and pids stats
+func collectCgroup(ctx context.Context, target ContainerInfo, out io.Writer) error {
+	path := fmt.Sprintf("/proc/%d/cgroup", target.Pid)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "== %s\n%s\n", path, data)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		var dir string
+		var files []string
+		switch {
+		case parts[0] == "0" && len(parts[1]) == 0:
+			dir = filepath.Join("/sys/fs/cgroup", parts[2])
+			files = []string{"cpu.max", "cpu.stat", "cpu.pressure", "memory.current", "memory.max",
+				"memory.events", "memory.stat", "memory.pressure", "pids.current", "pids.max", "io.stat"}
+		case strings.Contains(parts[1], "memory"):
+			dir = filepath.Join("/sys/fs/cgroup", parts[1], parts[2])
+			files = []string{"memory.usage_in_bytes", "memory.max_usage_in_bytes", "memory.limit_in_bytes",
+				"memory.failcnt", "memory.stat"}
+		case strings.Contains(parts[1], "cpu"):
+			dir = filepath.Join("/sys/fs/cgroup", parts[1], parts[2])
+			files = []string{"cpu.cfs_quota_us", "cpu.cfs_period_us", "cpu.shares", "cpu.stat", "cpuacct.usage"}
+		case strings.Contains(parts[1], "pids"):
+			dir = filepath.Join("/sys/fs/cgroup", parts[1], parts[2])
+			files = []string{"pids.current", "pids.max"}
+		default:
+			continue
+		}
+		for _, file := range files {
+			content, err := ioutil.ReadFile(filepath.Join(dir, file))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				fmt.Fprintf(out, "== %s\nerror: %v\n\n", filepath.Join(dir, file), err)
+				continue
+			}
+			fmt.Fprintf(out, "== %s\n%s\n", filepath.Join(dir, file), content)
+		}
+	}
+	return scanner.Err()
+}
+
+// collectDNS writes the resolv.conf of the target and resolves kubernetes.default
+// with each of its nameservers and search domains, from the network namespace of the target
+func collectDNS(ctx context.Context, target ContainerInfo, out io.Writer) error {
+	data, err := readFileInRoot(target, "/etc/resolv.conf")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "== /etc/resolv.conf\n%s\n", data)
+
+	var nameservers, search []string
+	ndots := 1
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			nameservers = append(nameservers, fields[1])
+		case "search":
+			search = fields[1:]
+		case "options":
+			for _, option := range fields[1:] {
+				if strings.HasPrefix(option, "ndots:") {
+					if n, err := strconv.Atoi(strings.TrimPrefix(option, "ndots:")); err == nil {
+						ndots = n
+					}
+				}
+			}
+		}
+	}
+	name := "kubernetes.default"
+	var candidates []string
+	if strings.Count(name, ".") < ndots {
+		for _, domain := range search {
+			candidates = append(candidates, name+"."+domain+".")
+		}
+	}
+	candidates = append(candidates, name+".")
+
+	fmt.Fprintln(out, "== lookups")
+	for _, nameserver := range nameservers {
+		server := net.JoinHostPort(nameserver, "53")
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialInNetNS(target.Pid, network, server)
+			},
+		}
+		for _, candidate := range candidates {
+			start := time.Now()
+			addrs, err := resolver.LookupHost(ctx, candidate)
+			took := time.Since(start).Round(time.Millisecond)
+			if err != nil {
+				fmt.Fprintf(out, "%s %s: %v (%v)\n", nameserver, candidate, err, took)
+				continue
+			}
+			fmt.Fprintf(out, "%s %s: %s (%v)\n", nameserver, candidate, strings.Join(addrs, " "), took)
+		}
+	}
+	return nil
+}
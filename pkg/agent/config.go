@@ -3,8 +3,14 @@ package agent
 import (
 	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"time"
 
+	term "github.com/aylei/kubectl-debug/pkg/util"
 	"gopkg.in/yaml.v2"
 )
 
@@ -18,6 +24,22 @@ var (
 
 		ListenAddress: "0.0.0.0:10027",
 
+		PrePullTimeout: 10 * time.Minute,
+
+		DetachGracePeriod: 5 * time.Minute,
+		DetachBufferSize:  64 * 1024,
+
+		CaptureMaxDuration: time.Hour,
+		CaptureMaxBytes:    1 << 30,
+
+		CollectTimeout: 30 * time.Second,
+
+		WebUI: WebUIConfig{
+			ListenAddress: "0.0.0.0:10028",
+			DefaultImage:  "nicolaka/netshoot:latest",
+			AssetsDir:     "/usr/share/kubectl-debug/webui",
+		},
+
 		AuditFifo: "/var/data/kubectl-debug-audit-fifo/KCTLDBG-CONTAINER-ID",
 		AuditShim: []string{"/usr/bin/strace", "-o", "KCTLDBG-FIFO", "-f", "-e", "trace=/exec"},
 	}
@@ -33,6 +55,51 @@ type Config struct {
 	ListenAddress string `yaml:"listen_address,omitempty"`
 	Verbosity     int    `yaml:"verbosity,omitempty"`
 
+	// exit when there is no debug session for the idle timeout, 0 means never
+	IdleTimeout time.Duration `yaml:"idle_timeout,omitempty"`
+
+	// keep the debug container for the grace period after the client disconnects,
+	// so that the session can be reattached, 0 removes the container at once
+	DetachGracePeriod time.Duration `yaml:"detach_grace_period,omitempty"`
+	// bytes of the latest output replayed on reattach
+	DetachBufferSize int `yaml:"detach_buffer_size,omitempty"`
+
+	// registry mirrors, TLS settings and credentials keyed by registry host, e.g. docker.io
+	Registries map[string]RegistryConfig `yaml:"registries,omitempty"`
+	// credentials of the node docker config.json are used for the registries
+	// without credentials in Registries
+	DockerConfigFile string `yaml:"docker_config_file,omitempty"`
+
+	// debug images pulled at startup and refreshed every PrePullInterval if set
+	PrePullImages   []string      `yaml:"pre_pull_images,omitempty"`
+	PrePullInterval time.Duration `yaml:"pre_pull_interval,omitempty"`
+	PrePullTimeout  time.Duration `yaml:"pre_pull_timeout,omitempty"`
+	// docker or containerd, default to docker if its socket exists
+	PrePullRuntime string `yaml:"pre_pull_runtime,omitempty"`
+
+	// paths of the node the clients may bind mount into the debug container, none by default
+	AllowedMountPaths []string `yaml:"allowed_mount_paths,omitempty"`
+	// security profiles of the debug container the clients may ask for:
+	// restricted, default, netadmin or sysadmin, all of them by default.
+	// The requests without a profile get the first one.
+	AllowedSecurityProfiles []string `yaml:"allowed_security_profiles,omitempty"`
+
+	// verification of the debug images before they are run
+	ImageVerification ImageVerificationConfig `yaml:"image_verification,omitempty"`
+
+	// limits of the packet captures, the client may ask for lower ones
+	CaptureMaxDuration time.Duration `yaml:"capture_max_duration,omitempty"`
+	CaptureMaxBytes    int64         `yaml:"capture_max_bytes,omitempty"`
+
+	// commands run by kubectl debug collect in addition to the builtin collectors,
+	// a collector named after a builtin one replaces it
+	Collectors []CollectorConfig `yaml:"collectors,omitempty"`
+	// timeout of each collector
+	CollectTimeout time.Duration `yaml:"collect_timeout,omitempty"`
+
+	// browser terminal, disabled by default
+	WebUI WebUIConfig `yaml:"web_ui,omitempty"`
+
 	Audit     bool     `yaml:"audit,omitempty"`
 	AuditFifo string   `yaml:"audit_fifo,omitempty"`
 	AuditShim []string `yaml:"audit_shim,omitempty"`
@@ -45,14 +112,128 @@ func Load(s string) (*Config, error) {
 	// point as well.
 	*cfg = DefaultConfig
 
-	err := yaml.UnmarshalStrict([]byte(s), cfg)
+	err := yaml.Unmarshal([]byte(s), cfg)
 	fmt.Printf("Config after reading from file %v\r\n", cfg)
 	if err != nil {
 		return nil, err
 	}
+	// the unknown keys, e.g. of a newer agent version, don't stop the agent,
+	// --validate-config rejects them
+	strict := DefaultConfig
+	if err := yaml.UnmarshalStrict([]byte(s), &strict); err != nil {
+		for _, problem := range term.YAMLProblems(err) {
+			log.Printf("warning: config %s\r\n", problem)
+		}
+	}
 	return cfg, nil
 }
 
+// ValidateConfig checks a config file, the problems are reported with their line when it is known
+func ValidateConfig(content []byte) []term.ConfigProblem {
+	cfg := DefaultConfig
+	var problems []term.ConfigProblem
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		problems = append(problems, term.YAMLProblems(err)...)
+	}
+	lines := term.YAMLKeyLines(content)
+	report := func(key, format string, args ...interface{}) {
+		problems = append(problems, term.ConfigProblem{
+			Line:    lines.Line(key),
+			Message: key + ": " + fmt.Sprintf(format, args...),
+		})
+	}
+	checkAddress := func(key, address string) string {
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			report(key, "invalid address %q: %v", address, err)
+			return ""
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+			report(key, "invalid port %q", port)
+			return ""
+		}
+		return port
+	}
+
+	port := checkAddress("listen_address", cfg.ListenAddress)
+	if cfg.WebUI.Enabled {
+		if webPort := checkAddress("web_ui.listen_address", cfg.WebUI.ListenAddress); len(port) > 0 && port == webPort {
+			report("web_ui.listen_address", "conflicts with the port %s of listen_address", port)
+		}
+		if len(cfg.WebUI.TLSCertFile) < 1 || len(cfg.WebUI.TLSKeyFile) < 1 {
+			report("web_ui", "tls_cert_file and tls_key_file are required, the browser sends the tokens of the users")
+		}
+	}
+	switch cfg.PrePullRuntime {
+	case "", string(DockerScheme), string(ContainerdScheme):
+	default:
+		report("pre_pull_runtime", "unknown runtime %q, expect %s or %s", cfg.PrePullRuntime, DockerScheme, ContainerdScheme)
+	}
+	switch cfg.ImageVerification.Mode {
+	case "", VerifyNone, VerifyDigest, VerifySignature:
+	default:
+		report("image_verification.mode", "unknown mode %q, expect %s, %s or %s", cfg.ImageVerification.Mode,
+			VerifyNone, VerifyDigest, VerifySignature)
+	}
+	for _, d := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"runtime_timeout", cfg.RuntimeTimeout},
+		{"stream_idle_timeout", cfg.StreamIdleTimeout},
+		{"stream_creation_timeout", cfg.StreamCreationTimeout},
+		{"idle_timeout", cfg.IdleTimeout},
+		{"detach_grace_period", cfg.DetachGracePeriod},
+		{"pre_pull_interval", cfg.PrePullInterval},
+		{"pre_pull_timeout", cfg.PrePullTimeout},
+		{"capture_max_duration", cfg.CaptureMaxDuration},
+		{"collect_timeout", cfg.CollectTimeout},
+	} {
+		if d.value < 0 {
+			report(d.key, "must not be negative")
+		}
+	}
+	if cfg.CaptureMaxBytes < 0 {
+		report("capture_max_bytes", "must not be negative")
+	}
+	if cfg.DetachBufferSize < 0 {
+		report("detach_buffer_size", "must not be negative")
+	}
+	for i, path := range cfg.AllowedMountPaths {
+		if !filepath.IsAbs(path) {
+			report(fmt.Sprintf("allowed_mount_paths[%d]", i), "the path %q must be absolute", path)
+		}
+	}
+	for i, profile := range cfg.AllowedSecurityProfiles {
+		if _, ok := securityProfiles[profile]; !ok {
+			report(fmt.Sprintf("allowed_security_profiles[%d]", i), "unknown security profile %q", profile)
+		}
+	}
+	names := map[string]bool{}
+	for i, collector := range cfg.Collectors {
+		key := fmt.Sprintf("collectors[%d]", i)
+		if len(collector.Name) < 1 {
+			report(key, "the collector must have a name")
+		} else if names[collector.Name] {
+			report(key, "duplicate collector %s", collector.Name)
+		}
+		names[collector.Name] = true
+		if len(collector.Command) < 1 {
+			report(key, "the collector must have a command")
+		}
+		for _, ns := range collector.Namespaces {
+			switch ns {
+			case "mount", "uts", "ipc", "net", "pid", "cgroup", "user":
+			default:
+				report(key+".namespaces", "unknown namespace %q", ns)
+			}
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	return problems
+}
+
 func LoadFile(filename string) (*Config, error) {
 	if len(filename) < 1 {
 		fmt.Println("No config file provided.  Using all default values.")
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		wantIdle    time.Duration
+		wantWarning string
+		wantErr     bool
+	}{
+		{
+			name:     "known keys",
+			content:  "idle_timeout: 1m\n",
+			wantIdle: time.Minute,
+		},
+		{
+			name:        "unknown key",
+			content:     "idle_timeout: 1m\nnew_feature: true\n",
+			wantIdle:    time.Minute,
+			wantWarning: "line 2: field new_feature not found",
+		},
+		{
+			name:    "invalid value",
+			content: "idle_timeout: [1m]\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+			cfg, err := Load(tt.content)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Load() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if cfg.IdleTimeout != tt.wantIdle || cfg.ListenAddress != DefaultConfig.ListenAddress {
+				t.Errorf("Load() = idle %v listen %s, want idle %v with the defaults", cfg.IdleTimeout, cfg.ListenAddress, tt.wantIdle)
+			}
+			if len(tt.wantWarning) > 0 && !strings.Contains(logs.String(), tt.wantWarning) {
+				t.Errorf("warnings = %q, want %q", logs.String(), tt.wantWarning)
+			}
+			if len(tt.wantWarning) < 1 && logs.Len() > 0 {
+				t.Errorf("unexpected warnings %q", logs.String())
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	content := `listen_address: 0.0.0.0:10027
+new_feature: true
+web_ui:
+  enabled: true
+  listen_address: 0.0.0.0:10027
+allowed_mount_paths: [relative]
+`
+	want := []string{
+		"line 2: field new_feature not found in type agent.Config",
+		"line 3: web_ui: tls_cert_file and tls_key_file are required, the browser sends the tokens of the users",
+		"line 5: web_ui.listen_address: conflicts with the port 10027 of listen_address",
+		`line 6: allowed_mount_paths[0]: the path "relative" must be absolute`,
+	}
+	problems := ValidateConfig([]byte(content))
+	var got []string
+	for _, problem := range problems {
+		got = append(got, problem.String())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ValidateConfig() = %q, want %q", got, want)
+	}
+}
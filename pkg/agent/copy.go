@@ -0,0 +1,405 @@
+package agent
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// the symlinks followed resolving a path in the target, same limit as the kernel
+const maxSymlinks = 40
+
+// ServeCopy copies files from or into the target container as a tar stream.
+// The agent works on the filesystem of the target at /proc/<pid>/root, so
+// the target doesn't need tar, e.g. distroless images.
+func (s *Server) ServeCopy(w http.ResponseWriter, req *http.Request) {
+	path := req.FormValue("path")
+	if !filepath.IsAbs(path) {
+		http.Error(w, "path must be absolute", 400)
+		return
+	}
+	direction := req.FormValue("direction")
+	switch direction {
+	case "download":
+		s.serveTool(w, req, "copy", "download "+path, false,
+			func(ctx context.Context, target ContainerInfo, in io.Reader, out, errOut io.Writer) error {
+				root, err := openRoot(target)
+				if err != nil {
+					return err
+				}
+				defer unix.Close(root)
+				return archiveInRoot(root, path, out)
+			})
+	case "upload":
+		s.serveTool(w, req, "copy", "upload "+path, true,
+			func(ctx context.Context, target ContainerInfo, in io.Reader, out, errOut io.Writer) error {
+				root, err := openRoot(target)
+				if err != nil {
+					return err
+				}
+				defer unix.Close(root)
+				return extractInRoot(root, path, in)
+			})
+	default:
+		http.Error(w, "direction must be download or upload", 400)
+	}
+}
+
+// targetRoot is the root filesystem of the target container seen from the agent
+func targetRoot(target ContainerInfo) string {
+	return fmt.Sprintf("/proc/%d/root", target.Pid)
+}
+
+// openRoot opens the root filesystem of the target, its paths are resolved relative to it
+func openRoot(target ContainerInfo) (int, error) {
+	fd, err := unix.Open(targetRoot(target), unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: targetRoot(target), Err: err}
+	}
+	return fd, nil
+}
+
+// resolveInRoot resolves the path in the root like a chroot would, the symlinks of
+// the target are followed inside the root instead of the filesystem of the agent.
+// Every directory is opened relative to its parent without following symlinks, so
+// the target can't swap a directory for a symlink between the resolution and the use.
+// It returns the directory holding the last component, to be closed by the caller,
+// and the name of the last component, which is followed only if follow is set.
+// The missing directories are created if create is set.
+func resolveInRoot(root int, path string, follow, create bool) (int, string, error) {
+	dirs := []int{root}
+	release := func() {
+		for _, fd := range dirs[1:] {
+			unix.Close(fd)
+		}
+		dirs = dirs[:1]
+	}
+	parts := strings.Split(path, "/")
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(dirs) > 1 {
+				unix.Close(dirs[len(dirs)-1])
+				dirs = dirs[:len(dirs)-1]
+			}
+			continue
+		}
+		dir := dirs[len(dirs)-1]
+		if lastComponent(parts) {
+			var st unix.Stat_t
+			err := unix.Fstatat(dir, part, &st, unix.AT_SYMLINK_NOFOLLOW)
+			if err == unix.ENOENT || (err == nil && (!follow || st.Mode&unix.S_IFMT != unix.S_IFLNK)) {
+				if dir, err = unix.Dup(dir); err != nil {
+					release()
+					return -1, "", err
+				}
+				release()
+				return dir, part, nil
+			}
+			if err != nil {
+				release()
+				return -1, "", &os.PathError{Op: "lstat", Path: path, Err: err}
+			}
+		} else {
+			fd, err := unix.Openat(dir, part, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+			switch {
+			case err == nil:
+				dirs = append(dirs, fd)
+				continue
+			case err == unix.ENOENT && create:
+				if err := unix.Mkdirat(dir, part, 0755); err != nil && err != unix.EEXIST {
+					release()
+					return -1, "", &os.PathError{Op: "mkdir", Path: path, Err: err}
+				}
+				parts = append([]string{part}, parts...)
+				continue
+			case err == unix.ELOOP || err == unix.ENOTDIR:
+				// a symlink, or a file which fails the resolution
+				var st unix.Stat_t
+				if serr := unix.Fstatat(dir, part, &st, unix.AT_SYMLINK_NOFOLLOW); serr != nil || st.Mode&unix.S_IFMT != unix.S_IFLNK {
+					release()
+					return -1, "", &os.PathError{Op: "open", Path: path, Err: err}
+				}
+			default:
+				release()
+				return -1, "", &os.PathError{Op: "open", Path: path, Err: err}
+			}
+		}
+		links++
+		if links > maxSymlinks {
+			release()
+			return -1, "", fmt.Errorf("too many levels of symbolic links in %s", path)
+		}
+		dest, err := readlinkat(dir, part)
+		if err != nil {
+			release()
+			return -1, "", &os.PathError{Op: "readlink", Path: path, Err: err}
+		}
+		if strings.HasPrefix(dest, "/") {
+			release()
+		}
+		parts = append(strings.Split(dest, "/"), parts...)
+	}
+	dir, err := unix.Dup(dirs[len(dirs)-1])
+	release()
+	if err != nil {
+		return -1, "", err
+	}
+	return dir, ".", nil
+}
+
+// lastComponent tells if the remaining parts of a path don't name another file
+func lastComponent(parts []string) bool {
+	for _, part := range parts {
+		if part != "" && part != "." {
+			return false
+		}
+	}
+	return true
+}
+
+func readlinkat(dir int, name string) (string, error) {
+	buf := make([]byte, unix.PathMax)
+	n, err := unix.Readlinkat(dir, name, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+// readFileInRoot reads a file of the target, resolved in its root
+func readFileInRoot(target ContainerInfo, path string) ([]byte, error) {
+	root, err := openRoot(target)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(root)
+	dir, name, err := resolveInRoot(root, path, true, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dir)
+	fd, err := unix.Openat(dir, name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// archiveInRoot writes the path as a tar stream, the entries are named after
+// the base name of the path. Symlinks are archived as is, devices and pipes are skipped.
+func archiveInRoot(root int, path string, out io.Writer) error {
+	dir, name, err := resolveInRoot(root, path, true, false)
+	if err == nil {
+		defer unix.Close(dir)
+		var st unix.Stat_t
+		if err = unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			err = &os.PathError{Op: "lstat", Path: path, Err: err}
+		}
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s does not exist in the target container", path)
+		}
+		return err
+	}
+	base := filepath.Base(path)
+	if base == "/" {
+		base = "."
+	}
+	tw := tar.NewWriter(out)
+	if err := archiveEntry(tw, dir, name, base); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// archiveEntry writes the file name of the directory dir as the entry entryName,
+// and the content of the directories recursively
+func archiveEntry(tw *tar.Writer, dir int, name, entryName string) error {
+	var st unix.Stat_t
+	if err := unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "lstat", Path: entryName, Err: err}
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFLNK:
+		link, err := readlinkat(dir, name)
+		if err != nil {
+			return &os.PathError{Op: "readlink", Path: entryName, Err: err}
+		}
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeSymlink,
+			Name:     entryName,
+			Linkname: link,
+			Mode:     int64(st.Mode & 07777),
+			Uid:      int(st.Uid),
+			Gid:      int(st.Gid),
+			ModTime:  time.Unix(st.Mtim.Unix()),
+		})
+	case unix.S_IFREG, unix.S_IFDIR:
+	default:
+		return nil
+	}
+	// nonblocking, a file replaced by a pipe after the stat must not block the copy
+	fd, err := unix.Openat(dir, name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: entryName, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), entryName)
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() && !fi.IsDir() {
+		return nil
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = entryName
+	if fi.Mode().IsRegular() {
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = io.CopyN(tw, f, hdr.Size)
+		return err
+	}
+	hdr.Name += "/"
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, child := range names {
+		if err := archiveEntry(tw, int(f.Fd()), child, entryName+"/"+child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractInRoot extracts the tar stream to the path, into it if it is a directory.
+// Every entry is resolved in the root so that the archive can't write outside of it.
+func extractInRoot(root int, path string, in io.Reader) error {
+	into := false
+	if dir, name, err := resolveInRoot(root, path, true, false); err == nil {
+		var st unix.Stat_t
+		into = unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW) == nil && st.Mode&unix.S_IFMT == unix.S_IFDIR
+		unix.Close(dir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, err := archiveEntryPath(path, hdr.Name, into)
+		if err != nil {
+			return err
+		}
+		dir, base, err := resolveInRoot(root, name, false, true)
+		if err != nil {
+			return err
+		}
+		err = extractEntry(tr, hdr, dir, base)
+		unix.Close(dir)
+		if err != nil {
+			return fmt.Errorf("extract %s: %v", name, err)
+		}
+	}
+}
+
+// archiveEntryPath maps an entry named after the base name of the copied path
+// to the destination, or into the destination directory
+func archiveEntryPath(dst, entry string, into bool) (string, error) {
+	entry = filepath.Clean(filepath.FromSlash(entry))
+	if filepath.IsAbs(entry) || entry == ".." || strings.HasPrefix(entry, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid archive entry %s", entry)
+	}
+	if into {
+		return filepath.Join(dst, entry), nil
+	}
+	parts := strings.SplitN(entry, string(filepath.Separator), 2)
+	if len(parts) < 2 {
+		return dst, nil
+	}
+	return filepath.Join(dst, parts[1]), nil
+}
+
+// extractEntry writes the entry as the file name of the directory dir,
+// an existing symlink is replaced, not followed
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dir int, name string) error {
+	mode := uint32(os.FileMode(hdr.Mode).Perm())
+	var st unix.Stat_t
+	exists := unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW) == nil
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if exists && st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			if err := unix.Unlinkat(dir, name, 0); err != nil {
+				return err
+			}
+		}
+		if err := unix.Mkdirat(dir, name, mode); err != nil && err != unix.EEXIST {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		if exists && st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			if err := unix.Unlinkat(dir, name, 0); err != nil {
+				return err
+			}
+		}
+		fd, err := unix.Openat(dir, name, unix.O_CREAT|unix.O_TRUNC|unix.O_WRONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, mode)
+		if err != nil {
+			return err
+		}
+		f := os.NewFile(uintptr(fd), name)
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Chmod(os.FileMode(mode)); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := unix.Unlinkat(dir, name, 0); err != nil && err != unix.ENOENT {
+			return err
+		}
+		return unix.Symlinkat(hdr.Linkname, dir, name)
+	default:
+		return errors.New("unsupported archive entry " + hdr.Name)
+	}
+	mtime := unix.NsecToTimespec(hdr.ModTime.UnixNano())
+	return unix.UtimesNanoAt(dir, name, []unix.Timespec{mtime, mtime}, unix.AT_SYMLINK_NOFOLLOW)
+}
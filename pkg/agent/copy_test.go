@@ -0,0 +1,211 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTestRoot creates the root filesystem of a target, with a host directory next to it
+// that must not be reachable from the root
+func newTestRoot(t *testing.T) (string, int) {
+	dir, err := ioutil.TempDir("", "copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	root := filepath.Join(dir, "root")
+	for _, d := range []string{"root/etc", "root/data/sub", "host/etc"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"root/etc/resolv.conf": "nameserver 10.0.0.10\n",
+		"root/data/sub/a.txt":  "a",
+		"host/etc/shadow":      "secret",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"root/abs":      "/etc",
+		"root/rel":      "data/sub",
+		"root/escape":   "../../host/etc",
+		"root/loop":     "loop",
+		"root/data/up":  "../..",
+		"root/data/dot": ".",
+	}
+	for name, dest := range links {
+		if err := os.Symlink(dest, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fd) })
+	return root, fd
+}
+
+func TestResolveInRoot(t *testing.T) {
+	root, fd := newTestRoot(t)
+	tests := []struct {
+		path    string
+		follow  bool
+		want    string
+		wantErr bool
+	}{
+		{path: "/", want: "."},
+		{path: "/etc/resolv.conf", want: "etc/resolv.conf"},
+		{path: "/../../etc/resolv.conf", want: "etc/resolv.conf"},
+		{path: "/abs/resolv.conf", want: "etc/resolv.conf"},
+		{path: "/rel/a.txt", want: "data/sub/a.txt"},
+		{path: "/rel", follow: true, want: "data/sub"},
+		{path: "/rel", want: "rel"},
+		{path: "/data/up/etc", want: "etc"},
+		{path: "/data/dot/dot/sub/a.txt", want: "data/sub/a.txt"},
+		// the symlinks leaving the root are resolved inside of it
+		{path: "/escape/shadow", wantErr: true},
+		{path: "/escape", follow: true, wantErr: true},
+		{path: "/missing", want: "missing"},
+		{path: "/missing/file", wantErr: true},
+		{path: "/loop/file", wantErr: true},
+	}
+	for _, tt := range tests {
+		dir, name, err := resolveInRoot(fd, tt.path, tt.follow, false)
+		if tt.wantErr {
+			if err == nil {
+				unix.Close(dir)
+				t.Errorf("resolveInRoot(%q) succeeded, want an error", tt.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveInRoot(%q): %v", tt.path, err)
+			continue
+		}
+		dirPath, err := os.Readlink(filepath.Join("/proc/self/fd", strconv.Itoa(dir)))
+		unix.Close(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := filepath.Rel(root, filepath.Join(dirPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("resolveInRoot(%q) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestResolveInRootCreate(t *testing.T) {
+	root, fd := newTestRoot(t)
+	dir, name, err := resolveInRoot(fd, "/escape/new/file", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(dir)
+	if name != "file" {
+		t.Errorf("name = %s, want file", name)
+	}
+	if _, err := os.Stat(filepath.Join(root, "host/etc/new")); err != nil {
+		t.Errorf("the directory is not created in the root: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "../host/etc/new")); err == nil {
+		t.Errorf("the directory is created outside of the root")
+	}
+}
+
+func TestCopyInRoot(t *testing.T) {
+	root, fd := newTestRoot(t)
+	tests := []struct {
+		src, dst string
+		want     map[string]string
+	}{
+		{src: "/data/sub", dst: "/copy", want: map[string]string{"copy/a.txt": "a"}},
+		{src: "/rel/a.txt", dst: "/etc", want: map[string]string{"etc/a.txt": "a"}},
+		{src: "/abs/resolv.conf", dst: "/data/up/copy/", want: map[string]string{"copy/resolv.conf": "nameserver 10.0.0.10\n"}},
+		{src: "/data/sub/a.txt", dst: "/escape/shadow", want: map[string]string{"host/etc/shadow": "a", "../host/etc/shadow": "secret"}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := archiveInRoot(fd, tt.src, &buf); err != nil {
+			t.Errorf("archiveInRoot(%q): %v", tt.src, err)
+			continue
+		}
+		if err := extractInRoot(fd, tt.dst, &buf); err != nil {
+			t.Errorf("extractInRoot(%q): %v", tt.dst, err)
+			continue
+		}
+		for name, want := range tt.want {
+			got, err := ioutil.ReadFile(filepath.Join(root, name))
+			if err != nil || string(got) != want {
+				t.Errorf("copy %s to %s: %s = %q, %v, want %q", tt.src, tt.dst, name, got, err, want)
+			}
+		}
+	}
+}
+
+func TestArchiveInRootEntries(t *testing.T) {
+	_, fd := newTestRoot(t)
+	var buf bytes.Buffer
+	if err := archiveInRoot(fd, "/data", &buf); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	want := []string{"data/", "data/dot", "data/sub/", "data/sub/a.txt", "data/up"}
+	if len(names) != len(want) {
+		t.Fatalf("entries = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("entries = %v, want %v", names, want)
+		}
+	}
+	if err := archiveInRoot(fd, "/missing", &buf); err == nil {
+		t.Errorf("archiveInRoot of a missing path succeeded")
+	}
+}
+
+func TestArchiveEntryPath(t *testing.T) {
+	tests := []struct {
+		dst, entry string
+		into       bool
+		want       string
+		wantErr    bool
+	}{
+		{dst: "/tmp/out", entry: "a.txt", want: "/tmp/out"},
+		{dst: "/tmp/out", entry: "dir/a.txt", want: "/tmp/out/a.txt"},
+		{dst: "/tmp", entry: "dir/a.txt", into: true, want: "/tmp/dir/a.txt"},
+		{dst: "/tmp", entry: "../etc/passwd", into: true, wantErr: true},
+		{dst: "/tmp", entry: "/etc/passwd", into: true, wantErr: true},
+		{dst: "/tmp", entry: "..", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := archiveEntryPath(tt.dst, tt.entry, tt.into)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("archiveEntryPath(%q, %q, %v) = %q, %v, want %q", tt.dst, tt.entry, tt.into, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	"github.com/docker/docker/api/types/container"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const cpuCFSPeriod = 100000
+
+// securityProfiles are the capabilities added to the debug container by profile, sysadmin
+// runs it privileged. Without a profile, the debug container keeps the capabilities it
+// always had: SYS_PTRACE and SYS_ADMIN with docker, privileged with containerd.
+var securityProfiles = map[string][]string{
+	"restricted": nil,
+	"default":    {"SYS_PTRACE", "SYS_ADMIN"},
+	"netadmin":   {"SYS_PTRACE", "NET_ADMIN", "NET_RAW"},
+	"sysadmin":   nil,
+}
+
+// ContainerOptions are the settings of the debug container asked by the client,
+// on top of the namespaces of the target it joins
+type ContainerOptions struct {
+	Env             []string
+	Mounts          []Mount
+	SecurityProfile string
+	// millicores and bytes, 0 means unlimited
+	CPULimit    int64
+	MemoryLimit int64
+}
+
+// Mount is a bind mount of a path of the node into the debug container
+type Mount struct {
+	HostPath  string `json:"hostPath"`
+	MountPath string `json:"mountPath"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+// parseContainerOptions reads the options of the debug container from the request,
+// the mounts and security profiles must be allowed by the config of the agent
+func parseContainerOptions(r *DebugSessionRequest, config *Config) (ContainerOptions, error) {
+	opts := ContainerOptions{Env: r.Env}
+	for _, e := range opts.Env {
+		if !strings.Contains(e, "=") {
+			return opts, fmt.Errorf("invalid env %s, expect NAME=VALUE", e)
+		}
+	}
+	var allowed []string
+	if len(r.Mounts) > 0 {
+		allowed = hostMountPaths(config.AllowedMountPaths)
+	}
+	for _, m := range r.Mounts {
+		if !filepath.IsAbs(m.HostPath) || !filepath.IsAbs(m.MountPath) {
+			return opts, fmt.Errorf("the paths of the mount %s must be absolute", m.HostPath)
+		}
+		// a symlink below an allowed path may point out of it
+		hostPath, err := evalSymlinksInRoot(hostRoot, m.HostPath)
+		if err != nil {
+			return opts, fmt.Errorf("invalid mount %s: %v", m.HostPath, err)
+		}
+		if !mountAllowed(hostPath, allowed) {
+			return opts, fmt.Errorf("mounting %s is not allowed by the agent", m.HostPath)
+		}
+		m.HostPath = hostPath
+		opts.Mounts = append(opts.Mounts, m)
+	}
+	profile := r.Security.Profile
+	if len(profile) < 1 && len(config.AllowedSecurityProfiles) > 0 {
+		// without a profile the debug container would be privileged with containerd
+		profile = config.AllowedSecurityProfiles[0]
+	}
+	if len(profile) > 0 {
+		if _, ok := securityProfiles[profile]; !ok {
+			return opts, fmt.Errorf("unknown security profile %s", profile)
+		}
+		if len(config.AllowedSecurityProfiles) > 0 && !contains(config.AllowedSecurityProfiles, profile) {
+			return opts, fmt.Errorf("the security profile %s is not allowed by the agent", profile)
+		}
+		opts.SecurityProfile = profile
+	}
+	if cpu := r.Limits.CPU; len(cpu) > 0 {
+		q, err := resource.ParseQuantity(cpu)
+		if err != nil || q.Sign() < 0 {
+			return opts, fmt.Errorf("invalid cpu limits %s", cpu)
+		}
+		opts.CPULimit = q.MilliValue()
+	}
+	if memory := r.Limits.Memory; len(memory) > 0 {
+		q, err := resource.ParseQuantity(memory)
+		if err != nil || q.Sign() < 0 {
+			return opts, fmt.Errorf("invalid memory limits %s", memory)
+		}
+		opts.MemoryLimit = q.Value()
+	}
+	return opts, nil
+}
+
+// hostRoot is the root filesystem of the node seen from the agent, which shares its pid namespace
+const hostRoot = "/proc/1/root"
+
+// hostMountPaths resolves the symlinks of the allowed mount paths on the node,
+// the paths which can't be resolved are kept as is
+func hostMountPaths(allowed []string) []string {
+	var paths []string
+	for _, path := range allowed {
+		if resolved, err := evalSymlinksInRoot(hostRoot, path); err == nil {
+			path = resolved
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// evalSymlinksInRoot is filepath.EvalSymlinks in a chroot, the symlinks of
+// the path are followed inside the root and the path must exist
+func evalSymlinksInRoot(root, path string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(path, "/")
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", path)
+		}
+		dest, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(dest) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(dest, "/"), parts...)
+	}
+	return resolved, nil
+}
+
+// mountAllowed checks that the path is one of the allowed paths or below one of them,
+// both without symlinks
+func mountAllowed(path string, allowed []string) bool {
+	path = filepath.Clean(path)
+	for _, prefix := range allowed {
+		prefix = filepath.Clean(prefix)
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// applyDocker sets the options on the config of a docker debug container
+func (o ContainerOptions) applyDocker(config *container.Config, hostConfig *container.HostConfig) {
+	config.Env = append(config.Env, o.Env...)
+	for _, m := range o.Mounts {
+		bind := m.HostPath + ":" + m.MountPath
+		if m.ReadOnly {
+			bind += ":ro"
+		}
+		hostConfig.Binds = append(hostConfig.Binds, bind)
+	}
+	if len(o.SecurityProfile) > 0 {
+		hostConfig.CapAdd = securityProfiles[o.SecurityProfile]
+		hostConfig.Privileged = o.SecurityProfile == "sysadmin"
+	}
+	if o.CPULimit > 0 {
+		hostConfig.NanoCPUs = o.CPULimit * 1000000
+	}
+	if o.MemoryLimit > 0 {
+		hostConfig.Memory = o.MemoryLimit
+	}
+}
+
+// containerdSpecOpts returns the spec options of a containerd debug container
+func (o ContainerOptions) containerdSpecOpts() []oci.SpecOpts {
+	var opts []oci.SpecOpts
+	switch o.SecurityProfile {
+	case "", "sysadmin":
+		opts = append(opts, oci.WithPrivileged)
+	default:
+		var caps []string
+		for _, c := range securityProfiles[o.SecurityProfile] {
+			caps = append(caps, "CAP_"+c)
+		}
+		opts = append(opts, oci.WithAddedCapabilities(caps))
+	}
+	if len(o.Env) > 0 {
+		opts = append(opts, oci.WithEnv(o.Env))
+	}
+	if len(o.Mounts) > 0 {
+		var mounts []specs.Mount
+		for _, m := range o.Mounts {
+			mode := "rw"
+			if m.ReadOnly {
+				mode = "ro"
+			}
+			mounts = append(mounts, specs.Mount{
+				Destination: m.MountPath,
+				Source:      m.HostPath,
+				Type:        "bind",
+				Options:     []string{"rbind", mode},
+			})
+		}
+		opts = append(opts, oci.WithMounts(mounts))
+	}
+	if o.CPULimit > 0 {
+		opts = append(opts, withCPULimit(o.CPULimit))
+	}
+	if o.MemoryLimit > 0 {
+		opts = append(opts, oci.WithMemoryLimit(uint64(o.MemoryLimit)))
+	}
+	return opts
+}
+
+// withCPULimit sets the cfs quota of the container to the millicores
+func withCPULimit(millicores int64) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Linux == nil {
+			s.Linux = &specs.Linux{}
+		}
+		if s.Linux.Resources == nil {
+			s.Linux.Resources = &specs.LinuxResources{}
+		}
+		if s.Linux.Resources.CPU == nil {
+			s.Linux.Resources.CPU = &specs.LinuxCPU{}
+		}
+		period := uint64(cpuCFSPeriod)
+		quota := millicores * cpuCFSPeriod / 1000
+		s.Linux.Resources.CPU.Period = &period
+		s.Linux.Resources.CPU.Quota = &quota
+		return nil
+	}
+}
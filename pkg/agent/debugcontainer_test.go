@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestEvalSymlinksInRoot(t *testing.T) {
+	root, _ := newTestRoot(t)
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "/", want: "/"},
+		{path: "/data/sub/a.txt", want: "/data/sub/a.txt"},
+		{path: "/abs", want: "/etc"},
+		{path: "/rel/a.txt", want: "/data/sub/a.txt"},
+		{path: "/data/up/etc/../data", want: "/data"},
+		{path: "/data/dot/sub", want: "/data/sub"},
+		// the symlink leaving the root is resolved inside of it
+		{path: "/escape", wantErr: true},
+		{path: "/../../etc", want: "/etc"},
+		{path: "/missing", wantErr: true},
+		{path: "/loop", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := evalSymlinksInRoot(root, tt.path)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("evalSymlinksInRoot(%q) = %q, %v, want %q", tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestMountAllowed(t *testing.T) {
+	allowed := []string{"/var/log/", "/data"}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/var/log", want: true},
+		{path: "/var/log/pods/x", want: true},
+		{path: "/data/", want: true},
+		{path: "/database", want: false},
+		{path: "/var", want: false},
+		{path: "/", want: false},
+	}
+	for _, tt := range tests {
+		if got := mountAllowed(tt.path, allowed); got != tt.want {
+			t.Errorf("mountAllowed(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+	if mountAllowed("/var/log", nil) {
+		t.Errorf("a mount is allowed without any allowed path")
+	}
+}
+
+func TestParseContainerOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		request DebugSessionRequest
+		config  Config
+		want    ContainerOptions
+		wantErr string
+	}{
+		{
+			name:    "env and limits",
+			request: DebugSessionRequest{Env: []string{"DEBUG=1"}, Limits: DebugLimits{CPU: "500m", Memory: "128Mi"}},
+			want:    ContainerOptions{Env: []string{"DEBUG=1"}, CPULimit: 500, MemoryLimit: 128 << 20},
+		},
+		{name: "invalid env", request: DebugSessionRequest{Env: []string{"DEBUG"}}, wantErr: "invalid env DEBUG"},
+		{name: "invalid cpu", request: DebugSessionRequest{Limits: DebugLimits{CPU: "-1"}}, wantErr: "invalid cpu limits"},
+		{name: "invalid memory", request: DebugSessionRequest{Limits: DebugLimits{Memory: "lots"}}, wantErr: "invalid memory limits"},
+		{name: "no profile", want: ContainerOptions{}},
+		{
+			// without a profile the debug container would be privileged with containerd
+			name:   "default profile",
+			config: Config{AllowedSecurityProfiles: []string{"restricted", "netadmin"}},
+			want:   ContainerOptions{SecurityProfile: "restricted"},
+		},
+		{
+			name:    "allowed profile",
+			request: DebugSessionRequest{Security: DebugSecurity{Profile: "netadmin"}},
+			config:  Config{AllowedSecurityProfiles: []string{"restricted", "netadmin"}},
+			want:    ContainerOptions{SecurityProfile: "netadmin"},
+		},
+		{
+			name:    "profile not allowed",
+			request: DebugSessionRequest{Security: DebugSecurity{Profile: "sysadmin"}},
+			config:  Config{AllowedSecurityProfiles: []string{"restricted"}},
+			wantErr: "the security profile sysadmin is not allowed by the agent",
+		},
+		{
+			name:    "unknown profile",
+			request: DebugSessionRequest{Security: DebugSecurity{Profile: "root"}},
+			wantErr: "unknown security profile root",
+		},
+		{
+			name:    "relative mount",
+			request: DebugSessionRequest{Mounts: []Mount{{HostPath: "var/log", MountPath: "/host/log"}}},
+			config:  Config{AllowedMountPaths: []string{"/var/log"}},
+			wantErr: "must be absolute",
+		},
+		{
+			name:    "mount not allowed",
+			request: DebugSessionRequest{Mounts: []Mount{{HostPath: "/", MountPath: "/host"}}},
+			config:  Config{AllowedMountPaths: []string{"/var/log"}},
+			wantErr: "mounting / is not allowed by the agent",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseContainerOptions(&tt.request, &tt.config)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseContainerOptions() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseContainerOptions() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyDocker(t *testing.T) {
+	tests := []struct {
+		profile        string
+		wantCaps       []string
+		wantPrivileged bool
+	}{
+		{profile: "restricted"},
+		{profile: "netadmin", wantCaps: []string{"SYS_PTRACE", "NET_ADMIN", "NET_RAW"}},
+		{profile: "sysadmin", wantPrivileged: true},
+	}
+	for _, tt := range tests {
+		opts := ContainerOptions{
+			SecurityProfile: tt.profile,
+			Mounts:          []Mount{{HostPath: "/var/log", MountPath: "/host/log", ReadOnly: true}},
+			CPULimit:        500,
+		}
+		config, hostConfig := &container.Config{}, &container.HostConfig{}
+		opts.applyDocker(config, hostConfig)
+		if !reflect.DeepEqual([]string(hostConfig.CapAdd), tt.wantCaps) || hostConfig.Privileged != tt.wantPrivileged {
+			t.Errorf("profile %s: caps %v privileged %v, want %v %v", tt.profile, hostConfig.CapAdd, hostConfig.Privileged, tt.wantCaps, tt.wantPrivileged)
+		}
+		if len(hostConfig.Binds) != 1 || hostConfig.Binds[0] != "/var/log:/host/log:ro" || hostConfig.NanoCPUs != 500000000 {
+			t.Errorf("binds %v cpus %d", hostConfig.Binds, hostConfig.NanoCPUs)
+		}
+	}
+}
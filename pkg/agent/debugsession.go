@@ -0,0 +1,507 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	dockerterm "github.com/docker/docker/pkg/term"
+	"github.com/google/uuid"
+	kubetype "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/remotecommand"
+	kubeletremote "k8s.io/kubernetes/pkg/kubelet/server/remotecommand"
+)
+
+// how long the output queued for a client is flushed before its stream is closed
+const sessionFlushTimeout = 5 * time.Second
+
+// outputBuffer keeps the latest bytes written to it
+type outputBuffer struct {
+	size int
+	data []byte
+}
+
+func (b *outputBuffer) Write(p []byte) {
+	b.data = append(b.data, p...)
+	if over := len(b.data) - b.size; over > 0 {
+		b.data = append(b.data[:0], b.data[over:]...)
+	}
+}
+
+func (b *outputBuffer) Bytes() []byte {
+	return append([]byte(nil), b.data...)
+}
+
+// sessionClient is a client attached to a debug session, the output
+// is queued so that a slow client doesn't block the debug container
+type sessionClient struct {
+	out io.Writer
+	// the owner drives the session, the others observe it
+	owner bool
+	// the input of read-only clients is discarded
+	writable bool
+	output   chan []byte
+	closed   chan struct{}
+	flushed  chan struct{}
+	once     sync.Once
+}
+
+func newSessionClient(out io.Writer, owner, writable bool) *sessionClient {
+	return &sessionClient{
+		out:      out,
+		owner:    owner,
+		writable: writable,
+		output:   make(chan []byte, 256),
+		closed:   make(chan struct{}),
+		flushed:  make(chan struct{}),
+	}
+}
+
+func (c *sessionClient) run() {
+	defer close(c.flushed)
+	for p := range c.output {
+		if _, err := c.out.Write(p); err != nil {
+			c.close()
+			// drain the queue till the client is detached
+			for range c.output {
+			}
+			return
+		}
+	}
+}
+
+// send queues the output, it returns false if the queue is full
+func (c *sessionClient) send(p []byte) bool {
+	select {
+	case c.output <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *sessionClient) close() {
+	c.once.Do(func() { close(c.closed) })
+}
+
+// debugSession runs a debug container independently of the client connection,
+// the container is kept for the grace period after the owner disconnects so
+// that the owner can reattach to it with the attach token and get the latest
+// output replayed. The output is multiplexed to the observers joining the session.
+type debugSession struct {
+	id        string
+	container string
+	// the user given by the client, only used for logging
+	user string
+	// the secret of the attach token, returned to the owner only
+	attachSecret string
+	// the secret of the join token of a shared session, empty if the session is not shared
+	joinSecret string
+	grace      time.Duration
+	registry   *sessionRegistry
+	// whether the observers may be granted write access
+	shareWrite bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// stdin of the debug container
+	stdin *io.PipeReader
+	input *io.PipeWriter
+	// tty size of the debug container
+	resize chan remotecommand.TerminalSize
+	start  sync.Once
+
+	mu        sync.Mutex
+	buffer    outputBuffer
+	owner     *sessionClient
+	observers map[*sessionClient]struct{}
+	expiry    *time.Timer
+	finished  bool
+	done      chan struct{}
+	err       error
+}
+
+// Write implements the stdout of the debug container
+func (s *debugSession) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buffer.Write(p)
+	for _, client := range s.clientsLocked() {
+		if !client.send(append([]byte(nil), p...)) {
+			log.Printf("Client of session %s is too slow, detaching it\r\n", s.id)
+			client.close()
+		}
+	}
+	return len(p), nil
+}
+
+// Close implements the stdout of the debug container, the output is
+// closed when the session ends
+func (s *debugSession) Close() error {
+	return nil
+}
+
+// run runs the debug container of the session till it exits
+func (s *debugSession) run(attacher kubeletremote.Attacher, tty bool) {
+	err := attacher.AttachContainer("", "", "", s.stdin, s, nil, tty, s.resize)
+	s.mu.Lock()
+	s.finished = true
+	s.err = err
+	close(s.resize)
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	s.mu.Unlock()
+	close(s.done)
+	s.cancel()
+	s.registry.remove(s)
+}
+
+func (s *debugSession) clientsLocked() []*sessionClient {
+	var clients []*sessionClient
+	if s.owner != nil {
+		clients = append(clients, s.owner)
+	}
+	for observer := range s.observers {
+		clients = append(clients, observer)
+	}
+	return clients
+}
+
+// attach pipes the client streams to the debug container till the container exits,
+// the client detaches with the detach keys or disconnects. The owner resizes the tty
+// and writes to the debug container, observers only write if they are writable.
+func (s *debugSession) attach(client *sessionClient, in io.Reader,
+	resize <-chan remotecommand.TerminalSize, tty bool, detachKeys []byte) error {
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return s.err
+	}
+	if client.owner {
+		// a reattach takes over the session from an owner whose connection isn't detected broken yet
+		if s.owner != nil {
+			s.owner.close()
+		}
+		if s.expiry != nil {
+			s.expiry.Stop()
+			s.expiry = nil
+		}
+		s.owner = client
+	} else {
+		s.observers[client] = struct{}{}
+	}
+	client.send(s.buffer.Bytes())
+	s.mu.Unlock()
+	go client.run()
+
+	// the resize channel of a SPDY stream is not closed when the client detaches
+	detached := make(chan struct{})
+	defer close(detached)
+	// the resizes of the observers are discarded, the channel must still be
+	// drained since the stream blocks sending on it
+	if resize != nil {
+		go func() {
+			for {
+				select {
+				case size, ok := <-resize:
+					if !ok {
+						return
+					}
+					if client.owner && s.attached(client) {
+						s.resizeTo(size)
+					}
+				case <-detached:
+					return
+				}
+			}
+		}()
+	}
+
+	input := make(chan error, 1)
+	go func() {
+		input <- s.copyInput(client, in, detachKeys)
+	}()
+
+	var err error
+	for waiting := true; waiting; {
+		select {
+		case <-s.done:
+			err = s.err
+			waiting = false
+		case <-client.closed:
+			waiting = false
+		case inErr := <-input:
+			input = nil
+			switch {
+			case inErr == nil:
+				// the client was taken over
+				waiting = false
+			case isEscapeError(inErr):
+				msg := fmt.Sprintf("\r\ndetached from session %s\r\n", s.id)
+				if client.owner && s.grace > 0 {
+					msg = fmt.Sprintf("\r\ndetached from session %s, reattach within %v with --attach %s\r\n",
+						s.id, s.grace, s.attachToken())
+				}
+				client.send([]byte(msg))
+				waiting = false
+			case inErr == io.EOF && !tty && client.owner:
+				// the input of a non interactive session is complete
+				s.input.Close()
+			default:
+				log.Printf("Client of session %s disconnected: %v\r\n", s.id, inErr)
+				waiting = false
+			}
+		}
+	}
+	s.detach(client)
+	select {
+	case <-client.flushed:
+	case <-time.After(sessionFlushTimeout):
+	}
+	return err
+}
+
+func (s *debugSession) copyInput(client *sessionClient, in io.Reader, detachKeys []byte) error {
+	if in == nil {
+		return io.EOF
+	}
+	if len(detachKeys) > 0 {
+		in = dockerterm.NewEscapeProxy(in, detachKeys)
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := in.Read(buf)
+		if n > 0 && client.writable {
+			if !s.attached(client) {
+				return nil
+			}
+			if _, werr := s.input.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func isEscapeError(err error) bool {
+	_, ok := err.(dockerterm.EscapeError)
+	return ok
+}
+
+func (s *debugSession) attached(client *sessionClient) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if client.owner {
+		return s.owner == client
+	}
+	_, ok := s.observers[client]
+	return ok
+}
+
+// detach detaches the client, the session ends if the owner doesn't reattach in the grace period
+func (s *debugSession) detach(client *sessionClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner == client {
+		s.owner = nil
+		if !s.finished {
+			if s.grace > 0 {
+				log.Printf("Session %s detached, keeping it for %v\r\n", s.id, s.grace)
+			}
+			s.expiry = time.AfterFunc(s.grace, s.expire)
+		}
+	}
+	delete(s.observers, client)
+	close(client.output)
+}
+
+func (s *debugSession) expire() {
+	s.mu.Lock()
+	if s.owner != nil || s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	if s.grace > 0 {
+		log.Printf("Session %s was not reattached within %v, ending it\r\n", s.id, s.grace)
+	}
+	s.input.Close()
+	s.cancel()
+}
+
+func (s *debugSession) resizeTo(size remotecommand.TerminalSize) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return
+	}
+	select {
+	case s.resize <- size:
+	default:
+	}
+}
+
+// sessionRegistry keeps the debug sessions which can be reattached or joined
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*debugSession
+	tracker  *sessionTracker
+}
+
+func newSessionRegistry(tracker *sessionTracker) *sessionRegistry {
+	return &sessionRegistry{
+		sessions: map[string]*debugSession{},
+		tracker:  tracker,
+	}
+}
+
+// create registers a new session, the session counts as open till it ends,
+// a shared session can be joined with its join token
+func (r *sessionRegistry) create(container, user string, grace time.Duration, bufferSize int,
+	shared, shareWrite bool) (*debugSession, error) {
+	attachSecret, err := newSessionSecret()
+	if err != nil {
+		return nil, err
+	}
+	var joinSecret string
+	if shared {
+		if joinSecret, err = newSessionSecret(); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stdin, input := io.Pipe()
+	s := &debugSession{
+		id:           uuid.New().String(),
+		container:    container,
+		user:         user,
+		attachSecret: attachSecret,
+		joinSecret:   joinSecret,
+		grace:        grace,
+		registry:     r,
+		shareWrite:   shareWrite,
+		ctx:          ctx,
+		cancel:       cancel,
+		stdin:        stdin,
+		input:        input,
+		resize:       make(chan remotecommand.TerminalSize, 8),
+		buffer:       outputBuffer{size: bufferSize},
+		observers:    map[*sessionClient]struct{}{},
+		done:         make(chan struct{}),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.id] = s
+	r.tracker.open()
+	return s, nil
+}
+
+// attachToken returns the token the owner reattaches to the session with
+func (s *debugSession) attachToken() string {
+	return s.id + "." + s.attachSecret
+}
+
+// joinToken returns the token the observers join the shared session with
+func (s *debugSession) joinToken() string {
+	return s.id + "." + s.joinSecret
+}
+
+// newSessionSecret returns a random secret of a session token
+func newSessionSecret() (string, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// parseSessionToken splits a session token into the id of the session and its secret
+func parseSessionToken(token string) (string, string) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return token, ""
+	}
+	return token[:i], token[i+1:]
+}
+
+// validSecret compares the secret of a session token in constant time
+func validSecret(secret, want string) bool {
+	return len(want) > 0 && subtle.ConstantTimeCompare([]byte(secret), []byte(want)) == 1
+}
+
+func (r *sessionRegistry) get(id string) *debugSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+func (r *sessionRegistry) remove(s *debugSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sessions[s.id]; ok {
+		delete(r.sessions, s.id)
+		r.tracker.close()
+	}
+}
+
+// sessionAttacher attaches a client to a debug session,
+// the debug container is started by the owner
+type sessionAttacher struct {
+	session    *debugSession
+	attacher   kubeletremote.Attacher
+	detachKeys []byte
+	// observer joins the session, writable if it has been granted write access
+	observer bool
+	writable bool
+}
+
+var sessionAttacherImplementsAttacher kubeletremote.Attacher = (*sessionAttacher)(nil)
+
+// Implement kubeletremote.Attacher
+func (a *sessionAttacher) AttachContainer(name string, uid kubetype.UID, container string,
+	in io.Reader, out, err io.WriteCloser, tty bool, resize <-chan remotecommand.TerminalSize) error {
+	if a.attacher != nil {
+		a.session.start.Do(func() {
+			if tty {
+				if len(a.session.joinSecret) > 0 {
+					fmt.Fprintf(out, "debug session %s, others can join with --join %s\r\n",
+						a.session.id, a.session.joinToken())
+				} else {
+					fmt.Fprintf(out, "debug session %s\r\n", a.session.id)
+				}
+				if a.session.grace > 0 {
+					fmt.Fprintf(out, "reattach with --attach %s if disconnected\r\n", a.session.attachToken())
+				}
+			}
+			go a.session.run(a.attacher, tty)
+		})
+	}
+	if a.observer {
+		mode := "read-only"
+		if a.writable {
+			mode = "read-write"
+		}
+		fmt.Fprintf(out, "joined debug session %s %s\r\n", a.session.id, mode)
+		return a.session.attach(newSessionClient(out, false, a.writable), in, resize, tty, a.detachKeys)
+	}
+	return a.session.attach(newSessionClient(out, true, true), in, resize, tty, a.detachKeys)
+}
+
+// parseDetachKeys parses a detach key sequence like ctrl-p,ctrl-q,
+// the empty sequence disables detaching
+func parseDetachKeys(keys string) ([]byte, error) {
+	if len(keys) < 1 {
+		return nil, nil
+	}
+	return dockerterm.ToBytes(keys)
+}
@@ -0,0 +1,278 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kubetype "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// echoAttacher echoes the input of the debug container till it is closed
+type echoAttacher struct{}
+
+func (echoAttacher) AttachContainer(name string, uid kubetype.UID, container string,
+	in io.Reader, out, err io.WriteCloser, tty bool, resize <-chan remotecommand.TerminalSize) error {
+	_, copyErr := io.Copy(out, in)
+	return copyErr
+}
+
+// syncBuffer is the output of a client, written by the session
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+const testDetachKeys = "ctrl-p,ctrl-q"
+
+// testClient is a client attached to a session
+type testClient struct {
+	input *io.PipeWriter
+	out   *syncBuffer
+	done  chan error
+}
+
+func attachTestClient(s *debugSession, owner, writable bool) *testClient {
+	in, input := io.Pipe()
+	c := &testClient{input: input, out: &syncBuffer{}, done: make(chan error, 1)}
+	detachKeys, _ := parseDetachKeys(testDetachKeys)
+	go func() {
+		c.done <- s.attach(newSessionClient(c.out, owner, writable), in, nil, true, detachKeys)
+	}()
+	return c
+}
+
+func TestDebugSessionReattach(t *testing.T) {
+	tracker := newSessionTracker()
+	registry := newSessionRegistry(tracker)
+	session, err := registry.create("docker://abc", "alice", 200*time.Millisecond, 1024, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registry.get(session.id) != session {
+		t.Fatalf("the session is not registered")
+	}
+	if _, idle := tracker.idleSince(); idle {
+		t.Errorf("the agent is idle with a session open")
+	}
+	go session.run(echoAttacher{}, true)
+
+	owner := attachTestClient(session, true, true)
+	owner.input.Write([]byte("hello"))
+	waitFor(t, "the echo", func() bool { return strings.Contains(owner.out.String(), "hello") })
+	// detach with ctrl-p ctrl-q, typed one after the other
+	owner.input.Write([]byte{16})
+	owner.input.Write([]byte{17})
+	if err := <-owner.done; err != nil {
+		t.Fatalf("detach error = %v", err)
+	}
+	if !strings.Contains(owner.out.String(), "--attach "+session.attachToken()) {
+		t.Errorf("the attach token is not returned on detach: %q", owner.out.String())
+	}
+
+	// the output is replayed to the owner reattaching within the grace period
+	owner = attachTestClient(session, true, true)
+	waitFor(t, "the replay", func() bool { return strings.Contains(owner.out.String(), "hello") })
+	owner.input.Close()
+	<-owner.done
+
+	// the session ends once the grace period expires
+	waitFor(t, "the expiry", func() bool { return registry.get(session.id) == nil })
+	select {
+	case <-session.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the debug container is still running")
+	}
+	if _, idle := tracker.idleSince(); !idle {
+		t.Errorf("the session is still open")
+	}
+}
+
+func TestParseSessionToken(t *testing.T) {
+	registry := newSessionRegistry(newSessionTracker())
+	a, err := registry.create("docker://abc", "alice", 0, 0, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := registry.create("docker://abc", "alice", 0, 0, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.attachSecret == b.attachSecret || len(a.attachSecret) < 32 {
+		t.Errorf("weak attach secrets %q and %q", a.attachSecret, b.attachSecret)
+	}
+	id, secret := parseSessionToken(a.attachToken())
+	if id != a.id || !validSecret(secret, a.attachSecret) {
+		t.Errorf("parseSessionToken(%q) = %q, %q", a.attachToken(), id, secret)
+	}
+	if validSecret(b.attachSecret, a.attachSecret) || validSecret("", "") {
+		t.Errorf("validSecret accepts a wrong secret")
+	}
+	if id, secret := parseSessionToken(a.id); id != a.id || len(secret) > 0 {
+		t.Errorf("parseSessionToken(%q) = %q, %q", a.id, id, secret)
+	}
+}
+
+func TestServeSessionReattach(t *testing.T) {
+	config := DefaultConfig
+	s := &Server{config: &config, sessions: newSessionTracker()}
+	s.debugSessions = newSessionRegistry(s.sessions)
+	session, err := s.debugSessions.create("docker://abc", "alice", time.Minute, 1024, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.debugSessions.remove(session)
+	tests := []struct {
+		name      string
+		container string
+		username  string
+		attach    string
+		wantCode  int
+	}{
+		{name: "unknown session", container: "docker://abc", username: "alice", attach: "unknown." + session.attachSecret, wantCode: 404},
+		{name: "other container", container: "docker://def", username: "alice", attach: session.attachToken(), wantCode: 403},
+		{name: "session id without the secret", container: "docker://abc", username: "alice", attach: session.id, wantCode: 403},
+		{name: "wrong secret", container: "docker://abc", username: "alice", attach: session.id + ".0123", wantCode: 403},
+		{name: "guessed secret", container: "docker://abc", username: "alice", attach: session.id + "." + strings.Repeat("0", 32), wantCode: 403},
+		// the username is given by the client and is not trusted
+		{name: "attach token with another username", container: "docker://abc", username: "bob", attach: session.attachToken()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DebugSessionRequest{
+				APIVersion: DebugSessionRequestV1,
+				Target:     DebugTarget{Container: tt.container},
+				Client:     DebugClient{Username: tt.username},
+				Session:    DebugSession{TTY: true, Attach: tt.attach},
+			}
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/debug", nil)
+			s.serveSession(w, req, r, nil, nil)
+			if tt.wantCode > 0 && w.Code != tt.wantCode {
+				t.Errorf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			// the stream is not upgraded once the request is authorized
+			if tt.wantCode == 0 && (w.Code == 403 || w.Code == 404) {
+				t.Errorf("code = %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestDebugSessionJoin(t *testing.T) {
+	registry := newSessionRegistry(newSessionTracker())
+	session, err := registry.create("docker://abc", "alice", 0, 1024, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go session.run(echoAttacher{}, true)
+	owner := attachTestClient(session, true, true)
+	owner.input.Write([]byte("before "))
+	waitFor(t, "the echo", func() bool { return strings.Contains(owner.out.String(), "before ") })
+
+	// the observers get the latest output replayed, and only the writable ones write to the session
+	reader := attachTestClient(session, false, false)
+	writer := attachTestClient(session, false, true)
+	waitFor(t, "the replay", func() bool {
+		return strings.Contains(reader.out.String(), "before ") && strings.Contains(writer.out.String(), "before ")
+	})
+	reader.input.Write([]byte("ignored "))
+	writer.input.Write([]byte("written "))
+	owner.input.Write([]byte("after"))
+	for name, c := range map[string]*testClient{"owner": owner, "reader": reader, "writer": writer} {
+		waitFor(t, "the output of the "+name, func() bool { return strings.Contains(c.out.String(), "written after") })
+		if strings.Contains(c.out.String(), "ignored") {
+			t.Errorf("the input of the read-only observer is written: %q", c.out.String())
+		}
+	}
+
+	// the session ends with its owner, and the observers with it
+	owner.input.Close()
+	for _, c := range []*testClient{owner, reader, writer} {
+		select {
+		case <-c.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the client is still attached")
+		}
+	}
+	waitFor(t, "the end of the session", func() bool { return registry.get(session.id) == nil })
+}
+
+func TestServeSessionJoin(t *testing.T) {
+	config := DefaultConfig
+	s := &Server{config: &config, sessions: newSessionTracker()}
+	s.debugSessions = newSessionRegistry(s.sessions)
+	private, err := s.debugSessions.create("docker://abc", "alice", time.Minute, 1024, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.debugSessions.remove(private)
+	shared, err := s.debugSessions.create("docker://abc", "alice", time.Minute, 1024, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.debugSessions.remove(shared)
+	if len(private.joinSecret) > 0 || len(shared.joinSecret) < 32 || shared.joinSecret == shared.attachSecret {
+		t.Fatalf("join secrets %q of the private session, %q of the shared one", private.joinSecret, shared.joinSecret)
+	}
+	tests := []struct {
+		name     string
+		join     string
+		write    bool
+		wantCode int
+	}{
+		{name: "session not shared", join: private.id + ".", wantCode: 403},
+		{name: "session id of a shared session", join: shared.id, wantCode: 403},
+		{name: "attach token of a shared session", join: shared.attachToken(), wantCode: 403},
+		{name: "write to a read-only session", join: shared.joinToken(), write: true, wantCode: 403},
+		{name: "join token", join: shared.joinToken()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DebugSessionRequest{
+				APIVersion: DebugSessionRequestV1,
+				Target:     DebugTarget{Container: "docker://abc"},
+				Client:     DebugClient{Username: "alice"},
+				Session:    DebugSession{TTY: true, Join: tt.join, Write: tt.write},
+			}
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/debug", nil)
+			s.serveSession(w, req, r, nil, nil)
+			if tt.wantCode > 0 && w.Code != tt.wantCode {
+				t.Errorf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode == 0 && (w.Code == 403 || w.Code == 404) {
+				t.Errorf("code = %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aylei/kubectl-debug/version"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/distribution/reference"
+)
+
+// DoctorReport is the result of the checks of the agent for a debug session of the
+// target container, written by /api/v1/doctor
+type DoctorReport struct {
+	Version string        `json:"version"`
+	Checks  []DoctorCheck `json:"checks"`
+}
+
+// DoctorCheck is a check of the agent, the message explains the failure
+type DoctorCheck struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message"`
+}
+
+// ServeDoctor checks what a debug session of the target container depends on in the agent:
+// the container runtime, the lxcfs mount if enabled, and the resolution of the debug image.
+// The session is described like for /api/v1/debug, the registry credentials are not read from the url.
+func (s *Server) ServeDoctor(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// the doctor runs no command, only the target is required
+	r, err := decodeDebugSessionRequest(req)
+	if err == nil && len(r.Target.Container) < 1 {
+		err = errors.New("target container id must be provided")
+	}
+	if err != nil {
+		http.Error(w, strings.ReplaceAll(err.Error(), ":", "-"), 400)
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), s.config.RuntimeTimeout)
+	defer cancel()
+
+	report := DoctorReport{Version: version.Version()}
+	report.Checks = append(report.Checks, s.checkRuntime(ctx, r.Target.Container))
+	if r.Lxcfs {
+		check := DoctorCheck{Name: "lxcfs", Passed: true, Message: LxcfsHomeDir + " is mounted"}
+		if err := CheckLxcfsMount(); err != nil {
+			check = DoctorCheck{Name: "lxcfs", Message: err.Error()}
+		}
+		report.Checks = append(report.Checks, check)
+	}
+	if len(r.Image) > 0 {
+		report.Checks = append(report.Checks, s.checkImage(ctx, r.Image, r.Registry.Auth, r.Registry.SkipTLSVerify))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("Failed to write doctor report: %v\r\n", err)
+	}
+}
+
+// checkRuntime checks that the runtime of the target container is supported and can inspect it
+func (s *Server) checkRuntime(ctx context.Context, containerUri string) DoctorCheck {
+	runtime, err := NewRuntimeManager(*s.config, containerUri, s.config.Verbosity, "", "")
+	if err != nil {
+		return DoctorCheck{Name: "runtime", Message: err.Error()}
+	}
+	defer runtime.Close()
+	target, err := runtime.TargetInfo(ctx)
+	if err != nil {
+		return DoctorCheck{Name: "runtime", Message: fmt.Sprintf("failed to inspect the target container: %v", err)}
+	}
+	return DoctorCheck{
+		Name:    "runtime",
+		Passed:  true,
+		Message: fmt.Sprintf("%s container %s has pid %d on the node", runtime.containerScheme, runtime.idOfContainerToDebug, target.Pid),
+	}
+}
+
+// checkImage checks that the debug image can be resolved through the registry mirrors and
+// the registry of the image with the credentials of the client
+func (s *Server) checkImage(ctx context.Context, image, authStr string, skipTLS bool) DoctorCheck {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return DoctorCheck{Name: "image", Message: fmt.Sprintf("invalid image %s: %v", image, err)}
+	}
+	named = reference.TagNameOnly(named)
+	username, password, err := parseAuthStr(authStr)
+	if err != nil {
+		return DoctorCheck{Name: "image", Message: err.Error()}
+	}
+	registries, err := newRegistryResolver(*s.config)
+	if err != nil {
+		return DoctorCheck{Name: "image", Message: err.Error()}
+	}
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: registries.containerdHosts(username, password, skipTLS, s.config.Verbosity),
+	})
+	_, desc, err := resolver.Resolve(ctx, named.String())
+	if err != nil {
+		return DoctorCheck{Name: "image", Message: fmt.Sprintf("failed to resolve image %s: %v", named, err)}
+	}
+	return DoctorCheck{Name: "image", Passed: true, Message: fmt.Sprintf("image %s resolves to %s", named, desc.Digest)}
+}
@@ -0,0 +1,169 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PullPolicy describes when the debug image is pulled, same as corev1.PullPolicy
+type PullPolicy string
+
+const (
+	// PullAlways pulls the image for every session
+	PullAlways PullPolicy = "Always"
+	// PullIfNotPresent pulls the image only if it is not present on the node
+	PullIfNotPresent PullPolicy = "IfNotPresent"
+	// PullNever never pulls the image, the session fails if it is not present
+	PullNever PullPolicy = "Never"
+)
+
+// ParsePullPolicy parses a pull policy, the empty policy means Always
+func ParsePullPolicy(s string) (PullPolicy, error) {
+	switch PullPolicy(s) {
+	case "":
+		return PullAlways, nil
+	case PullAlways, PullIfNotPresent, PullNever:
+		return PullPolicy(s), nil
+	}
+	return "", fmt.Errorf("invalid pull policy %q, must be one of %s, %s, %s", s, PullAlways, PullIfNotPresent, PullNever)
+}
+
+// CachedImage is the state of an image pre-pulled by the agent
+type CachedImage struct {
+	Image     string    `json:"image"`
+	Runtime   string    `json:"runtime"`
+	Present   bool      `json:"present"`
+	PulledAt  time.Time `json:"pulledAt,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// imageCache pre-pulls the configured debug images and keeps their state
+type imageCache struct {
+	config *Config
+	mu     sync.Mutex
+	images map[string]*CachedImage
+}
+
+func newImageCache(config *Config) *imageCache {
+	c := &imageCache{
+		config: config,
+		images: map[string]*CachedImage{},
+	}
+	for _, image := range config.PrePullImages {
+		c.images[image] = &CachedImage{Image: image, Runtime: string(c.runtimeScheme())}
+	}
+	return c
+}
+
+// runtimeScheme returns the runtime the images are pre-pulled into,
+// docker is used if its socket exists on the node
+func (c *imageCache) runtimeScheme() ContainerRuntimeScheme {
+	if len(c.config.PrePullRuntime) > 0 {
+		return ContainerRuntimeScheme(c.config.PrePullRuntime)
+	}
+	if _, err := os.Stat(strings.TrimPrefix(c.config.DockerEndpoint, "unix://")); err == nil {
+		return DockerScheme
+	}
+	return ContainerdScheme
+}
+
+// run pre-pulls the images at startup and then refreshes them periodically
+func (c *imageCache) run() {
+	c.refresh()
+	if c.config.PrePullInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.config.PrePullInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.refresh()
+	}
+}
+
+func (c *imageCache) refresh() {
+	registries, err := newRegistryResolver(*c.config)
+	if err != nil {
+		log.Printf("Failed to load registry config to pre-pull images: %v\n", err)
+		return
+	}
+	runtime, closeRuntime, err := c.newRuntime(registries)
+	if err != nil {
+		log.Printf("Failed to connect container runtime to pre-pull images: %v\n", err)
+		return
+	}
+	defer closeRuntime()
+	for _, image := range c.config.PrePullImages {
+		ctx, cancel := context.WithTimeout(context.Background(), c.config.PrePullTimeout)
+		cfg := RunConfig{context: ctx, timeout: c.config.RuntimeTimeout, verbosity: c.config.Verbosity}
+		log.Printf("Pre-pulling image %s\n", image)
+		err := runtime.PullImage(ctx, image, false, "", cfg)
+		cancel()
+		c.mu.Lock()
+		cached := c.images[image]
+		if err != nil {
+			log.Printf("Failed to pre-pull image %s: %v\n", image, err)
+			cached.LastError = err.Error()
+		} else {
+			cached.Present = true
+			cached.PulledAt = time.Now()
+			cached.LastError = ""
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *imageCache) newRuntime(registries *registryResolver) (ContainerRuntime, func(), error) {
+	dockerClient, containerdClient, err := newRuntimeClient(*c.config, c.runtimeScheme(), c.config.Verbosity)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dockerClient != nil {
+		return &DockerContainerRuntime{client: dockerClient, registries: registries},
+			func() { dockerClient.Close() }, nil
+	}
+	return &ContainerdContainerRuntime{client: containerdClient, registries: registries},
+		func() { containerdClient.Close() }, nil
+}
+
+// list returns the state of the pre-pulled images,
+// the presence is checked against the runtime
+func (c *imageCache) list() []CachedImage {
+	runtime, closeRuntime, err := c.newRuntime(nil)
+	if err == nil {
+		defer closeRuntime()
+	}
+	var ret []CachedImage
+	for _, image := range c.config.PrePullImages {
+		var present bool
+		if runtime != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), c.config.RuntimeTimeout)
+			present, _ = runtime.LoadImage(ctx, image, RunConfig{})
+			cancel()
+		}
+		c.mu.Lock()
+		cached := *c.images[image]
+		c.mu.Unlock()
+		cached.Present = present
+		ret = append(ret, cached)
+	}
+	return ret
+}
+
+// ServeImages serves the state of the pre-pulled images
+func (s *Server) ServeImages(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.images.list()); err != nil {
+		log.Printf("Failed to write images: %v\n", err)
+	}
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pullRuntime is a container runtime recording the pulls of the images present or not
+type pullRuntime struct {
+	ContainerRuntime
+	present bool
+	loadErr error
+	pulled  []string
+}
+
+func (r *pullRuntime) LoadImage(ctx context.Context, image string, cfg RunConfig) (bool, error) {
+	return r.present, r.loadErr
+}
+
+func (r *pullRuntime) PullImage(ctx context.Context, image string, skipTLS bool, authStr string, cfg RunConfig) error {
+	r.pulled = append(r.pulled, image)
+	return nil
+}
+
+func TestParsePullPolicy(t *testing.T) {
+	for s, want := range map[string]PullPolicy{"": PullAlways, "Always": PullAlways, "IfNotPresent": PullIfNotPresent, "Never": PullNever} {
+		if got, err := ParsePullPolicy(s); err != nil || got != want {
+			t.Errorf("ParsePullPolicy(%q) = %s, %v, want %s", s, got, err, want)
+		}
+	}
+	if _, err := ParsePullPolicy("always"); err == nil {
+		t.Errorf("ParsePullPolicy() of an invalid policy succeeded")
+	}
+}
+
+func TestEnsureImage(t *testing.T) {
+	tests := []struct {
+		policy     PullPolicy
+		present    bool
+		loadErr    error
+		wantPulled bool
+		wantErr    string
+	}{
+		{policy: PullAlways, present: true, wantPulled: true},
+		{policy: PullIfNotPresent, present: true},
+		{policy: PullIfNotPresent, wantPulled: true},
+		{policy: PullIfNotPresent, loadErr: errors.New("runtime unavailable"), wantErr: "runtime unavailable"},
+		{policy: PullNever, present: true},
+		{policy: PullNever, wantErr: "is not present on the node and the pull policy is Never"},
+	}
+	for _, tt := range tests {
+		runtime := &pullRuntime{present: tt.present, loadErr: tt.loadErr}
+		m := &DebugAttacher{containerRuntime: runtime, image: "nicolaka/netshoot:latest", pullPolicy: tt.policy, context: context.Background()}
+		err := m.ensureImage(RunConfig{})
+		if len(tt.wantErr) > 0 != (err != nil) || err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("ensureImage() with %s and present %v error = %v, want %q", tt.policy, tt.present, err, tt.wantErr)
+		}
+		if (len(runtime.pulled) > 0) != tt.wantPulled {
+			t.Errorf("ensureImage() with %s and present %v pulled %v, want %v", tt.policy, tt.present, runtime.pulled, tt.wantPulled)
+		}
+	}
+}
+
+func TestImageCacheRuntimeScheme(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "docker.sock")
+	tests := []struct {
+		name   string
+		config Config
+		want   ContainerRuntimeScheme
+	}{
+		{name: "configured", config: Config{PrePullRuntime: "containerd", DockerEndpoint: "unix://" + socket}, want: ContainerdScheme},
+		{name: "docker socket", config: Config{DockerEndpoint: "unix://" + socket}, want: DockerScheme},
+		{name: "no docker socket", config: Config{DockerEndpoint: "unix://" + filepath.Join(dir, "missing.sock")}, want: ContainerdScheme},
+	}
+	if err := ioutil.WriteFile(socket, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.PrePullImages = []string{"nicolaka/netshoot:latest"}
+			c := newImageCache(&tt.config)
+			if got := c.runtimeScheme(); got != tt.want {
+				t.Errorf("runtimeScheme() = %s, want %s", got, tt.want)
+			}
+			cached := c.images["nicolaka/netshoot:latest"]
+			if cached == nil || cached.Runtime != string(tt.want) || cached.Present {
+				t.Errorf("cached image = %+v, want not present in %s", cached, tt.want)
+			}
+		})
+	}
+}
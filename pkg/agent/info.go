@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aylei/kubectl-debug/version"
+)
+
+// features are the optional parameters and apis of the agent, the clients don't use
+// the ones an agent doesn't report
+var features = []string{
+	// parameters of the debug sessions
+	"lxcfs",
+	"registrySkipTLS",
+	"pullPolicy",
+	"nonInteractive",
+	"reattach",
+	"share",
+	"shareable",
+	"env",
+	"mounts",
+	"securityProfile",
+	"limits",
+	"targetPid",
+	"websocket",
+	"sessionRequestV1",
+	// apis of the tools
+	"images",
+	"cp",
+	"capture",
+	"portforward",
+	"collect",
+	"doctor",
+}
+
+// AgentInfo describes the agent to the clients, written by /api/v1/info
+type AgentInfo struct {
+	Version string `json:"version"`
+	// container runtimes whose socket is found on the node
+	Runtimes []string    `json:"runtimes"`
+	Features []string    `json:"features"`
+	Limits   AgentLimits `json:"limits"`
+}
+
+// AgentLimits are the policies of the agent config the requests must comply with
+type AgentLimits struct {
+	AllowedMountPaths       []string `json:"allowedMountPaths"`
+	AllowedSecurityProfiles []string `json:"allowedSecurityProfiles"`
+	ImageVerification       string   `json:"imageVerification,omitempty"`
+	// seconds and bytes, 0 for no limit
+	CaptureMaxDuration int64 `json:"captureMaxDuration"`
+	CaptureMaxBytes    int64 `json:"captureMaxBytes"`
+	// seconds a detached session is kept, 0 if the sessions can't be reattached
+	DetachGracePeriod int64 `json:"detachGracePeriod"`
+}
+
+// ServeInfo writes the version, the runtimes, the features and the limits of the agent
+func (s *Server) ServeInfo(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	info := AgentInfo{
+		Version:  version.Version(),
+		Runtimes: []string{},
+		Features: features,
+		Limits: AgentLimits{
+			AllowedMountPaths:       s.config.AllowedMountPaths,
+			AllowedSecurityProfiles: s.config.AllowedSecurityProfiles,
+			ImageVerification:       s.config.ImageVerification.Mode,
+			CaptureMaxDuration:      int64(s.config.CaptureMaxDuration.Seconds()),
+			CaptureMaxBytes:         s.config.CaptureMaxBytes,
+			DetachGracePeriod:       int64(s.config.DetachGracePeriod.Seconds()),
+		},
+	}
+	if _, err := os.Stat(strings.TrimPrefix(s.config.DockerEndpoint, "unix://")); err == nil {
+		info.Runtimes = append(info.Runtimes, string(DockerScheme))
+	}
+	if _, err := os.Stat(strings.TrimPrefix(s.config.ContainerdEndpoint, "unix://")); err == nil {
+		info.Runtimes = append(info.Runtimes, string(ContainerdScheme))
+	}
+	if info.Limits.AllowedMountPaths == nil {
+		info.Limits.AllowedMountPaths = []string{}
+	}
+	// all the security profiles are allowed by default
+	if len(info.Limits.AllowedSecurityProfiles) < 1 {
+		for profile := range securityProfiles {
+			info.Limits.AllowedSecurityProfiles = append(info.Limits.AllowedSecurityProfiles, profile)
+		}
+		sort.Strings(info.Limits.AllowedSecurityProfiles)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		log.Printf("Failed to write agent info: %v\r\n", err)
+	}
+}
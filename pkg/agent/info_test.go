@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aylei/kubectl-debug/version"
+)
+
+func TestServeInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	tests := []struct {
+		name         string
+		config       Config
+		wantRuntimes []string
+		wantLimits   AgentLimits
+	}{
+		{
+			name: "defaults",
+			config: Config{
+				DockerEndpoint:     "unix://" + socket,
+				ContainerdEndpoint: "unix://" + filepath.Join(dir, "containerd.sock"),
+			},
+			wantRuntimes: []string{"docker"},
+			wantLimits: AgentLimits{
+				AllowedMountPaths:       []string{},
+				AllowedSecurityProfiles: []string{"default", "netadmin", "restricted", "sysadmin"},
+			},
+		},
+		{
+			name: "limits",
+			config: Config{
+				DockerEndpoint:          filepath.Join(dir, "missing.sock"),
+				ContainerdEndpoint:      socket,
+				AllowedMountPaths:       []string{"/var/log"},
+				AllowedSecurityProfiles: []string{"restricted"},
+				ImageVerification:       ImageVerificationConfig{Mode: "enforce"},
+				CaptureMaxDuration:      10 * time.Minute,
+				CaptureMaxBytes:         1 << 20,
+				DetachGracePeriod:       5 * time.Minute,
+			},
+			wantRuntimes: []string{"containerd"},
+			wantLimits: AgentLimits{
+				AllowedMountPaths:       []string{"/var/log"},
+				AllowedSecurityProfiles: []string{"restricted"},
+				ImageVerification:       "enforce",
+				CaptureMaxDuration:      600,
+				CaptureMaxBytes:         1 << 20,
+				DetachGracePeriod:       300,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{config: &tt.config}
+			w := httptest.NewRecorder()
+			s.ServeInfo(w, httptest.NewRequest(http.MethodGet, "/api/v1/info", nil))
+			if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("ServeInfo() = %d %s", w.Code, w.Header().Get("Content-Type"))
+			}
+			var info AgentInfo
+			if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+				t.Fatal(err)
+			}
+			if info.Version != version.Version() || !reflect.DeepEqual(info.Features, features) {
+				t.Errorf("version %s features %v", info.Version, info.Features)
+			}
+			if !reflect.DeepEqual(info.Runtimes, tt.wantRuntimes) {
+				t.Errorf("runtimes = %v, want %v", info.Runtimes, tt.wantRuntimes)
+			}
+			if !reflect.DeepEqual(info.Limits, tt.wantLimits) {
+				t.Errorf("limits = %+v, want %+v", info.Limits, tt.wantLimits)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	(&Server{config: &Config{}}).ServeInfo(w, httptest.NewRequest(http.MethodPost, "/api/v1/info", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /api/v1/info = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
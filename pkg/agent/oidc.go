@@ -0,0 +1,284 @@
+package agent
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+	"golang.org/x/oauth2"
+)
+
+// OIDCConfig configures the OpenID Connect login of the web UI, the claims
+// are mapped to the kubernetes user the same way as the apiserver --oidc flags
+type OIDCConfig struct {
+	IssuerURL string `yaml:"issuer_url,omitempty"`
+	ClientID  string `yaml:"client_id,omitempty"`
+	// the file holding the client secret, used by the authorization code flow
+	ClientSecretFile string `yaml:"client_secret_file,omitempty"`
+	// the callback of the web UI registered at the issuer, e.g. https://node:10028/callback
+	RedirectURL    string   `yaml:"redirect_url,omitempty"`
+	Scopes         []string `yaml:"scopes,omitempty"`
+	UsernameClaim  string   `yaml:"username_claim,omitempty"`
+	UsernamePrefix string   `yaml:"username_prefix,omitempty"`
+	GroupsClaim    string   `yaml:"groups_claim,omitempty"`
+	GroupsPrefix   string   `yaml:"groups_prefix,omitempty"`
+}
+
+// how long the keys of the issuer are cached
+const oidcKeysTTL = time.Hour
+
+// oidcProvider verifies the id tokens of an issuer and runs the authorization code flow
+type oidcProvider struct {
+	config OIDCConfig
+	oauth2 *oauth2.Config
+	client *http.Client
+
+	mu      sync.Mutex
+	jwksURI string
+	keys    map[string]interface{}
+	fetched time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func newOIDCProvider(config OIDCConfig) (*oidcProvider, error) {
+	if len(config.ClientID) < 1 {
+		return nil, errors.New("oidc client_id must be provided")
+	}
+	if len(config.UsernameClaim) < 1 {
+		config.UsernameClaim = "email"
+	}
+	if len(config.GroupsClaim) < 1 {
+		config.GroupsClaim = "groups"
+	}
+	p := &oidcProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	var discovery oidcDiscovery
+	if err := p.getJSON(strings.TrimSuffix(config.IssuerURL, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("failed to discover oidc issuer %s: %v", config.IssuerURL, err)
+	}
+	if discovery.Issuer != config.IssuerURL {
+		return nil, fmt.Errorf("oidc issuer %s does not match the discovered issuer %s", config.IssuerURL, discovery.Issuer)
+	}
+	p.jwksURI = discovery.JWKSURI
+
+	// the authorization code flow is optional, tokens can also be pasted in the login form
+	if len(config.ClientSecretFile) > 0 && len(config.RedirectURL) > 0 {
+		secret, err := ioutil.ReadFile(config.ClientSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		scopes := config.Scopes
+		if len(scopes) < 1 {
+			scopes = []string{"openid", "email", "groups"}
+		}
+		p.oauth2 = &oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: strings.TrimSpace(string(secret)),
+			RedirectURL:  config.RedirectURL,
+			Scopes:       scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  discovery.AuthorizationEndpoint,
+				TokenURL: discovery.TokenEndpoint,
+			},
+		}
+	}
+	return p, nil
+}
+
+func (p *oidcProvider) getJSON(url string, v interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// issued returns whether the token is a jwt of the issuer, without verifying it
+func (p *oidcProvider) issued(token string) bool {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return false
+	}
+	iss, _ := claims["iss"].(string)
+	return iss == p.config.IssuerURL
+}
+
+// verify verifies the id token and returns the user it identifies
+func (p *oidcProvider) verify(token string) (*webUser, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unsupported signing method %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return p.key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != p.config.IssuerURL {
+		return nil, fmt.Errorf("token issued by %s", iss)
+	}
+	if !p.audience(claims["aud"]) {
+		return nil, fmt.Errorf("token not issued for client %s", p.config.ClientID)
+	}
+	name, _ := claims[p.config.UsernameClaim].(string)
+	if len(name) < 1 {
+		return nil, fmt.Errorf("token has no %s claim", p.config.UsernameClaim)
+	}
+	if p.config.UsernameClaim == "email" {
+		if verified, ok := claims["email_verified"].(bool); ok && !verified {
+			return nil, errors.New("email of the token is not verified")
+		}
+	}
+	user := &webUser{name: p.config.UsernamePrefix + name}
+	switch groups := claims[p.config.GroupsClaim].(type) {
+	case string:
+		user.groups = []string{p.config.GroupsPrefix + groups}
+	case []interface{}:
+		for _, group := range groups {
+			if g, ok := group.(string); ok {
+				user.groups = append(user.groups, p.config.GroupsPrefix+g)
+			}
+		}
+	}
+	return user, nil
+}
+
+func (p *oidcProvider) audience(aud interface{}) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == p.config.ClientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == p.config.ClientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the signing key, the keys are refetched for unknown key ids
+func (p *oidcProvider) key(kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok && time.Since(p.fetched) < oidcKeysTTL {
+		return key, nil
+	}
+	// don't hammer the issuer with tokens of unknown keys
+	if time.Since(p.fetched) < 10*time.Second {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	p.fetched = time.Now()
+	if err := p.getJSON(p.jwksURI, &jwks); err != nil {
+		return nil, err
+	}
+	p.keys = map[string]interface{}{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		p.keys[k.Kid] = key
+	}
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// exchange exchanges the authorization code for the id token
+func (p *oidcProvider) exchange(ctx context.Context, code string) (string, error) {
+	token, err := p.oauth2.Exchange(ctx, code)
+	if err != nil {
+		return "", err
+	}
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", errors.New("no id_token in the token response")
+	}
+	return idToken, nil
+}
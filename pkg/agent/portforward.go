@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	kubetype "k8s.io/apimachinery/pkg/types"
+	kubeletportforward "k8s.io/kubernetes/pkg/kubelet/server/portforward"
+)
+
+const portForwardDialTimeout = 10 * time.Second
+
+// ServePortForward forwards the connections of the client to a host, localhost by default,
+// dialed in the network namespace of the target container. Unlike kubectl port-forward,
+// the ports only bound to the loopback interface of the target are reachable.
+func (s *Server) ServePortForward(w http.ResponseWriter, req *http.Request) {
+	host := req.FormValue("host")
+	if len(host) < 1 {
+		host = "localhost"
+	}
+	opts, err := kubeletportforward.NewV4Options(req)
+	if err != nil {
+		http.Error(w, strings.ReplaceAll(err.Error(), ":", "-"), 400)
+		return
+	}
+	s.withTarget(w, req, "port-forward", "host "+host, func(ctx context.Context, target ContainerInfo) {
+		forwarder := &netNSForwarder{target: target, host: host}
+		kubeletportforward.ServePortForward(w, req, forwarder, "", "", opts,
+			s.config.StreamIdleTimeout, s.config.StreamCreationTimeout, kubeletportforward.SupportedProtocols)
+	})
+}
+
+// netNSForwarder dials the host in the network namespace of the target
+type netNSForwarder struct {
+	target ContainerInfo
+	host   string
+}
+
+var netNSForwarderImplementsPortForwarder kubeletportforward.PortForwarder = (*netNSForwarder)(nil)
+
+// Implement kubeletportforward.PortForwarder
+func (f *netNSForwarder) PortForward(name string, uid kubetype.UID, port int32, stream io.ReadWriteCloser) error {
+	address := net.JoinHostPort(f.host, strconv.Itoa(int(port)))
+	conn, err := dialInNetNS(f.target.Pid, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("forwarding a connection to %s in the network namespace of %d\r\n", address, f.target.Pid)
+
+	go func() {
+		io.Copy(conn, stream)
+		// the client closed its side, let the target finish its response
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	_, err = io.Copy(stream, conn)
+	return err
+}
+
+// dialInNetNS dials the address in the network namespace of the process. The host is
+// resolved by the agent, the socket is created on a thread switched to the namespace.
+func dialInNetNS(pid int64, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), portForwardDialTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := os.Open(GetNetworkNamespace(pid))
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// the thread is only unlocked, i.e. reused by other goroutines,
+		// once it is back in the namespace of the agent
+		runtime.LockOSThread()
+		origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			done <- result{err: err}
+			return
+		}
+		defer origin.Close()
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			done <- result{err: fmt.Errorf("failed to enter the network namespace of %d: %v", pid, err)}
+			return
+		}
+		var res result
+		dialer := &net.Dialer{}
+		for _, addr := range addrs {
+			res.conn, res.err = dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+			if res.err == nil {
+				break
+			}
+		}
+		if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+			// leave the thread locked, it exits with the goroutine
+			log.Printf("failed to restore the network namespace of the agent: %v\r\n", err)
+		} else {
+			runtime.UnlockOSThread()
+		}
+		done <- res
+	}()
+	res := <-done
+	if res.err != nil {
+		return nil, res.err
+	}
+	return res.conn, nil
+}
@@ -0,0 +1,286 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+const (
+	dockerHubDomain   = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+)
+
+// RegistryConfig configures how the agent accesses an image registry
+type RegistryConfig struct {
+	// Mirrors are tried in order before the registry itself, e.g. https://mirror.internal:5000,
+	// the path of a mirror is prepended to the repository, e.g. harbor.internal/dockerhub-proxy
+	Mirrors []string `yaml:"mirrors,omitempty"`
+	// CAFile is a PEM bundle trusted in addition to the system roots
+	CAFile string `yaml:"ca_file,omitempty"`
+	// Insecure skips the TLS certificate verification
+	Insecure bool `yaml:"insecure,omitempty"`
+	// PlainHTTP uses http instead of https
+	PlainHTTP bool   `yaml:"plain_http,omitempty"`
+	Username  string `yaml:"username,omitempty"`
+	Password  string `yaml:"password,omitempty"`
+}
+
+// registryEndpoint is a registry or a mirror an image can be pulled from
+type registryEndpoint struct {
+	host     string
+	scheme   string
+	path     string
+	isMirror bool
+}
+
+// registryResolver resolves the endpoints, TLS settings and credentials
+// of image pulls from the agent config and the node docker config.json
+type registryResolver struct {
+	registries map[string]RegistryConfig
+	// credentials from the node docker config.json, keyed by registry host
+	dockerAuths map[string]types.AuthConfig
+}
+
+func newRegistryResolver(cfg Config) (*registryResolver, error) {
+	r := &registryResolver{
+		registries:  cfg.Registries,
+		dockerAuths: map[string]types.AuthConfig{},
+	}
+	if len(cfg.DockerConfigFile) < 1 {
+		return r, nil
+	}
+	content, err := ioutil.ReadFile(cfg.DockerConfigFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, fmt.Errorf("failed to read docker config %s: %v", cfg.DockerConfigFile, err)
+	}
+	var dockerCfg struct {
+		Auths map[string]types.AuthConfig `json:"auths"`
+	}
+	if err := json.Unmarshal(content, &dockerCfg); err != nil {
+		return nil, fmt.Errorf("failed to parse docker config %s: %v", cfg.DockerConfigFile, err)
+	}
+	for key, auth := range dockerCfg.Auths {
+		if len(auth.Auth) > 0 {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode auth of %s in docker config %s: %v", key, cfg.DockerConfigFile, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) == 2 {
+				auth.Username, auth.Password = parts[0], parts[1]
+			}
+		}
+		r.dockerAuths[normalizeRegistryHost(key)] = auth
+	}
+	return r, nil
+}
+
+// normalizeRegistryHost returns the host of a registry address,
+// e.g. https://index.docker.io/v1/ -> docker.io
+func normalizeRegistryHost(address string) string {
+	address = strings.TrimPrefix(address, "https://")
+	address = strings.TrimPrefix(address, "http://")
+	host := strings.ToLower(strings.SplitN(address, "/", 2)[0])
+	switch host {
+	case "index.docker.io", dockerHubRegistry, "registry.hub.docker.com":
+		return dockerHubDomain
+	}
+	return host
+}
+
+// parseAuthStr parses the credentials sent by the client,
+// either a docker AuthConfig json or username:password
+func parseAuthStr(authStr string) (string, string, error) {
+	if len(authStr) < 1 {
+		return "", "", nil
+	}
+	var authConfig types.AuthConfig
+	if err := json.Unmarshal([]byte(authStr), &authConfig); err == nil {
+		return authConfig.Username, authConfig.Password, nil
+	}
+	crds := strings.SplitN(authStr, ":", 2)
+	if len(crds) != 2 {
+		return "", "", fmt.Errorf("failed to parse authStr, expected username:password or a docker auth config")
+	}
+	return crds[0], crds[1], nil
+}
+
+// credentials returns the configured credentials of a registry host
+func (r *registryResolver) credentials(host string) (string, string) {
+	host = normalizeRegistryHost(host)
+	if reg, ok := r.registries[host]; ok && (len(reg.Username) > 0 || len(reg.Password) > 0) {
+		return reg.Username, reg.Password
+	}
+	if auth, ok := r.dockerAuths[host]; ok {
+		return auth.Username, auth.Password
+	}
+	return "", ""
+}
+
+// endpoints returns the mirrors of the registry of an image followed by the registry itself
+func (r *registryResolver) endpoints(domain string) ([]registryEndpoint, error) {
+	reg := r.registries[domain]
+	var ret []registryEndpoint
+	for _, mirror := range reg.Mirrors {
+		if !strings.Contains(mirror, "://") {
+			mirror = "https://" + mirror
+		}
+		u, err := url.Parse(mirror)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror %s of registry %s: %v", mirror, domain, err)
+		}
+		ret = append(ret, registryEndpoint{
+			host:     u.Host,
+			scheme:   u.Scheme,
+			path:     strings.TrimSuffix(u.Path, "/"),
+			isMirror: true,
+		})
+	}
+	host := domain
+	if domain == dockerHubDomain {
+		host = dockerHubRegistry
+	}
+	scheme := "https"
+	if reg.PlainHTTP {
+		scheme = "http"
+	}
+	return append(ret, registryEndpoint{host: host, scheme: scheme}), nil
+}
+
+// httpClient returns a client with the TLS settings of a registry host
+func (r *registryResolver) httpClient(host string, skipTLS bool) (*http.Client, error) {
+	reg := r.registries[normalizeRegistryHost(host)]
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: skipTLS || reg.Insecure,
+	}
+	if len(reg.CAFile) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(reg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle of registry %s: %v", host, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA bundle %s of registry %s", reg.CAFile, host)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+				DualStack: true,
+			}).DialContext,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			TLSClientConfig:       tlsConfig,
+			ExpectContinueTimeout: 5 * time.Second,
+		},
+	}, nil
+}
+
+// containerdHosts returns the registry hosts used by the containerd resolver,
+// the credentials sent by the client are used for the registry of the image only
+func (r *registryResolver) containerdHosts(username, password string, skipTLS bool, verbosity int) docker.RegistryHosts {
+	return func(domain string) ([]docker.RegistryHost, error) {
+		endpoints, err := r.endpoints(domain)
+		if err != nil {
+			return nil, err
+		}
+		var hosts []docker.RegistryHost
+		for _, endpoint := range endpoints {
+			client, err := r.httpClient(endpoint.host, skipTLS)
+			if err != nil {
+				return nil, err
+			}
+			user, pass := r.credentials(endpoint.host)
+			if !endpoint.isMirror && (len(username) > 0 || len(password) > 0) {
+				user, pass = username, password
+			}
+			host := endpoint.host
+			crdsClbck := func(string) (string, string, error) {
+				if verbosity > 0 {
+					log.Printf("crdsClbck returning username: %v for %v\r\n", user, host)
+				}
+				return user, pass, nil
+			}
+			// the path of a mirror is a repository prefix, e.g. a proxy project of harbor
+			path := "/v2" + endpoint.path
+			capabilities := docker.HostCapabilityPull | docker.HostCapabilityResolve
+			if !endpoint.isMirror {
+				capabilities |= docker.HostCapabilityPush
+			}
+			hosts = append(hosts, docker.RegistryHost{
+				Client:       client,
+				Authorizer:   docker.NewDockerAuthorizer(docker.WithAuthClient(client), docker.WithAuthCreds(crdsClbck)),
+				Host:         endpoint.host,
+				Scheme:       endpoint.scheme,
+				Path:         path,
+				Capabilities: capabilities,
+			})
+		}
+		return hosts, nil
+	}
+}
+
+// checkDockerEndpoints fails if the TLS settings of the endpoints are configured, the docker
+// daemon resolves them itself from certs.d and insecure-registries and would ignore them
+func (r *registryResolver) checkDockerEndpoints(endpoints []registryEndpoint) error {
+	for _, endpoint := range endpoints {
+		reg := r.registries[normalizeRegistryHost(endpoint.host)]
+		if len(reg.CAFile) > 0 || reg.Insecure || reg.PlainHTTP || endpoint.scheme == "http" {
+			return fmt.Errorf("registry %s sets ca_file, insecure or plain_http, which the docker runtime doesn't support, "+
+				"configure them in the docker daemon of the node instead", endpoint.host)
+		}
+	}
+	return nil
+}
+
+// dockerPullRefs returns the references to pull an image from its mirrors and its registry,
+// the docker daemon resolves the TLS settings of the registries itself
+func (r *registryResolver) dockerPullRefs(named reference.Named) ([]registryEndpoint, []string, error) {
+	domain := reference.Domain(named)
+	endpoints, err := r.endpoints(domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	suffix := ""
+	if tagged, ok := named.(reference.Tagged); ok {
+		suffix = ":" + tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		suffix = "@" + digested.Digest().String()
+	}
+	var refs []string
+	for _, endpoint := range endpoints {
+		if !endpoint.isMirror {
+			refs = append(refs, named.String())
+			continue
+		}
+		refs = append(refs, endpoint.host+endpoint.path+"/"+reference.Path(named)+suffix)
+	}
+	return endpoints, refs, nil
+}
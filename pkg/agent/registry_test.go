@@ -0,0 +1,218 @@
+package agent
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/distribution/reference"
+)
+
+func newTestRegistryResolver(t *testing.T, registries map[string]RegistryConfig, dockerConfig string) *registryResolver {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	cfg := Config{Registries: registries, DockerConfigFile: filepath.Join(dir, "config.json")}
+	if len(dockerConfig) > 0 {
+		if err := ioutil.WriteFile(cfg.DockerConfigFile, []byte(dockerConfig), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := newRegistryResolver(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestNormalizeRegistryHost(t *testing.T) {
+	for address, want := range map[string]string{
+		"https://index.docker.io/v1/": "docker.io",
+		"registry-1.docker.io":        "docker.io",
+		"http://Harbor.internal:5000": "harbor.internal:5000",
+		"gcr.io/project":              "gcr.io",
+	} {
+		if got := normalizeRegistryHost(address); got != want {
+			t.Errorf("normalizeRegistryHost(%q) = %s, want %s", address, got, want)
+		}
+	}
+}
+
+func TestParseAuthStr(t *testing.T) {
+	tests := []struct {
+		authStr            string
+		wantUser, wantPass string
+		wantErr            bool
+	}{
+		{},
+		{authStr: "alice:p:ss", wantUser: "alice", wantPass: "p:ss"},
+		{authStr: `{"username":"alice","password":"secret"}`, wantUser: "alice", wantPass: "secret"},
+		{authStr: "alice", wantErr: true},
+	}
+	for _, tt := range tests {
+		user, pass, err := parseAuthStr(tt.authStr)
+		if (err != nil) != tt.wantErr || user != tt.wantUser || pass != tt.wantPass {
+			t.Errorf("parseAuthStr(%q) = %q, %q, %v, want %q, %q", tt.authStr, user, pass, err, tt.wantUser, tt.wantPass)
+		}
+	}
+}
+
+func TestRegistryCredentials(t *testing.T) {
+	dockerConfig := `{"auths":{
+		"https://index.docker.io/v1/":{"auth":"` + base64.StdEncoding.EncodeToString([]byte("hub:hub-secret")) + `"},
+		"harbor.internal":{"username":"robot","password":"node-secret"},
+		"gcr.io":{"auth":"` + base64.StdEncoding.EncodeToString([]byte("_json_key:key")) + `"}}}`
+	r := newTestRegistryResolver(t, map[string]RegistryConfig{
+		"harbor.internal": {Username: "admin", Password: "config-secret"},
+		"quay.io":         {Mirrors: []string{"mirror.internal"}},
+	}, dockerConfig)
+	for host, want := range map[string][2]string{
+		"registry-1.docker.io": {"hub", "hub-secret"},
+		"harbor.internal":      {"admin", "config-secret"},
+		"gcr.io":               {"_json_key", "key"},
+		"quay.io":              {"", ""},
+	} {
+		if user, pass := r.credentials(host); user != want[0] || pass != want[1] {
+			t.Errorf("credentials(%s) = %q, %q, want %q, %q", host, user, pass, want[0], want[1])
+		}
+	}
+
+	if _, err := newRegistryResolver(Config{DockerConfigFile: "/nonexistent/config.json"}); err != nil {
+		t.Errorf("a missing docker config fails: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	invalid := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(invalid, []byte(`{"auths":{"gcr.io":{"auth":"not base64!"}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newRegistryResolver(Config{DockerConfigFile: invalid}); err == nil || !strings.Contains(err.Error(), "failed to decode auth of gcr.io") {
+		t.Errorf("newRegistryResolver() of an invalid auth error = %v", err)
+	}
+}
+
+func TestDockerPullRefs(t *testing.T) {
+	r := newTestRegistryResolver(t, map[string]RegistryConfig{
+		"docker.io":       {Mirrors: []string{"mirror.internal:5000", "https://harbor.internal/dockerhub-proxy/"}},
+		"harbor.internal": {PlainHTTP: true},
+	}, "")
+	tests := []struct {
+		image         string
+		wantRefs      []string
+		wantEndpoints []registryEndpoint
+	}{
+		{
+			image: "nicolaka/netshoot:latest",
+			wantRefs: []string{
+				"mirror.internal:5000/nicolaka/netshoot:latest",
+				"harbor.internal/dockerhub-proxy/nicolaka/netshoot:latest",
+				"docker.io/nicolaka/netshoot:latest",
+			},
+			wantEndpoints: []registryEndpoint{
+				{host: "mirror.internal:5000", scheme: "https", isMirror: true},
+				{host: "harbor.internal", scheme: "https", path: "/dockerhub-proxy", isMirror: true},
+				{host: "registry-1.docker.io", scheme: "https"},
+			},
+		},
+		{
+			image: "busybox@sha256:" + strings.Repeat("a", 64),
+			wantRefs: []string{
+				"mirror.internal:5000/library/busybox@sha256:" + strings.Repeat("a", 64),
+				"harbor.internal/dockerhub-proxy/library/busybox@sha256:" + strings.Repeat("a", 64),
+				"docker.io/library/busybox@sha256:" + strings.Repeat("a", 64),
+			},
+		},
+		{
+			image:         "harbor.internal/tools/netshoot:v1",
+			wantRefs:      []string{"harbor.internal/tools/netshoot:v1"},
+			wantEndpoints: []registryEndpoint{{host: "harbor.internal", scheme: "http"}},
+		},
+	}
+	for _, tt := range tests {
+		named, err := reference.ParseNormalizedNamed(tt.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoints, refs, err := r.dockerPullRefs(named)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(refs, tt.wantRefs) {
+			t.Errorf("dockerPullRefs(%s) = %q, want %q", tt.image, refs, tt.wantRefs)
+		}
+		if tt.wantEndpoints != nil && !reflect.DeepEqual(endpoints, tt.wantEndpoints) {
+			t.Errorf("endpoints of %s = %+v, want %+v", tt.image, endpoints, tt.wantEndpoints)
+		}
+	}
+
+	r = newTestRegistryResolver(t, map[string]RegistryConfig{"docker.io": {Mirrors: []string{"https://mirror.internal:port"}}}, "")
+	if _, err := r.endpoints(dockerHubDomain); err == nil {
+		t.Errorf("an invalid mirror is accepted")
+	}
+}
+
+func TestCheckDockerEndpoints(t *testing.T) {
+	r := newTestRegistryResolver(t, map[string]RegistryConfig{
+		"docker.io":       {Mirrors: []string{"mirror.internal", "http://plain.internal"}},
+		"quay.io":         {Mirrors: []string{"mirror.internal"}},
+		"mirror.internal": {Username: "robot", Password: "secret"},
+		"harbor.internal": {CAFile: "/etc/ssl/harbor.pem"},
+		"insecure.local":  {Insecure: true},
+	}, "")
+	tests := []struct {
+		domain  string
+		wantErr string
+	}{
+		{domain: "quay.io"},
+		{domain: "gcr.io"},
+		{domain: "docker.io", wantErr: "registry plain.internal sets"},
+		{domain: "harbor.internal", wantErr: "registry harbor.internal sets"},
+		{domain: "insecure.local", wantErr: "registry insecure.local sets"},
+	}
+	for _, tt := range tests {
+		endpoints, err := r.endpoints(tt.domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = r.checkDockerEndpoints(endpoints)
+		if len(tt.wantErr) > 0 != (err != nil) || err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("checkDockerEndpoints(%s) error = %v, want %q", tt.domain, err, tt.wantErr)
+		}
+	}
+}
+
+func TestContainerdHosts(t *testing.T) {
+	r := newTestRegistryResolver(t, map[string]RegistryConfig{
+		"docker.io":       {Mirrors: []string{"harbor.internal/dockerhub-proxy"}},
+		"harbor.internal": {Username: "robot", Password: "mirror-secret"},
+	}, "")
+	hosts, err := r.containerdHosts("alice", "secret", false, 0)(dockerHubDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 {
+		t.Fatalf("hosts = %+v, want the mirror and the registry", hosts)
+	}
+	mirror, registry := hosts[0], hosts[1]
+	if mirror.Host != "harbor.internal" || mirror.Path != "/v2/dockerhub-proxy" || mirror.Capabilities.Has(docker.HostCapabilityPush) {
+		t.Errorf("mirror = %s%s with %v, want a pull only harbor.internal/v2/dockerhub-proxy", mirror.Host, mirror.Path, mirror.Capabilities)
+	}
+	if registry.Host != dockerHubRegistry || registry.Path != "/v2" || registry.Scheme != "https" || !registry.Capabilities.Has(docker.HostCapabilityPush) {
+		t.Errorf("registry = %s://%s%s with %v", registry.Scheme, registry.Host, registry.Path, registry.Capabilities)
+	}
+
+	r = newTestRegistryResolver(t, map[string]RegistryConfig{"harbor.internal": {CAFile: "/nonexistent/ca.pem"}}, "")
+	if _, err := r.containerdHosts("", "", false, 0)("harbor.internal"); err == nil || !strings.Contains(err.Error(), "failed to read CA bundle") {
+		t.Errorf("containerdHosts() with a missing CA bundle error = %v", err)
+	}
+}
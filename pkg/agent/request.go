@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DebugSessionRequestHeader holds the base64 encoded json of a DebugSessionRequest,
+	// the request can also be sent as the json body of the upgrade request
+	DebugSessionRequestHeader = "X-Kubectl-Debug-Request"
+	// DebugSessionRequestV1 is the api version of DebugSessionRequest
+	DebugSessionRequestV1 = "v1"
+
+	maxDebugSessionRequestSize = 1 << 20
+)
+
+// DebugSessionRequest is the typed request of a debug session, it replaces the form
+// parameters so that the credentials are not part of the url
+type DebugSessionRequest struct {
+	APIVersion string        `json:"apiVersion"`
+	Target     DebugTarget   `json:"target"`
+	Client     DebugClient   `json:"client,omitempty"`
+	Session    DebugSession  `json:"session,omitempty"`
+	Image      string        `json:"image,omitempty"`
+	PullPolicy string        `json:"pullPolicy,omitempty"`
+	Command    []string      `json:"command,omitempty"`
+	Env        []string      `json:"env,omitempty"`
+	Mounts     []Mount       `json:"mounts,omitempty"`
+	Security   DebugSecurity `json:"security,omitempty"`
+	Limits     DebugLimits   `json:"limits,omitempty"`
+	Lxcfs      bool          `json:"lxcfs,omitempty"`
+	Registry   DebugRegistry `json:"registry,omitempty"`
+}
+
+// DebugTarget is the container to debug, as runtime://id
+type DebugTarget struct {
+	Container string `json:"container"`
+}
+
+// DebugClient identifies the client in the logs of the agent, the username is
+// given by the client and is not trusted for anything else
+type DebugClient struct {
+	Hostname  string `json:"hostname,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Verbosity int    `json:"verbosity,omitempty"`
+}
+
+// DebugSession are the terminal and the sharing of the session, a session without
+// tty runs the command to completion and can't be reattached or joined
+type DebugSession struct {
+	TTY          bool   `json:"tty,omitempty"`
+	Reattachable bool   `json:"reattachable,omitempty"`
+	DetachKeys   string `json:"detachKeys,omitempty"`
+	// the session can be joined with the join token returned to the owner, ShareWrite
+	// shares it and lets the observers ask for write access
+	Shareable  bool `json:"shareable,omitempty"`
+	ShareWrite bool `json:"shareWrite,omitempty"`
+	// token of the session to reattach to, or to join
+	Attach string `json:"attach,omitempty"`
+	Join   string `json:"join,omitempty"`
+	Write  bool   `json:"write,omitempty"`
+}
+
+// DebugSecurity is the security profile of the debug container
+type DebugSecurity struct {
+	Profile string `json:"profile,omitempty"`
+}
+
+// DebugLimits are the cpu and memory limits of the debug container, as quantities
+type DebugLimits struct {
+	CPU    string `json:"cpu,omitempty"`
+	Memory string `json:"memory,omitempty"`
+}
+
+// DebugRegistry are the credentials of the registry of the image, either username:password
+// or a docker auth config json, and its TLS verification
+type DebugRegistry struct {
+	Auth          string `json:"auth,omitempty"`
+	SkipTLSVerify bool   `json:"skipTLSVerify,omitempty"`
+}
+
+// parseDebugSessionRequest reads the request from its header or json body, or from the
+// form parameters of the clients older than DebugSessionRequest, and validates it
+func parseDebugSessionRequest(req *http.Request) (*DebugSessionRequest, error) {
+	r, err := decodeDebugSessionRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// decodeDebugSessionRequest reads the request without validating it
+func decodeDebugSessionRequest(req *http.Request) (*DebugSessionRequest, error) {
+	var content []byte
+	if header := req.Header.Get(DebugSessionRequestHeader); len(header) > 0 {
+		var err error
+		content, err = base64.StdEncoding.DecodeString(header)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode the %s header", DebugSessionRequestHeader)
+		}
+	} else if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		var err error
+		content, err = ioutil.ReadAll(io.LimitReader(req.Body, maxDebugSessionRequestSize))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return legacyDebugSessionRequest(req)
+	}
+	r := &DebugSessionRequest{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(r); err != nil {
+		return nil, fmt.Errorf("cannot parse the debug session request, %v", err)
+	}
+	if r.APIVersion != DebugSessionRequestV1 {
+		return nil, fmt.Errorf("unsupported debug session request version %q, expect %s", r.APIVersion, DebugSessionRequestV1)
+	}
+	return r, nil
+}
+
+// legacyDebugSessionRequest reads the request from the form parameters
+func legacyDebugSessionRequest(req *http.Request) (*DebugSessionRequest, error) {
+	verbosity, _ := strconv.Atoi(req.FormValue("verbosity"))
+	r := &DebugSessionRequest{
+		APIVersion: DebugSessionRequestV1,
+		Target:     DebugTarget{Container: req.FormValue("container")},
+		Client: DebugClient{
+			Hostname:  req.FormValue("hostname"),
+			Username:  req.FormValue("username"),
+			Verbosity: verbosity,
+		},
+		Session: DebugSession{
+			TTY:          req.FormValue("tty") != "false",
+			Reattachable: req.FormValue("reattachable") == "true",
+			DetachKeys:   req.FormValue("detachKeys"),
+			Shareable:    req.FormValue("shareable") == "true",
+			ShareWrite:   req.FormValue("shareWrite") == "true",
+			Attach:       req.FormValue("session"),
+			Join:         req.FormValue("join"),
+			Write:        req.FormValue("write") == "true",
+		},
+		Image:      req.FormValue("image"),
+		PullPolicy: req.FormValue("pullPolicy"),
+		Security:   DebugSecurity{Profile: req.FormValue("securityProfile")},
+		Limits: DebugLimits{
+			CPU:    req.FormValue("cpuLimits"),
+			Memory: req.FormValue("memoryLimits"),
+		},
+		Lxcfs: req.FormValue("lxcfsEnabled") == "true",
+		Registry: DebugRegistry{
+			Auth:          req.FormValue("authStr"),
+			SkipTLSVerify: req.FormValue("registrySkipTLS") == "true",
+		},
+	}
+	if command := req.FormValue("command"); len(command) > 0 {
+		if err := json.Unmarshal([]byte(command), &r.Command); err != nil {
+			return nil, errors.New("cannot parse command")
+		}
+	}
+	if env := req.FormValue("env"); len(env) > 0 {
+		if err := json.Unmarshal([]byte(env), &r.Env); err != nil {
+			return nil, errors.New("cannot parse env")
+		}
+	}
+	if mounts := req.FormValue("mounts"); len(mounts) > 0 {
+		if err := json.Unmarshal([]byte(mounts), &r.Mounts); err != nil {
+			return nil, errors.New("cannot parse mounts")
+		}
+	}
+	return r, nil
+}
+
+// validate checks the fields of the request which don't depend on the config of the agent
+func (r *DebugSessionRequest) validate() error {
+	if len(r.Target.Container) < 1 {
+		return errors.New("target container id must be provided")
+	}
+	if _, err := parseDetachKeys(r.Session.DetachKeys); err != nil {
+		return errors.New("invalid detach keys")
+	}
+	if len(r.Session.Attach) > 0 && len(r.Session.Join) > 0 {
+		return errors.New("a session can't be both reattached and joined")
+	}
+	if len(r.Session.Attach) > 0 || len(r.Session.Join) > 0 {
+		if !r.Session.TTY {
+			return errors.New("only interactive sessions can be reattached or joined")
+		}
+		return nil
+	}
+	if len(r.Command) < 1 {
+		return errors.New("command must be provided")
+	}
+	if _, err := ParsePullPolicy(r.PullPolicy); err != nil {
+		return err
+	}
+	return nil
+}
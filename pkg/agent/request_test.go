@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDebugSessionRequest(t *testing.T) {
+	const full = `{"apiVersion":"v1","target":{"container":"docker://abc"},
+		"client":{"username":"alice"},"session":{"tty":true},"image":"busybox",
+		"command":["sh"],"registry":{"auth":"user:p+a%41s"}}`
+	want := &DebugSessionRequest{
+		APIVersion: DebugSessionRequestV1,
+		Target:     DebugTarget{Container: "docker://abc"},
+		Client:     DebugClient{Username: "alice"},
+		Session:    DebugSession{TTY: true},
+		Image:      "busybox",
+		Command:    []string{"sh"},
+		Registry:   DebugRegistry{Auth: "user:p+a%41s"},
+	}
+	legacy := url.Values{
+		"container": {"docker://abc"},
+		"username":  {"alice"},
+		"image":     {"busybox"},
+		"command":   {`["sh"]`},
+		"authStr":   {"user:p+a%41s"},
+	}
+	tests := []struct {
+		name        string
+		header      string
+		contentType string
+		body        string
+		query       url.Values
+		want        *DebugSessionRequest
+		wantErr     string
+	}{
+		{
+			name:   "header",
+			header: base64.StdEncoding.EncodeToString([]byte(full)),
+			want:   want,
+		},
+		{
+			name:        "json body",
+			contentType: "application/json; charset=utf-8",
+			body:        full,
+			want:        want,
+		},
+		{
+			// the form values are decoded once, a plus or an escape in the password is kept
+			name:  "legacy form",
+			query: legacy,
+			want:  want,
+		},
+		{
+			name:    "invalid header",
+			header:  "not base64!",
+			wantErr: "cannot decode",
+		},
+		{
+			name:        "unknown field",
+			contentType: "application/json",
+			body:        `{"apiVersion":"v1","target":{"container":"docker://abc"},"command":["sh"],"authStr":"x"}`,
+			wantErr:     "unknown field",
+		},
+		{
+			name:        "unsupported version",
+			contentType: "application/json",
+			body:        `{"apiVersion":"v2","target":{"container":"docker://abc"},"command":["sh"]}`,
+			wantErr:     "unsupported debug session request version",
+		},
+		{
+			name:        "missing target",
+			contentType: "application/json",
+			body:        `{"apiVersion":"v1","command":["sh"]}`,
+			wantErr:     "target container id must be provided",
+		},
+		{
+			name:        "missing command",
+			contentType: "application/json",
+			body:        `{"apiVersion":"v1","target":{"container":"docker://abc"}}`,
+			wantErr:     "command must be provided",
+		},
+		{
+			name:        "attach and join",
+			contentType: "application/json",
+			body:        `{"apiVersion":"v1","target":{"container":"docker://abc"},"session":{"tty":true,"attach":"a","join":"b"}}`,
+			wantErr:     "can't be both reattached and joined",
+		},
+		{
+			name:    "legacy form with an invalid command",
+			query:   url.Values{"container": {"docker://abc"}, "command": {"sh"}},
+			wantErr: "cannot parse command",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/debug?"+tt.query.Encode(), strings.NewReader(tt.body))
+			if len(tt.header) > 0 {
+				req.Header.Set(DebugSessionRequestHeader, tt.header)
+			}
+			if len(tt.contentType) > 0 {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			got, err := parseDebugSessionRequest(req)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseDebugSessionRequest() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDebugSessionRequest() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDebugSessionRequest() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,7 +3,6 @@ package agent
 import (
 	"bufio"
 	"context"
-	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -11,9 +10,6 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
-	"net/http"
-	"net/url"
 	"os"
 	"path"
 	"strings"
@@ -28,6 +24,7 @@ import (
 	"github.com/containerd/containerd/cio"
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
 	glog "github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/oci"
@@ -35,6 +32,7 @@ import (
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/typeurl"
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/strslice"
@@ -47,6 +45,7 @@ import (
 	kubetype "k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/remotecommand"
 	kubeletremote "k8s.io/kubernetes/pkg/kubelet/server/remotecommand"
+	utilexec "k8s.io/utils/exec"
 )
 
 type ContainerRuntimeScheme string
@@ -69,6 +68,7 @@ type RunConfig struct {
 	idOfContainerToDebug string
 	image                string
 	command              []string
+	options              ContainerOptions
 	stdin                io.Reader
 	stdout               io.WriteCloser
 	stderr               io.WriteCloser
@@ -86,16 +86,32 @@ func (c *RunConfig) getContextWithTimeout() (context.Context, context.CancelFunc
 	return context.WithTimeout(c.context, c.timeout)
 }
 
+// progress returns the writer of the progress messages, stderr in non-interactive
+// sessions so that stdout only holds the output of the command
+func (c *RunConfig) progress() io.Writer {
+	if !c.tty && c.stderr != nil {
+		return c.stderr
+	}
+	return c.stdout
+}
+
 type ContainerRuntime interface {
 	PullImage(ctx context.Context, image string,
 		skipTLS bool, authStr string,
 		cfg RunConfig) error
+	// LoadImage looks up the image in the local store of the runtime,
+	// it returns false if the image is not present
+	LoadImage(ctx context.Context, image string, cfg RunConfig) (bool, error)
+	// ImageDigest returns the digest of the manifest the local image was pulled from, and
+	// the local reference of that digest to run the image by if the runtime runs it by name
+	ImageDigest(ctx context.Context, image string, cfg RunConfig) (string, string, error)
 	ContainerInfo(ctx context.Context, cfg RunConfig) (ContainerInfo, error)
 	RunDebugContainer(cfg RunConfig) error
 }
 
 type DockerContainerRuntime struct {
-	client *dockerclient.Client
+	client     *dockerclient.Client
+	registries *registryResolver
 }
 
 var DockerContainerRuntimeImplementsContainerRuntime ContainerRuntime = (*DockerContainerRuntime)(nil)
@@ -103,35 +119,128 @@ var DockerContainerRuntimeImplementsContainerRuntime ContainerRuntime = (*Docker
 func (c *DockerContainerRuntime) PullImage(ctx context.Context,
 	image string, skipTLS bool, authStr string,
 	cfg RunConfig) error {
-	// Verify that we have a valid Docker AuthConfig and try to make one out of a
-	// username:password-style authStr if not.
-	if authStr != "" {
-		var authConfig types.AuthConfig
-		authBytes := []byte(authStr)
-		if err := json.Unmarshal(authBytes, &authConfig); err != nil {
-			crds := strings.Split(authStr, ":")
-			if len(crds) == 2 {
-				authConfig = types.AuthConfig{
-					Username: crds[0],
-					Password: crds[1],
-				}
-				authBytes, _ = json.Marshal(authConfig)
-			} else {
-				return fmt.Errorf("Failed to parse authStr '%s': %v", authStr, err)
+	username, password, err := parseAuthStr(authStr)
+	if err != nil {
+		return err
+	}
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return err
+	}
+	named = reference.TagNameOnly(named)
+	// try the mirrors of the registry first
+	endpoints, refs, err := c.registries.dockerPullRefs(named)
+	if err != nil {
+		return err
+	}
+	if err := c.registries.checkDockerEndpoints(endpoints); err != nil {
+		return err
+	}
+	for i, ref := range refs {
+		user, pass := c.registries.credentials(endpoints[i].host)
+		if !endpoints[i].isMirror && (len(username) > 0 || len(password) > 0) {
+			user, pass = username, password
+		}
+		if cfg.verbosity > 0 {
+			log.Printf("Pulling image %v, user name for pull : %v\r\n", ref, user)
+		}
+		err = c.pullImage(ctx, ref, user, pass, cfg)
+		if err == nil {
+			if ref != named.String() {
+				return c.client.ImageTag(ctx, ref, named.String())
 			}
+			return nil
+		}
+		log.Printf("Failed to pull image %v: %v\r\n", ref, err)
+	}
+	return err
+}
+
+func (c *DockerContainerRuntime) pullImage(ctx context.Context,
+	ref, username, password string, cfg RunConfig) error {
+	var registryAuth string
+	if len(username) > 0 || len(password) > 0 {
+		authBytes, err := json.Marshal(types.AuthConfig{
+			Username: username,
+			Password: password,
+		})
+		if err != nil {
+			return err
 		}
-		authStr = base64.URLEncoding.EncodeToString(authBytes)
+		registryAuth = base64.URLEncoding.EncodeToString(authBytes)
 	}
-	out, err := c.client.ImagePull(ctx, image, types.ImagePullOptions{RegistryAuth: authStr})
+	out, err := c.client.ImagePull(ctx, ref, types.ImagePullOptions{RegistryAuth: registryAuth})
 	if err != nil {
 		return err
 	}
 	defer out.Close()
-	// write pull progress to user
-	if cfg.verbosity > 0 {
-		term.DisplayJSONMessagesStream(out, cfg.stdout, 1, true, nil)
+	// write pull progress to user, the stream must be read
+	// till the end to complete the pull and get its error
+	switch {
+	case cfg.progress() != nil && cfg.verbosity > 0:
+		return term.DisplayJSONMessagesStream(out, cfg.progress(), 1, cfg.tty, nil)
+	case cfg.stdout != nil && cfg.tty:
+		return term.DisplayJSONMessagesCompact(out, cfg.stdout, ref)
 	}
-	return nil
+	return term.DisplayJSONMessagesStream(out, ioutil.Discard, 1, false, nil)
+}
+
+func (c *DockerContainerRuntime) LoadImage(ctx context.Context, image string, cfg RunConfig) (bool, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return false, err
+	}
+	_, _, err = c.client.ImageInspectWithRaw(ctx, reference.TagNameOnly(named).String())
+	if err != nil {
+		if dockerclient.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *DockerContainerRuntime) ImageDigest(ctx context.Context, image string, cfg RunConfig) (string, string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", "", err
+	}
+	named = reference.TagNameOnly(named)
+	inspect, _, err := c.client.ImageInspectWithRaw(ctx, named.String())
+	if err != nil {
+		return "", "", err
+	}
+	// the image may have been pulled from a mirror, only the repo digests of the
+	// repository of the image and of its mirrors are the digest of the image
+	repositories := map[string]bool{named.Name(): true}
+	if _, refs, err := c.registries.dockerPullRefs(named); err == nil {
+		for _, ref := range refs {
+			if mirrored, err := reference.ParseNormalizedNamed(ref); err == nil {
+				repositories[mirrored.Name()] = true
+			}
+		}
+	}
+	var digest, pinned string
+	for _, repoDigest := range inspect.RepoDigests {
+		digested, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil {
+			continue
+		}
+		canonical, ok := digested.(reference.Canonical)
+		if !ok || !repositories[canonical.Name()] {
+			continue
+		}
+		if canonical.Name() == named.Name() {
+			return canonical.Digest().String(), canonical.String(), nil
+		}
+		if len(digest) < 1 {
+			digest, pinned = canonical.Digest().String(), canonical.String()
+		}
+	}
+	if len(digest) < 1 {
+		return "", "", fmt.Errorf("image %s has no repo digest of its repository", image)
+	}
+	return digest, pinned, nil
 }
 
 func (c *DockerContainerRuntime) ContainerInfo(ctx context.Context, cfg RunConfig) (ContainerInfo, error) {
@@ -153,6 +262,10 @@ func (c *DockerContainerRuntime) RunDebugContainer(cfg RunConfig) error {
 	if err != nil {
 		return err
 	}
+	if !cfg.tty {
+		defer c.CleanContainer(cfg, createdBody.ID)
+		return c.runToCompletion(cfg, createdBody.ID)
+	}
 	if err := c.StartContainer(cfg, createdBody.ID); err != nil {
 		return err
 	}
@@ -167,14 +280,55 @@ func (c *DockerContainerRuntime) RunDebugContainer(cfg RunConfig) error {
 	return c.AttachToContainer(cfg, createdBody.ID)
 }
 
+// runToCompletion runs a non-interactive debug container, it is attached before it starts
+// so that the output of short commands is not lost, and its exit code is returned
+func (c *DockerContainerRuntime) runToCompletion(cfg RunConfig, id string) error {
+	ctx, cancel := cfg.getContextWithTimeout()
+	defer cancel()
+	resp, err := c.client.ContainerAttach(ctx, id, types.ContainerAttachOptions{
+		Stream: true,
+		Stdin:  cfg.stdin != nil,
+		Stdout: cfg.stdout != nil,
+		Stderr: cfg.stderr != nil,
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	if err := c.StartContainer(cfg, id); err != nil {
+		return err
+	}
+	if err := c.holdHijackedConnection(cfg, resp); err != nil {
+		return err
+	}
+	statusCh, errCh := c.client.ContainerWait(cfg.context, id, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		return err
+	case status := <-statusCh:
+		return exitCodeError(int(status.StatusCode))
+	}
+}
+
+// exitCodeError returns the error of a non-zero exit code of a debug container
+func exitCodeError(code int) error {
+	if code == 0 {
+		return nil
+	}
+	return utilexec.CodeExitError{
+		Err:  fmt.Errorf("command terminated with exit code %d", code),
+		Code: code,
+	}
+}
+
 func (c *DockerContainerRuntime) CreateContainer(cfg RunConfig) (*container.ContainerCreateCreatedBody, error) {
 
 	config := &container.Config{
 		Entrypoint: strslice.StrSlice(cfg.command),
 		Image:      cfg.image,
-		Tty:        true,
-		OpenStdin:  true,
-		StdinOnce:  true,
+		Tty:        cfg.tty,
+		OpenStdin:  cfg.stdin != nil,
+		StdinOnce:  cfg.stdin != nil,
 	}
 	hostConfig := &container.HostConfig{
 		NetworkMode: container.NetworkMode(c.containerMode(cfg.idOfContainerToDebug)),
@@ -183,6 +337,7 @@ func (c *DockerContainerRuntime) CreateContainer(cfg RunConfig) (*container.Cont
 		PidMode:     container.PidMode(c.containerMode(cfg.idOfContainerToDebug)),
 		CapAdd:      strslice.StrSlice([]string{"SYS_PTRACE", "SYS_ADMIN"}),
 	}
+	cfg.options.applyDocker(config, hostConfig)
 	ctx, cancel := cfg.getContextWithTimeout()
 	defer cancel()
 	body, err := c.client.ContainerCreate(ctx, config, hostConfig, nil, "")
@@ -298,8 +453,16 @@ func (c *DockerContainerRuntime) holdHijackedConnection(cfg RunConfig, resp type
 		return err
 	case <-stdinDone:
 		if cfg.stdout != nil || cfg.stderr != nil {
-			return <-receiveStdout
+			select {
+			case err := <-receiveStdout:
+				return err
+			case <-cfg.context.Done():
+				return cfg.context.Err()
+			}
 		}
+	case <-cfg.context.Done():
+		// the session ended, the container is removed on return
+		return cfg.context.Err()
 	}
 	return nil
 }
@@ -323,8 +486,9 @@ func (c *DockerContainerRuntime) redirectResponseToOutputStream(cfg RunConfig, r
 }
 
 type ContainerdContainerRuntime struct {
-	client *containerd.Client
-	image  containerd.Image
+	client     *containerd.Client
+	image      containerd.Image
+	registries *registryResolver
 }
 
 var ContainerdContainerRuntimeImplementsContainerRuntime ContainerRuntime = (*ContainerdContainerRuntime)(nil)
@@ -339,6 +503,18 @@ type jobs struct {
 	resolved bool
 }
 
+func (j *jobs) add(desc ocispec.Descriptor) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.resolved = true
+
+	if _, ok := j.added[desc.Digest]; ok {
+		return
+	}
+	j.descs = append(j.descs, desc)
+	j.added[desc.Digest] = struct{}{}
+}
+
 func (j *jobs) isResolved() bool {
 	j.mu.Lock()
 	defer j.mu.Unlock()
@@ -410,13 +586,52 @@ func Display(w io.Writer, statuses []StatusInfo, start time.Time) {
 		progress.NewBytesPerSecond(total, time.Since(start)))
 }
 
-func showProgress(ctx context.Context, ongoing *jobs, cs content.Store, out io.Writer) {
+// displayCompact renders the statuses of the layers on the single progress line
+func displayCompact(line *term.PullProgress, statuses []StatusInfo, done bool) {
+	var doneLayers, layers int
+	var current, total int64
+	for _, status := range statuses {
+		// the manifests and the config are small, only count the layers
+		if !strings.HasPrefix(status.Ref, "layer-") {
+			continue
+		}
+		layers++
+		switch status.Status {
+		case "done", "exists":
+			doneLayers++
+		}
+		current += status.Offset
+		total += status.Total
+	}
+	line.Update(doneLayers, layers, current, total, done)
+	if done {
+		line.Done()
+	}
+}
+
+// displayChanges writes a line for each status which changed since the last call,
+// the output of the sessions without a TTY can't be redrawn
+func displayChanges(w io.Writer, statuses []StatusInfo, printed map[string]string) {
+	for _, status := range statuses {
+		if printed[status.Ref] == status.Status {
+			continue
+		}
+		printed[status.Ref] = status.Status
+		fmt.Fprintf(w, "%s: %s\n", status.Ref, status.Status)
+	}
+}
+
+// showProgress renders the pull progress of every layer, or a single line if compact is set.
+// Without a TTY only the changes of the statuses are written
+func showProgress(ctx context.Context, ongoing *jobs, cs content.Store, out io.Writer, compact, tty bool) {
 	var (
 		ticker   = time.NewTicker(100 * time.Millisecond)
 		fw       = progress.NewWriter(out)
 		start    = time.Now()
 		statuses = map[string]StatusInfo{}
 		done     bool
+		line     = term.NewPullProgress(out, ongoing.name)
+		printed  = map[string]string{}
 	)
 	defer ticker.Stop()
 
@@ -514,6 +729,20 @@ outer:
 				ordered = append(ordered, statuses[key])
 			}
 
+			if !tty {
+				displayChanges(out, ordered, printed)
+				if done {
+					return
+				}
+				continue
+			}
+			if compact {
+				displayCompact(line, ordered[1:], done)
+				if done {
+					return
+				}
+				continue
+			}
 			Display(tw, ordered, start)
 			tw.Flush()
 
@@ -532,82 +761,58 @@ func (c *ContainerdContainerRuntime) PullImage(
 	authStr string,
 	cfg RunConfig) error {
 
-	authStr, err := url.QueryUnescape(authStr)
+	ctx = namespaces.WithNamespace(ctx, KubectlDebugNS)
+
+	username, password, err := parseAuthStr(authStr)
 	if err != nil {
-		log.Printf("Failed to decode authStr: %v\r\n", err)
 		return err
 	}
-	ctx = namespaces.WithNamespace(ctx, KubectlDebugNS)
+	if cfg.verbosity > 0 {
+		log.Printf("User name for pull : %v\r\n", username)
+	}
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return err
+	}
+	image = reference.TagNameOnly(named).String()
 
 	ongoing := newJobs(image)
 	pctx, stopProgress := context.WithCancel(ctx)
-	if cfg.verbosity > 0 {
-		progress := make(chan struct{})
+	// the detail of each layer is shown in verbose mode, and a single line on TTY sessions
+	progress := make(chan struct{})
+	if cfg.progress() != nil && (cfg.verbosity > 0 || cfg.tty) {
 		go func() {
-			if cfg.stdout != nil {
-				// no progress bar, because it hides some debug logs
-				showProgress(pctx, ongoing, c.client.ContentStore(), cfg.stdout)
-			}
+			showProgress(pctx, ongoing, c.client.ContentStore(), cfg.progress(), cfg.verbosity < 1, cfg.tty)
 			close(progress)
 		}()
+	} else {
+		close(progress)
 	}
 
+	// the hosts resolve the mirrors, TLS settings and credentials of each registry
 	rslvrOpts := docker.ResolverOptions{
 		Tracker: PushTracker,
+		Hosts:   c.registries.containerdHosts(username, password, skipTLS, cfg.verbosity),
 	}
 
-	rmtOpts := []containerd.RemoteOpt{
-		containerd.WithPullUnpack,
-	}
-
-	crds := strings.Split(authStr, ":")
-	if cfg.verbosity > 0 {
-		log.Printf("User name for pull : %v\r\n", crds[0])
-	}
-	var useCrds = len(crds) == 2
-	if useCrds || skipTLS {
-		tr := &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-				DualStack: true,
-			}).DialContext,
-			MaxIdleConns:        10,
-			IdleConnTimeout:     30 * time.Second,
-			TLSHandshakeTimeout: 10 * time.Second,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: skipTLS,
-			},
-			ExpectContinueTimeout: 5 * time.Second,
-		}
-
-		rslvrOpts.Client = &http.Client{
-			Transport: tr,
+	// track the descriptors of the image for the progress
+	tracker := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if desc.MediaType != images.MediaTypeDockerSchema1Manifest {
+			ongoing.add(desc)
 		}
+		return nil, nil
+	})
 
-		if useCrds {
-			if cfg.verbosity > 0 {
-				log.Println("Setting credentials call back")
-			}
-			crdsClbck := func(host string) (string, string, error) {
-				if cfg.verbosity > 0 {
-					log.Printf("crdsClbck returning username: %v\r\n", crds[0])
-				}
-				return crds[0], crds[1], nil
-			}
-
-			authOpts := []docker.AuthorizerOpt{
-				docker.WithAuthClient(rslvrOpts.Client), docker.WithAuthCreds(crdsClbck),
-			}
-
-			rslvrOpts.Authorizer = docker.NewDockerAuthorizer(authOpts...)
-		}
-		rmtOpts = append(rmtOpts, containerd.WithResolver(docker.NewResolver(rslvrOpts)))
+	rmtOpts := []containerd.RemoteOpt{
+		containerd.WithPullUnpack,
+		containerd.WithImageHandler(tracker),
+		containerd.WithResolver(docker.NewResolver(rslvrOpts)),
 	}
 
 	c.image, err = c.client.Pull(ctx, image, rmtOpts...)
 	stopProgress()
+	// let the progress render its last state before the debug container writes
+	<-progress
 
 	if err != nil {
 		log.Printf("Failed to download image: %v\r\n", err)
@@ -616,6 +821,38 @@ func (c *ContainerdContainerRuntime) PullImage(
 	return err
 }
 
+func (c *ContainerdContainerRuntime) LoadImage(ctx context.Context, image string, cfg RunConfig) (bool, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return false, err
+	}
+	ctx = namespaces.WithNamespace(ctx, KubectlDebugNS)
+	img, err := c.client.GetImage(ctx, reference.TagNameOnly(named).String())
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	unpacked, err := img.IsUnpacked(ctx, containerd.DefaultSnapshotter)
+	if err != nil || !unpacked {
+		// pulling unpacks the image
+		return false, err
+	}
+	c.image = img
+	return true, nil
+}
+
+// ImageDigest returns the digest of the loaded image, which is run as is
+func (c *ContainerdContainerRuntime) ImageDigest(ctx context.Context, image string, cfg RunConfig) (string, string, error) {
+	if c.image == nil {
+		if present, err := c.LoadImage(ctx, image, cfg); err != nil || !present {
+			return "", "", fmt.Errorf("image %s is not present: %v", image, err)
+		}
+	}
+	return c.image.Target().Digest.String(), "", nil
+}
+
 func (c *ContainerdContainerRuntime) ContainerInfo(
 	ctx context.Context, cfg RunConfig) (ContainerInfo, error) {
 	var ret ContainerInfo
@@ -750,7 +987,7 @@ func (c *ContainerdContainerRuntime) RunDebugContainer(cfg RunConfig) error {
 
 	var spcOpts []oci.SpecOpts
 	spcOpts = append(spcOpts, oci.WithImageConfig(c.image))
-	spcOpts = append(spcOpts, oci.WithPrivileged)
+	spcOpts = append(spcOpts, cfg.options.containerdSpecOpts()...)
 	// if audit, build command vector array using shim + cfg.command
 	// Make sure to replace KCTLDBG-FIFO with the actual fifo path ( Or maybe that is done before we get this far )
 	if cfg.audit {
@@ -763,7 +1000,9 @@ func (c *ContainerdContainerRuntime) RunDebugContainer(cfg RunConfig) error {
 	} else {
 		spcOpts = append(spcOpts, oci.WithProcessArgs(cfg.command...))
 	}
-	spcOpts = append(spcOpts, oci.WithTTY)
+	if cfg.tty {
+		spcOpts = append(spcOpts, oci.WithTTY)
+	}
 	// If fifo, make sure fifo is bind mounted
 	trgtInf, err := c.ContainerInfo(ctx, cfg)
 	if err != nil {
@@ -856,11 +1095,11 @@ func (c *ContainerdContainerRuntime) RunDebugContainer(cfg RunConfig) error {
 		stdIo = cio.WithStreams(cfg.stdin, cfg.stdout, cfg.stderr)
 	}
 
-	tsk, err := cntnr.NewTask(ctx,
-		cio.NewCreator(
-			stdIo,
-			cio.WithTerminal,
-		))
+	ioOpts := []cio.Opt{stdIo}
+	if cfg.tty {
+		ioOpts = append(ioOpts, cio.WithTerminal)
+	}
+	tsk, err := cntnr.NewTask(ctx, cio.NewCreator(ioOpts...))
 
 	if tsk != nil {
 		defer func() {
@@ -897,13 +1136,24 @@ func (c *ContainerdContainerRuntime) RunDebugContainer(cfg RunConfig) error {
 		return err
 	}
 
-	status := <-exitStatusC
-	_, _, err = status.Result()
+	var status containerd.ExitStatus
+	select {
+	case status = <-exitStatusC:
+	case <-ctx.Done():
+		// the session ended, the task is killed on return
+		return ctx.Err()
+	}
+	code, _, err := status.Result()
 	if err != nil {
 		log.Printf("Failed to get exit status for task for debugging %s : %v\r\n",
 			cfg.idOfContainerToDebug, err)
 		return err
 	}
+	if !cfg.tty {
+		// the output of the task is copied till its end
+		tsk.IO().Wait()
+		return exitCodeError(int(code))
+	}
 
 	return nil
 }
@@ -925,8 +1175,12 @@ type DebugAttacher struct {
 	image                string
 	authStr              string
 	registrySkipTLS      bool
+	pullPolicy           PullPolicy
+	verification         ImageVerificationConfig
+	registries           *registryResolver
 	lxcfsEnabled         bool
 	command              []string
+	options              ContainerOptions
 	timeout              time.Duration
 	idOfContainerToDebug string
 	verbosity            int
@@ -962,6 +1216,7 @@ func (a *DebugAttacher) AttachContainer(name string, uid kubetype.UID, container
 		idOfContainerToDebug: a.idOfContainerToDebug,
 		image:                a.image,
 		command:              a.command,
+		options:              a.options,
 		stdin:                in,
 		stdout:               out,
 		stderr:               err,
@@ -1010,7 +1265,7 @@ func (m *DebugAttacher) DebugContainer(cfg RunConfig) error {
 	//} ()
 	// step 0: set container procfs correct by lxcfs
 	if cfg.verbosity > 0 {
-		cfg.stdout.Write([]byte(fmt.Sprintf("set container procfs correct %t .. \n\r", m.lxcfsEnabled)))
+		cfg.progress().Write([]byte(fmt.Sprintf("set container procfs correct %t .. \n\r", m.lxcfsEnabled)))
 	}
 	if m.lxcfsEnabled {
 		if err := CheckLxcfsMount(); err != nil {
@@ -1022,23 +1277,60 @@ func (m *DebugAttacher) DebugContainer(cfg RunConfig) error {
 		}
 	}
 
-	// step 1: pull image
-	if cfg.verbosity > 0 {
-		cfg.stdout.Write([]byte(fmt.Sprintf("pulling image %s, skip TLS %v... \n\r", m.image, m.registrySkipTLS)))
+	// step 1: pull image according to the pull policy
+	if err := m.ensureImage(cfg); err != nil {
+		return err
 	}
-	err := m.containerRuntime.PullImage(m.context, m.image,
-		m.registrySkipTLS, m.authStr, cfg)
+
+	// step 2: verify the image and pin its digest
+	digest, pinned, err := m.verifyImage(cfg)
 	if err != nil {
-		return err
+		log.Printf("audit - user: %v debugee: %v image: %v refused: %v\r\n", cfg.clientUserName,
+			m.idOfContainerToDebug, m.image, err)
+		return fmt.Errorf("image verification failed: %v", err)
+	}
+	if len(digest) > 0 {
+		if cfg.audit || cfg.verbosity > 0 {
+			log.Printf("audit - user: %v debugee: %v image: %v digest: %v\r\n", cfg.clientUserName,
+				m.idOfContainerToDebug, m.image, digest)
+		}
+	}
+	// run the verified content even if the tag moves
+	if len(pinned) > 0 {
+		cfg.image = pinned
 	}
 
-	// step 2: run debug container (join the namespaces of target container)
+	// step 3: run debug container (join the namespaces of target container)
 	if cfg.verbosity > 0 {
-		cfg.stdout.Write([]byte("starting debug container...\n\r"))
+		cfg.progress().Write([]byte("starting debug container...\n\r"))
 	}
 	return m.containerRuntime.RunDebugContainer(cfg)
 }
 
+// ensureImage pulls the debug image unless the pull policy allows to use the local one
+func (m *DebugAttacher) ensureImage(cfg RunConfig) error {
+	if m.pullPolicy == PullIfNotPresent || m.pullPolicy == PullNever {
+		present, err := m.containerRuntime.LoadImage(m.context, m.image, cfg)
+		if err != nil {
+			return err
+		}
+		if present {
+			if cfg.verbosity > 0 {
+				cfg.progress().Write([]byte(fmt.Sprintf("image %s is present, skip pulling \n\r", m.image)))
+			}
+			return nil
+		}
+		if m.pullPolicy == PullNever {
+			return fmt.Errorf("image %s is not present on the node and the pull policy is %s", m.image, PullNever)
+		}
+	}
+	if cfg.verbosity > 0 {
+		cfg.progress().Write([]byte(fmt.Sprintf("pulling image %s, skip TLS %v... \n\r", m.image, m.registrySkipTLS)))
+	}
+	return m.containerRuntime.PullImage(m.context, m.image,
+		m.registrySkipTLS, m.authStr, cfg)
+}
+
 func (m *DebugAttacher) SetContainerLxcfs(cfg RunConfig) error {
 	ctx, cancel := cfg.getContextWithTimeout()
 	defer cancel()
@@ -1081,6 +1373,8 @@ type RuntimeManager struct {
 	audit                bool
 	auditFifo            string
 	auditShim            []string
+	registries           *registryResolver
+	verification         ImageVerificationConfig
 }
 
 func NewRuntimeManager(srvCfg Config, containerUri string, verbosity int,
@@ -1099,6 +1393,36 @@ func NewRuntimeManager(srvCfg Config, containerUri string, verbosity int,
 	containerScheme := ContainerRuntimeScheme(containerUriParts[0])
 	idOfContainerToDebug := containerUriParts[1]
 
+	registries, err := newRegistryResolver(srvCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dockerClient, containerdClient, err := newRuntimeClient(srvCfg, containerScheme, verbosity)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RuntimeManager{
+		dockerClient:         dockerClient,
+		containerdClient:     containerdClient,
+		timeout:              srvCfg.RuntimeTimeout,
+		verbosity:            verbosity,
+		idOfContainerToDebug: idOfContainerToDebug,
+		containerScheme:      containerScheme,
+		clientHostName:       hstNm,
+		clientUserName:       usrNm,
+		audit:                srvCfg.Audit,
+		auditFifo:            srvCfg.AuditFifo,
+		auditShim:            srvCfg.AuditShim,
+		registries:           registries,
+		verification:         srvCfg.ImageVerification,
+	}, nil
+}
+
+// newRuntimeClient connects to the container runtime of the given scheme
+func newRuntimeClient(srvCfg Config, containerScheme ContainerRuntimeScheme,
+	verbosity int) (*dockerclient.Client, *containerd.Client, error) {
 	var dockerClient *dockerclient.Client
 	var containerdClient *containerd.Client
 	switch containerScheme {
@@ -1107,7 +1431,7 @@ func NewRuntimeManager(srvCfg Config, containerUri string, verbosity int,
 			var err error
 			dockerClient, err = dockerclient.NewClient(srvCfg.DockerEndpoint, "", nil, nil)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 		}
 	case ContainerdScheme:
@@ -1124,45 +1448,35 @@ func NewRuntimeManager(srvCfg Config, containerUri string, verbosity int,
 			containerdClient, err = containerd.New(srvCfg.ContainerdEndpoint,
 				clntOpts...)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 		}
 	default:
 		{
 			msg := "only docker and containerd container runtimes are suppored right now"
 			log.Println(msg)
-			return nil, errors.New(msg)
+			return nil, nil, errors.New(msg)
 		}
 	}
 
-	return &RuntimeManager{
-		dockerClient:         dockerClient,
-		containerdClient:     containerdClient,
-		timeout:              srvCfg.RuntimeTimeout,
-		verbosity:            verbosity,
-		idOfContainerToDebug: idOfContainerToDebug,
-		containerScheme:      containerScheme,
-		clientHostName:       hstNm,
-		clientUserName:       usrNm,
-		audit:                srvCfg.Audit,
-		auditFifo:            srvCfg.AuditFifo,
-		auditShim:            srvCfg.AuditShim,
-	}, nil
+	return dockerClient, containerdClient, nil
 }
 
 // GetAttacher returns an implementation of Attacher
 func (m *RuntimeManager) GetAttacher(image, authStr string,
-	lxcfsEnabled, registrySkipTLS bool,
-	command []string, context context.Context,
+	lxcfsEnabled, registrySkipTLS bool, pullPolicy PullPolicy,
+	command []string, options ContainerOptions, context context.Context,
 	cancel context.CancelFunc) kubeletremote.Attacher {
 	var containerRuntime ContainerRuntime
 	if m.dockerClient != nil {
 		containerRuntime = &DockerContainerRuntime{
-			client: m.dockerClient,
+			client:     m.dockerClient,
+			registries: m.registries,
 		}
 	} else {
 		containerRuntime = &ContainerdContainerRuntime{
-			client: m.containerdClient,
+			client:     m.containerdClient,
+			registries: m.registries,
 		}
 	}
 	return &DebugAttacher{
@@ -1171,7 +1485,11 @@ func (m *RuntimeManager) GetAttacher(image, authStr string,
 		authStr:              authStr,
 		lxcfsEnabled:         lxcfsEnabled,
 		registrySkipTLS:      registrySkipTLS,
+		pullPolicy:           pullPolicy,
+		verification:         m.verification,
+		registries:           m.registries,
 		command:              command,
+		options:              options,
 		context:              context,
 		idOfContainerToDebug: m.idOfContainerToDebug,
 		verbosity:            m.verbosity,
@@ -1185,3 +1503,30 @@ func (m *RuntimeManager) GetAttacher(image, authStr string,
 		auditShim:            m.auditShim,
 	}
 }
+
+// TargetInfo returns the info of the target container, used by the tools which
+// work in the namespaces of the target without running a debug container
+func (m *RuntimeManager) TargetInfo(ctx context.Context) (ContainerInfo, error) {
+	cfg := RunConfig{
+		context:              ctx,
+		timeout:              m.timeout,
+		idOfContainerToDebug: m.idOfContainerToDebug,
+		verbosity:            m.verbosity,
+	}
+	ctx, cancel := cfg.getContextWithTimeout()
+	defer cancel()
+	if m.dockerClient != nil {
+		return (&DockerContainerRuntime{client: m.dockerClient}).ContainerInfo(ctx, cfg)
+	}
+	return (&ContainerdContainerRuntime{client: m.containerdClient}).ContainerInfo(ctx, cfg)
+}
+
+// Close releases the runtime clients, the attachers must not be used afterwards
+func (m *RuntimeManager) Close() {
+	if m.dockerClient != nil {
+		m.dockerClient.Close()
+	}
+	if m.containerdClient != nil {
+		m.containerdClient.Close()
+	}
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// progressStore is a content store with a single layer being downloaded
+type progressStore struct {
+	content.Store
+	ref string
+}
+
+func (s *progressStore) ListStatuses(ctx context.Context, filters ...string) ([]content.Status, error) {
+	return []content.Status{{Ref: s.ref, Offset: 512, Total: 1024}}, nil
+}
+
+func (s *progressStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	return content.Info{}, errdefs.ErrNotFound
+}
+
+func TestShowProgress(t *testing.T) {
+	layer := digest.FromString("layer")
+	tests := []struct {
+		name      string
+		compact   bool
+		tty       bool
+		want      string
+		wantEsc   bool
+		wantLines int
+	}{
+		{name: "verbose without a TTY", want: "layer-" + layer.String() + ": downloading\n", wantLines: 3},
+		{name: "verbose on a TTY", tty: true, want: "downloading", wantEsc: true},
+		{name: "compact on a TTY", compact: true, tty: true, want: "0/1 layers", wantEsc: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ongoing := newJobs("docker.io/library/busybox:latest")
+			ongoing.add(ocispec.Descriptor{MediaType: images.MediaTypeDockerSchema2Layer, Digest: layer, Size: 1024})
+			ctx, cancel := context.WithCancel(context.Background())
+			var out bytes.Buffer
+			done := make(chan struct{})
+			go func() {
+				showProgress(ctx, ongoing, &progressStore{ref: "layer-" + layer.String()}, &out, tt.compact, tt.tty)
+				close(done)
+			}()
+			// let the progress be rendered a few times
+			time.Sleep(350 * time.Millisecond)
+			cancel()
+			<-done
+			got := out.String()
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("output %q doesn't contain %q", got, tt.want)
+			}
+			if strings.Contains(got, "\x1b") != tt.wantEsc {
+				t.Errorf("output %q has escape sequences: %v, want %v", got, !tt.wantEsc, tt.wantEsc)
+			}
+			// each status is written once, and the layer again when it's done
+			if tt.wantLines > 0 && strings.Count(got, "\n") != tt.wantLines {
+				t.Errorf("output %q has %d lines, want %d", got, strings.Count(got, "\n"), tt.wantLines)
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package agent
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,25 +11,61 @@ import (
 	"strings"
 	"time"
 
-	remoteapi "k8s.io/apimachinery/pkg/util/remotecommand"
 	kubeletremote "k8s.io/kubernetes/pkg/kubelet/server/remotecommand"
 )
 
+// targetPidPlaceholder is replaced in the command of the debug container by the pid of the target
+const targetPidPlaceholder = "KCTLDBG-TARGET-PID"
+
 type Server struct {
-	config *Config
+	config        *Config
+	sessions      *sessionTracker
+	debugSessions *sessionRegistry
+	images        *imageCache
+	webUI         *webUI
 }
 
 func NewServer(config *Config) (*Server, error) {
-	return &Server{config: config}, nil
+	sessions := newSessionTracker()
+	server := &Server{
+		config:        config,
+		sessions:      sessions,
+		debugSessions: newSessionRegistry(sessions),
+		images:        newImageCache(config),
+	}
+	if config.WebUI.Enabled {
+		webUI, err := newWebUI(server, config.WebUI)
+		if err != nil {
+			return nil, err
+		}
+		server.webUI = webUI
+	}
+	return server, nil
 }
 
 func (s *Server) Run() error {
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt)
+	if s.config.IdleTimeout > 0 {
+		go s.exitWhenIdle(stop)
+	}
+	if len(s.config.PrePullImages) > 0 {
+		go s.images.run()
+	}
+	if s.webUI != nil {
+		go s.webUI.run()
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/v1/debug", s.ServeDebug)
+	mux.HandleFunc("/api/v1/images", s.ServeImages)
+	mux.HandleFunc("/api/v1/cp", s.ServeCopy)
+	mux.HandleFunc("/api/v1/capture", s.ServeCapture)
+	mux.HandleFunc("/api/v1/portforward", s.ServePortForward)
+	mux.HandleFunc("/api/v1/collect", s.ServeCollect)
+	mux.HandleFunc("/api/v1/doctor", s.ServeDoctor)
+	mux.HandleFunc("/api/v1/info", s.ServeInfo)
 	mux.HandleFunc("/healthz", s.Healthz)
 	server := &http.Server{Addr: s.config.ListenAddress, Handler: mux}
 
@@ -68,15 +103,46 @@ func maxInt(lhs, rhs int) int {
 func (s *Server) ServeDebug(w http.ResponseWriter, req *http.Request) {
 
 	log.Println("receive debug request")
-	containerUri := req.FormValue("container")
+	r, err := parseDebugSessionRequest(req)
+	if err != nil {
+		http.Error(w, strings.ReplaceAll(err.Error(), ":", "-"), 400)
+		return
+	}
+	s.serveDebug(w, req, r)
+}
+
+// serveDebug serves a parsed debug request
+func (s *Server) serveDebug(w http.ResponseWriter, req *http.Request, r *DebugSessionRequest) {
+	s.sessions.open()
+	defer s.sessions.close()
+	containerUri := r.Target.Container
+	iverbosity := r.Client.Verbosity
 
-	sverbosity := req.FormValue("verbosity")
-	if sverbosity == "" {
-		sverbosity = "0"
+	streamOpts := &kubeletremote.Options{
+		Stdin:  true,
+		Stdout: true,
+		Stderr: false,
+		TTY:    true,
+	}
+	// a non-interactive session runs the command to completion and returns its exit code
+	interactive := r.Session.TTY
+	if !interactive {
+		streamOpts = &kubeletremote.Options{
+			Stdin:  false,
+			Stdout: true,
+			Stderr: true,
+			TTY:    false,
+		}
 	}
-	iverbosity, _ := strconv.Atoi(sverbosity)
+	detachKeys, _ := parseDetachKeys(r.Session.DetachKeys)
 
-	imageFromPlugin := req.FormValue("image")
+	// reattach to a session kept after its owner disconnected, or join a session
+	if len(r.Session.Attach) > 0 || len(r.Session.Join) > 0 {
+		s.serveSession(w, req, r, detachKeys, streamOpts)
+		return
+	}
+
+	imageFromPlugin := r.Image
 	imageFromEnv := os.Getenv("KCTLDBG_RESTRICT_IMAGE_TO")
 	var image string
 	if len(imageFromEnv) > 0 {
@@ -92,41 +158,26 @@ func (s *Server) ServeDebug(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "image must be provided", 400)
 		return
 	}
-	command := req.FormValue("command")
-	var commandSlice []string
-	err := json.Unmarshal([]byte(command), &commandSlice)
-	if err != nil || len(commandSlice) < 1 {
-		http.Error(w, "cannot parse command", 400)
+	commandSlice := r.Command
+	authStr := r.Registry.Auth
+	LxcfsEnabled = r.Lxcfs
+	registrySkipTLS := r.Registry.SkipTLSVerify
+
+	pullPolicy, _ := ParsePullPolicy(r.PullPolicy)
+	containerOptions, err := parseContainerOptions(r, s.config)
+	if err != nil {
+		http.Error(w, strings.ReplaceAll(err.Error(), ":", "-"), 400)
 		return
 	}
-	authStr := req.FormValue("authStr")
-	streamOpts := &kubeletremote.Options{
-		Stdin:  true,
-		Stdout: true,
-		Stderr: false,
-		TTY:    true,
-	}
-	lxcfsEnabled := req.FormValue("lxcfsEnabled")
-	if lxcfsEnabled == "" || lxcfsEnabled == "false" {
-		LxcfsEnabled = false
-	} else if lxcfsEnabled == "true" {
-		LxcfsEnabled = true
-	}
-	var registrySkipTLS bool
-	registrySkipTLSParam := req.FormValue("registrySkipTLS")
-	if registrySkipTLSParam == "" || registrySkipTLSParam == "false" {
-		registrySkipTLS = false
-	} else if registrySkipTLSParam == "true" {
-		registrySkipTLS = true
+	if len(containerOptions.Mounts) > 0 || len(containerOptions.SecurityProfile) > 0 {
+		log.Printf("audit - user: %v debugee: %v security profile: %v mounts: %v\r\n", r.Client.Username,
+			containerUri, containerOptions.SecurityProfile, containerOptions.Mounts)
 	}
 
-	context, cancel := context.WithCancel(req.Context())
-	defer cancel()
-
 	runtime, err := NewRuntimeManager(*s.config, containerUri,
 		maxInt(iverbosity, s.config.Verbosity),
-		req.FormValue("hostname"),
-		req.FormValue("username"))
+		r.Client.Hostname,
+		r.Client.Username)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to construct RuntimeManager.  Error: %s", err.Error())
 		log.Println(msg)
@@ -138,27 +189,150 @@ func (s *Server) ServeDebug(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, strings.ReplaceAll(msg, ":", "-"), 400)
 		return
 	}
+	if commandSlice, err = s.substituteTargetPid(req.Context(), runtime, commandSlice); err != nil {
+		msg := fmt.Sprintf("Failed to inspect the target container.  Error: %s", err.Error())
+		log.Println(msg)
+		http.Error(w, strings.ReplaceAll(msg, ":", "-"), 400)
+		return
+	}
 
 	// replace Attacher implementation to hook the ServeAttach procedure
 	if s.config.Verbosity > 0 {
-		log.Println("Invoking kubeletremote.ServeAttach")
-	}
-
-	kubeletremote.ServeAttach(
-		w,
-		req,
-		runtime.GetAttacher(image, authStr, LxcfsEnabled, registrySkipTLS,
-			commandSlice, context, cancel),
-		"",
-		"",
-		"",
-		streamOpts,
-		s.config.StreamIdleTimeout,
-		s.config.StreamCreationTimeout,
-		remoteapi.SupportedStreamingProtocols)
+		log.Println("Invoking serveAttach")
+	}
+
+	if !interactive {
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		s.serveAttach(w, req,
+			runtime.GetAttacher(image, authStr, LxcfsEnabled, registrySkipTLS, pullPolicy,
+				commandSlice, containerOptions, ctx, cancel),
+			streamOpts)
+		if s.config.Verbosity > 0 {
+			log.Println("serveAttach returned")
+		}
+		return
+	}
+
+	// the debug container of a session outlives the connection for the detach grace period
+	// if the owner can reattach, i.e. the agent is not deleted with the client session
+	var grace time.Duration
+	if r.Session.Reattachable {
+		grace = s.config.DetachGracePeriod
+	}
+	// the sessions are only joined if their owner shares them
+	session, err := s.debugSessions.create(containerUri, r.Client.Username,
+		grace, s.config.DetachBufferSize, r.Session.Shareable || r.Session.ShareWrite, r.Session.ShareWrite)
+	if err != nil {
+		http.Error(w, strings.ReplaceAll(err.Error(), ":", "-"), 500)
+		return
+	}
+	// the session is dropped if the owner never attached to it
+	defer session.start.Do(func() {
+		s.debugSessions.remove(session)
+		session.cancel()
+	})
+
+	s.serveAttach(w, req,
+		&sessionAttacher{
+			session: session,
+			attacher: runtime.GetAttacher(image, authStr, LxcfsEnabled, registrySkipTLS, pullPolicy,
+				commandSlice, containerOptions, session.ctx, session.cancel),
+			detachKeys: detachKeys,
+		},
+		streamOpts)
 	if s.config.Verbosity > 0 {
-		log.Println("kubeletremote.ServeAttach returned")
+		log.Println("serveAttach returned")
+	}
+}
+
+// serveSession attaches to an existing debug session, the owner reattaches to it
+// and the observers join it
+func (s *Server) serveSession(w http.ResponseWriter, req *http.Request, r *DebugSessionRequest,
+	detachKeys []byte, streamOpts *kubeletremote.Options) {
+	containerUri := r.Target.Container
+	token := r.Session.Attach
+	observer := len(token) < 1
+	if observer {
+		token = r.Session.Join
+	}
+	sessionID, secret := parseSessionToken(token)
+	session := s.debugSessions.get(sessionID)
+	if session == nil {
+		http.Error(w, fmt.Sprintf("debug session %s not found or ended", sessionID), 404)
+		return
+	}
+	// the client is authorized to exec into the pod of the container
+	if session.container != containerUri {
+		http.Error(w, fmt.Sprintf("debug session %s does not debug the requested container", sessionID), 403)
+		return
+	}
+	// only the owner of the session reattaches to it, with the attach token returned at its start,
+	// and the observers join it with the join token of a shared session. The username of the
+	// client is only logged.
+	if !observer && !validSecret(secret, session.attachSecret) {
+		http.Error(w, fmt.Sprintf("invalid attach token of debug session %s, join it instead", sessionID), 403)
+		return
+	}
+	if observer && !validSecret(secret, session.joinSecret) {
+		http.Error(w, fmt.Sprintf("debug session %s is not shared or the join token is invalid", sessionID), 403)
+		return
+	}
+	writable := observer && r.Session.Write
+	if writable && !session.shareWrite {
+		http.Error(w, fmt.Sprintf("debug session %s is read-only for the users joining it", sessionID), 403)
+		return
+	}
+	action := "reattach"
+	if observer {
+		action = "join read-only"
+		if writable {
+			action = "join read-write"
+		}
+	}
+	// the usernames are given by the clients, the remote address is not
+	log.Printf("audit - user: %v (unverified) remote: %v debugee: %v %v session: %v owner: %v (unverified)\r\n",
+		r.Client.Username, req.RemoteAddr, containerUri, action, sessionID, session.user)
+	s.serveAttach(w, req,
+		&sessionAttacher{
+			session:    session,
+			detachKeys: detachKeys,
+			observer:   observer,
+			writable:   writable,
+		},
+		streamOpts)
+}
+
+// substituteTargetPid replaces KCTLDBG-TARGET-PID in the command with the pid of the main
+// process of the target as seen in its pid namespace, which the debug container joins,
+// so that profilers and the like can be pointed at the target
+func (s *Server) substituteTargetPid(ctx context.Context, runtime *RuntimeManager, command []string) ([]string, error) {
+	found := false
+	for _, arg := range command {
+		if strings.Contains(arg, targetPidPlaceholder) {
+			found = true
+		}
+	}
+	if !found {
+		return command, nil
+	}
+	target, err := runtime.TargetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pid := strconv.FormatInt(target.Pid, 10)
+	status, err := procStatus(int(target.Pid))
+	if err != nil {
+		return nil, err
+	}
+	if fields := strings.Fields(status["NSpid"]); len(fields) > 0 {
+		pid = fields[len(fields)-1]
+	}
+	substituted := make([]string, len(command))
+	for i, arg := range command {
+		substituted[i] = strings.ReplaceAll(arg, targetPidPlaceholder, pid)
 	}
+	return substituted, nil
 }
 
 func (s *Server) Healthz(w http.ResponseWriter, req *http.Request) {
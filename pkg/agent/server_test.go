@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dockerclient "github.com/docker/docker/client"
+)
+
+func TestSubstituteTargetPid(t *testing.T) {
+	// the target is the test process, whose pid in its own namespace is the last of NSpid
+	status, err := procStatus(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(status["NSpid"])
+	if len(fields) < 1 {
+		t.Skip("NSpid is not available")
+	}
+	pid := fields[len(fields)-1]
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/containers/abc/json") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"Id": "abc", "State": map[string]interface{}{"Pid": os.Getpid()}})
+	}))
+	defer server.Close()
+	client, err := dockerclient.NewClient("tcp://"+strings.TrimPrefix(server.URL, "http://"), "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime := &RuntimeManager{dockerClient: client, timeout: time.Minute, idOfContainerToDebug: "abc"}
+	s := &Server{}
+
+	got, err := s.substituteTargetPid(context.Background(), runtime, []string{"jcmd", targetPidPlaceholder, "Thread.print"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"jcmd", pid, "Thread.print"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("substituteTargetPid() = %q, want %q", got, want)
+	}
+
+	// the runtime is not inspected without a placeholder
+	command := []string{"ss", "-s"}
+	if got, err := s.substituteTargetPid(context.Background(), nil, command); err != nil || !reflect.DeepEqual(got, command) {
+		t.Errorf("substituteTargetPid() = %q, %v, want %q", got, err, command)
+	}
+
+	runtime.idOfContainerToDebug = "missing"
+	if _, err := s.substituteTargetPid(context.Background(), runtime, []string{"--pid=" + targetPidPlaceholder}); err == nil {
+		t.Errorf("substituteTargetPid() of a missing target succeeded")
+	}
+}
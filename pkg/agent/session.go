@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// sessionTracker keeps track of the open debug sessions,
+// so that an idle agent can exit by itself
+type sessionTracker struct {
+	mu         sync.Mutex
+	active     int
+	lastActive time.Time
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{lastActive: time.Now()}
+}
+
+func (t *sessionTracker) open() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active++
+	t.lastActive = time.Now()
+}
+
+func (t *sessionTracker) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active--
+	t.lastActive = time.Now()
+}
+
+// idleSince returns the time the last session was closed,
+// and false if there are sessions open
+func (t *sessionTracker) idleSince() (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastActive, t.active == 0
+}
+
+// exitWhenIdle sends an interrupt to stop once no session has been
+// open for the idle timeout
+func (s *Server) exitWhenIdle(stop chan<- os.Signal) {
+	interval := s.config.IdleTimeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		since, idle := s.sessions.idleSince()
+		if idle && time.Since(since) >= s.config.IdleTimeout {
+			log.Printf("No debug session in the last %v, exiting\n", s.config.IdleTimeout)
+			stop <- os.Interrupt
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	kubetype "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/remotecommand"
+	kubeletremote "k8s.io/kubernetes/pkg/kubelet/server/remotecommand"
+)
+
+// toolFunc runs a tool against the target container, the streams are not interactive
+type toolFunc func(ctx context.Context, target ContainerInfo, in io.Reader, out, errOut io.Writer) error
+
+// toolAttacher runs a tool over the attach streams instead of a debug container
+type toolAttacher struct {
+	ctx    context.Context
+	target ContainerInfo
+	run    toolFunc
+}
+
+var toolAttacherImplementsAttacher kubeletremote.Attacher = (*toolAttacher)(nil)
+
+// Implement kubeletremote.Attacher
+func (a *toolAttacher) AttachContainer(name string, uid kubetype.UID, container string,
+	in io.Reader, out, err io.WriteCloser, tty bool, resize <-chan remotecommand.TerminalSize) error {
+	return a.run(a.ctx, a.target, in, out, err)
+}
+
+// serveTool serves a tool request on the target container with the same streaming and
+// authentication as the debug sessions, stdin is only streamed if the tool reads it
+func (s *Server) serveTool(w http.ResponseWriter, req *http.Request, tool, detail string,
+	stdin bool, run toolFunc) {
+	s.withTarget(w, req, tool, detail, func(ctx context.Context, target ContainerInfo) {
+		s.serveAttach(w, req, &toolAttacher{ctx: ctx, target: target, run: run},
+			&kubeletremote.Options{
+				Stdin:  stdin,
+				Stdout: true,
+				Stderr: true,
+				TTY:    false,
+			})
+	})
+}
+
+// withTarget inspects the target container of the request and records the tool
+// in the audit log before serving it, the errors are written to the response
+func (s *Server) withTarget(w http.ResponseWriter, req *http.Request, tool, detail string,
+	serve func(ctx context.Context, target ContainerInfo)) {
+	s.sessions.open()
+	defer s.sessions.close()
+	containerUri := req.FormValue("container")
+	verbosity, _ := strconv.Atoi(req.FormValue("verbosity"))
+
+	runtime, err := NewRuntimeManager(*s.config, containerUri,
+		maxInt(verbosity, s.config.Verbosity),
+		req.FormValue("hostname"),
+		req.FormValue("username"))
+	if err != nil {
+		msg := fmt.Sprintf("Failed to construct RuntimeManager.  Error: %s", err.Error())
+		log.Println(msg)
+		http.Error(w, strings.ReplaceAll(msg, ":", "-"), 400)
+		return
+	}
+	defer runtime.Close()
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	target, err := runtime.TargetInfo(ctx)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to inspect the target container.  Error: %s", err.Error())
+		log.Println(msg)
+		http.Error(w, strings.ReplaceAll(msg, ":", "-"), 400)
+		return
+	}
+	log.Printf("audit - user: %v debugee: %v %v: %v\r\n", req.FormValue("username"), containerUri, tool, detail)
+	serve(ctx, target)
+}
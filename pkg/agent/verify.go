@@ -0,0 +1,247 @@
+package agent
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/distribution/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// VerifyNone runs any image
+	VerifyNone = "none"
+	// VerifyDigest runs images whose digest is in the allowlist only
+	VerifyDigest = "digest"
+	// VerifySignature runs images signed by one of the public keys only
+	VerifySignature = "signature"
+
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+// ImageVerificationConfig configures the verification of the debug images
+// after they are pulled and before they are run
+type ImageVerificationConfig struct {
+	// Mode is none, digest or signature
+	Mode string `yaml:"mode,omitempty"`
+	// AllowedDigests are the digests allowed in the digest mode, e.g. sha256:...
+	// or nicolaka/netshoot@sha256:... to allow a digest for a repository only
+	AllowedDigests []string `yaml:"allowed_digests,omitempty"`
+	// PublicKeys are PEM files of the cosign public keys used in the signature mode
+	PublicKeys []string `yaml:"public_keys,omitempty"`
+	// SignatureDir holds the signatures as sha256-<hex>.sig and sha256-<hex>.payload files
+	// (cosign sign --output-signature --output-payload), the signatures are fetched
+	// from the registry (<repository>:sha256-<hex>.sig) if not set
+	SignatureDir string `yaml:"signature_dir,omitempty"`
+}
+
+// cosignPayload is the simple signing payload signed by cosign
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+type cosignSignature struct {
+	payload   []byte
+	signature []byte
+}
+
+// verifyImage checks the digest of the pulled image against the verification config, the
+// digest and the reference to run the image by are returned even if the verification is disabled
+func (m *DebugAttacher) verifyImage(cfg RunConfig) (string, string, error) {
+	ctx, cancel := cfg.getContextWithTimeout()
+	defer cancel()
+	digest, pinned, err := m.containerRuntime.ImageDigest(ctx, m.image, cfg)
+	mode := m.verification.Mode
+	if mode == "" || mode == VerifyNone {
+		if err != nil {
+			log.Printf("Failed to resolve digest of image %s: %v\r\n", m.image, err)
+		}
+		return digest, pinned, nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to resolve digest of image %s: %v", m.image, err)
+	}
+	named, err := reference.ParseNormalizedNamed(m.image)
+	if err != nil {
+		return "", "", err
+	}
+	switch mode {
+	case VerifyDigest:
+		for _, allowed := range m.verification.AllowedDigests {
+			if allowed == digest {
+				return digest, pinned, nil
+			}
+			if i := strings.Index(allowed, "@"); i >= 0 && allowed[i+1:] == digest {
+				allowedNamed, err := reference.ParseNormalizedNamed(allowed[:i])
+				if err == nil && allowedNamed.Name() == named.Name() {
+					return digest, pinned, nil
+				}
+			}
+		}
+		return "", "", fmt.Errorf("digest %s of image %s is not allowed", digest, m.image)
+	case VerifySignature:
+		if err := m.verifySignature(ctx, named, digest, cfg); err != nil {
+			return "", "", err
+		}
+		return digest, pinned, nil
+	}
+	return "", "", fmt.Errorf("unknown image verification mode %q", mode)
+}
+
+func (m *DebugAttacher) verifySignature(ctx context.Context, named reference.Named, digest string, cfg RunConfig) error {
+	keys, err := loadPublicKeys(m.verification.PublicKeys)
+	if err != nil {
+		return err
+	}
+	if len(keys) < 1 {
+		return errors.New("no public key configured to verify image signatures")
+	}
+	var signatures []cosignSignature
+	if len(m.verification.SignatureDir) > 0 {
+		signatures, err = loadLocalSignatures(m.verification.SignatureDir, digest)
+	} else {
+		signatures, err = m.fetchSignatures(ctx, named, digest, cfg)
+	}
+	if err != nil {
+		return err
+	}
+	for _, sig := range signatures {
+		var payload cosignPayload
+		if err := json.Unmarshal(sig.payload, &payload); err != nil {
+			continue
+		}
+		if payload.Critical.Image.DockerManifestDigest != digest {
+			continue
+		}
+		for _, key := range keys {
+			if verifyBlob(key, sig.payload, sig.signature) == nil {
+				if cfg.verbosity > 0 {
+					log.Printf("Signature of image %s@%s verified\r\n", named.Name(), digest)
+				}
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no valid signature found for image %s@%s", named.Name(), digest)
+}
+
+// fetchSignatures fetches the cosign signatures stored in the registry
+// as the tag sha256-<hex>.sig of the image repository
+func (m *DebugAttacher) fetchSignatures(ctx context.Context, named reference.Named, digest string, cfg RunConfig) ([]cosignSignature, error) {
+	username, password, err := parseAuthStr(m.authStr)
+	if err != nil {
+		return nil, err
+	}
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: m.registries.containerdHosts(username, password, m.registrySkipTLS, cfg.verbosity),
+	})
+	ref := named.Name() + ":" + strings.Replace(digest, ":", "-", 1) + ".sig"
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve signature %s: %v", ref, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signature %s: %v", ref, err)
+	}
+	defer rc.Close()
+	var manifest ocispec.Manifest
+	if err := json.NewDecoder(rc).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse signature manifest %s: %v", ref, err)
+	}
+	var ret []cosignSignature
+	for _, layer := range manifest.Layers {
+		sig, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(sig) < 1 {
+			continue
+		}
+		lrc, err := fetcher.Fetch(ctx, layer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch signature payload %s: %v", layer.Digest, err)
+		}
+		payload, err := ioutil.ReadAll(lrc)
+		lrc.Close()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, cosignSignature{payload: payload, signature: sig})
+	}
+	return ret, nil
+}
+
+// loadLocalSignatures loads the signature and the payload written by cosign for a digest
+func loadLocalSignatures(dir, digest string) ([]cosignSignature, error) {
+	base := filepath.Join(dir, strings.Replace(digest, ":", "-", 1))
+	sig, err := ioutil.ReadFile(base + ".sig")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature of %s: %v", digest, err)
+	}
+	payload, err := ioutil.ReadFile(base + ".payload")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature payload of %s: %v", digest, err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		// raw signature
+		decoded = sig
+	}
+	return []cosignSignature{{payload: payload, signature: decoded}}, nil
+}
+
+func loadPublicKeys(files []string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key %s: %v", file, err)
+		}
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM block found in public key %s", file)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key %s: %v", file, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// verifyBlob verifies a cosign signature of the sha256 of the payload
+func verifyBlob(key crypto.PublicKey, payload, signature []byte) error {
+	hash := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(k, hash[:], signature) {
+			return nil
+		}
+		return errors.New("invalid ecdsa signature")
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], signature)
+	}
+	return fmt.Errorf("unsupported public key type %T", key)
+}
@@ -0,0 +1,303 @@
+package agent
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dockerclient "github.com/docker/docker/client"
+)
+
+var (
+	testDigest  = "sha256:" + strings.Repeat("a", 64)
+	otherDigest = "sha256:" + strings.Repeat("b", 64)
+)
+
+// digestRuntime is a container runtime whose local image has the digest
+type digestRuntime struct {
+	ContainerRuntime
+	digest string
+	err    error
+}
+
+func (r *digestRuntime) ImageDigest(ctx context.Context, image string, cfg RunConfig) (string, string, error) {
+	return r.digest, "", r.err
+}
+
+// cosignPayloadOf returns the simple signing payload of the digest
+func cosignPayloadOf(t *testing.T, digest string) []byte {
+	var payload cosignPayload
+	payload.Critical.Image.DockerManifestDigest = digest
+	payload.Critical.Type = "cosign container image signature"
+	content, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func writePublicKey(t *testing.T, file string, key crypto.PublicKey) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyBlob(t *testing.T) {
+	payload := []byte(`{"critical":{}}`)
+	hash := sha256.Sum256(payload)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecSig, err := ecdsa.SignASN1(rand.Reader, ecKey, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		key       crypto.PublicKey
+		payload   []byte
+		signature []byte
+		wantErr   bool
+	}{
+		{name: "ecdsa", key: &ecKey.PublicKey, payload: payload, signature: ecSig},
+		{name: "rsa", key: &rsaKey.PublicKey, payload: payload, signature: rsaSig},
+		{name: "tampered payload", key: &ecKey.PublicKey, payload: []byte(`{"critical":{"x":1}}`), signature: ecSig, wantErr: true},
+		{name: "signature of another key", key: &rsaKey.PublicKey, payload: payload, signature: ecSig, wantErr: true},
+		{name: "unsupported key", key: edKey, payload: payload, signature: ecSig, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := verifyBlob(tt.key, tt.payload, tt.signature); (err != nil) != tt.wantErr {
+			t.Errorf("verifyBlob() of %s error = %v, want an error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestVerifyImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, otherKeyFile := filepath.Join(dir, "cosign.pub"), filepath.Join(dir, "other.pub")
+	writePublicKey(t, keyFile, &key.PublicKey)
+	writePublicKey(t, otherKeyFile, &other.PublicKey)
+	// the signatures written by cosign, of the digest and of a payload naming another digest
+	sign := func(digest, payloadDigest string) {
+		payload := cosignPayloadOf(t, payloadDigest)
+		hash := sha256.Sum256(payload)
+		sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		base := filepath.Join(dir, strings.Replace(digest, ":", "-", 1))
+		if err := ioutil.WriteFile(base+".payload", payload, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(base+".sig", []byte(base64.StdEncoding.EncodeToString(sig)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sign(testDigest, testDigest)
+	sign(otherDigest, testDigest)
+
+	tests := []struct {
+		name         string
+		verification ImageVerificationConfig
+		digest       string
+		digestErr    error
+		wantErr      string
+	}{
+		{name: "disabled", digest: testDigest},
+		{name: "disabled without a digest", verification: ImageVerificationConfig{Mode: VerifyNone}, digestErr: errors.New("no repo digest")},
+		{
+			name:         "no digest",
+			verification: ImageVerificationConfig{Mode: VerifyDigest, AllowedDigests: []string{testDigest}},
+			digestErr:    errors.New("no repo digest"),
+			wantErr:      "failed to resolve digest",
+		},
+		{
+			name:         "allowed digest",
+			verification: ImageVerificationConfig{Mode: VerifyDigest, AllowedDigests: []string{otherDigest, testDigest}},
+			digest:       testDigest,
+		},
+		{
+			name:         "digest allowed for the repository",
+			verification: ImageVerificationConfig{Mode: VerifyDigest, AllowedDigests: []string{"docker.io/nicolaka/netshoot@" + testDigest}},
+			digest:       testDigest,
+		},
+		{
+			name:         "digest allowed for another repository",
+			verification: ImageVerificationConfig{Mode: VerifyDigest, AllowedDigests: []string{"busybox@" + testDigest}},
+			digest:       testDigest,
+			wantErr:      "is not allowed",
+		},
+		{
+			name:         "signed",
+			verification: ImageVerificationConfig{Mode: VerifySignature, PublicKeys: []string{otherKeyFile, keyFile}, SignatureDir: dir},
+			digest:       testDigest,
+		},
+		{
+			name:         "signed by another key",
+			verification: ImageVerificationConfig{Mode: VerifySignature, PublicKeys: []string{otherKeyFile}, SignatureDir: dir},
+			digest:       testDigest,
+			wantErr:      "no valid signature found",
+		},
+		{
+			name:         "signature of another digest",
+			verification: ImageVerificationConfig{Mode: VerifySignature, PublicKeys: []string{keyFile}, SignatureDir: dir},
+			digest:       otherDigest,
+			wantErr:      "no valid signature found",
+		},
+		{
+			name:         "unsigned",
+			verification: ImageVerificationConfig{Mode: VerifySignature, PublicKeys: []string{keyFile}, SignatureDir: dir},
+			digest:       "sha256:" + strings.Repeat("c", 64),
+			wantErr:      "failed to read signature",
+		},
+		{
+			name:         "no public key",
+			verification: ImageVerificationConfig{Mode: VerifySignature, SignatureDir: dir},
+			digest:       testDigest,
+			wantErr:      "no public key configured",
+		},
+		{
+			name:         "invalid public key",
+			verification: ImageVerificationConfig{Mode: VerifySignature, PublicKeys: []string{filepath.Join(dir, strings.Replace(testDigest, ":", "-", 1)+".payload")}, SignatureDir: dir},
+			digest:       testDigest,
+			wantErr:      "no PEM block found",
+		},
+		{
+			name:         "unknown mode",
+			verification: ImageVerificationConfig{Mode: "cosign"},
+			digest:       testDigest,
+			wantErr:      "unknown image verification mode",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &DebugAttacher{
+				containerRuntime: &digestRuntime{digest: tt.digest, err: tt.digestErr},
+				image:            "nicolaka/netshoot:latest",
+				verification:     tt.verification,
+			}
+			digest, _, err := m.verifyImage(RunConfig{context: context.Background(), timeout: time.Minute})
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("verifyImage() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || digest != tt.digest {
+				t.Errorf("verifyImage() = %s, %v, want %s", digest, err, tt.digest)
+			}
+		})
+	}
+}
+
+func TestDockerImageDigest(t *testing.T) {
+	tests := []struct {
+		name        string
+		image       string
+		registries  map[string]RegistryConfig
+		repoDigests []string
+		wantDigest  string
+		wantPinned  string
+		wantErr     bool
+	}{
+		{
+			name:        "repo digest of the repository",
+			image:       "nicolaka/netshoot:latest",
+			repoDigests: []string{"harbor.internal/tools/netshoot@" + otherDigest, "nicolaka/netshoot@" + testDigest},
+			wantDigest:  testDigest,
+			wantPinned:  "docker.io/nicolaka/netshoot@" + testDigest,
+		},
+		{
+			name:        "repo digest of a mirror",
+			image:       "nicolaka/netshoot:latest",
+			registries:  map[string]RegistryConfig{"docker.io": {Mirrors: []string{"mirror.internal"}}},
+			repoDigests: []string{"mirror.internal/nicolaka/netshoot@" + testDigest},
+			wantDigest:  testDigest,
+			wantPinned:  "mirror.internal/nicolaka/netshoot@" + testDigest,
+		},
+		{
+			name:        "repo digest of another repository only",
+			image:       "nicolaka/netshoot:latest",
+			repoDigests: []string{"harbor.internal/tools/netshoot@" + otherDigest},
+			wantErr:     true,
+		},
+		{
+			name:    "no repo digest of a local image",
+			image:   "netshoot:dev",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.Contains(r.URL.Path, "/images/") || !strings.HasSuffix(r.URL.Path, "/json") {
+					http.NotFound(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{"Id": "sha256:" + strings.Repeat("f", 64), "RepoDigests": tt.repoDigests})
+			}))
+			defer server.Close()
+			client, err := dockerclient.NewClient("tcp://"+strings.TrimPrefix(server.URL, "http://"), "", nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			registries, err := newRegistryResolver(Config{Registries: tt.registries})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &DockerContainerRuntime{client: client, registries: registries}
+			digest, pinned, err := c.ImageDigest(context.Background(), tt.image, RunConfig{})
+			if (err != nil) != tt.wantErr || digest != tt.wantDigest || pinned != tt.wantPinned {
+				t.Errorf("ImageDigest() = %s, %s, %v, want %s, %s", digest, pinned, err, tt.wantDigest, tt.wantPinned)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubetype "k8s.io/apimachinery/pkg/types"
+	remoteapi "k8s.io/apimachinery/pkg/util/remotecommand"
+	"k8s.io/apiserver/pkg/util/wsstream"
+	"k8s.io/client-go/tools/remotecommand"
+	kubeletremote "k8s.io/kubernetes/pkg/kubelet/server/remotecommand"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	// WebSocketProtocolV5 adds the close signal of the stdin to the v4 protocol
+	WebSocketProtocolV5 = "v5.channel.k8s.io"
+	// WebSocketProtocolV4 sends the status as json on the error channel
+	WebSocketProtocolV4 = "v4.channel.k8s.io"
+
+	// the first byte of a websocket message is the channel of its data
+	stdinChannel  = 0
+	stdoutChannel = 1
+	stderrChannel = 2
+	errorChannel  = 3
+	resizeChannel = 4
+	// a close message of the v5 protocol holds the channel to close
+	closeChannel = 255
+)
+
+// supportedWebSocketProtocols are the binary channel protocols, by preference
+var supportedWebSocketProtocols = []string{WebSocketProtocolV5, WebSocketProtocolV4}
+
+// serveAttach serves the attach request over websocket or SPDY
+func (s *Server) serveAttach(w http.ResponseWriter, req *http.Request,
+	attacher kubeletremote.Attacher, streamOpts *kubeletremote.Options) {
+	if wsstream.IsWebSocketRequest(req) {
+		s.serveWebSocketAttach(w, req, attacher, streamOpts)
+		return
+	}
+	// served as an exec so that the exit code of a non-interactive session reaches the client
+	kubeletremote.ServeExec(
+		w,
+		req,
+		&attachExecutor{attacher: attacher},
+		"",
+		"",
+		"",
+		nil,
+		streamOpts,
+		s.config.StreamIdleTimeout,
+		s.config.StreamCreationTimeout,
+		remoteapi.SupportedStreamingProtocols)
+}
+
+// serveWebSocketAttach serves the attach request over the channel websocket protocols,
+// with the same resize and exit status semantics as SPDY
+func (s *Server) serveWebSocketAttach(w http.ResponseWriter, req *http.Request,
+	attacher kubeletremote.Attacher, streamOpts *kubeletremote.Options) {
+	websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			// a web page must not drive the agent, e.g. one forwarded to localhost
+			if !sameOrigin(req) {
+				return fmt.Errorf("cross origin request from %s", req.Header.Get("Origin"))
+			}
+			for _, requested := range config.Protocol {
+				for _, supported := range supportedWebSocketProtocols {
+					if requested == supported {
+						config.Protocol = []string{requested}
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("requested protocols %v are not supported, supports %v",
+				config.Protocol, supportedWebSocketProtocols)
+		},
+		Handler: func(ws *websocket.Conn) {
+			s.handleWebSocketAttach(ws, attacher, streamOpts)
+		},
+	}.ServeHTTP(w, req)
+}
+
+func (s *Server) handleWebSocketAttach(ws *websocket.Conn, attacher kubeletremote.Attacher,
+	streamOpts *kubeletremote.Options) {
+	defer ws.Close()
+	protocol := ws.Config().Protocol[0]
+	if s.config.Verbosity > 0 {
+		log.Printf("Serving attach over websocket protocol %s\r\n", protocol)
+	}
+	conn := &webSocketConn{ws: ws}
+
+	stdin, stdinWriter := io.Pipe()
+	resize := make(chan remotecommand.TerminalSize, 8)
+	go func() {
+		defer close(resize)
+		for {
+			var data []byte
+			if err := websocket.Message.Receive(ws, &data); err != nil {
+				if err == io.EOF {
+					stdinWriter.Close()
+				} else {
+					stdinWriter.CloseWithError(err)
+				}
+				return
+			}
+			if len(data) < 1 {
+				continue
+			}
+			switch data[0] {
+			case stdinChannel:
+				if _, err := stdinWriter.Write(data[1:]); err != nil {
+					return
+				}
+			case resizeChannel:
+				var size remotecommand.TerminalSize
+				if err := json.Unmarshal(data[1:], &size); err != nil {
+					log.Printf("Invalid resize message: %v\r\n", err)
+					continue
+				}
+				select {
+				case resize <- size:
+				default:
+				}
+			case closeChannel:
+				if protocol == WebSocketProtocolV5 && len(data) > 1 && data[1] == stdinChannel {
+					stdinWriter.Close()
+				}
+			}
+		}
+	}()
+
+	// notify the client the streams are established
+	conn.write(stdoutChannel, []byte{})
+
+	var in io.Reader
+	if streamOpts.Stdin {
+		in = stdin
+	}
+	var stderr io.WriteCloser
+	if streamOpts.Stderr {
+		stderr = conn.channel(stderrChannel)
+	}
+	err := attacher.AttachContainer("", "", "", in, conn.channel(stdoutChannel), stderr,
+		streamOpts.TTY, resize)
+	status := metav1.Status{Status: metav1.StatusSuccess}
+	if exitErr, ok := err.(utilexec.ExitError); ok && exitErr.Exited() {
+		status = exitCodeStatus(exitErr)
+	} else if err != nil {
+		err = fmt.Errorf("error attaching to container: %v", err)
+		log.Println(err)
+		status = apierrors.NewInternalError(err).ErrStatus
+	}
+	bs, err := json.Marshal(status)
+	if err == nil {
+		conn.write(errorChannel, bs)
+	}
+}
+
+// exitCodeStatus is the status of a command exited with a non-zero code, same as kubelet
+func exitCodeStatus(exitErr utilexec.ExitError) metav1.Status {
+	return metav1.Status{
+		Status: metav1.StatusFailure,
+		Reason: remoteapi.NonZeroExitCodeReason,
+		Details: &metav1.StatusDetails{
+			Causes: []metav1.StatusCause{
+				{
+					Type:    remoteapi.ExitCodeCauseType,
+					Message: fmt.Sprintf("%d", exitErr.ExitStatus()),
+				},
+			},
+		},
+		Message: fmt.Sprintf("command terminated with non-zero exit code: %v", exitErr),
+	}
+}
+
+// attachExecutor serves an attacher as an executor
+type attachExecutor struct {
+	attacher kubeletremote.Attacher
+}
+
+var attachExecutorImplementsExecutor kubeletremote.Executor = (*attachExecutor)(nil)
+
+// Implement kubeletremote.Executor
+func (e *attachExecutor) ExecInContainer(name string, uid kubetype.UID, container string, cmd []string,
+	in io.Reader, out, err io.WriteCloser, tty bool, resize <-chan remotecommand.TerminalSize, timeout time.Duration) error {
+	return e.attacher.AttachContainer(name, uid, container, in, out, err, tty, resize)
+}
+
+// webSocketConn writes the messages of the channels to the websocket
+type webSocketConn struct {
+	ws *websocket.Conn
+	mu sync.Mutex
+}
+
+func (c *webSocketConn) write(channel byte, data []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	frame := make([]byte, len(data)+1)
+	frame[0] = channel
+	copy(frame[1:], data)
+	if err := websocket.Message.Send(c.ws, frame); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (c *webSocketConn) channel(channel byte) io.WriteCloser {
+	return &webSocketChannel{conn: c, channel: channel}
+}
+
+type webSocketChannel struct {
+	conn    *webSocketConn
+	channel byte
+}
+
+func (c *webSocketChannel) Write(data []byte) (int, error) {
+	return c.conn.write(c.channel, data)
+}
+
+func (c *webSocketChannel) Close() error {
+	return nil
+}
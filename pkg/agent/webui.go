@@ -0,0 +1,518 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	restclient "k8s.io/client-go/rest"
+)
+
+// WebUIConfig configures the browser terminal served by the agent
+type WebUIConfig struct {
+	Enabled       bool   `yaml:"enabled,omitempty"`
+	ListenAddress string `yaml:"listen_address,omitempty"`
+	TLSCertFile   string `yaml:"tls_cert_file,omitempty"`
+	TLSKeyFile    string `yaml:"tls_key_file,omitempty"`
+	// the debug image filled in the form
+	DefaultImage string `yaml:"default_image,omitempty"`
+	// the xterm.js assets served to the browser, installed in the agent image
+	AssetsDir string     `yaml:"assets_dir,omitempty"`
+	OIDC      OIDCConfig `yaml:"oidc,omitempty"`
+}
+
+const (
+	webUITokenCookie = "kubectl-debug-token"
+	webUIStateCookie = "kubectl-debug-state"
+	// the path the assets are served under
+	webUIAssets = "/assets"
+)
+
+// webUser is an authenticated user of the web UI
+type webUser struct {
+	name   string
+	groups []string
+}
+
+// webUI serves a browser terminal over the debug sessions of the pods of the node,
+// the users authenticate with a bearer token checked by the apiserver or an OIDC id token,
+// and are authorized with the pods/exec privilege like kubectl debug
+type webUI struct {
+	server   *Server
+	config   WebUIConfig
+	client   kubernetes.Interface
+	nodeName string
+	oidc     *oidcProvider
+}
+
+func newWebUI(server *Server, config WebUIConfig) (*webUI, error) {
+	// the browser sends the tokens of the users
+	if len(config.TLSCertFile) < 1 || len(config.TLSKeyFile) < 1 {
+		return nil, errors.New("web UI requires tls_cert_file and tls_key_file")
+	}
+	restConfig, err := restclient.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("web UI requires the agent to run in cluster: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	nodeName := os.Getenv("NODE_NAME")
+	if len(nodeName) < 1 {
+		if nodeName, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	ui := &webUI{
+		server:   server,
+		config:   config,
+		client:   client,
+		nodeName: nodeName,
+	}
+	if len(config.OIDC.IssuerURL) > 0 {
+		if ui.oidc, err = newOIDCProvider(config.OIDC); err != nil {
+			return nil, err
+		}
+	}
+	return ui, nil
+}
+
+func (u *webUI) run() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", u.serveIndex)
+	mux.HandleFunc("/login", u.serveLogin)
+	mux.HandleFunc("/login/oidc", u.serveOIDCLogin)
+	mux.HandleFunc("/callback", u.serveCallback)
+	mux.HandleFunc("/logout", u.serveLogout)
+	mux.HandleFunc("/api/pods", u.servePods)
+	mux.HandleFunc("/api/session", u.serveSession)
+	mux.Handle(webUIAssets+"/", http.StripPrefix(webUIAssets, u.assets()))
+	server := &http.Server{Addr: u.config.ListenAddress, Handler: mux}
+
+	log.Printf("Web UI listening on %s for the pods of node %s\n", u.config.ListenAddress, u.nodeName)
+	if err := server.ListenAndServeTLS(u.config.TLSCertFile, u.config.TLSKeyFile); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// assets serves the files of the assets directory, without listing it
+func (u *webUI) assets() http.Handler {
+	files := http.FileServer(http.Dir(u.config.AssetsDir))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/") {
+			http.NotFound(w, req)
+			return
+		}
+		files.ServeHTTP(w, req)
+	})
+}
+
+// authenticate authenticates the bearer token of the request or of the session cookie
+func (u *webUI) authenticate(req *http.Request) (*webUser, error) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if len(token) < 1 {
+		if cookie, err := req.Cookie(webUITokenCookie); err == nil {
+			token = cookie.Value
+		}
+	}
+	if len(token) < 1 {
+		return nil, errors.New("not signed in")
+	}
+	return u.authenticateToken(token)
+}
+
+func (u *webUI) authenticateToken(token string) (*webUser, error) {
+	if u.oidc != nil && u.oidc.issued(token) {
+		return u.oidc.verify(token)
+	}
+	review, err := u.client.AuthenticationV1().TokenReviews().Create(&authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !review.Status.Authenticated {
+		if len(review.Status.Error) > 0 {
+			return nil, errors.New(review.Status.Error)
+		}
+		return nil, errors.New("invalid token")
+	}
+	return &webUser{name: review.Status.User.Username, groups: review.Status.User.Groups}, nil
+}
+
+// authorize checks the user can exec into the pods of the namespace, same as kubectl debug
+func (u *webUI) authorize(user *webUser, namespace string) error {
+	review, err := u.client.AuthorizationV1().SubjectAccessReviews().Create(&authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.name,
+			Groups: user.groups,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        "create",
+				Resource:    "pods",
+				Subresource: "exec",
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if !review.Status.Allowed {
+		return fmt.Errorf("user %s cannot exec into the pods of namespace %s", user.name, namespace)
+	}
+	return nil
+}
+
+// sameOrigin rejects the cross site requests riding on the session cookie
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if len(origin) < 1 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == req.Host
+}
+
+func (u *webUI) setCookie(w http.ResponseWriter, name, value string, maxAge int, sameSite http.SameSite) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: sameSite,
+	})
+}
+
+func (u *webUI) serveIndex(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	data := webUIPage{
+		Assets: webUIAssets,
+		Image:  u.config.DefaultImage,
+		OIDC:   u.oidc != nil && u.oidc.oauth2 != nil,
+	}
+	if user, err := u.authenticate(req); err == nil {
+		data.User = user.name
+	}
+	u.render(w, http.StatusOK, data)
+}
+
+func (u *webUI) render(w http.ResponseWriter, code int, data webUIPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(code)
+	if err := webUITemplate.Execute(w, data); err != nil {
+		log.Printf("Failed to render web UI: %v\r\n", err)
+	}
+}
+
+func (u *webUI) serveLogin(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || !sameOrigin(req) {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimSpace(req.PostFormValue("token"))
+	user, err := u.authenticateToken(token)
+	if err != nil {
+		log.Printf("Web UI login failed: %v\r\n", err)
+		u.render(w, http.StatusUnauthorized, webUIPage{
+			Assets: webUIAssets,
+			OIDC:   u.oidc != nil && u.oidc.oauth2 != nil,
+			Error:  "invalid token",
+		})
+		return
+	}
+	log.Printf("Web UI login of user %s\r\n", user.name)
+	u.setCookie(w, webUITokenCookie, token, 0, http.SameSiteStrictMode)
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+}
+
+func (u *webUI) serveOIDCLogin(w http.ResponseWriter, req *http.Request) {
+	if u.oidc == nil || u.oidc.oauth2 == nil {
+		http.NotFound(w, req)
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	state := hex.EncodeToString(b)
+	// the identity provider redirects back cross site
+	u.setCookie(w, webUIStateCookie, state, 600, http.SameSiteLaxMode)
+	http.Redirect(w, req, u.oidc.oauth2.AuthCodeURL(state), http.StatusFound)
+}
+
+func (u *webUI) serveCallback(w http.ResponseWriter, req *http.Request) {
+	if u.oidc == nil || u.oidc.oauth2 == nil {
+		http.NotFound(w, req)
+		return
+	}
+	state, err := req.Cookie(webUIStateCookie)
+	if err != nil || len(state.Value) < 1 || state.Value != req.FormValue("state") {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+	u.setCookie(w, webUIStateCookie, "", -1, http.SameSiteLaxMode)
+	if e := req.FormValue("error"); len(e) > 0 {
+		http.Error(w, "login failed "+e, http.StatusUnauthorized)
+		return
+	}
+	idToken, err := u.oidc.exchange(req.Context(), req.FormValue("code"))
+	if err != nil {
+		log.Printf("Web UI oidc login failed: %v\r\n", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	user, err := u.oidc.verify(idToken)
+	if err != nil {
+		log.Printf("Web UI oidc login failed: %v\r\n", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	log.Printf("Web UI login of user %s\r\n", user.name)
+	u.setCookie(w, webUITokenCookie, idToken, 0, http.SameSiteStrictMode)
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+}
+
+func (u *webUI) serveLogout(w http.ResponseWriter, req *http.Request) {
+	u.setCookie(w, webUITokenCookie, "", -1, http.SameSiteStrictMode)
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+}
+
+// webUIPod is a pod of the node listed in the form
+type webUIPod struct {
+	Name       string   `json:"name"`
+	Containers []string `json:"containers"`
+}
+
+func (u *webUI) servePods(w http.ResponseWriter, req *http.Request) {
+	user, err := u.authenticate(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	namespace := req.FormValue("namespace")
+	if len(namespace) < 1 {
+		http.Error(w, "namespace must be provided", http.StatusBadRequest)
+		return
+	}
+	if err := u.authorize(user, namespace); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	pods, err := u.client.CoreV1().Pods(namespace).List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", u.nodeName).String(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := []webUIPod{}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		p := webUIPod{Name: pod.Name}
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Running != nil {
+				p.Containers = append(p.Containers, status.Name)
+			}
+		}
+		result = append(result, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// serveSession opens a debug session through the same flow as /api/v1/debug
+func (u *webUI) serveSession(w http.ResponseWriter, req *http.Request) {
+	if !sameOrigin(req) {
+		http.Error(w, "cross origin request", http.StatusForbidden)
+		return
+	}
+	user, err := u.authenticate(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	namespace, podName := req.FormValue("namespace"), req.FormValue("pod")
+	if err := u.authorize(user, namespace); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	pod, err := u.client.CoreV1().Pods(namespace).Get(podName, metav1.GetOptions{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if pod.Spec.NodeName != u.nodeName {
+		http.Error(w, fmt.Sprintf("pod %s runs on node %s, use the web UI of its agent", podName, pod.Spec.NodeName),
+			http.StatusBadRequest)
+		return
+	}
+	containerName := req.FormValue("container")
+	if len(containerName) < 1 && len(pod.Spec.Containers) > 0 {
+		containerName = pod.Spec.Containers[0].Name
+	}
+	var containerID string
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == containerName && status.State.Running != nil {
+			containerID = status.ContainerID
+		}
+	}
+	if len(containerID) < 1 {
+		http.Error(w, fmt.Sprintf("container %s of pod %s is not running", containerName, podName), http.StatusBadRequest)
+		return
+	}
+	command := strings.Fields(req.FormValue("command"))
+	if len(command) < 1 {
+		command = []string{"bash"}
+	}
+	image := req.FormValue("image")
+	if len(image) < 1 {
+		image = u.config.DefaultImage
+	}
+	hostname, _, _ := net.SplitHostPort(req.RemoteAddr)
+	log.Printf("audit - user: %v debugee: %v web session namespace: %v pod: %v container: %v\r\n",
+		user.name, containerID, namespace, podName, containerName)
+
+	// the request of the plugin, the client only chooses the target and the image
+	r := &DebugSessionRequest{
+		APIVersion: DebugSessionRequestV1,
+		Target:     DebugTarget{Container: containerID},
+		Client:     DebugClient{Hostname: hostname, Username: user.name},
+		Session:    DebugSession{TTY: true},
+		Image:      image,
+		PullPolicy: req.FormValue("pullPolicy"),
+		Command:    command,
+	}
+	if err := r.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u.server.serveDebug(w, req, r)
+}
+
+type webUIPage struct {
+	Assets string
+	Image  string
+	User   string
+	OIDC   bool
+	Error  string
+}
+
+var webUITemplate = template.Must(template.New("webui").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>kubectl debug</title>
+<link rel="stylesheet" href="{{.Assets}}/xterm@4.19.0/css/xterm.css">
+<script src="{{.Assets}}/xterm@4.19.0/lib/xterm.js"></script>
+<script src="{{.Assets}}/xterm-addon-fit@0.5.0/lib/xterm-addon-fit.js"></script>
+<style>
+body { font-family: sans-serif; margin: 0; display: flex; flex-direction: column; height: 100vh; }
+form, header { padding: 8px; }
+#terminal { flex: 1; background: #000; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+{{if .User}}
+<header>signed in as {{.User}} <a href="/logout">sign out</a></header>
+<form id="target">
+namespace <input name="namespace" value="default">
+<button type="button" id="load">load pods</button>
+pod <select name="pod"></select>
+container <select name="container"></select>
+image <input name="image" value="{{.Image}}">
+pull policy <select name="pullPolicy"><option>IfNotPresent</option><option>Always</option><option>Never</option></select>
+command <input name="command" value="bash">
+<button type="submit">debug</button>
+</form>
+<div id="terminal"></div>
+<script>
+const form = document.getElementById('target');
+const encoder = new TextEncoder();
+let pods = [], ws, term;
+document.getElementById('load').onclick = async () => {
+  const resp = await fetch('/api/pods?namespace=' + encodeURIComponent(form.namespace.value));
+  if (!resp.ok) { alert(await resp.text()); return; }
+  pods = await resp.json();
+  form.pod.innerHTML = '';
+  pods.forEach(p => form.pod.add(new Option(p.name)));
+  form.pod.onchange();
+};
+form.pod.onchange = () => {
+  form.container.innerHTML = '';
+  const pod = pods.find(p => p.name === form.pod.value);
+  if (pod) (pod.containers || []).forEach(c => form.container.add(new Option(c)));
+};
+form.onsubmit = e => {
+  e.preventDefault();
+  if (ws) ws.close();
+  if (term) term.dispose();
+  term = new Terminal();
+  const fit = new FitAddon.FitAddon();
+  term.loadAddon(fit);
+  term.open(document.getElementById('terminal'));
+  fit.fit();
+  const scheme = location.protocol === 'https:' ? 'wss://' : 'ws://';
+  const params = new URLSearchParams(new FormData(form));
+  const conn = ws = new WebSocket(scheme + location.host + '/api/session?' + params, ['v5.channel.k8s.io']);
+  conn.binaryType = 'arraybuffer';
+  const send = (channel, data) => {
+    const frame = new Uint8Array(data.length + 1);
+    frame[0] = channel;
+    frame.set(data, 1);
+    if (conn.readyState === WebSocket.OPEN) conn.send(frame);
+  };
+  const resize = () => send(4, encoder.encode(JSON.stringify({Width: term.cols, Height: term.rows})));
+  conn.onopen = () => { resize(); term.focus(); };
+  conn.onmessage = m => {
+    const data = new Uint8Array(m.data);
+    if (data.length < 1) return;
+    if (data[0] === 1 || data[0] === 2) {
+      term.write(data.subarray(1));
+    } else if (data[0] === 3) {
+      const status = JSON.parse(new TextDecoder().decode(data.subarray(1)));
+      term.write('\r\n[' + (status.status === 'Success' ? 'session ended' : status.message) + ']\r\n');
+    }
+  };
+  conn.onclose = () => term.write('\r\n[disconnected]\r\n');
+  term.onData(d => send(0, encoder.encode(d)));
+  term.onResize(resize);
+  window.onresize = () => fit.fit();
+};
+</script>
+{{else}}
+<form method="post" action="/login">
+bearer token <input type="password" name="token" autocomplete="off">
+<button type="submit">sign in</button>
+{{if .OIDC}}or <a href="/login/oidc">sign in with OIDC</a>{{end}}
+</form>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{end}}
+</body>
+</html>
+`))
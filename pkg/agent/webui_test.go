@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newTestWebUI returns a web UI of node-1, the token of alice is valid and she can exec
+// into the pods of namespace dev only
+func newTestWebUI(pods ...runtime.Object) *webUI {
+	client := fake.NewSimpleClientset(pods...)
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "alice-token" {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{Username: "alice", Groups: []string{"dev"}}
+		}
+		return true, review, nil
+	})
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = review.Spec.User == "alice" && attrs.Namespace == "dev" &&
+			attrs.Verb == "create" && attrs.Resource == "pods" && attrs.Subresource == "exec"
+		return true, review, nil
+	})
+	return &webUI{client: client, nodeName: "node-1"}
+}
+
+func testPod(namespace, name, node string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       corev1.PodSpec{NodeName: node, Containers: []corev1.Container{{Name: "app"}}},
+		Status: corev1.PodStatus{
+			Phase: phase,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:        "app",
+				ContainerID: "docker://" + name,
+				State:       corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+			}},
+		},
+	}
+}
+
+func TestWebUIServePods(t *testing.T) {
+	tests := []struct {
+		name      string
+		token     string
+		cookie    string
+		namespace string
+		wantCode  int
+		wantPods  []string
+	}{
+		{name: "not signed in", namespace: "dev", wantCode: http.StatusUnauthorized},
+		{name: "invalid token", token: "mallory-token", namespace: "dev", wantCode: http.StatusUnauthorized},
+		{name: "no privilege in the namespace", token: "alice-token", namespace: "prod", wantCode: http.StatusForbidden},
+		{name: "missing namespace", token: "alice-token", wantCode: http.StatusBadRequest},
+		{name: "bearer token", token: "alice-token", namespace: "dev", wantCode: http.StatusOK, wantPods: []string{"web"}},
+		{name: "session cookie", cookie: "alice-token", namespace: "dev", wantCode: http.StatusOK, wantPods: []string{"web"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestWebUI(
+				testPod("dev", "web", "node-1", corev1.PodRunning),
+				testPod("dev", "done", "node-1", corev1.PodSucceeded),
+			)
+			req := httptest.NewRequest(http.MethodGet, "/api/pods?namespace="+tt.namespace, nil)
+			if len(tt.token) > 0 {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if len(tt.cookie) > 0 {
+				req.AddCookie(&http.Cookie{Name: webUITokenCookie, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			u.servePods(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var pods []webUIPod
+			if err := json.NewDecoder(w.Body).Decode(&pods); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, pod := range pods {
+				names = append(names, pod.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.wantPods, ",") {
+				t.Errorf("pods = %v, want %v", names, tt.wantPods)
+			}
+		})
+	}
+}
+
+func TestWebUIServeSessionRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		origin   string
+		token    string
+		form     url.Values
+		wantCode int
+	}{
+		{
+			name:     "cross origin",
+			origin:   "https://evil.example.com",
+			token:    "alice-token",
+			form:     url.Values{"namespace": {"dev"}, "pod": {"web"}},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "not signed in",
+			form:     url.Values{"namespace": {"dev"}, "pod": {"web"}},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "no privilege in the namespace",
+			token:    "alice-token",
+			form:     url.Values{"namespace": {"prod"}, "pod": {"db"}},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "pod of another node",
+			origin:   "https://agent.example.com",
+			token:    "alice-token",
+			form:     url.Values{"namespace": {"dev"}, "pod": {"elsewhere"}},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "container not running",
+			token:    "alice-token",
+			form:     url.Values{"namespace": {"dev"}, "pod": {"web"}, "container": {"sidecar"}},
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestWebUI(
+				testPod("dev", "web", "node-1", corev1.PodRunning),
+				testPod("dev", "elsewhere", "node-2", corev1.PodRunning),
+				testPod("prod", "db", "node-1", corev1.PodRunning),
+			)
+			req := httptest.NewRequest(http.MethodGet, "https://agent.example.com/api/session?"+tt.form.Encode(), nil)
+			if len(tt.origin) > 0 {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if len(tt.token) > 0 {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			u.serveSession(w, req)
+			if w.Code != tt.wantCode {
+				t.Errorf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+}
@@ -59,3 +59,43 @@ func (cli *MountNSEnter) setCommand(ctx context.Context) (*exec.Cmd, error) {
 	cmd := exec.CommandContext(ctx, "/usr/bin/nsenter", args...)
 	return cmd, nil
 }
+
+// NetNSEnter is the client used to run commands in the network namespace of a process
+type NetNSEnter struct {
+	Target int64 // target PID (required)
+}
+
+// Command returns the command running in the network namespace of the target,
+// the streams of the command are left to the caller
+func (cli *NetNSEnter) Command(ctx context.Context, command string, args ...string) (*exec.Cmd, error) {
+	if cli.Target == 0 {
+		return nil, fmt.Errorf("Target must be specified")
+	}
+	nsArgs := []string{"--target", strconv.FormatInt(cli.Target, 10), "--net", "--", command}
+	return exec.CommandContext(ctx, "/usr/bin/nsenter", append(nsArgs, args...)...), nil
+}
+
+// NSEnter is the client used to run commands in the given namespaces of a process
+type NSEnter struct {
+	Target     int64    // target PID (required)
+	Namespaces []string // namespaces to enter: mount, uts, ipc, net, pid, cgroup or user
+}
+
+// Command returns the command running in the namespaces of the target,
+// the streams of the command are left to the caller
+func (cli *NSEnter) Command(ctx context.Context, command string, args ...string) (*exec.Cmd, error) {
+	if cli.Target == 0 {
+		return nil, fmt.Errorf("Target must be specified")
+	}
+	nsArgs := []string{"--target", strconv.FormatInt(cli.Target, 10)}
+	for _, ns := range cli.Namespaces {
+		switch ns {
+		case "mount", "uts", "ipc", "net", "pid", "cgroup", "user":
+			nsArgs = append(nsArgs, "--"+ns)
+		default:
+			return nil, fmt.Errorf("unknown namespace %s", ns)
+		}
+	}
+	nsArgs = append(nsArgs, "--", command)
+	return exec.CommandContext(ctx, "/usr/bin/nsenter", append(nsArgs, args...)...), nil
+}
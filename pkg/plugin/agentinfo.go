@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aylei/kubectl-debug/version"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const agentInfoTimeout = 10 * time.Second
+
+// legacyAgentFeatures are the features of the agents which don't serve /api/v1/info
+var legacyAgentFeatures = []string{"lxcfs", "registrySkipTLS"}
+
+// agentInfo describes the agent, see agent.AgentInfo
+type agentInfo struct {
+	Version  string   `json:"version"`
+	Runtimes []string `json:"runtimes"`
+	Features []string `json:"features"`
+	Limits   struct {
+		AllowedMountPaths       []string `json:"allowedMountPaths"`
+		AllowedSecurityProfiles []string `json:"allowedSecurityProfiles"`
+		ImageVerification       string   `json:"imageVerification"`
+		CaptureMaxDuration      int64    `json:"captureMaxDuration"`
+		CaptureMaxBytes         int64    `json:"captureMaxBytes"`
+		DetachGracePeriod       int64    `json:"detachGracePeriod"`
+	} `json:"limits"`
+}
+
+// checkAgent reads the info of the agent serving the pod before it is used, and warns
+// if the versions of the agent and of the plugin differ. The options the agent doesn't
+// support are then dropped with a warning, or fail the request.
+func (o *DebugOptions) checkAgent(pod *corev1.Pod) error {
+	uri, err := o.agentURL(pod, "/api/v1/info")
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: agentInfoTimeout}
+	resp, err := client.Get(uri.String())
+	if err != nil {
+		return fmt.Errorf("failed to reach the agent: %v", err)
+	}
+	defer resp.Body.Close()
+	info := &agentInfo{}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+			return fmt.Errorf("failed to read the info of the agent: %v", err)
+		}
+	case http.StatusNotFound:
+		info.Features = legacyAgentFeatures
+		fmt.Fprintf(o.ErrOut, "warning: the agent predates the plugin version %s, "+
+			"the options the agent doesn't support are not used\r\n", version.Version())
+	default:
+		return fmt.Errorf("failed to read the info of the agent: %s", resp.Status)
+	}
+	if len(info.Version) > 0 && info.Version != version.Version() {
+		fmt.Fprintf(o.ErrOut, "warning: the agent version %s differs from the plugin version %s, "+
+			"the options the agent doesn't support are not used\r\n", info.Version, version.Version())
+	}
+	if o.Verbosity > 0 {
+		o.Logger.Printf("Agent %s runtimes: %v features: %v\r\n", info.Version, info.Runtimes, info.Features)
+	}
+	o.agentInfo = info
+	return nil
+}
+
+// agentSupports tells whether the agent supports the feature, any feature is
+// assumed to be supported if the agent wasn't checked
+func (o *DebugOptions) agentSupports(feature string) bool {
+	return o.agentInfo == nil || containsString(o.agentInfo.Features, feature)
+}
+
+// requireAgentFeatures fails if the agent doesn't support one of the features
+func (o *DebugOptions) requireAgentFeatures(features ...string) error {
+	var missing []string
+	for _, feature := range features {
+		if !o.agentSupports(feature) {
+			missing = append(missing, feature)
+		}
+	}
+	if len(missing) > 0 {
+		agent := "the agent"
+		if len(o.agentInfo.Version) > 0 {
+			agent += " " + o.agentInfo.Version
+		}
+		return fmt.Errorf("%s doesn't support %s, upgrade the agent image", agent, strings.Join(missing, ", "))
+	}
+	return nil
+}
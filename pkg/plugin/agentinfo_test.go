@@ -0,0 +1,158 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aylei/kubectl-debug/version"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+func TestCheckAgent(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		body         string
+		wantFeatures []string
+		wantWarning  string
+		wantErr      string
+	}{
+		{
+			name:         "same version",
+			status:       http.StatusOK,
+			body:         fmt.Sprintf(`{"version":%q,"runtimes":["docker"],"features":["lxcfs","websocket"]}`, version.Version()),
+			wantFeatures: []string{"lxcfs", "websocket"},
+		},
+		{
+			name:         "version skew",
+			status:       http.StatusOK,
+			body:         `{"version":"v0.0.1","features":["lxcfs"]}`,
+			wantFeatures: []string{"lxcfs"},
+			wantWarning:  "warning: the agent version v0.0.1 differs from the plugin version",
+		},
+		{
+			name:         "legacy agent",
+			status:       http.StatusNotFound,
+			wantFeatures: legacyAgentFeatures,
+			wantWarning:  "warning: the agent predates the plugin version",
+		},
+		{
+			name:    "agent error",
+			status:  http.StatusInternalServerError,
+			wantErr: "failed to read the info of the agent: 500 Internal Server Error",
+		},
+		{
+			name:    "invalid info",
+			status:  http.StatusOK,
+			body:    "not json",
+			wantErr: "failed to read the info of the agent",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodGet || req.URL.Path != "/api/v1/info" {
+					t.Errorf("request %s %s, want GET /api/v1/info", req.Method, req.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			uri, _ := url.Parse(server.URL)
+			port, _ := strconv.Atoi(uri.Port())
+
+			opts, _ := newTestAgentOptions()
+			var errOut bytes.Buffer
+			opts.IOStreams = genericclioptions.IOStreams{In: opts.In, Out: opts.Out, ErrOut: &errOut}
+			opts.PortForward = true
+			opts.agentLocalPort = port
+			err := opts.checkAgent(testDoctorPod(corev1.PodRunning, "docker://abc"))
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("checkAgent() error = %v, want %q", err, tt.wantErr)
+				}
+				if opts.agentInfo != nil {
+					t.Errorf("the agent info is set on an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkAgent() error = %v", err)
+			}
+			if fmt.Sprint(opts.agentInfo.Features) != fmt.Sprint(tt.wantFeatures) {
+				t.Errorf("features = %v, want %v", opts.agentInfo.Features, tt.wantFeatures)
+			}
+			if len(tt.wantWarning) == 0 && errOut.Len() > 0 || !strings.Contains(errOut.String(), tt.wantWarning) {
+				t.Errorf("warnings = %q, want %q", errOut.String(), tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestCheckAgentUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	uri, _ := url.Parse(server.URL)
+	server.Close()
+	port, _ := strconv.Atoi(uri.Port())
+
+	opts, _ := newTestAgentOptions()
+	opts.PortForward = true
+	opts.agentLocalPort = port
+	if err := opts.checkAgent(testDoctorPod(corev1.PodRunning, "docker://abc")); err == nil || !strings.Contains(err.Error(), "failed to reach the agent") {
+		t.Errorf("checkAgent() error = %v, want failed to reach the agent", err)
+	}
+}
+
+func TestRequireAgentFeatures(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     *agentInfo
+		features []string
+		wantErr  string
+	}{
+		{
+			name:     "unchecked agent",
+			features: []string{"websocket", "cp"},
+		},
+		{
+			name:     "supported",
+			info:     &agentInfo{Version: "v0.2.0", Features: []string{"cp", "websocket"}},
+			features: []string{"websocket", "cp"},
+		},
+		{
+			name:     "missing features",
+			info:     &agentInfo{Version: "v0.1.1", Features: legacyAgentFeatures},
+			features: []string{"lxcfs", "cp", "capture"},
+			wantErr:  "the agent v0.1.1 doesn't support cp, capture, upgrade the agent image",
+		},
+		{
+			name:     "legacy agent without version",
+			info:     &agentInfo{Features: legacyAgentFeatures},
+			features: []string{"doctor"},
+			wantErr:  "the agent doesn't support doctor, upgrade the agent image",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, _ := newTestAgentOptions()
+			opts.agentInfo = tt.info
+			err := opts.requireAgentFeatures(tt.features...)
+			if len(tt.wantErr) == 0 && err != nil || len(tt.wantErr) > 0 && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("requireAgentFeatures(%v) error = %v, want %q", tt.features, err, tt.wantErr)
+			}
+			for _, feature := range tt.features {
+				want := tt.info == nil || containsString(tt.info.Features, feature)
+				if got := opts.agentSupports(feature); got != want {
+					t.Errorf("agentSupports(%s) = %v, want %v", feature, got, want)
+				}
+			}
+		})
+	}
+}
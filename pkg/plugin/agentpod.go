@@ -0,0 +1,111 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/yaml"
+)
+
+// tolerate all taints by default, the agent pod is pinned to the node of the target pod anyway
+var defaultAgentTolerations = []corev1.Toleration{
+	{
+		Operator: corev1.TolerationOpExists,
+	},
+}
+
+// parseTolerations parses tolerations in the form key[=value][:effect],
+// "*" tolerates everything
+func parseTolerations(specs []string) ([]corev1.Toleration, error) {
+	var ret []corev1.Toleration
+	for _, spec := range specs {
+		if spec == "*" {
+			ret = append(ret, corev1.Toleration{Operator: corev1.TolerationOpExists})
+			continue
+		}
+		toleration := corev1.Toleration{Operator: corev1.TolerationOpExists}
+		keyValue := spec
+		if i := strings.LastIndex(spec, ":"); i >= 0 {
+			keyValue = spec[:i]
+			toleration.Effect = corev1.TaintEffect(spec[i+1:])
+			switch toleration.Effect {
+			case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+			default:
+				return nil, fmt.Errorf("invalid toleration %q, unknown effect %q", spec, toleration.Effect)
+			}
+		}
+		parts := strings.SplitN(keyValue, "=", 2)
+		toleration.Key = parts[0]
+		if len(parts) == 2 {
+			toleration.Operator = corev1.TolerationOpEqual
+			toleration.Value = parts[1]
+		}
+		if len(toleration.Key) < 1 {
+			return nil, fmt.Errorf("invalid toleration %q, expected key[=value][:effect]", spec)
+		}
+		ret = append(ret, toleration)
+	}
+	return ret, nil
+}
+
+// toCoreTolerations converts the tolerations of the config file
+func toCoreTolerations(tolerations []Toleration) []corev1.Toleration {
+	var ret []corev1.Toleration
+	for _, t := range tolerations {
+		ret = append(ret, corev1.Toleration{
+			Key:               t.Key,
+			Operator:          corev1.TolerationOperator(t.Operator),
+			Value:             t.Value,
+			Effect:            corev1.TaintEffect(t.Effect),
+			TolerationSeconds: t.TolerationSeconds,
+		})
+	}
+	return ret
+}
+
+// mergeAgentPodTemplate merges the pod template in the given file into the
+// generated agent pod with the strategic merge patch semantic, e.g. the
+// container named 'debug-agent' in the template is merged into the agent container
+func mergeAgentPodTemplate(agentPod *corev1.Pod, templateFile string) (*corev1.Pod, error) {
+	template, err := ioutil.ReadFile(templateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent pod template %s: %v", templateFile, err)
+	}
+	patch, err := yaml.YAMLToJSON(template)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse agent pod template %s: %v", templateFile, err)
+	}
+	original, err := json.Marshal(agentPod)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := strategicpatch.StrategicMergePatch(original, patch, corev1.Pod{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge agent pod template %s: %v", templateFile, err)
+	}
+	ret := &corev1.Pod{}
+	if err := json.Unmarshal(merged, ret); err != nil {
+		return nil, err
+	}
+	if len(ret.Spec.Containers) < 1 {
+		return nil, fmt.Errorf("agent pod template %s removes the agent container", templateFile)
+	}
+	return ret, nil
+}
+
+// agentPodSpecHash returns the hash of the spec of an agent pod, a reusable agent pod
+// is only reused by the sessions asking for the same spec
+func agentPodSpecHash(spec *corev1.PodSpec) (string, error) {
+	content, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])[:16], nil
+}
@@ -0,0 +1,358 @@
+package plugin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestAgentOptions(objects ...runtime.Object) (*DebugOptions, *fake.Clientset) {
+	client := fake.NewSimpleClientset(objects...)
+	var out bytes.Buffer
+	opts := NewDebugOptions(genericclioptions.IOStreams{In: &bytes.Buffer{}, Out: &out, ErrOut: &out})
+	opts.CoreClient = client.CoreV1()
+	opts.Logger = log.New(&out, "", 0)
+	opts.AgentPodNamespace = "default"
+	opts.AgentPodName = "debug-agent-pod"
+	opts.AgentPodNode = "node-1"
+	opts.AgentImage = "aylei/debug-agent:latest"
+	opts.AgentPort = 10027
+	opts.AgentReuse = true
+	return opts, client
+}
+
+// testAgentPod returns a reusable agent pod of node-1 with the spec hash, whose
+// agent container is running if the phase is
+func testAgentPod(name, hash string, phase corev1.PodPhase) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{agentPodLabel: "true", agentReusableLabel: "true", agentSpecHashLabel: hash},
+		},
+		Spec:   corev1.PodSpec{NodeName: "node-1", Containers: []corev1.Container{{Name: "debug-agent"}}},
+		Status: corev1.PodStatus{Phase: phase},
+	}
+	state := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	if phase != corev1.PodRunning {
+		state = corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}}
+	}
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "debug-agent", State: state}}
+	return pod
+}
+
+func TestFindReusableAgentPod(t *testing.T) {
+	opts, _ := newTestAgentOptions()
+	agentPod, err := opts.getAgentPod()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := agentPod.Labels[agentSpecHashLabel]
+	if len(hash) < 1 {
+		t.Fatalf("the reusable agent pod has no spec hash")
+	}
+
+	exited := testAgentPod("exited", hash, corev1.PodRunning)
+	exited.Status.ContainerStatuses[0].State = corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}}
+	deleting := testAgentPod("deleting", hash, corev1.PodRunning)
+	now := v1.Now()
+	deleting.DeletionTimestamp = &now
+	tests := []struct {
+		name        string
+		pods        []runtime.Object
+		want        string
+		wantDeleted []string
+	}{
+		{
+			name: "same spec",
+			pods: []runtime.Object{testAgentPod("other", "0123456789abcdef", corev1.PodRunning), testAgentPod("same", hash, corev1.PodRunning)},
+			want: "same",
+		},
+		{
+			name: "other spec",
+			pods: []runtime.Object{testAgentPod("other", "0123456789abcdef", corev1.PodRunning)},
+		},
+		{
+			name: "pods no longer running",
+			pods: []runtime.Object{
+				testAgentPod("succeeded", hash, corev1.PodSucceeded),
+				testAgentPod("failed", hash, corev1.PodFailed),
+				exited,
+				deleting,
+				testAgentPod("pending", hash, corev1.PodPending),
+			},
+			wantDeleted: []string{"exited", "failed", "succeeded"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, client := newTestAgentOptions(tt.pods...)
+			found, err := opts.findReusableAgentPod(agentPod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found == nil && len(tt.want) > 0 || found != nil && found.Name != tt.want {
+				t.Errorf("findReusableAgentPod() = %v, want %q", found, tt.want)
+			}
+			var deleted []string
+			for _, action := range client.Actions() {
+				if action.GetVerb() == "delete" {
+					deleted = append(deleted, action.(k8stesting.DeleteAction).GetName())
+				}
+			}
+			sort.Strings(deleted)
+			if strings.Join(deleted, ",") != strings.Join(tt.wantDeleted, ",") {
+				t.Errorf("deleted %v, want %v", deleted, tt.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestAgentPodSpecHash(t *testing.T) {
+	opts, _ := newTestAgentOptions()
+	base, err := opts.getAgentPod()
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, err := opts.getAgentPod()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base.Labels[agentSpecHashLabel] != same.Labels[agentSpecHashLabel] {
+		t.Errorf("the hash of the same spec changed: %s, %s", base.Labels[agentSpecHashLabel], same.Labels[agentSpecHashLabel])
+	}
+	for name, change := range map[string]func(o *DebugOptions){
+		"image":    func(o *DebugOptions) { o.AgentImage = "aylei/debug-agent:v0.2.0" },
+		"idle ttl": func(o *DebugOptions) { o.AgentIdleTTL = time.Minute },
+		"resource": func(o *DebugOptions) { o.AgentPodResource.MemoryLimits = "1Gi" },
+	} {
+		opts, _ := newTestAgentOptions()
+		change(opts)
+		changed, err := opts.getAgentPod()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed.Labels[agentSpecHashLabel] == base.Labels[agentSpecHashLabel] {
+			t.Errorf("the hash doesn't change with the %s", name)
+		}
+	}
+}
+
+func TestParseTolerations(t *testing.T) {
+	tests := []struct {
+		specs   []string
+		want    []corev1.Toleration
+		wantErr bool
+	}{
+		{specs: []string{"*"}, want: []corev1.Toleration{{Operator: corev1.TolerationOpExists}}},
+		{specs: []string{"dedicated"}, want: []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpExists}}},
+		{
+			specs: []string{"dedicated=debug:NoSchedule", "node.kubernetes.io/unreachable:NoExecute"},
+			want: []corev1.Toleration{
+				{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "debug", Effect: corev1.TaintEffectNoSchedule},
+				{Key: "node.kubernetes.io/unreachable", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute},
+			},
+		},
+		{specs: []string{"dedicated:Never"}, wantErr: true},
+		{specs: []string{"=debug"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTolerations(tt.specs)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTolerations(%q) = %+v, %v, want %+v", tt.specs, got, err, tt.want)
+		}
+	}
+}
+
+func TestAgentPodScheduling(t *testing.T) {
+	const config = `agentTolerations:
+- key: dedicated
+  operator: Equal
+  value: debug
+  effect: NoSchedule
+agentPriorityClassName: system-node-critical
+agentServiceAccountName: debug-agent
+agentLabels:
+  team: sre
+agentAnnotations:
+  owner: sre
+`
+	tests := []struct {
+		name               string
+		config             string
+		args               []string
+		wantTolerations    []corev1.Toleration
+		wantPriorityClass  string
+		wantServiceAccount string
+		wantLabels         map[string]string
+		wantAnnotations    map[string]string
+	}{
+		{
+			name:            "defaults",
+			wantTolerations: defaultAgentTolerations,
+		},
+		{
+			name:               "config",
+			config:             config,
+			wantTolerations:    []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "debug", Effect: corev1.TaintEffectNoSchedule}},
+			wantPriorityClass:  "system-node-critical",
+			wantServiceAccount: "debug-agent",
+			wantLabels:         map[string]string{"team": "sre"},
+			wantAnnotations:    map[string]string{"owner": "sre"},
+		},
+		{
+			name:   "flags override the config",
+			config: config,
+			args: []string{"--agent-toleration", "gpu:NoExecute", "--agent-priority-class", "high",
+				"--agent-service-account", "debugger", "--agent-labels", "team=ops", "--agent-annotations", "owner=ops"},
+			wantTolerations:    []corev1.Toleration{{Key: "gpu", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute}},
+			wantPriorityClass:  "high",
+			wantServiceAccount: "debugger",
+			wantLabels:         map[string]string{"team": "ops"},
+			wantAnnotations:    map[string]string{"owner": "ops"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := completeTestOptions(t, tt.config, append(tt.args, "mypod")...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.AgentPodNode = "node-1"
+			pod, err := opts.getAgentPod()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(pod.Spec.Tolerations, tt.wantTolerations) {
+				t.Errorf("tolerations = %+v, want %+v", pod.Spec.Tolerations, tt.wantTolerations)
+			}
+			if pod.Spec.PriorityClassName != tt.wantPriorityClass || pod.Spec.ServiceAccountName != tt.wantServiceAccount {
+				t.Errorf("priority class = %q, service account = %q, want %q, %q",
+					pod.Spec.PriorityClassName, pod.Spec.ServiceAccountName, tt.wantPriorityClass, tt.wantServiceAccount)
+			}
+			for k, v := range tt.wantLabels {
+				if pod.Labels[k] != v {
+					t.Errorf("label %s = %q, want %q", k, pod.Labels[k], v)
+				}
+			}
+			if pod.Labels[agentNodeLabel] != "node-1" {
+				t.Errorf("the extra labels replaced the node label: %v", pod.Labels)
+			}
+			if len(tt.wantAnnotations) > 0 && !reflect.DeepEqual(pod.Annotations, tt.wantAnnotations) {
+				t.Errorf("annotations = %v, want %v", pod.Annotations, tt.wantAnnotations)
+			}
+		})
+	}
+
+	if _, err := completeTestOptions(t, "", "--agent-toleration", "gpu:Sometimes", "mypod"); err == nil {
+		t.Errorf("an invalid toleration is accepted")
+	}
+}
+
+func TestMergeAgentPodTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		check    func(t *testing.T, pod *corev1.Pod)
+		wantErr  string
+	}{
+		{
+			name: "agent container merged by name",
+			template: `spec:
+  containers:
+  - name: debug-agent
+    env:
+    - name: HTTP_PROXY
+      value: http://proxy:3128
+  nodeSelector:
+    pool: debug
+`,
+			check: func(t *testing.T, pod *corev1.Pod) {
+				if len(pod.Spec.Containers) != 1 {
+					t.Fatalf("containers = %d, want the agent container only", len(pod.Spec.Containers))
+				}
+				c := pod.Spec.Containers[0]
+				if c.Image != "aylei/debug-agent:latest" || len(c.Ports) != 1 || c.Ports[0].HostPort != 10027 {
+					t.Errorf("the generated agent container is lost: %+v", c)
+				}
+				if len(c.Env) != 1 || c.Env[0].Value != "http://proxy:3128" {
+					t.Errorf("env = %+v, want HTTP_PROXY", c.Env)
+				}
+				if pod.Spec.NodeSelector["pool"] != "debug" || pod.Spec.NodeName != "node-1" {
+					t.Errorf("node selector = %v, node = %s", pod.Spec.NodeSelector, pod.Spec.NodeName)
+				}
+			},
+		},
+		{
+			name: "sidecar added",
+			template: `spec:
+  containers:
+  - name: sidecar
+    image: busybox
+`,
+			check: func(t *testing.T, pod *corev1.Pod) {
+				if len(pod.Spec.Containers) != 2 {
+					t.Errorf("containers = %+v, want the agent and the sidecar", pod.Spec.Containers)
+				}
+			},
+		},
+		{
+			name: "agent container removed",
+			template: `spec:
+  containers:
+  - name: debug-agent
+    $patch: delete
+`,
+			wantErr: "removes the agent container",
+		},
+		{
+			name:     "invalid template",
+			template: "spec: [",
+			wantErr:  "failed to parse agent pod template",
+		},
+	}
+	opts, _ := newTestAgentOptions()
+	opts.AgentReuse = false
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "template")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			opts.AgentPodTemplate = filepath.Join(dir, "template.yaml")
+			if err := ioutil.WriteFile(opts.AgentPodTemplate, []byte(tt.template), 0644); err != nil {
+				t.Fatal(err)
+			}
+			pod, err := opts.getAgentPod()
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("getAgentPod() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, pod)
+		})
+	}
+
+	if _, err := mergeAgentPodTemplate(&corev1.Pod{}, "/nonexistent/template.yaml"); err == nil || !strings.Contains(err.Error(), "failed to read") {
+		t.Errorf("mergeAgentPodTemplate() of a missing file error = %v", err)
+	}
+}
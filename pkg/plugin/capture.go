@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	dockerterm "github.com/docker/docker/pkg/term"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/resource"
+	cmdutil "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+)
+
+const captureExample = `
+	# capture the https traffic of a pod for 30 seconds
+	kubectl debug capture POD_NAME -i eth0 -f 'port 443' --duration 30s -w out.pcapng
+
+	# stream the capture of a pod in another namespace to wireshark
+	kubectl debug capture NAMESPACE/POD_NAME -w - | wireshark -k -i -
+`
+
+// captureOptions are the options of kubectl debug capture
+type captureOptions struct {
+	iface    string
+	filter   string
+	write    string
+	duration time.Duration
+	maxBytes string
+	snaplen  int
+}
+
+func newCaptureCmd(opts *DebugOptions) *cobra.Command {
+	captureOpts := &captureOptions{}
+	cmd := &cobra.Command{
+		Use:                   "capture [NAMESPACE/]POD -w FILE",
+		DisableFlagsInUseLine: true,
+		Short:                 "Capture the packets of a pod as pcapng",
+		Long: `Capture the packets in the network namespace of a pod with tcpdump run by the agent,
+the pod doesn't need tcpdump or any capability. The capture stops at the duration,
+at the byte limit or on ctrl-c, and is written to a file or to stdout with -w -.`,
+		Example: captureExample,
+		Args:    cobra.ExactArgs(1),
+		Run: func(c *cobra.Command, args []string) {
+			cmdutil.CheckErr(opts.runCapture(c, args, captureOpts))
+		},
+	}
+	cmd.Flags().StringVarP(&captureOpts.iface, "interface", "i", "any",
+		"The interface to capture on")
+	cmd.Flags().StringVarP(&captureOpts.filter, "filter", "f", "",
+		"The capture filter, in the pcap-filter syntax, e.g. 'port 443'")
+	cmd.Flags().StringVarP(&captureOpts.write, "write", "w", "",
+		"The file to write the capture to, - for stdout")
+	cmd.Flags().DurationVar(&captureOpts.duration, "duration", 0,
+		"The duration of the capture, 0 for the maximum duration allowed by the agent")
+	cmd.Flags().StringVar(&captureOpts.maxBytes, "max-bytes", "",
+		"The size limit of the capture, e.g. 100Mi, defaults to the maximum size allowed by the agent")
+	cmd.Flags().IntVar(&captureOpts.snaplen, "snaplen", 0,
+		"The bytes captured of each packet, defaults to the whole packet")
+	return cmd
+}
+
+func (o *DebugOptions) runCapture(cmd *cobra.Command, args []string, captureOpts *captureOptions) error {
+	if len(captureOpts.write) < 1 {
+		return cmdutil.UsageErrorf(cmd, "the file to write the capture to must be specified with -w")
+	}
+	if captureOpts.duration < 0 {
+		return cmdutil.UsageErrorf(cmd, "--duration must not be negative")
+	}
+	if captureOpts.snaplen < 0 {
+		return cmdutil.UsageErrorf(cmd, "--snaplen must not be negative")
+	}
+	params := url.Values{}
+	params.Set("interface", captureOpts.iface)
+	params.Set("filter", captureOpts.filter)
+	if captureOpts.duration > 0 {
+		params.Set("duration", captureOpts.duration.String())
+	}
+	if len(captureOpts.maxBytes) > 0 {
+		quantity, err := resource.ParseQuantity(captureOpts.maxBytes)
+		if err != nil || quantity.Sign() < 0 {
+			return cmdutil.UsageErrorf(cmd, "invalid --max-bytes %s", captureOpts.maxBytes)
+		}
+		params.Set("maxBytes", strconv.FormatInt(quantity.Value(), 10))
+	}
+	if captureOpts.snaplen > 0 {
+		params.Set("snaplen", strconv.Itoa(captureOpts.snaplen))
+	}
+
+	var out io.Writer
+	if captureOpts.write == "-" {
+		if _, isTerminal := dockerterm.GetFdInfo(os.Stdout); isTerminal {
+			return errors.New("refusing to write the capture to a terminal, redirect stdout or use -w FILE")
+		}
+		out = os.Stdout
+	}
+	if err := o.completeTool(cmd, args[0]); err != nil {
+		return err
+	}
+	if out == nil {
+		f, err := os.Create(captureOpts.write)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	counter := &countingWriter{writer: out}
+	err := o.runTool(func(target *toolTarget) error {
+		fmt.Fprintf(o.ErrOut, "capturing on %s of pod %s, press ctrl-c to stop\r\n", captureOpts.iface, o.PodName)
+		return o.toolExecute(target, "/api/v1/capture", params, nil, counter)
+	})
+	fmt.Fprintf(o.ErrOut, "%d bytes captured\r\n", counter.written)
+	return err
+}
+
+// countingWriter counts the bytes written to the writer
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.written += int64(n)
+	return n, err
+}
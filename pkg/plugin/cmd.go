@@ -2,8 +2,6 @@ package plugin
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -13,6 +11,7 @@ import (
 	"os/user"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,20 +19,24 @@ import (
 
 	term "github.com/aylei/kubectl-debug/pkg/util"
 	dockerterm "github.com/docker/docker/pkg/term"
-	"github.com/rs/xid"
 	"github.com/spf13/cobra"
 	authorizationv1 "k8s.io/api/authorization/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
 	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/validation"
+	watchapi "k8s.io/apimachinery/pkg/watch"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/kubernetes"
 	coreclient "k8s.io/client-go/kubernetes/typed/core/v1"
 	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	cmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"k8s.io/client-go/tools/portforward"
 	"k8s.io/client-go/tools/remotecommand"
@@ -52,6 +55,9 @@ const (
 	# specify namespace or container
 	kubectl debug --namespace foo POD_NAME -c CONTAINER_NAME
 
+	# debug a pod named like a subcommand, e.g. cp
+	kubectl debug --pod cp
+
 	# override the default troubleshooting image
 	kubectl debug POD_NAME --image aylei/debug-jvm
 
@@ -61,6 +67,36 @@ const (
 	# override the debug config file
 	kubectl debug POD_NAME --debug-config ./debug-config.yml
 
+	# fork the pod into another namespace and node, with extra env and a raised memory limit
+	kubectl debug POD_NAME --fork --fork-namespace debug --fork-node node-2 --fork-env DEBUG=1 --fork-memory-limits 4Gi
+
+	# reattach to a debug session after a disconnect, detach from a session with ctrl-p ctrl-q
+	kubectl debug POD_NAME --attach ATTACH_TOKEN
+
+	# share a debug session, the others watch it with the join token printed at its start,
+	# or co-drive it if the owner started it with --share-write
+	kubectl debug POD_NAME --shareable
+	kubectl debug POD_NAME --join JOIN_TOKEN
+	kubectl debug POD_NAME --join JOIN_TOKEN --join-write
+
+	# run a command in all the pods of a label selector, 10 pods at a time, and summarize the exit codes
+	kubectl debug -l app=api --all --parallel 10 -- ss -s
+
+	# copy files from or into the target container, see kubectl debug cp --help
+	kubectl debug cp POD_NAME:/tmp/heap.hprof ./heap.hprof
+
+	# capture the packets of a pod as pcapng, see kubectl debug capture --help
+	kubectl debug capture POD_NAME -f 'port 443' -w out.pcapng
+
+	# forward a local port to a port only listening on localhost in the pod, see kubectl debug port-forward --help
+	kubectl debug port-forward POD_NAME 9000:localhost:6060
+
+	# collect a diagnostic bundle of a pod, see kubectl debug collect --help
+	kubectl debug collect POD_NAME -o bundle.tar.gz
+
+	# take a 30s cpu profile of a go process, see kubectl debug profile --help
+	kubectl debug profile POD_NAME --lang go --duration 30s -o cpu.pprof
+
 	# check version
 	kubectl --version
 `
@@ -91,6 +127,17 @@ You may set default configuration such as image and command in the config file,
 	defaultRegistrySecretNamespace = "default"
 	defaultRegistrySkipTLSVerify   = false
 
+	defaultLaunchTimeout = 5 * time.Minute
+	defaultParallel      = 10
+	defaultDetachKeys    = "ctrl-p,ctrl-q"
+	defaultAgentIdleTTL  = 10 * time.Minute
+
+	// labels of the agent pods in agentless mode
+	agentPodLabel      = "kubectl-debug/agent"
+	agentReusableLabel = "kubectl-debug/reusable-agent"
+	agentSpecHashLabel = "kubectl-debug/agent-spec-hash"
+	agentNodeLabel     = "kubectl-debug/agent-node"
+
 	defaultPortForward = true
 	defaultAgentless   = true
 	defaultLxcfsEnable = true
@@ -99,20 +146,35 @@ You may set default configuration such as image and command in the config file,
 	enableLxcsFlag  = "enable-lxcfs"
 	portForwardFlag = "port-forward"
 	agentlessFlag   = "agentless"
+	agentReuseFlag  = "agent-reuse"
+
+	registryUsePodSecretsFlag = "registry-use-pod-secrets"
 )
 
+// forkOverrideFlags change the forked pod, they require --fork
+var forkOverrideFlags = []string{"fork-namespace", "fork-node", "fork-node-selector", "fork-env",
+	"fork-cpu-requests", "fork-memory-requests", "fork-cpu-limits", "fork-memory-limits"}
+
 // DebugOptions specify how to run debug container in a running pod
 type DebugOptions struct {
 
 	// Pod select options
 	Namespace string
 	PodName   string
+	// select the pods by label, the command runs non-interactively in all
+	// of them if All is set, with at most Parallel sessions at a time
+	Selector  string
+	All       bool
+	Parallel  int
+	OutputDir string
 
 	// Debug options
 	Image                   string
+	ImagePullPolicy         string
 	RegistrySecretName      string
 	RegistrySecretNamespace string
 	RegistrySkipTLSVerify   bool
+	RegistryUsePodSecrets   bool
 
 	ContainerName       string
 	Command             []string
@@ -121,6 +183,14 @@ type DebugOptions struct {
 	ConfigLocation      string
 	Fork                bool
 	ForkPodRetainLabels []string
+	// used for fork mode, override the copied pod
+	ForkPodNamespace    string
+	ForkPodNodeName     string
+	ForkPodNodeSelector map[string]string
+	ForkPodEnv          []string
+	ForkPodResource     podResources
+	// the fork flags set on the command line
+	forkFlags []string
 	//used for agentless mode
 	AgentLess                bool
 	AgentImage               string
@@ -130,9 +200,43 @@ type DebugOptions struct {
 	AgentPodName      string
 	AgentPodNamespace string
 	AgentPodNode      string
-	AgentPodResource  agentPodResources
+	AgentPodResource  podResources
+	// keep the agent pod running after the session for reuse,
+	// the agent exits once idle for AgentIdleTTL
+	AgentReuse   bool
+	AgentIdleTTL time.Duration
+	// scheduling controls of the agent pod
+	AgentTolerations        []string
+	AgentPriorityClassName  string
+	AgentServiceAccountName string
+	AgentPodLabels          map[string]string
+	AgentPodAnnotations     map[string]string
+	AgentPodTemplate        string
+	agentTolerations        []corev1.Toleration
 	// enable lxcfs
 	IsLxcfsEnabled bool
+	// how long to wait for the agent pod and the forked pod to run
+	LaunchTimeout time.Duration
+	// attach token of the debug session to reattach to
+	Attach string
+	// key sequence detaching from the debug session
+	DetachKeys string
+	// join token of the debug session to join as an observer, with write access if JoinWrite is set
+	Join      string
+	JoinWrite bool
+	// allow the observers of the debug session to write to it
+	ShareWrite bool
+	// the debug session can be joined with the join token printed at its start
+	Shareable bool
+	// profiler definitions of the config file by language, see kubectl debug profile
+	Profilers map[string]ProfilerConfig
+	// debug profile of the config file, and the debug container settings it sets
+	ProfileName     string
+	Env             []string
+	Mounts          []Mount
+	SecurityProfile string
+	CpuLimits       string
+	MemoryLimits    string
 
 	Flags      *genericclioptions.ConfigFlags
 	CoreClient coreclient.CoreV1Interface
@@ -153,14 +257,23 @@ type DebugOptions struct {
 
 	genericclioptions.IOStreams
 
-	wait sync.WaitGroup
+	wait *sync.WaitGroup
+	// the port-forward of the agent and its local port, if not the agent port
+	agentForward   *portforward.PortForwarder
+	agentLocalPort int
+	// the error of the port-forward of the agent, set before the ready signal
+	agentForwardErr error
+	// the agent pod is a reusable one found running
+	agentReused bool
+	// the info of the agent, nil until it is checked
+	agentInfo *agentInfo
 
 	Verbosity int
 	Logger    *log.Logger
 	UserName  string
 }
 
-type agentPodResources struct {
+type podResources struct {
 	CpuRequests    string
 	CpuLimits      string
 	MemoryRequests string
@@ -176,13 +289,16 @@ func NewDebugOptions(streams genericclioptions.IOStreams) *DebugOptions {
 			IOStreams: streams,
 		},
 		Logger: log.New(streams.Out, "kubectl-debug ", (log.LstdFlags | log.Lshortfile)),
+		wait:   &sync.WaitGroup{},
 	}
 }
 
 // NewDebugCmd returns a cobra command wrapping DebugOptions
 func NewDebugCmd(streams genericclioptions.IOStreams) *cobra.Command {
-	opts := NewDebugOptions(streams)
+	return newDebugCmd(NewDebugOptions(streams))
+}
 
+func newDebugCmd(opts *DebugOptions) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:                   "debug POD [-c CONTAINER] -- COMMAND [args...]",
 		DisableFlagsInUseLine: true,
@@ -190,6 +306,8 @@ func NewDebugCmd(streams genericclioptions.IOStreams) *cobra.Command {
 		Long:                  longDesc,
 		Example:               example,
 		Version:               version.Version(),
+		// the pod name isn't a subcommand, the pods named like one are given with --pod
+		Args: cobra.ArbitraryArgs,
 		Run: func(c *cobra.Command, args []string) {
 			argsLenAtDash := c.ArgsLenAtDash()
 			cmdutil.CheckErr(opts.Complete(c, args, argsLenAtDash))
@@ -197,66 +315,135 @@ func NewDebugCmd(streams genericclioptions.IOStreams) *cobra.Command {
 			cmdutil.CheckErr(opts.Run())
 		},
 	}
-	//cmd.Flags().BoolVarP(&opts.RetainContainer, "retain", "r", defaultRetain,
+	//cmd.PersistentFlags().BoolVarP(&opts.RetainContainer, "retain", "r", defaultRetain,
 	//	fmt.Sprintf("Retain container after debug session closed, default to %s", defaultRetain))
-	cmd.Flags().StringVar(&opts.Image, "image", "",
+	cmd.PersistentFlags().StringVar(&opts.Image, "image", "",
 		fmt.Sprintf("Container Image to run the debug container, default to %s", defaultImage))
-	cmd.Flags().StringVar(&opts.RegistrySecretName, "registry-secret-name", "",
-		"private registry secret name, default is kubectl-debug-registry-secret")
-	cmd.Flags().StringVar(&opts.RegistrySecretNamespace, "registry-secret-namespace", "",
+	cmd.PersistentFlags().StringVar(&opts.ImagePullPolicy, "image-pull-policy", "",
+		"Pull policy of the debug image: Always, IfNotPresent or Never, default to Always for the latest tag and IfNotPresent otherwise")
+	cmd.PersistentFlags().StringVar(&opts.RegistrySecretName, "registry-secret-name", "",
+		"private registry secret names separated by comma, default is kubectl-debug-registry-secret")
+	cmd.PersistentFlags().StringVar(&opts.RegistrySecretNamespace, "registry-secret-namespace", "",
 		"private registry secret namespace, default is default")
-	cmd.Flags().BoolVar(&opts.RegistrySkipTLSVerify, "registry-skip-tls-verify", false,
+	cmd.PersistentFlags().BoolVar(&opts.RegistryUsePodSecrets, registryUsePodSecretsFlag, false,
+		"Also look up the registry credentials in the image pull secrets of the target pod and its service account")
+	cmd.PersistentFlags().BoolVar(&opts.RegistrySkipTLSVerify, "registry-skip-tls-verify", false,
 		"If true, the registry's certificate will not be checked for validity. This will make your HTTPS connections insecure")
-	cmd.Flags().StringSliceVar(&opts.ForkPodRetainLabels, "fork-pod-retain-labels", []string{},
+	cmd.PersistentFlags().StringSliceVar(&opts.ForkPodRetainLabels, "fork-pod-retain-labels", []string{},
 		"in fork mode the pod labels retain labels name list, default is not set")
-	cmd.Flags().StringVarP(&opts.ContainerName, "container", "c", "",
+	cmd.PersistentFlags().StringVar(&opts.ForkPodNamespace, "fork-namespace", "",
+		"in fork mode the namespace of the copied pod, default to the namespace of the target pod")
+	cmd.PersistentFlags().StringVar(&opts.ForkPodNodeName, "fork-node", "",
+		"in fork mode pin the copied pod to the given node, default to the node of the target pod")
+	cmd.PersistentFlags().StringToStringVar(&opts.ForkPodNodeSelector, "fork-node-selector", map[string]string{},
+		"in fork mode schedule the copied pod with the given node selector instead of the node of the target pod")
+	cmd.PersistentFlags().StringArrayVar(&opts.ForkPodEnv, "fork-env", []string{},
+		"in fork mode add or replace environment variables of the target container, in the form KEY=VALUE")
+	cmd.PersistentFlags().StringVar(&opts.ForkPodResource.CpuRequests, "fork-cpu-requests", "",
+		"in fork mode override the cpu requests of the target container, default is not changed")
+	cmd.PersistentFlags().StringVar(&opts.ForkPodResource.MemoryRequests, "fork-memory-requests", "",
+		"in fork mode override the memory requests of the target container, default is not changed")
+	cmd.PersistentFlags().StringVar(&opts.ForkPodResource.CpuLimits, "fork-cpu-limits", "",
+		"in fork mode override the cpu limits of the target container, default is not changed")
+	cmd.PersistentFlags().StringVar(&opts.ForkPodResource.MemoryLimits, "fork-memory-limits", "",
+		"in fork mode override the memory limits of the target container, default is not changed")
+	cmd.Flags().StringVar(&opts.PodName, "pod", "",
+		"Name of the pod to debug, for the pods named like a subcommand, e.g. cp, then all the arguments are the command")
+	cmd.PersistentFlags().StringVarP(&opts.Selector, "selector", "l", "",
+		"Selector (label query) of the pods to debug, the first running pod is debugged unless --all is set")
+	cmd.PersistentFlags().BoolVar(&opts.All, "all", false,
+		"Run the command non-interactively in all the pods matching --selector and summarize the exit codes")
+	cmd.PersistentFlags().IntVar(&opts.Parallel, "parallel", defaultParallel,
+		"With --all, the number of pods the command runs in at a time")
+	cmd.PersistentFlags().StringVar(&opts.OutputDir, "output-dir", "",
+		"With --all, write the output of each pod to DIR/POD.log instead of prefixing it with the pod name")
+	cmd.PersistentFlags().StringVarP(&opts.ContainerName, "container", "c", "",
 		"Target container to debug, default to the first container in pod")
-	cmd.Flags().IntVarP(&opts.AgentPort, "port", "p", 0,
+	cmd.PersistentFlags().IntVarP(&opts.AgentPort, "port", "p", 0,
 		fmt.Sprintf("Agent port for debug cli to connect, default to %d", defaultAgentPort))
-	cmd.Flags().StringVar(&opts.ConfigLocation, "debug-config", "",
+	cmd.PersistentFlags().StringVar(&opts.ConfigLocation, "debug-config", "",
 		fmt.Sprintf("Debug config file, default to ~%s", filepath.FromSlash(defaultConfigLocation)))
-	cmd.Flags().BoolVar(&opts.Fork, "fork", false,
+	cmd.PersistentFlags().BoolVar(&opts.Fork, "fork", false,
 		"Fork a new pod for debugging (useful if the pod status is CrashLoopBackoff)")
-	cmd.Flags().BoolVar(&opts.PortForward, portForwardFlag, true,
+	cmd.PersistentFlags().BoolVar(&opts.PortForward, portForwardFlag, true,
 		fmt.Sprintf("Whether using port-forward to connect debug-agent, default to %t", defaultPortForward))
-	cmd.Flags().StringVar(&opts.DebugAgentDaemonSet, "daemonset-name", opts.DebugAgentDaemonSet,
+	cmd.PersistentFlags().StringVar(&opts.DebugAgentDaemonSet, "daemonset-name", opts.DebugAgentDaemonSet,
 		"Debug agent daemonset name when using port-forward")
-	cmd.Flags().StringVar(&opts.DebugAgentNamespace, "daemonset-ns", opts.DebugAgentNamespace,
+	cmd.PersistentFlags().StringVar(&opts.DebugAgentNamespace, "daemonset-ns", opts.DebugAgentNamespace,
 		"Debug agent namespace, default to 'default'")
 	// flags used for agentless mode.
-	cmd.Flags().BoolVarP(&opts.AgentLess, agentlessFlag, "a", true,
+	cmd.PersistentFlags().BoolVarP(&opts.AgentLess, agentlessFlag, "a", true,
 		fmt.Sprintf("Whether to turn on agentless mode. Agentless mode: debug target pod if there isn't an agent running on the target host, default to %t", defaultAgentless))
-	cmd.Flags().StringVar(&opts.AgentImage, "agent-image", "",
+	cmd.PersistentFlags().StringVar(&opts.AgentImage, "agent-image", "",
 		fmt.Sprintf("Agentless mode, the container Image to run the agent container , default to %s", defaultAgentImage))
-	cmd.Flags().StringVar(&opts.AgentImagePullPolicy, "agent-pull-policy", "",
+	cmd.PersistentFlags().StringVar(&opts.AgentImagePullPolicy, "agent-pull-policy", "",
 		fmt.Sprintf("Agentless mode, the container Image pull policy , default to %s", defaultAgentImagePullPolicy))
-	cmd.Flags().StringVar(&opts.AgentImagePullSecretName, "agent-pull-secret-name", "",
+	cmd.PersistentFlags().StringVar(&opts.AgentImagePullSecretName, "agent-pull-secret-name", "",
 		fmt.Sprintf("Agentless mode, the container Image pull secret name , default to empty"))
-	cmd.Flags().StringVar(&opts.AgentPodName, "agent-pod-name-prefix", "",
+	cmd.PersistentFlags().StringVar(&opts.AgentPodName, "agent-pod-name-prefix", "",
 		fmt.Sprintf("Agentless mode, pod name prefix , default to %s", defaultAgentPodNamePrefix))
-	cmd.Flags().StringVar(&opts.AgentPodNamespace, "agent-pod-namespace", "",
+	cmd.PersistentFlags().StringVar(&opts.AgentPodNamespace, "agent-pod-namespace", "",
 		fmt.Sprintf("Agentless mode, agent pod namespace, default to %s", defaultAgentPodNamespace))
-	cmd.Flags().StringVar(&opts.AgentPodResource.CpuRequests, "agent-pod-cpu-requests", "",
+	cmd.PersistentFlags().StringVar(&opts.AgentPodResource.CpuRequests, "agent-pod-cpu-requests", "",
 		fmt.Sprintf("Agentless mode, agent pod cpu requests, default is not set"))
-	cmd.Flags().StringVar(&opts.AgentPodResource.MemoryRequests, "agent-pod-memory-requests", "",
+	cmd.PersistentFlags().StringVar(&opts.AgentPodResource.MemoryRequests, "agent-pod-memory-requests", "",
 		fmt.Sprintf("Agentless mode, agent pod memory requests, default is not set"))
-	cmd.Flags().StringVar(&opts.AgentPodResource.CpuLimits, "agent-pod-cpu-limits", "",
+	cmd.PersistentFlags().StringVar(&opts.AgentPodResource.CpuLimits, "agent-pod-cpu-limits", "",
 		fmt.Sprintf("Agentless mode, agent pod cpu limits, default is not set"))
-	cmd.Flags().StringVar(&opts.AgentPodResource.MemoryLimits, "agent-pod-memory-limits", "",
+	cmd.PersistentFlags().StringVar(&opts.AgentPodResource.MemoryLimits, "agent-pod-memory-limits", "",
 		fmt.Sprintf("Agentless mode, agent pod memory limits, default is not set"))
-	cmd.Flags().BoolVarP(&opts.IsLxcfsEnabled, enableLxcsFlag, "", true,
+	cmd.PersistentFlags().BoolVar(&opts.AgentReuse, agentReuseFlag, false,
+		"Agentless mode, keep the agent pod running after the session and reuse it in the following sessions on the same node, default to false")
+	cmd.PersistentFlags().DurationVar(&opts.AgentIdleTTL, "agent-idle-ttl", 0,
+		fmt.Sprintf("Agentless mode, how long a reusable agent pod keeps running after the last session, default to %v", defaultAgentIdleTTL))
+	cmd.PersistentFlags().StringArrayVar(&opts.AgentTolerations, "agent-toleration", []string{},
+		"Agentless mode, toleration of the agent pod in the form key[=value][:effect], '*' tolerates everything, default to tolerate everything")
+	cmd.PersistentFlags().StringVar(&opts.AgentPriorityClassName, "agent-priority-class", "",
+		"Agentless mode, priority class name of the agent pod, default is not set")
+	cmd.PersistentFlags().StringVar(&opts.AgentServiceAccountName, "agent-service-account", "",
+		"Agentless mode, service account name of the agent pod, default is not set")
+	cmd.PersistentFlags().StringToStringVar(&opts.AgentPodLabels, "agent-labels", map[string]string{},
+		"Agentless mode, extra labels of the agent pod, default is not set")
+	cmd.PersistentFlags().StringToStringVar(&opts.AgentPodAnnotations, "agent-annotations", map[string]string{},
+		"Agentless mode, extra annotations of the agent pod, default is not set")
+	cmd.PersistentFlags().StringVar(&opts.AgentPodTemplate, "agent-pod-template", "",
+		"Agentless mode, file of a pod template merged into the generated agent pod, default is not set")
+	cmd.PersistentFlags().DurationVar(&opts.LaunchTimeout, "launch-timeout", 0,
+		fmt.Sprintf("How long to wait for the agent pod or the forked pod to run, default to %v", defaultLaunchTimeout))
+	cmd.PersistentFlags().StringVar(&opts.Attach, "attach", "",
+		"Reattach to the debug session of the attach token printed at its start, kept by the agent for a grace period after a disconnect")
+	cmd.PersistentFlags().StringVar(&opts.Join, "join", "",
+		"Join the debug session of the join token printed at its start as a read-only observer, the session must have been started with --shareable")
+	cmd.PersistentFlags().BoolVar(&opts.JoinWrite, "join-write", false,
+		"Join the debug session with write access, the owner of the session must have started it with --share-write")
+	cmd.PersistentFlags().BoolVar(&opts.ShareWrite, "share-write", false,
+		"Share the debug session and allow the users joining it to write to it")
+	cmd.PersistentFlags().BoolVar(&opts.Shareable, "shareable", false,
+		"Share the debug session, the others join it read-only with the join token printed at its start")
+	cmd.PersistentFlags().StringVar(&opts.ProfileName, "profile", "",
+		"Name of the debug profile of the config file setting the image, command and settings of the debug container")
+	cmd.PersistentFlags().StringVar(&opts.DetachKeys, "detach-keys", "",
+		fmt.Sprintf("Key sequence to detach from the debug session, default to %s", defaultDetachKeys))
+	cmd.PersistentFlags().BoolVarP(&opts.IsLxcfsEnabled, enableLxcsFlag, "", true,
 		fmt.Sprintf("Enable Lxcfs, the target container can use its proc files, default to %t", defaultLxcfsEnable))
-	cmd.Flags().IntVarP(&opts.Verbosity, "verbosity ", "v", 0,
+	cmd.PersistentFlags().IntVarP(&opts.Verbosity, "verbosity ", "v", 0,
 		fmt.Sprintf("Set logging verbosity, default to %d", defaultVerbosity))
-	opts.Flags.AddFlags(cmd.Flags())
-
+	opts.Flags.AddFlags(cmd.PersistentFlags())
+
+	cmd.AddCommand(newCopyCmd(opts))
+	cmd.AddCommand(newCaptureCmd(opts))
+	cmd.AddCommand(newPortForwardCmd(opts))
+	cmd.AddCommand(newCollectCmd(opts))
+	cmd.AddCommand(newProfileCmd(opts))
+	cmd.AddCommand(newConfigCmd(opts))
+	cmd.AddCommand(newDoctorCmd(opts))
 	return cmd
 }
 
 // Complete populate default values from KUBECONFIG file
 func (o *DebugOptions) Complete(cmd *cobra.Command, args []string, argsLenAtDash int) error {
 	o.Args = args
-	if len(args) == 0 {
+	if len(args) == 0 && len(o.Selector) < 1 && len(o.PodName) < 1 {
 		return cmdutil.UsageErrorf(cmd, usageError)
 	}
 
@@ -274,27 +461,65 @@ func (o *DebugOptions) Complete(cmd *cobra.Command, args []string, argsLenAtDash
 		return err
 	}
 
-	o.PodName = args[0]
-
-	// read defaults from config file
-	configFile := o.ConfigLocation
-	if len(o.ConfigLocation) < 1 {
-		usr, err := user.Current()
-		if err == nil {
-			configFile = usr.HomeDir + filepath.FromSlash(defaultConfigLocation)
+	// the pods selected by label are looked up in Run, all the arguments are the command
+	podArgs := 1
+	switch {
+	case len(o.Selector) > 0:
+		// the arguments before -- would be the pod, the command must follow --
+		if len(o.PodName) > 0 || argsLenAtDash > 0 || (argsLenAtDash < 0 && len(args) > 0) {
+			return cmdutil.UsageErrorf(cmd, "a pod can't be specified together with --selector, pass the command after --")
 		}
+		podArgs = 0
+	case len(o.PodName) > 0:
+		// the pod is given with --pod
+		podArgs = 0
+	default:
+		o.PodName = args[0]
 	}
+
+	// read defaults from config file
+	configFile := o.configFile()
 	config, err := LoadFile(configFile)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			// TODO: support verbosity level
-			fmt.Fprintf(o.ErrOut, "error parsing configuration file: %v", err)
+			return fmt.Errorf("error parsing configuration file %s: %v, run kubectl debug config validate for details", configFile, err)
 		}
 		config = &Config{}
 	}
+	contextName, err := currentContext(configLoader, o.Flags)
+	if err != nil {
+		return err
+	}
+	// the sections of the active context and namespace override the global settings
+	if err := config.applyOverrides(contextName, o.Namespace); err != nil {
+		return err
+	}
+
+	// the debug profile overrides the config file, the default profile is only
+	// used in the contexts and namespaces it is restricted to
+	profileName := o.ProfileName
+	if len(profileName) < 1 {
+		profileName = config.Profile
+	}
+	if len(profileName) > 0 {
+		profile, err := config.profile(profileName, contextName, o.Namespace)
+		// the default profile is skipped out of its contexts and namespaces, an invalid one fails
+		if _, restricted := err.(*profileRestrictedError); err != nil && (len(o.ProfileName) > 0 || !restricted) {
+			return err
+		}
+		if err == nil {
+			config = config.withProfile(profile)
+			o.ProfileName = profileName
+			o.Env = profile.Env
+			o.Mounts = profile.Mounts
+			o.SecurityProfile = profile.SecurityProfile
+			o.CpuLimits = profile.CpuLimits
+			o.MemoryLimits = profile.MemoryLimits
+		}
+	}
 
 	// combine defaults, config file and user parameters
-	o.Command = args[1:]
+	o.Command = args[podArgs:]
 	if len(o.Command) < 1 {
 		if len(config.Command) > 0 {
 			o.Command = config.Command
@@ -309,6 +534,13 @@ func (o *DebugOptions) Complete(cmd *cobra.Command, args []string, argsLenAtDash
 			o.Image = defaultImage
 		}
 	}
+	if len(o.ImagePullPolicy) < 1 {
+		if len(config.ImagePullPolicy) > 0 {
+			o.ImagePullPolicy = config.ImagePullPolicy
+		} else {
+			o.ImagePullPolicy = defaultImagePullPolicy(o.Image)
+		}
+	}
 	if len(o.RegistrySecretName) < 1 {
 		if len(config.RegistrySecretName) > 0 {
 			o.RegistrySecretName = config.RegistrySecretName
@@ -330,9 +562,43 @@ func (o *DebugOptions) Complete(cmd *cobra.Command, args []string, argsLenAtDash
 			o.RegistrySkipTLSVerify = defaultRegistrySkipTLSVerify
 		}
 	}
-	if len(o.ForkPodRetainLabels) < 1 {
-		if len(config.ForkPodRetainLabels) > 0 {
-			o.ForkPodRetainLabels = config.ForkPodRetainLabels
+	if !cmd.Flag(registryUsePodSecretsFlag).Changed {
+		o.RegistryUsePodSecrets = config.RegistryUsePodSecrets
+	}
+	// the fork settings of the config file only apply to the forked pods, while the
+	// fork flags without --fork are rejected by Validate
+	for _, name := range forkOverrideFlags {
+		if cmd.Flag(name).Changed {
+			o.forkFlags = append(o.forkFlags, "--"+name)
+		}
+	}
+	if o.Fork {
+		if len(o.ForkPodRetainLabels) < 1 {
+			if len(config.ForkPodRetainLabels) > 0 {
+				o.ForkPodRetainLabels = config.ForkPodRetainLabels
+			}
+		}
+		if len(o.ForkPodNodeSelector) < 1 {
+			if len(config.ForkPodNodeSelector) > 0 {
+				o.ForkPodNodeSelector = config.ForkPodNodeSelector
+			}
+		}
+		if len(o.ForkPodEnv) < 1 {
+			if len(config.ForkPodEnv) > 0 {
+				o.ForkPodEnv = config.ForkPodEnv
+			}
+		}
+		if len(o.ForkPodResource.CpuRequests) < 1 {
+			o.ForkPodResource.CpuRequests = config.ForkPodCpuRequests
+		}
+		if len(o.ForkPodResource.MemoryRequests) < 1 {
+			o.ForkPodResource.MemoryRequests = config.ForkPodMemoryRequests
+		}
+		if len(o.ForkPodResource.CpuLimits) < 1 {
+			o.ForkPodResource.CpuLimits = config.ForkPodCpuLimits
+		}
+		if len(o.ForkPodResource.MemoryLimits) < 1 {
+			o.ForkPodResource.MemoryLimits = config.ForkPodMemoryLimits
 		}
 	}
 	if o.AgentPort < 1 {
@@ -438,6 +704,65 @@ func (o *DebugOptions) Complete(cmd *cobra.Command, args []string, argsLenAtDash
 		}
 	}
 
+	if len(o.AgentTolerations) > 0 {
+		o.agentTolerations, err = parseTolerations(o.AgentTolerations)
+		if err != nil {
+			return err
+		}
+	} else if len(config.AgentTolerations) > 0 {
+		o.agentTolerations = toCoreTolerations(config.AgentTolerations)
+	} else {
+		o.agentTolerations = defaultAgentTolerations
+	}
+
+	if len(o.AgentPriorityClassName) < 1 {
+		o.AgentPriorityClassName = config.AgentPriorityClassName
+	}
+
+	if len(o.AgentServiceAccountName) < 1 {
+		o.AgentServiceAccountName = config.AgentServiceAccountName
+	}
+
+	if len(o.AgentPodLabels) < 1 {
+		o.AgentPodLabels = config.AgentPodLabels
+	}
+
+	if len(o.AgentPodAnnotations) < 1 {
+		o.AgentPodAnnotations = config.AgentPodAnnotations
+	}
+
+	if len(o.AgentPodTemplate) < 1 {
+		o.AgentPodTemplate = config.AgentPodTemplate
+	}
+
+	if !cmd.Flag(agentReuseFlag).Changed {
+		o.AgentReuse = config.AgentReuse
+	}
+
+	if o.AgentIdleTTL <= 0 {
+		if config.AgentIdleTTL > 0 {
+			o.AgentIdleTTL = config.AgentIdleTTL
+		} else {
+			o.AgentIdleTTL = defaultAgentIdleTTL
+		}
+	}
+
+	if o.LaunchTimeout <= 0 {
+		if config.LaunchTimeout > 0 {
+			o.LaunchTimeout = config.LaunchTimeout
+		} else {
+			o.LaunchTimeout = defaultLaunchTimeout
+		}
+	}
+
+	if len(o.DetachKeys) < 1 {
+		if len(config.DetachKeys) > 0 {
+			o.DetachKeys = config.DetachKeys
+		} else {
+			o.DetachKeys = defaultDetachKeys
+		}
+	}
+
 	if !cmd.Flag(enableLxcsFlag).Changed {
 		o.IsLxcfsEnabled = config.IsLxcfsEnabled
 	}
@@ -450,6 +775,8 @@ func (o *DebugOptions) Complete(cmd *cobra.Command, args []string, argsLenAtDash
 		o.AgentLess = config.Agentless
 	}
 
+	o.Profilers = config.Profilers
+
 	o.Ports = []string{strconv.Itoa(o.AgentPort)}
 	o.Config, err = configLoader.ClientConfig()
 	if err != nil {
@@ -497,20 +824,93 @@ func (o *DebugOptions) Complete(cmd *cobra.Command, args []string, argsLenAtDash
 	return nil
 }
 
+// configFile returns the path of the config file, ~/.kube/debug-config by default
+func (o *DebugOptions) configFile() string {
+	if len(o.ConfigLocation) > 0 {
+		return o.ConfigLocation
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return usr.HomeDir + filepath.FromSlash(defaultConfigLocation)
+}
+
 // Validate validate
 func (o *DebugOptions) Validate() error {
-	if len(o.PodName) == 0 {
+	if len(o.PodName) == 0 && len(o.Selector) == 0 {
 		return fmt.Errorf("pod name must be specified")
 	}
+	if o.All {
+		if len(o.Selector) == 0 {
+			return fmt.Errorf("--all can only be used together with --selector")
+		}
+		if o.Fork || o.joinsSession() {
+			return fmt.Errorf("--all can't be used with --fork, --attach or --join")
+		}
+		if o.Parallel < 1 {
+			return fmt.Errorf("--parallel must be at least 1")
+		}
+		if len(o.Args) < 1 {
+			return fmt.Errorf("--all requires a command, e.g. kubectl debug -l app=api --all -- ss -s")
+		}
+	} else if len(o.OutputDir) > 0 {
+		return fmt.Errorf("--output-dir can only be used together with --all")
+	}
 	if len(o.Command) == 0 {
 		return fmt.Errorf("you must specify at least one command for the container")
 	}
+	switch corev1.PullPolicy(o.ImagePullPolicy) {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		return fmt.Errorf("invalid image pull policy %q, must be one of %s, %s, %s",
+			o.ImagePullPolicy, corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever)
+	}
+	if !o.Fork && len(o.forkFlags) > 0 {
+		return fmt.Errorf("%s can only be used together with --fork", strings.Join(o.forkFlags, ", "))
+	}
+	if len(o.ForkPodNodeName) > 0 && len(o.ForkPodNodeSelector) > 0 {
+		return fmt.Errorf("--fork-node and --fork-node-selector are mutually exclusive")
+	}
+	if _, err := parseEnvVars(o.ForkPodEnv); err != nil {
+		return err
+	}
+	if _, err := dockerterm.ToBytes(o.DetachKeys); err != nil {
+		return fmt.Errorf("invalid detach keys %q: %v", o.DetachKeys, err)
+	}
+	if len(o.Attach) > 0 && len(o.Join) > 0 {
+		return fmt.Errorf("--attach and --join are mutually exclusive")
+	}
+	if o.JoinWrite && len(o.Join) < 1 {
+		return fmt.Errorf("--join-write can only be used together with --join")
+	}
+	if len(o.Join) > 0 && o.Fork {
+		return fmt.Errorf("--join can not be used together with --fork, join the forked pod instead")
+	}
+	if len(o.Attach) > 0 {
+		if o.Fork {
+			return fmt.Errorf("--attach can not be used together with --fork, the forked pod is deleted with its session")
+		}
+		if o.AgentLess && !o.AgentReuse {
+			return fmt.Errorf("--attach requires the agent to outlive the session, use --agent-reuse or --agentless=false")
+		}
+	}
 	return nil
 }
 
 // TODO: refactor Run() spaghetti code
 // Run run
 func (o *DebugOptions) Run() error {
+	if len(o.Selector) > 0 {
+		if o.All {
+			return o.runAll()
+		}
+		podName, err := o.selectPod()
+		if err != nil {
+			return err
+		}
+		o.PodName = podName
+	}
 	pod, err := o.CoreClient.Pods(o.Namespace).Get(o.PodName, v1.GetOptions{})
 	if err != nil {
 		return err
@@ -528,43 +928,48 @@ func (o *DebugOptions) Run() error {
 	if err != nil {
 		return err
 	}
-	// Launch debug launching pod in agentless mode.
-	var agentPod *corev1.Pod
-	if o.AgentLess {
-		o.AgentPodNode = pod.Spec.NodeName
-		o.AgentPodName = fmt.Sprintf("%s-%s", o.AgentPodName, uuid.NewUUID())
-		agentPod = o.getAgentPod()
-		agentPod, err = o.launchPod(agentPod)
-		if err != nil {
-			fmt.Fprintf(o.Out, "the agentPod is not running, you should check the reason and delete the failed agentPod and retry.\n")
-			return err
-		}
-	}
-
 	// in fork mode, we launch an new pod as a copy of target pod
 	// and hack the entry point of the target container with sleep command
 	// which keeps the container running.
+	// The forked pod may be scheduled to another node, so it is launched
+	// before the agent pod.
 	if o.Fork {
 		// build the fork pod labels
 		podLabels := o.buildForkPodLabels(pod)
 		// copy pod and run
 		pod = copyAndStripPod(pod, containerName, podLabels)
+		if err = o.applyForkOverrides(pod, containerName); err != nil {
+			return err
+		}
+		if pod.Namespace != o.Namespace {
+			if err = o.auth(pod); err != nil {
+				return err
+			}
+		}
 		pod, err = o.launchPod(pod)
 		if err != nil {
 			fmt.Fprintf(o.Out, "the ForkedPod is not running, you should check the reason and delete the failed ForkedPod and retry\n")
-			o.deleteAgent(agentPod)
 			return err
 		}
 	}
 
+	// Launch debug launching pod in agentless mode.
+	agentPod, err := o.launchAgent(pod)
+	if err != nil {
+		o.deleteForkedPod(pod)
+		return err
+	}
+
 	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
 		o.deleteAgent(agentPod)
+		o.deleteForkedPod(pod)
 		return fmt.Errorf("cannot debug in a completed pod; current phase is %s", pod.Status.Phase)
 	}
 
 	containerID, err := o.getContainerIDByName(pod, containerName)
 	if err != nil {
 		o.deleteAgent(agentPod)
+		o.deleteForkedPod(pod)
 		return err
 	}
 
@@ -578,110 +983,60 @@ func (o *DebugOptions) Run() error {
 		// o.ErrOut = nil
 	}
 
-	if o.PortForward {
-		var agent *corev1.Pod
-		if !o.AgentLess {
-			// Agent is running
-			if o.Verbosity > 0 {
-				o.Logger.Printf("Fetching daemonset '%v' from namespace %v\r\n", o.DebugAgentDaemonSet, o.DebugAgentNamespace)
-			}
-			daemonSet, err := o.KubeCli.AppsV1().DaemonSets(o.DebugAgentNamespace).Get(o.DebugAgentDaemonSet, v1.GetOptions{})
-			if err != nil {
-				return err
-			}
-			labelSet := labels.Set(daemonSet.Spec.Selector.MatchLabels)
-			agents, err := o.CoreClient.Pods(o.DebugAgentNamespace).List(v1.ListOptions{
-				LabelSelector: labelSet.String(),
-			})
-			if err != nil {
-				return err
-			}
-			for i := range agents.Items {
-				if agents.Items[i].Spec.NodeName == pod.Spec.NodeName {
-					agent = &agents.Items[i]
-					break
-				}
-			}
-		} else {
-			agent = agentPod
-		}
-
-		if agent == nil {
-			return fmt.Errorf("there is no agent pod in the same node with your specified pod %s", o.PodName)
-		}
-		if o.Verbosity > 0 {
-			fmt.Fprintf(o.Out, "pod %s PodIP %s, agentPodIP %s\n", o.PodName, pod.Status.PodIP, agent.Status.HostIP)
-		}
-		err = o.runPortForward(agent)
-		if err != nil {
-			o.deleteAgent(agentPod)
-			return err
-		}
-		// client can't access the node ip in the k8s cluster sometimes,
-		// than we use forward ports to connect the specified pod and that will listen
-		// on specified ports in localhost, the ports can not access until receive the
-		// ready signal
-		if o.Verbosity > 0 {
-			fmt.Fprintln(o.Out, "wait for forward port to debug agent ready...")
-		}
-		<-o.ReadyChannel
+	if agentPod, err = o.forwardAgentPort(pod, agentPod); err != nil {
+		o.deleteAgent(agentPod)
+		o.deleteForkedPod(pod)
+		return err
 	}
 
 	fn := func() error {
-		// TODO: refactor as kubernetes api style, reuse rbac mechanism of kubernetes
-		var targetHost string
-		if o.PortForward {
-			targetHost = "localhost"
-		} else {
-			targetHost = pod.Status.HostIP
-		}
-		uri, err := url.Parse(fmt.Sprintf("http://%s:%d", targetHost, o.AgentPort))
-		if err != nil {
+		if err := o.checkAgent(pod); err != nil {
 			return err
 		}
-		uri.Path = fmt.Sprintf("/api/v1/debug")
-		params := url.Values{}
-		params.Add("image", o.Image)
-		params.Add("container", containerID)
-		params.Add("verbosity", fmt.Sprintf("%v", o.Verbosity))
-		hstNm, _ := os.Hostname()
-		params.Add("hostname", hstNm)
-		params.Add("username", o.UserName)
-		if o.IsLxcfsEnabled {
-			params.Add("lxcfsEnabled", "true")
-		} else {
-			params.Add("lxcfsEnabled", "false")
+		r := o.newDebugRequest(containerID, true)
+		// the session can be reattached only if the agent outlives this client
+		reattachable := (!o.AgentLess || o.AgentReuse) && o.agentSupports("reattach")
+		if reattachable {
+			r.Session.Reattachable = true
 		}
-		if o.RegistrySkipTLSVerify {
-			params.Add("registrySkipTLS", "true")
-		} else {
-			params.Add("registrySkipTLS", "false")
+		if reattachable || len(o.Join) > 0 {
+			r.Session.DetachKeys = o.DetachKeys
 		}
-		var authStr string
-		registrySecret, err := o.CoreClient.Secrets(o.RegistrySecretNamespace).Get(o.RegistrySecretName, v1.GetOptions{})
-		if err != nil {
-			if errors.IsNotFound(err) {
-				if o.Verbosity > 0 {
-					o.Logger.Printf("Secret %v not found in namespace %v\r\n", o.RegistrySecretName, o.RegistrySecretNamespace)
+		if o.joinsSession() {
+			if len(o.Attach) > 0 {
+				if err := o.requireAgentFeatures("reattach"); err != nil {
+					return err
 				}
-				authStr = ""
+				r.Session.Attach = o.Attach
 			} else {
-				return err
+				if err := o.requireAgentFeatures("share"); err != nil {
+					return err
+				}
+				r.Session.Join = o.Join
+				r.Session.Write = o.JoinWrite
 			}
 		} else {
-			if o.Verbosity > 1 {
-				o.Logger.Printf("Found secret %v:%v\r\n", o.RegistrySecretNamespace, o.RegistrySecretName)
+			if o.ShareWrite {
+				if err := o.requireAgentFeatures("share"); err != nil {
+					return err
+				}
+				r.Session.ShareWrite = true
+			}
+			if o.Shareable {
+				if err := o.requireAgentFeatures("shareable"); err != nil {
+					return err
+				}
+				r.Session.Shareable = true
+			}
+			if err := o.setDebugContainer(r, pod); err != nil {
+				return err
 			}
-			authStr, _ = o.extractSecret(registrySecret.Data)
 		}
-		params.Add("authStr", authStr)
-		commandBytes, err := json.Marshal(o.Command)
+		uri, header, err := o.debugURL(pod, r)
 		if err != nil {
 			return err
 		}
-		params.Add("command", string(commandBytes))
-		uri.RawQuery = params.Encode()
-		return o.remoteExecute("POST", uri, o.Config, o.In, o.Out, o.ErrOut, t.Raw, sizeQueue)
+		return o.remoteExecute("POST", uri, header, o.Config, o.In, o.Out, o.ErrOut, t.Raw, sizeQueue)
 	}
 
 	// ensure forked pod is deleted on cancelation
@@ -689,11 +1044,7 @@ func (o *DebugOptions) Run() error {
 		return interrupt.Chain(nil, func() {
 			if o.Fork {
 				fmt.Fprintf(o.Out, "Start deleting forked pod %s \n\r", pod.Name)
-				err := o.CoreClient.Pods(pod.Namespace).Delete(pod.Name, v1.NewDeleteOptions(0))
-				if err != nil {
-					// we may leak pod here, but we have nothing to do except noticing the user
-					fmt.Fprintf(o.ErrOut, "failed to delete forked pod[Name:%s, Namespace:%s], consider manual deletion.\n\r", pod.Name, pod.Namespace)
-				}
+				o.deleteForkedPod(pod)
 			}
 
 			if o.PortForward {
@@ -703,7 +1054,7 @@ func (o *DebugOptions) Run() error {
 				}
 			}
 			// delete agent pod
-			if o.AgentLess && agentPod != nil {
+			if o.AgentLess && !o.AgentReuse && !o.joinsSession() && agentPod != nil {
 				fmt.Fprintf(o.Out, "Start deleting agent pod %s \n\r", pod.Name)
 				o.deleteAgent(agentPod)
 			}
@@ -718,45 +1069,32 @@ func (o *DebugOptions) Run() error {
 	return nil
 }
 
-func (o *DebugOptions) extractSecret(scrtDta map[string][]byte) (string, error) {
-	var ret []byte
-	ret = scrtDta["authStr"]
-	if len(ret) == 0 {
-		// In IKS ( IBM Kubernetes ) the secret is stored in a json blob with the key '.dockerconfigjson'
-		// The json has the form
-		// {"auths":{"<REGISTRY FOR REGION>":{"username":"iamapikey","password":"<APIKEY>","email":"iamapikey","auth":"<APIKEY>"}}}
-		// Where <REGISTRY FOR REGION> would be one of the public domain names values here
-		// https://cloud.ibm.com/docs/Registry?topic=registry-registry_overview#registry_regions_local
-		// e.g. us.icr.io
-		ret = scrtDta[".dockerconfigjson"]
-		if len(ret) == 0 {
-			return "", nil
-		} else if o.Verbosity > 0 {
-			o.Logger.Printf("Found secret with key .dockerconfigjson\r\n")
-		}
-
-		var dta map[string]interface{}
-		if err := json.Unmarshal(ret, &dta); err != nil {
-			o.Logger.Printf("Failed to parse .dockerconfigjson value: %v\r\n", err)
-			return "", err
-		} else {
-			dta = dta["auths"].(map[string]interface{})
-			// Under auths there will be a value stored with the region key.  e.g. "us.icr.io"
-			for _, v := range dta {
-				dta = v.(map[string]interface{})
-				break
-			}
-			sret := dta["auth"].(string)
-			ret, err = base64.StdEncoding.DecodeString(sret)
-			if err != nil {
-				o.Logger.Printf("Failed to base 64 decode auth value : %v\r\n", err)
-				return "", err
-			}
-		}
-	} else if o.Verbosity > 0 {
-		o.Logger.Println("Found secret with key authStr")
+// currentContext returns the name of the kubeconfig context in use
+func currentContext(configLoader clientcmd.ClientConfig, flags *genericclioptions.ConfigFlags) (string, error) {
+	if flags.Context != nil && len(*flags.Context) > 0 {
+		return *flags.Context, nil
+	}
+	rawConfig, err := configLoader.RawConfig()
+	if err != nil {
+		return "", err
+	}
+	return rawConfig.CurrentContext, nil
+}
+
+// defaultImagePullPolicy returns the default pull policy of kubernetes,
+// Always for the latest tag and IfNotPresent otherwise
+func defaultImagePullPolicy(image string) string {
+	if strings.Contains(image, "@") {
+		return string(corev1.PullIfNotPresent)
+	}
+	tag := "latest"
+	if i := strings.LastIndex(image, ":"); i >= 0 && !strings.Contains(image[i:], "/") {
+		tag = image[i+1:]
+	}
+	if tag == "latest" {
+		return string(corev1.PullAlways)
 	}
-	return string(ret), nil
+	return string(corev1.PullIfNotPresent)
 }
 
 func (o *DebugOptions) getContainerIDByName(pod *corev1.Pod, containerName string) (string, error) {
@@ -794,19 +1132,33 @@ func (o *DebugOptions) getContainerIDByName(pod *corev1.Pod, containerName strin
 func (o *DebugOptions) remoteExecute(
 	method string,
 	url *url.URL,
+	header http.Header,
 	config *restclient.Config,
 	stdin io.Reader,
 	stdout, stderr io.Writer,
 	tty bool,
 	terminalSizeQueue remotecommand.TerminalSizeQueue) error {
 
-	if o.Verbosity > 0 {
-		o.Logger.Printf("Creating SPDY executor %+v %+v %+v\r\n", config, method, url)
-	}
-	exec, err := remotecommand.NewSPDYExecutor(config, method, url)
-	if err != nil {
-		o.Logger.Printf("Error creating SPDY executor.\r\n")
-		return err
+	var exec remotecommand.Executor
+	// prefer websocket and fall back to SPDY for the agents or proxies rejecting the upgrade
+	wsExec, err := newWebSocketExecutor(url, header)
+	if err == nil {
+		if o.Verbosity > 0 {
+			o.Logger.Printf("Streaming over websocket protocol %s\r\n", wsExec.protocol)
+		}
+		exec = wsExec
+	} else {
+		if _, ok := err.(*upgradeRejectedError); !ok {
+			return err
+		}
+		if o.Verbosity > 0 {
+			o.Logger.Printf("Websocket unavailable (%v), creating SPDY executor %+v %+v %+v\r\n", err, config, method, url)
+		}
+		exec, err = newSPDYExecutor(config, method, url, header)
+		if err != nil {
+			o.Logger.Printf("Error creating SPDY executor.\r\n")
+			return err
+		}
 	}
 	if o.Verbosity > 0 {
 		o.Logger.Printf("Creating exec Stream\r\n")
@@ -820,6 +1172,33 @@ func (o *DebugOptions) remoteExecute(
 	})
 }
 
+// newSPDYExecutor returns a SPDY executor sending the header with the upgrade request
+func newSPDYExecutor(config *restclient.Config, method string, url *url.URL, header http.Header) (remotecommand.Executor, error) {
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > 0 {
+		transport = &headerRoundTripper{header: header, rt: transport}
+	}
+	return remotecommand.NewSPDYExecutorForTransports(transport, upgrader, method, url)
+}
+
+// headerRoundTripper adds the header to the requests
+type headerRoundTripper struct {
+	header http.Header
+	rt     http.RoundTripper
+}
+
+func (h *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.WithContext(req.Context())
+	req.Header = req.Header.Clone()
+	for key, values := range h.header {
+		req.Header[key] = values
+	}
+	return h.rt.RoundTrip(req)
+}
+
 func (o *DebugOptions) setupTTY() term.TTY {
 	t := term.TTY{
 		Out: o.Out,
@@ -861,9 +1240,9 @@ func copyAndStripPod(pod *corev1.Pod, targetContainer string, podLabels map[stri
 		ObjectMeta: *pod.ObjectMeta.DeepCopy(),
 		Spec:       *pod.Spec.DeepCopy(),
 	}
-	// Using original pod name + xid + debug ad copied pod name. To ensure a
+	// Using original pod name + random suffix + debug ad copied pod name. To ensure a
 	// valid pod name we truncate original pod name to keep the total chars <64
-	copied.Name = fmt.Sprintf("%.34s-%s-debug", pod.Name, xid.New().String())
+	copied.Name = fmt.Sprintf("%.34s-%s-debug", pod.Name, utilrand.String(20))
 	copied.Labels = podLabels
 	copied.Spec.RestartPolicy = corev1.RestartPolicyNever
 	for i, c := range copied.Spec.Containers {
@@ -884,6 +1263,87 @@ func copyAndStripPod(pod *corev1.Pod, targetContainer string, podLabels map[stri
 	return copied
 }
 
+// applyForkOverrides apply the namespace, node, env and resources overrides
+// specified by user to the copied pod
+func (o *DebugOptions) applyForkOverrides(copied *corev1.Pod, targetContainer string) error {
+	if len(o.ForkPodNamespace) > 0 && o.ForkPodNamespace != copied.Namespace {
+		fmt.Fprintf(o.ErrOut, "Forking pod into namespace %s, the configmaps, secrets and service account referenced by the pod must exist there.\n\r", o.ForkPodNamespace)
+		copied.Namespace = o.ForkPodNamespace
+	}
+	if len(o.ForkPodNodeName) > 0 {
+		copied.Spec.NodeName = o.ForkPodNodeName
+	} else if len(o.ForkPodNodeSelector) > 0 {
+		// let the scheduler pick a node matching the selector
+		copied.Spec.NodeName = ""
+		copied.Spec.NodeSelector = o.ForkPodNodeSelector
+	}
+
+	envVars, err := parseEnvVars(o.ForkPodEnv)
+	if err != nil {
+		return err
+	}
+	for i := range copied.Spec.Containers {
+		c := &copied.Spec.Containers[i]
+		if c.Name != targetContainer {
+			continue
+		}
+		c.Env = mergeEnvVars(c.Env, envVars)
+		if c.Resources.Requests == nil {
+			c.Resources.Requests = corev1.ResourceList{}
+		}
+		if c.Resources.Limits == nil {
+			c.Resources.Limits = corev1.ResourceList{}
+		}
+		requests, err := getResourceList(o.ForkPodResource.CpuRequests, o.ForkPodResource.MemoryRequests)
+		if err != nil {
+			return fmt.Errorf("invalid forked pod requests: %v", err)
+		}
+		for name, quantity := range requests {
+			c.Resources.Requests[name] = quantity
+		}
+		limits, err := getResourceList(o.ForkPodResource.CpuLimits, o.ForkPodResource.MemoryLimits)
+		if err != nil {
+			return fmt.Errorf("invalid forked pod limits: %v", err)
+		}
+		for name, quantity := range limits {
+			c.Resources.Limits[name] = quantity
+		}
+	}
+	return nil
+}
+
+// parseEnvVars parses environment variables in the form KEY=VALUE
+func parseEnvVars(envs []string) ([]corev1.EnvVar, error) {
+	var ret []corev1.EnvVar
+	for _, env := range envs {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 || len(parts[0]) < 1 {
+			return nil, fmt.Errorf("invalid environment variable %q, expected KEY=VALUE", env)
+		}
+		ret = append(ret, corev1.EnvVar{Name: parts[0], Value: parts[1]})
+	}
+	return ret, nil
+}
+
+// mergeEnvVars replace the existing environment variables with the same name
+// and append the others
+func mergeEnvVars(existing []corev1.EnvVar, overrides []corev1.EnvVar) []corev1.EnvVar {
+	for _, override := range overrides {
+		replaced := false
+		for i := range existing {
+			if existing[i].Name == override.Name {
+				existing[i] = override
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			existing = append(existing, override)
+		}
+	}
+	return existing
+}
+
 // launchPod launch given pod until it's running
 func (o *DebugOptions) launchPod(pod *corev1.Pod) (*corev1.Pod, error) {
 	pod, err := o.CoreClient.Pods(pod.Namespace).Create(pod)
@@ -895,13 +1355,18 @@ func (o *DebugOptions) launchPod(pod *corev1.Pod) (*corev1.Pod, error) {
 	if err != nil {
 		return nil, err
 	}
-	// FIXME: hard code -> config
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), o.LaunchTimeout)
 	defer cancel()
 	fmt.Fprintf(o.Out, "Waiting for pod %s to run...\n", pod.Name)
-	event, err := watch.UntilWithoutRetry(ctx, watcher, conditions.PodRunning)
+	go o.streamPodEvents(ctx, pod)
+	reporter := newPodProgressReporter(o.Out)
+	event, err := watch.UntilWithoutRetry(ctx, watcher, func(event watchapi.Event) (bool, error) {
+		reporter.report(event)
+		return conditions.PodRunning(event)
+	})
 	if err != nil {
 		fmt.Fprintf(o.ErrOut, "Error occurred while waiting for pod to run:  %v\n", err)
+		o.diagnosePodLaunch(pod)
 		return nil, err
 	}
 	pod = event.Object.(*corev1.Pod)
@@ -909,22 +1374,31 @@ func (o *DebugOptions) launchPod(pod *corev1.Pod) (*corev1.Pod, error) {
 }
 
 // getAgentPod construnct agentPod from agent pod template
-func (o *DebugOptions) getAgentPod() *corev1.Pod {
+func (o *DebugOptions) getAgentPod() (*corev1.Pod, error) {
 	prop := corev1.MountPropagationBidirectional
 	directoryCreate := corev1.HostPathDirectoryOrCreate
 	priveleged := true
+	resources, err := o.buildAgentResourceRequirements()
+	if err != nil {
+		return nil, err
+	}
 	agentPod := &corev1.Pod{
 		TypeMeta: v1.TypeMeta{
 			Kind:       "Pod",
 			APIVersion: "v1",
 		},
 		ObjectMeta: v1.ObjectMeta{
-			Name:      o.AgentPodName,
-			Namespace: o.AgentPodNamespace,
+			Name:        o.AgentPodName,
+			Namespace:   o.AgentPodNamespace,
+			Labels:      map[string]string{agentPodLabel: "true"},
+			Annotations: o.AgentPodAnnotations,
 		},
 		Spec: corev1.PodSpec{
-			HostPID:  true,
-			NodeName: o.AgentPodNode,
+			HostPID:            true,
+			NodeName:           o.AgentPodNode,
+			Tolerations:        o.agentTolerations,
+			PriorityClassName:  o.AgentPriorityClassName,
+			ServiceAccountName: o.AgentServiceAccountName,
 			ImagePullSecrets: []corev1.LocalObjectReference{
 				{
 					Name: o.AgentImagePullSecretName,
@@ -951,7 +1425,7 @@ func (o *DebugOptions) getAgentPod() *corev1.Pod {
 					SecurityContext: &corev1.SecurityContext{
 						Privileged: &priveleged,
 					},
-					Resources: o.buildAgentResourceRequirements(),
+					Resources: resources,
 					VolumeMounts: []corev1.VolumeMount{
 						{
 							Name:      "docker",
@@ -1043,8 +1517,260 @@ func (o *DebugOptions) getAgentPod() *corev1.Pod {
 			RestartPolicy: corev1.RestartPolicyNever,
 		},
 	}
-	fmt.Fprintf(o.Out, "Agent Pod info: [Name:%s, Namespace:%s, Image:%s, HostPort:%d, ContainerPort:%d]\n", agentPod.ObjectMeta.Name, agentPod.ObjectMeta.Namespace, agentPod.Spec.Containers[0].Image, agentPod.Spec.Containers[0].Ports[0].HostPort, agentPod.Spec.Containers[0].Ports[0].ContainerPort)
-	return agentPod
+	for k, v := range o.AgentPodLabels {
+		agentPod.Labels[k] = v
+	}
+	if len(validation.IsValidLabelValue(o.AgentPodNode)) == 0 {
+		agentPod.Labels[agentNodeLabel] = o.AgentPodNode
+	}
+	if o.AgentReuse {
+		agentPod.Labels[agentReusableLabel] = "true"
+		agentPod.Spec.Containers[0].Command = []string{"/start.sh"}
+		agentPod.Spec.Containers[0].Args = []string{fmt.Sprintf("--idle.timeout=%v", o.AgentIdleTTL)}
+	}
+	if len(o.AgentPodTemplate) > 0 {
+		var err error
+		agentPod, err = mergeAgentPodTemplate(agentPod, o.AgentPodTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.AgentReuse {
+		hash, err := agentPodSpecHash(&agentPod.Spec)
+		if err != nil {
+			return nil, err
+		}
+		agentPod.Labels[agentSpecHashLabel] = hash
+	}
+	return agentPod, nil
+}
+
+// joinsSession returns whether the command attaches to an existing debug session
+func (o *DebugOptions) joinsSession() bool {
+	return len(o.Attach) > 0 || len(o.Join) > 0
+}
+
+// findNodeAgentPod returns the running agent pod on the node of the target pod,
+// which holds the debug session to reattach to or to join
+func (o *DebugOptions) findNodeAgentPod() (*corev1.Pod, error) {
+	pods, err := o.CoreClient.Pods(o.AgentPodNamespace).List(v1.ListOptions{
+		LabelSelector: labels.Set{agentPodLabel: "true"}.String(),
+		FieldSelector: fields.Set{"spec.nodeName": o.AgentPodNode}.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		agentPod := &pods.Items[i]
+		if agentPod.DeletionTimestamp == nil && agentPod.Status.Phase == corev1.PodRunning {
+			return agentPod, nil
+		}
+	}
+	return nil, fmt.Errorf("there is no running agent pod on node %s, the debug session has ended", o.AgentPodNode)
+}
+
+// findReusableAgentPod returns a running reusable agent pod on the node of the
+// target pod with the spec of the agent pod, agent pods which are no longer
+// running are cleaned up on the way
+func (o *DebugOptions) findReusableAgentPod(agentPod *corev1.Pod) (*corev1.Pod, error) {
+	pods, err := o.CoreClient.Pods(o.AgentPodNamespace).List(v1.ListOptions{
+		LabelSelector: labels.Set{agentReusableLabel: "true"}.String(),
+		FieldSelector: fields.Set{"spec.nodeName": o.AgentPodNode}.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	hash := agentPod.Labels[agentSpecHashLabel]
+	var found *corev1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		switch {
+		case pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodPending:
+			continue
+		case !agentPodRunning(pod):
+			if o.Verbosity > 0 {
+				o.Logger.Printf("Deleting agent pod %s which is no longer running\r\n", pod.Name)
+			}
+			o.deleteReusableAgent(pod)
+		case found == nil && pod.Labels[agentSpecHashLabel] == hash:
+			found = pod
+		}
+	}
+	if found != nil {
+		fmt.Fprintf(o.Out, "Reusing agent pod %s on node %s\n", found.Name, found.Spec.NodeName)
+	}
+	return found, nil
+}
+
+// agentPodRunning returns whether the pod and its agent container are running
+func agentPodRunning(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Running == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteReusableAgent deletes a reusable agent pod which can't be reused
+func (o *DebugOptions) deleteReusableAgent(agentPod *corev1.Pod) {
+	err := o.CoreClient.Pods(agentPod.Namespace).Delete(agentPod.Name, v1.NewDeleteOptions(0))
+	if err != nil && !errors.IsNotFound(err) {
+		fmt.Fprintf(o.ErrOut, "failed to delete agent pod[Name:%s, Namespace: %s], consider manual deletion.\nerror msg: %v\n", agentPod.Name, agentPod.Namespace, err)
+	}
+}
+
+// launchAgent launches the agent pod on the node of the target pod in agentless mode,
+// or reuses a running one. It returns nil if the agent runs as a daemonset.
+func (o *DebugOptions) launchAgent(pod *corev1.Pod) (*corev1.Pod, error) {
+	if !o.AgentLess {
+		return nil, nil
+	}
+	o.AgentPodNode = pod.Spec.NodeName
+	if o.joinsSession() {
+		// the agent holding the session runs on the node already
+		return o.findNodeAgentPod()
+	}
+	agentPod, err := o.getAgentPod()
+	if err != nil {
+		return nil, err
+	}
+	if o.AgentReuse {
+		found, err := o.findReusableAgentPod(agentPod)
+		if err != nil {
+			return nil, err
+		}
+		if found != nil {
+			o.agentReused = true
+			return found, nil
+		}
+	}
+	return o.createAgent(agentPod)
+}
+
+// createAgent creates the agent pod under a new name and waits for it to run
+func (o *DebugOptions) createAgent(agentPod *corev1.Pod) (*corev1.Pod, error) {
+	agentPod.Name = fmt.Sprintf("%s-%s", o.AgentPodName, uuid.NewUUID())
+	// the template may leave the agent container without ports
+	if ports := agentPod.Spec.Containers[0].Ports; len(ports) > 0 {
+		fmt.Fprintf(o.Out, "Agent Pod info: [Name:%s, Namespace:%s, Image:%s, HostPort:%d, ContainerPort:%d]\n", agentPod.ObjectMeta.Name, agentPod.ObjectMeta.Namespace, agentPod.Spec.Containers[0].Image, ports[0].HostPort, ports[0].ContainerPort)
+	} else {
+		fmt.Fprintf(o.Out, "Agent Pod info: [Name:%s, Namespace:%s, Image:%s]\n", agentPod.ObjectMeta.Name, agentPod.ObjectMeta.Namespace, agentPod.Spec.Containers[0].Image)
+	}
+	o.agentReused = false
+	agentPod, err := o.launchPod(agentPod)
+	if err != nil {
+		fmt.Fprintf(o.Out, "the agentPod is not running, you should check the reason and delete the failed agentPod and retry.\n")
+		return nil, err
+	}
+	return agentPod, nil
+}
+
+// forwardAgentPort forwards the agent port to localhost in port-forward mode,
+// and waits for the forwarding to be ready. A reused agent pod may have exited
+// once idle since it was found, it is replaced by a new agent pod if the
+// forwarding fails, which is returned.
+func (o *DebugOptions) forwardAgentPort(pod, agentPod *corev1.Pod) (*corev1.Pod, error) {
+	if !o.PortForward {
+		return agentPod, nil
+	}
+	var agent *corev1.Pod
+	if !o.AgentLess {
+		// Agent is running
+		if o.Verbosity > 0 {
+			o.Logger.Printf("Fetching daemonset '%v' from namespace %v\r\n", o.DebugAgentDaemonSet, o.DebugAgentNamespace)
+		}
+		daemonSet, err := o.KubeCli.AppsV1().DaemonSets(o.DebugAgentNamespace).Get(o.DebugAgentDaemonSet, v1.GetOptions{})
+		if err != nil {
+			return agentPod, err
+		}
+		labelSet := labels.Set(daemonSet.Spec.Selector.MatchLabels)
+		agents, err := o.CoreClient.Pods(o.DebugAgentNamespace).List(v1.ListOptions{
+			LabelSelector: labelSet.String(),
+		})
+		if err != nil {
+			return agentPod, err
+		}
+		for i := range agents.Items {
+			if agents.Items[i].Spec.NodeName == pod.Spec.NodeName {
+				agent = &agents.Items[i]
+				break
+			}
+		}
+	} else {
+		agent = agentPod
+	}
+
+	if agent == nil {
+		return agentPod, fmt.Errorf("there is no agent pod in the same node with your specified pod %s", pod.Name)
+	}
+	if o.Verbosity > 0 {
+		fmt.Fprintf(o.Out, "pod %s PodIP %s, agentPodIP %s\n", pod.Name, pod.Status.PodIP, agent.Status.HostIP)
+	}
+	if o.AgentLess && o.agentReused && !agentPodRunning(agent) {
+		return o.replaceReusedAgent(pod, agent, fmt.Errorf("pod is %s", agent.Status.Phase))
+	}
+	if err := o.runPortForward(agent); err != nil {
+		return agentPod, err
+	}
+	// client can't access the node ip in the k8s cluster sometimes,
+	// than we use forward ports to connect the specified pod and that will listen
+	// on specified ports in localhost, the ports can not access until receive the
+	// ready signal
+	if o.Verbosity > 0 {
+		fmt.Fprintln(o.Out, "wait for forward port to debug agent ready...")
+	}
+	<-o.ReadyChannel
+	if o.AgentLess && o.agentReused && o.agentForwardErr != nil {
+		return o.replaceReusedAgent(pod, agent, o.agentForwardErr)
+	}
+	if o.agentForward != nil {
+		if ports, err := o.agentForward.GetPorts(); err == nil && len(ports) > 0 {
+			o.agentLocalPort = int(ports[0].Local)
+		}
+	}
+	return agentPod, nil
+}
+
+// replaceReusedAgent deletes the reused agent pod which can't be forwarded to,
+// and forwards the port of a new agent pod instead
+func (o *DebugOptions) replaceReusedAgent(pod, agentPod *corev1.Pod, cause error) (*corev1.Pod, error) {
+	fmt.Fprintf(o.ErrOut, "warning: cannot forward the port of agent pod %s, creating a new one: %v\r\n", agentPod.Name, cause)
+	o.deleteReusableAgent(agentPod)
+	o.agentForwardErr = nil
+	template, err := o.getAgentPod()
+	if err != nil {
+		return nil, err
+	}
+	newPod, err := o.createAgent(template)
+	if err != nil {
+		return nil, err
+	}
+	return o.forwardAgentPort(pod, newPod)
+}
+
+// agentURL returns the url of the api path of the agent serving the pod
+func (o *DebugOptions) agentURL(pod *corev1.Pod, path string) (*url.URL, error) {
+	// TODO: refactor as kubernetes api style, reuse rbac mechanism of kubernetes
+	var targetHost string
+	port := o.AgentPort
+	if o.PortForward {
+		targetHost = "localhost"
+		if o.agentLocalPort > 0 {
+			port = o.agentLocalPort
+		}
+	} else {
+		targetHost = pod.Status.HostIP
+	}
+	uri, err := url.Parse(fmt.Sprintf("http://%s:%d", targetHost, port))
+	if err != nil {
+		return nil, err
+	}
+	uri.Path = path
+	return uri, nil
 }
 
 func (o *DebugOptions) runPortForward(pod *corev1.Pod) error {
@@ -1061,6 +1787,7 @@ func (o *DebugOptions) runPortForward(pod *corev1.Pod) error {
 			SubResource("portforward")
 		err := o.PortForwarder.ForwardPorts("POST", req.URL(), o)
 		if err != nil {
+			o.agentForwardErr = err
 			log.Printf("PortForwarded failed with %+v\r\n", err)
 			log.Printf("Sending ready signal just in case the failure reason is that the port is already forwarded.\r\n")
 			o.ReadyChannel <- struct{}{}
@@ -1091,6 +1818,7 @@ func (f *defaultPortForwarder) ForwardPorts(method string, url *url.URL, opts *D
 	if err != nil {
 		return err
 	}
+	opts.agentForward = fw
 	return fw.ForwardPorts()
 }
 
@@ -1129,8 +1857,10 @@ func (o *DebugOptions) auth(pod *corev1.Pod) error {
 
 // delete the agent pod
 func (o *DebugOptions) deleteAgent(agentPod *corev1.Pod) {
-	// only with agentless flag we can delete the agent pod
-	if !o.AgentLess {
+	// only with agentless flag we can delete the agent pod,
+	// a reusable agent pod exits by itself once idle, and
+	// the agent pod of a joined session belongs to its owner
+	if !o.AgentLess || o.AgentReuse || o.joinsSession() || agentPod == nil {
 		return
 	}
 	err := o.CoreClient.Pods(agentPod.Namespace).Delete(agentPod.Name, v1.NewDeleteOptions(0))
@@ -1139,26 +1869,49 @@ func (o *DebugOptions) deleteAgent(agentPod *corev1.Pod) {
 	}
 }
 
+// delete the forked pod
+func (o *DebugOptions) deleteForkedPod(pod *corev1.Pod) {
+	// only in fork mode the pod is created by us
+	if !o.Fork {
+		return
+	}
+	err := o.CoreClient.Pods(pod.Namespace).Delete(pod.Name, v1.NewDeleteOptions(0))
+	if err != nil {
+		// we may leak pod here, but we have nothing to do except noticing the user
+		fmt.Fprintf(o.ErrOut, "failed to delete forked pod[Name:%s, Namespace:%s], consider manual deletion.\n\r", pod.Name, pod.Namespace)
+	}
+}
+
 // build the agent pod Resource Requirements
-func (o *DebugOptions) buildAgentResourceRequirements() corev1.ResourceRequirements {
-	return getResourceRequirements(getResourceList(o.AgentPodResource.CpuRequests, o.AgentPodResource.MemoryRequests), getResourceList(o.AgentPodResource.CpuLimits, o.AgentPodResource.MemoryLimits))
+func (o *DebugOptions) buildAgentResourceRequirements() (corev1.ResourceRequirements, error) {
+	requests, err := getResourceList(o.AgentPodResource.CpuRequests, o.AgentPodResource.MemoryRequests)
+	if err != nil {
+		return corev1.ResourceRequirements{}, fmt.Errorf("invalid agent pod requests: %v", err)
+	}
+	limits, err := getResourceList(o.AgentPodResource.CpuLimits, o.AgentPodResource.MemoryLimits)
+	if err != nil {
+		return corev1.ResourceRequirements{}, fmt.Errorf("invalid agent pod limits: %v", err)
+	}
+	return getResourceRequirements(requests, limits), nil
 }
 
-func getResourceList(cpu, memory string) corev1.ResourceList {
-	// catch error in resource.MustParse
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Printf("Parse Resource list error: %v\n", err)
-		}
-	}()
+func getResourceList(cpu, memory string) (corev1.ResourceList, error) {
 	res := corev1.ResourceList{}
 	if cpu != "" {
-		res[corev1.ResourceCPU] = resource.MustParse(cpu)
+		quantity, err := resource.ParseQuantity(cpu)
+		if err != nil {
+			return nil, fmt.Errorf("cpu %q: %v", cpu, err)
+		}
+		res[corev1.ResourceCPU] = quantity
 	}
 	if memory != "" {
-		res[corev1.ResourceMemory] = resource.MustParse(memory)
+		quantity, err := resource.ParseQuantity(memory)
+		if err != nil {
+			return nil, fmt.Errorf("memory %q: %v", memory, err)
+		}
+		res[corev1.ResourceMemory] = quantity
 	}
-	return res
+	return res, nil
 }
 
 func getResourceRequirements(requests, limits corev1.ResourceList) corev1.ResourceRequirements {
@@ -0,0 +1,216 @@
+package plugin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+const testKubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: https://127.0.0.1:6443
+users:
+- name: alice
+  user:
+    token: secret
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: alice
+    namespace: default
+current-context: test
+`
+
+// completeTestOptions runs Complete and Validate on the command line with the debug config,
+// it returns the options and the error of Complete or Validate
+func completeTestOptions(t *testing.T, debugConfig string, args ...string) (*DebugOptions, error) {
+	dir, err := ioutil.TempDir("", "cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	kubeConfig := filepath.Join(dir, "kubeconfig")
+	configFile := filepath.Join(dir, "debug-config")
+	if err := ioutil.WriteFile(kubeConfig, []byte(testKubeConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(configFile, []byte(debugConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	opts := NewDebugOptions(genericclioptions.IOStreams{In: &bytes.Buffer{}, Out: &out, ErrOut: &out})
+	cmd := newDebugCmd(opts)
+	args = append([]string{"--kubeconfig", kubeConfig, "--debug-config", configFile}, args...)
+	if err := cmd.ParseFlags(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.Complete(cmd, cmd.Flags().Args(), cmd.Flags().ArgsLenAtDash()); err != nil {
+		return opts, err
+	}
+	return opts, opts.Validate()
+}
+
+func TestForkConfigDefaults(t *testing.T) {
+	const config = `forkPodNodeSelector:
+  pool: debug
+forkPodEnv: [DEBUG=1]
+forkCpuRequests: 100m
+forkMemoryLimits: 1Gi
+`
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+		wantEnv []string
+		wantCPU string
+	}{
+		{
+			name: "without --fork the defaults are not applied",
+			args: []string{"mypod"},
+		},
+		{
+			name:    "with --fork the defaults are applied",
+			args:    []string{"mypod", "--fork"},
+			wantEnv: []string{"DEBUG=1"},
+			wantCPU: "100m",
+		},
+		{
+			name:    "the flags override the defaults",
+			args:    []string{"mypod", "--fork", "--fork-env", "DEBUG=2", "--fork-cpu-requests", "1"},
+			wantEnv: []string{"DEBUG=2"},
+			wantCPU: "1",
+		},
+		{
+			name:    "the fork flags require --fork",
+			args:    []string{"mypod", "--fork-env", "DEBUG=2", "--fork-node", "node-1"},
+			wantErr: "--fork-node, --fork-env can only be used together with --fork",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := completeTestOptions(t, config, tt.args...)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(opts.ForkPodEnv, ",") != strings.Join(tt.wantEnv, ",") {
+				t.Errorf("ForkPodEnv = %v, want %v", opts.ForkPodEnv, tt.wantEnv)
+			}
+			if opts.ForkPodResource.CpuRequests != tt.wantCPU {
+				t.Errorf("CpuRequests = %q, want %q", opts.ForkPodResource.CpuRequests, tt.wantCPU)
+			}
+			if !opts.Fork && (len(opts.ForkPodNodeSelector) > 0 || len(opts.ForkPodResource.MemoryLimits) > 0) {
+				t.Errorf("the fork defaults are applied without --fork: %+v %v", opts.ForkPodResource, opts.ForkPodNodeSelector)
+			}
+		})
+	}
+}
+
+func TestPodArgument(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		wantPod     string
+		wantCommand []string
+		wantErr     string
+	}{
+		{
+			name:        "pod and command",
+			args:        []string{"mypod", "--", "sh", "-c", "ls"},
+			wantPod:     "mypod",
+			wantCommand: []string{"sh", "-c", "ls"},
+		},
+		{
+			name:        "pod named like a subcommand",
+			args:        []string{"--pod", "cp"},
+			wantPod:     "cp",
+			wantCommand: []string{"bash"},
+		},
+		{
+			name:        "all the arguments are the command with --pod",
+			args:        []string{"--pod", "doctor", "--", "sh", "-c", "ls"},
+			wantPod:     "doctor",
+			wantCommand: []string{"sh", "-c", "ls"},
+		},
+		{
+			name:    "--pod with --selector",
+			args:    []string{"--pod", "cp", "-l", "app=api"},
+			wantErr: "a pod can't be specified together with --selector",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the pod named like a subcommand is not routed to the subcommand
+			root := NewDebugCmd(genericclioptions.IOStreams{In: &bytes.Buffer{}, Out: &bytes.Buffer{}, ErrOut: &bytes.Buffer{}})
+			if found, _, err := root.Find(tt.args); err != nil || found != root {
+				t.Fatalf("%v is routed to %v, %v", tt.args, found.Name(), err)
+			}
+			opts, err := completeTestOptions(t, "", tt.args...)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.PodName != tt.wantPod || strings.Join(opts.Command, " ") != strings.Join(tt.wantCommand, " ") {
+				t.Errorf("pod %q command %q, want pod %q command %q", opts.PodName, opts.Command, tt.wantPod, tt.wantCommand)
+			}
+		})
+	}
+	root := NewDebugCmd(genericclioptions.IOStreams{In: &bytes.Buffer{}, Out: &bytes.Buffer{}, ErrOut: &bytes.Buffer{}})
+	if found, _, err := root.Find([]string{"cp", "mypod:/tmp/a", "a"}); err != nil || found.Name() != "cp" {
+		t.Errorf("the subcommand is routed to %v, %v", found.Name(), err)
+	}
+}
+
+func TestImagePullPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{name: "latest tag of the default image", want: "Always"},
+		{name: "versioned image", args: []string{"--image", "nicolaka/netshoot:v0.11"}, want: "IfNotPresent"},
+		{name: "untagged image of a registry with a port", args: []string{"--image", "harbor.internal:5000/netshoot"}, want: "Always"},
+		{name: "digest", args: []string{"--image", "busybox@sha256:" + strings.Repeat("a", 64)}, want: "IfNotPresent"},
+		{name: "config", config: "imagePullPolicy: Never\n", want: "Never"},
+		{name: "flag overrides the config", config: "imagePullPolicy: Never\n", args: []string{"--image-pull-policy", "Always"}, want: "Always"},
+		{name: "invalid", args: []string{"--image-pull-policy", "always"}, wantErr: `invalid image pull policy "always"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := completeTestOptions(t, tt.config, append(tt.args, "mypod")...)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.ImagePullPolicy != tt.want {
+				t.Errorf("image pull policy = %s, want %s", opts.ImagePullPolicy, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cmdutil "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	collectExample = `
+	# collect the diagnostic bundle of a pod
+	kubectl debug collect POD_NAME -o bundle.tar.gz
+
+	# only collect the processes, the sockets and the logs of a container
+	kubectl debug collect NAMESPACE/POD_NAME -c CONTAINER_NAME --collectors processes,sockets,logs
+`
+
+	defaultLogLines = 1000
+)
+
+var (
+	// localCollectors are read from the api server, the other collectors are run by the agent
+	localCollectors = []string{"pod", "node", "logs", "events"}
+
+	// the values of the environment variables matching are redacted, same as the agent
+	secretEnvPattern = regexp.MustCompile(`(?i)secret|passw|token|key|credential|auth|private|cookie|dsn`)
+)
+
+// collectOptions are the options of kubectl debug collect
+type collectOptions struct {
+	output     string
+	collectors []string
+	logLines   int64
+}
+
+func newCollectCmd(opts *DebugOptions) *cobra.Command {
+	collectOpts := &collectOptions{}
+	cmd := &cobra.Command{
+		Use:                   "collect [NAMESPACE/]POD [-o FILE]",
+		DisableFlagsInUseLine: true,
+		Short:                 "Collect a diagnostic bundle of a pod",
+		Long: `Collect a diagnostic bundle of a pod as a tar.gz, to attach to a bug report.
+
+The agent reads the processes, sockets, status, limits, environment (with the values of
+the secret looking variables redacted), cgroup stats, mounts and DNS resolution of the
+target container, and runs the collectors of its config. The pod (redacted the same way),
+node, events and the recent logs of the container are read from the api server. A failed
+collector, or agent, doesn't fail the bundle, its error is written in its file.`,
+		Example: collectExample,
+		Args:    cobra.ExactArgs(1),
+		Run: func(c *cobra.Command, args []string) {
+			cmdutil.CheckErr(opts.runCollect(c, args, collectOpts))
+		},
+	}
+	cmd.Flags().StringVarP(&collectOpts.output, "output", "o", "",
+		"The file to write the bundle to, defaults to POD-TIMESTAMP.tar.gz")
+	cmd.Flags().StringSliceVar(&collectOpts.collectors, "collectors", nil,
+		fmt.Sprintf("The collectors to run (comma separated), defaults to all of them. The local collectors are %s",
+			strings.Join(localCollectors, ", ")))
+	cmd.Flags().Int64Var(&collectOpts.logLines, "log-lines", defaultLogLines,
+		"The number of the latest log lines of the container to collect")
+	return cmd
+}
+
+func (o *DebugOptions) runCollect(cmd *cobra.Command, args []string, collectOpts *collectOptions) error {
+	if collectOpts.logLines < 1 {
+		return cmdutil.UsageErrorf(cmd, "--log-lines must be positive")
+	}
+	if err := o.completeTool(cmd, args[0]); err != nil {
+		return err
+	}
+
+	local := map[string]bool{}
+	for _, name := range localCollectors {
+		local[name] = len(collectOpts.collectors) < 1
+	}
+	var remote []string
+	for _, name := range collectOpts.collectors {
+		if _, ok := local[name]; ok {
+			local[name] = true
+		} else {
+			remote = append(remote, name)
+		}
+	}
+
+	params := url.Values{}
+	if len(remote) > 0 {
+		params.Set("collectors", strings.Join(remote, ","))
+	}
+	return o.runTool(func(target *toolTarget) error {
+		now := time.Now()
+		prefix := fmt.Sprintf("%s-%s", target.pod.Name, now.Format("20060102-150405"))
+		output := collectOpts.output
+		if len(output) < 1 {
+			output = prefix + ".tar.gz"
+		}
+
+		// a failed agent doesn't fail the bundle, the files it sent are kept
+		var agentFiles bytes.Buffer
+		var agentErr error
+		if len(remote) > 0 || len(collectOpts.collectors) < 1 {
+			agentErr = o.toolExecute(target, "/api/v1/collect", params, nil, &agentFiles)
+		}
+
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		gz := gzip.NewWriter(f)
+		tw := tar.NewWriter(gz)
+		add := func(name string, data []byte) error {
+			hdr := &tar.Header{Name: prefix + "/" + name, Mode: 0644, Size: int64(len(data)), ModTime: now}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := tw.Write(data)
+			return err
+		}
+
+		for _, name := range localCollectors {
+			if !local[name] {
+				continue
+			}
+			files, err := o.collectLocal(name, target, collectOpts.logLines)
+			if err != nil {
+				fmt.Fprintf(o.ErrOut, "collector %s failed: %v\r\n", name, err)
+				files = map[string][]byte{name + ".txt": []byte(fmt.Sprintf("collector failed: %v\n", err))}
+			}
+			var names []string
+			for file := range files {
+				names = append(names, file)
+			}
+			sort.Strings(names)
+			for _, file := range names {
+				if err := add(file, files[file]); err != nil {
+					return err
+				}
+			}
+		}
+
+		tr := tar.NewReader(&agentFiles)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				if agentErr == nil {
+					agentErr = fmt.Errorf("invalid bundle from the agent: %v", err)
+				}
+				break
+			}
+			var data bytes.Buffer
+			if _, err := io.Copy(&data, tr); err != nil {
+				if agentErr == nil {
+					agentErr = fmt.Errorf("invalid bundle from the agent: %v", err)
+				}
+				break
+			}
+			if err := add(hdr.Name, data.Bytes()); err != nil {
+				return err
+			}
+		}
+		if agentErr != nil {
+			fmt.Fprintf(o.ErrOut, "the collectors of the agent failed: %v\r\n", agentErr)
+			if err := add("agent.txt", []byte(fmt.Sprintf("collector failed: %v\n", agentErr))); err != nil {
+				return err
+			}
+		}
+
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintf(o.Out, "bundle written to %s\r\n", output)
+		return nil
+	})
+}
+
+// collectLocal runs a collector reading from the api server, it returns the files of the bundle
+func (o *DebugOptions) collectLocal(name string, target *toolTarget, logLines int64) (map[string][]byte, error) {
+	pod := target.pod
+	switch name {
+	case "pod":
+		data, err := yaml.Marshal(redactPod(pod))
+		return map[string][]byte{"pod.yaml": data}, err
+	case "node":
+		node, err := o.CoreClient.Nodes().Get(pod.Spec.NodeName, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		data, err := yaml.Marshal(node)
+		return map[string][]byte{"node.yaml": data}, err
+	case "events":
+		events, err := o.CoreClient.Events(pod.Namespace).List(v1.ListOptions{
+			FieldSelector: fmt.Sprintf("involvedObject.kind=Pod,involvedObject.name=%s", pod.Name),
+		})
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		for _, event := range events.Items {
+			fmt.Fprintf(&buf, "%s\t%s\t%s\tx%d\t%s\n", event.LastTimestamp.Format(time.RFC3339),
+				event.Type, event.Reason, event.Count, event.Message)
+		}
+		return map[string][]byte{"events.txt": buf.Bytes()}, nil
+	case "logs":
+		files := map[string][]byte{}
+		logOpts := &corev1.PodLogOptions{Container: target.containerName, TailLines: &logLines, Timestamps: true}
+		data, err := o.CoreClient.Pods(pod.Namespace).GetLogs(pod.Name, logOpts).Do().Raw()
+		if err != nil {
+			return nil, err
+		}
+		files["logs.txt"] = data
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name == target.containerName && status.RestartCount > 0 {
+				logOpts.Previous = true
+				data, err := o.CoreClient.Pods(pod.Namespace).GetLogs(pod.Name, logOpts).Do().Raw()
+				if err != nil {
+					data = []byte(fmt.Sprintf("collector failed: %v\n", err))
+				}
+				files["logs-previous.txt"] = data
+			}
+		}
+		return files, nil
+	}
+	return nil, fmt.Errorf("unknown collector %s", name)
+}
+
+// redactPod returns a copy of the pod with the values of the secret looking environment
+// variables redacted, and without the last applied configuration which holds them too
+func redactPod(pod *corev1.Pod) *corev1.Pod {
+	redacted := pod.DeepCopy()
+	if _, ok := redacted.Annotations[corev1.LastAppliedConfigAnnotation]; ok {
+		redacted.Annotations[corev1.LastAppliedConfigAnnotation] = "<redacted>"
+	}
+	redact := func(containers []corev1.Container) {
+		for i := range containers {
+			for j, env := range containers[i].Env {
+				if len(env.Value) > 0 && secretEnvPattern.MatchString(env.Name) {
+					containers[i].Env[j].Value = "<redacted>"
+				}
+			}
+		}
+	}
+	redact(redacted.Spec.InitContainers)
+	redact(redacted.Spec.Containers)
+	return redacted
+}
@@ -1,44 +1,126 @@
 package plugin
 
 import (
+	"fmt"
 	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
 
+	term "github.com/aylei/kubectl-debug/pkg/util"
+	dockerterm "github.com/docker/docker/pkg/term"
 	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 type Config struct {
-	AgentPort                int      `yaml:"agentPort,omitempty"`
-	Image                    string   `yaml:"image,omitempty"`
-	RegistrySecretName       string   `yaml:"registrySecretName,omitempty"`
-	RegistrySecretNamespace  string   `yaml:"registrySecretNamespace,omitempty"`
-	RegistrySkipTLSVerify    bool     `yaml:"registrySkipTLSVerify,omitempty"`
-	ForkPodRetainLabels      []string `yaml:"forkPodRetainLabels,omitempty"`
-	DebugAgentDaemonSet      string   `yaml:"debugAgentDaemonset,omitempty"`
-	DebugAgentNamespace      string   `yaml:"debugAgentNamespace,omitempty"`
-	Command                  []string `yaml:"command,omitempty"`
-	PortForward              bool     `yaml:"portForward,omitempty"`
-	Agentless                bool     `yaml:"agentless,omitempty"`
-	AgentPodNamePrefix       string   `yaml:"agentPodNamePrefix,omitempty"`
-	AgentPodNamespace        string   `yaml:"agentPodNamespace,omitempty"`
-	AgentImage               string   `yaml:"agentImage,omitempty"`
-	AgentImagePullPolicy     string   `yaml:"agentImagePullPolicy,omitempty"`
-	AgentImagePullSecretName string   `yaml:"agentImagePullSecretName,omitempty"`
-	AgentPodCpuRequests      string   `yaml:"agentCpuRequests,omitempty"`
-	AgentPodMemoryRequests   string   `yaml:"agentMemoryRequests,omitempty"`
-	AgentPodCpuLimits        string   `yaml:"agentCpuLimits,omitempty"`
-	AgentPodMemoryLimits     string   `yaml:"agentMemoryLimits,omitempty"`
-	IsLxcfsEnabled           bool     `yaml:"isLxcfsEnabled,omitempty"`
-	Verbosity                int      `yaml:"verbosity,omitempty"`
+	AgentPort                int               `yaml:"agentPort,omitempty"`
+	Image                    string            `yaml:"image,omitempty"`
+	ImagePullPolicy          string            `yaml:"imagePullPolicy,omitempty"`
+	RegistrySecretName       string            `yaml:"registrySecretName,omitempty"`
+	RegistrySecretNamespace  string            `yaml:"registrySecretNamespace,omitempty"`
+	RegistrySkipTLSVerify    bool              `yaml:"registrySkipTLSVerify,omitempty"`
+	RegistryUsePodSecrets    bool              `yaml:"registryUsePodSecrets,omitempty"`
+	ForkPodRetainLabels      []string          `yaml:"forkPodRetainLabels,omitempty"`
+	ForkPodNodeSelector      map[string]string `yaml:"forkPodNodeSelector,omitempty"`
+	ForkPodEnv               []string          `yaml:"forkPodEnv,omitempty"`
+	ForkPodCpuRequests       string            `yaml:"forkCpuRequests,omitempty"`
+	ForkPodMemoryRequests    string            `yaml:"forkMemoryRequests,omitempty"`
+	ForkPodCpuLimits         string            `yaml:"forkCpuLimits,omitempty"`
+	ForkPodMemoryLimits      string            `yaml:"forkMemoryLimits,omitempty"`
+	DebugAgentDaemonSet      string            `yaml:"debugAgentDaemonset,omitempty"`
+	DebugAgentNamespace      string            `yaml:"debugAgentNamespace,omitempty"`
+	Command                  []string          `yaml:"command,omitempty"`
+	PortForward              bool              `yaml:"portForward,omitempty"`
+	Agentless                bool              `yaml:"agentless,omitempty"`
+	AgentPodNamePrefix       string            `yaml:"agentPodNamePrefix,omitempty"`
+	AgentPodNamespace        string            `yaml:"agentPodNamespace,omitempty"`
+	AgentImage               string            `yaml:"agentImage,omitempty"`
+	AgentImagePullPolicy     string            `yaml:"agentImagePullPolicy,omitempty"`
+	AgentImagePullSecretName string            `yaml:"agentImagePullSecretName,omitempty"`
+	AgentPodCpuRequests      string            `yaml:"agentCpuRequests,omitempty"`
+	AgentPodMemoryRequests   string            `yaml:"agentMemoryRequests,omitempty"`
+	AgentPodCpuLimits        string            `yaml:"agentCpuLimits,omitempty"`
+	AgentPodMemoryLimits     string            `yaml:"agentMemoryLimits,omitempty"`
+	AgentReuse               bool              `yaml:"agentReuse,omitempty"`
+	AgentIdleTTL             time.Duration     `yaml:"agentIdleTTL,omitempty"`
+	AgentTolerations         []Toleration      `yaml:"agentTolerations,omitempty"`
+	AgentPriorityClassName   string            `yaml:"agentPriorityClassName,omitempty"`
+	AgentServiceAccountName  string            `yaml:"agentServiceAccountName,omitempty"`
+	AgentPodLabels           map[string]string `yaml:"agentLabels,omitempty"`
+	AgentPodAnnotations      map[string]string `yaml:"agentAnnotations,omitempty"`
+	AgentPodTemplate         string            `yaml:"agentPodTemplate,omitempty"`
+	IsLxcfsEnabled           bool              `yaml:"isLxcfsEnabled,omitempty"`
+	LaunchTimeout            time.Duration     `yaml:"launchTimeout,omitempty"`
+	DetachKeys               string            `yaml:"detachKeys,omitempty"`
+	Verbosity                int               `yaml:"verbosity,omitempty"`
+	// profiler definitions by language, merged over the builtin ones
+	Profilers map[string]ProfilerConfig `yaml:"profilers,omitempty"`
+	// named debug profiles selected with --profile, and the profile used by default
+	Profiles map[string]DebugProfile `yaml:"profiles,omitempty"`
+	Profile  string                  `yaml:"profile,omitempty"`
+	// sections of settings by kubeconfig context and by namespace, merged over the
+	// settings above when the context or the namespace is the active one
+	Contexts   map[string]yaml.MapSlice `yaml:"contexts,omitempty"`
+	Namespaces map[string]yaml.MapSlice `yaml:"namespaces,omitempty"`
 	// deprecated
 	AgentPortOld int `yaml:"agent_port,omitempty"`
 }
 
+// Toleration of the agent pod, see corev1.Toleration
+type Toleration struct {
+	Key               string `yaml:"key,omitempty"`
+	Operator          string `yaml:"operator,omitempty"`
+	Value             string `yaml:"value,omitempty"`
+	Effect            string `yaml:"effect,omitempty"`
+	TolerationSeconds *int64 `yaml:"tolerationSeconds,omitempty"`
+}
+
+// DebugProfile is a named set of debug container settings, the fields it sets
+// override the ones of the config file and are overridden by the flags
+type DebugProfile struct {
+	Image           string   `yaml:"image,omitempty"`
+	ImagePullPolicy string   `yaml:"imagePullPolicy,omitempty"`
+	Command         []string `yaml:"command,omitempty"`
+	IsLxcfsEnabled  *bool    `yaml:"isLxcfsEnabled,omitempty"`
+	// environment of the debug container, NAME=VALUE
+	Env []string `yaml:"env,omitempty"`
+	// paths of the node mounted into the debug container, they must be allowed by the agent
+	Mounts []Mount `yaml:"mounts,omitempty"`
+	// capabilities of the debug container: restricted, default, netadmin or sysadmin
+	SecurityProfile string `yaml:"securityProfile,omitempty"`
+	CpuLimits       string `yaml:"cpuLimits,omitempty"`
+	MemoryLimits    string `yaml:"memoryLimits,omitempty"`
+	// the kubeconfig contexts and namespaces the profile can be used in, any if not set
+	Contexts   []string `yaml:"contexts,omitempty"`
+	Namespaces []string `yaml:"namespaces,omitempty"`
+}
+
+// Mount is a bind mount of a path of the node into the debug container
+type Mount struct {
+	HostPath  string `yaml:"hostPath" json:"hostPath"`
+	MountPath string `yaml:"mountPath" json:"mountPath"`
+	ReadOnly  bool   `yaml:"readOnly,omitempty" json:"readOnly,omitempty"`
+}
+
+// ProfilerConfig defines how kubectl debug profile profiles a language, the command runs in
+// the debug container and writes the profile to stdout, KCTLDBG-TARGET-PID is replaced by
+// the pid of the target process and KCTLDBG-DURATION by the duration in seconds
+type ProfilerConfig struct {
+	Image   string   `yaml:"image,omitempty"`
+	Command []string `yaml:"command,omitempty"`
+	// extension of the default output file
+	Extension string `yaml:"extension,omitempty"`
+}
+
 func Load(s string) (*Config, error) {
 	cfg := &Config{}
 	cfg.Agentless = true
 	cfg.PortForward = true
 	cfg.IsLxcfsEnabled = true
-	err := yaml.Unmarshal([]byte(s), cfg)
+	// a misspelled key is an error rather than a silently ignored setting
+	err := yaml.UnmarshalStrict([]byte(s), cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -49,6 +131,256 @@ func Load(s string) (*Config, error) {
 	return cfg, nil
 }
 
+// applyOverrides merges the sections of the context and of the namespace over the
+// config, in this order. The keys set in a section override the ones of the config,
+// the maps are merged and the lists are replaced.
+func (c *Config) applyOverrides(context, namespace string) error {
+	sections := []struct {
+		key    string
+		values yaml.MapSlice
+	}{
+		{"contexts." + context, c.Contexts[context]},
+		{"namespaces." + namespace, c.Namespaces[namespace]},
+	}
+	c.Contexts, c.Namespaces = nil, nil
+	for _, section := range sections {
+		if len(section.values) < 1 {
+			continue
+		}
+		if err := overlay(c, section.values); err != nil {
+			return fmt.Errorf("error in %s of the configuration file: %v", section.key, err)
+		}
+	}
+	return nil
+}
+
+// overlay decodes the section over the config, the keys are checked on an empty
+// config since a strict decoding rejects the keys already set in the maps
+func overlay(c *Config, section yaml.MapSlice) error {
+	content, err := yaml.Marshal(section)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(content, &Config{}); err != nil {
+		// the lines are the ones of the section, not of the file
+		var messages []string
+		for _, problem := range term.YAMLProblems(err) {
+			messages = append(messages, problem.Message)
+		}
+		return fmt.Errorf("%s", strings.Join(messages, ", "))
+	}
+	if err := yaml.Unmarshal(content, c); err != nil {
+		return err
+	}
+	if c.Contexts != nil || c.Namespaces != nil {
+		return fmt.Errorf("the contexts and namespaces sections can't be nested")
+	}
+	if c.AgentPort == 0 {
+		c.AgentPort = c.AgentPortOld
+	}
+	return nil
+}
+
+// profileRestrictedError is returned for a debug profile restricted to other contexts or namespaces
+type profileRestrictedError struct {
+	name, kind, value string
+}
+
+func (e *profileRestrictedError) Error() string {
+	return fmt.Sprintf("debug profile %s can't be used in the %s %s", e.name, e.kind, e.value)
+}
+
+// profile returns the named debug profile, checking that it is valid and that it can be
+// used in the context and namespace
+func (c *Config) profile(name, context, namespace string) (*DebugProfile, error) {
+	profile, ok := c.Profiles[name]
+	if !ok {
+		var names []string
+		for n := range c.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("debug profile %s not found in the config file, the profiles are [%s]", name, strings.Join(names, ", "))
+	}
+	for field, value := range map[string]string{"cpuLimits": profile.CpuLimits, "memoryLimits": profile.MemoryLimits} {
+		if len(value) > 0 {
+			if _, err := resource.ParseQuantity(value); err != nil {
+				return nil, fmt.Errorf("invalid %s of debug profile %s: %v", field, name, err)
+			}
+		}
+	}
+	for _, env := range profile.Env {
+		if !strings.Contains(env, "=") {
+			return nil, fmt.Errorf("invalid env %s of debug profile %s, expect NAME=VALUE", env, name)
+		}
+	}
+	if len(profile.Contexts) > 0 && !containsString(profile.Contexts, context) {
+		return nil, &profileRestrictedError{name: name, kind: "context", value: context}
+	}
+	if len(profile.Namespaces) > 0 && !containsString(profile.Namespaces, namespace) {
+		return nil, &profileRestrictedError{name: name, kind: "namespace", value: namespace}
+	}
+	return &profile, nil
+}
+
+// withProfile returns a copy of the config with the fields set by the profile
+func (c *Config) withProfile(profile *DebugProfile) *Config {
+	config := *c
+	if len(profile.Image) > 0 {
+		config.Image = profile.Image
+	}
+	if len(profile.ImagePullPolicy) > 0 {
+		config.ImagePullPolicy = profile.ImagePullPolicy
+	}
+	if len(profile.Command) > 0 {
+		config.Command = profile.Command
+	}
+	if profile.IsLxcfsEnabled != nil {
+		config.IsLxcfsEnabled = *profile.IsLxcfsEnabled
+	}
+	return &config
+}
+
+// ValidateConfig checks a config file, the problems are reported with their line when it is known
+func ValidateConfig(content []byte) []term.ConfigProblem {
+	cfg := &Config{}
+	var problems []term.ConfigProblem
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		problems = append(problems, term.YAMLProblems(err)...)
+	}
+	lines := term.YAMLKeyLines(content)
+	report := func(key, format string, args ...interface{}) {
+		problems = append(problems, term.ConfigProblem{
+			Line:    lines.Line(key),
+			Message: key + ": " + fmt.Sprintf(format, args...),
+		})
+	}
+	cfg.validate("", report)
+	if len(cfg.Profile) > 0 {
+		if _, ok := cfg.Profiles[cfg.Profile]; !ok {
+			report("profile", "debug profile %s is not defined in profiles", cfg.Profile)
+		}
+	}
+
+	// the sections are checked on their own, their default profile may be defined globally
+	checkSections := func(kind string, sections map[string]yaml.MapSlice) {
+		for name, values := range sections {
+			key := kind + "." + name
+			section := &Config{}
+			// the other keys are still decoded on an error
+			if err := overlay(section, values); err != nil {
+				report(key, "%v", err)
+			}
+			section.validate(key+".", report)
+			if len(section.Profile) > 0 {
+				_, global := cfg.Profiles[section.Profile]
+				if _, ok := section.Profiles[section.Profile]; !ok && !global {
+					report(key+".profile", "debug profile %s is not defined in profiles", section.Profile)
+				}
+			}
+		}
+	}
+	checkSections("contexts", cfg.Contexts)
+	checkSections("namespaces", cfg.Namespaces)
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	return problems
+}
+
+// validate checks the values of the config, the keys are reported with the prefix
+func (c *Config) validate(prefix string, report func(key, format string, args ...interface{})) {
+	checkQuantity := func(key, value string) {
+		if len(value) > 0 {
+			if _, err := resource.ParseQuantity(value); err != nil {
+				report(key, "invalid quantity %q", value)
+			}
+		}
+	}
+	checkPullPolicy := func(key, value string) {
+		switch corev1.PullPolicy(value) {
+		case "", corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+		default:
+			report(key, "invalid pull policy %q, expect %s, %s or %s", value,
+				corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever)
+		}
+	}
+	checkPort := func(key string, port int) {
+		if port < 0 || port > 65535 {
+			report(key, "invalid port %d", port)
+		}
+	}
+
+	checkPort(prefix+"agentPort", c.AgentPort)
+	checkPort(prefix+"agent_port", c.AgentPortOld)
+	if c.AgentPort > 0 && c.AgentPortOld > 0 && c.AgentPort != c.AgentPortOld {
+		report(prefix+"agent_port", "conflicts with agentPort %d, remove the deprecated agent_port", c.AgentPort)
+	}
+	checkPullPolicy(prefix+"imagePullPolicy", c.ImagePullPolicy)
+	checkPullPolicy(prefix+"agentImagePullPolicy", c.AgentImagePullPolicy)
+	checkQuantity(prefix+"agentCpuRequests", c.AgentPodCpuRequests)
+	checkQuantity(prefix+"agentMemoryRequests", c.AgentPodMemoryRequests)
+	checkQuantity(prefix+"agentCpuLimits", c.AgentPodCpuLimits)
+	checkQuantity(prefix+"agentMemoryLimits", c.AgentPodMemoryLimits)
+	checkQuantity(prefix+"forkCpuRequests", c.ForkPodCpuRequests)
+	checkQuantity(prefix+"forkMemoryRequests", c.ForkPodMemoryRequests)
+	checkQuantity(prefix+"forkCpuLimits", c.ForkPodCpuLimits)
+	checkQuantity(prefix+"forkMemoryLimits", c.ForkPodMemoryLimits)
+	for i, env := range c.ForkPodEnv {
+		if parts := strings.SplitN(env, "=", 2); len(parts) != 2 || len(parts[0]) < 1 {
+			report(prefix+fmt.Sprintf("forkPodEnv[%d]", i), "invalid environment variable %q, expect KEY=VALUE", env)
+		}
+	}
+	for i, toleration := range c.AgentTolerations {
+		switch corev1.TolerationOperator(toleration.Operator) {
+		case "", corev1.TolerationOpExists, corev1.TolerationOpEqual:
+		default:
+			report(prefix+fmt.Sprintf("agentTolerations[%d].operator", i), "invalid operator %q", toleration.Operator)
+		}
+	}
+	if len(c.DetachKeys) > 0 {
+		if _, err := dockerterm.ToBytes(c.DetachKeys); err != nil {
+			report(prefix+"detachKeys", "%v", err)
+		}
+	}
+
+	for name, profile := range c.Profiles {
+		key := prefix + "profiles." + name
+		checkPullPolicy(key+".imagePullPolicy", profile.ImagePullPolicy)
+		checkQuantity(key+".cpuLimits", profile.CpuLimits)
+		checkQuantity(key+".memoryLimits", profile.MemoryLimits)
+		switch profile.SecurityProfile {
+		case "", "restricted", "default", "netadmin", "sysadmin":
+		default:
+			report(key+".securityProfile", "unknown security profile %q, expect restricted, default, netadmin or sysadmin",
+				profile.SecurityProfile)
+		}
+		for i, env := range profile.Env {
+			if !strings.Contains(env, "=") {
+				report(fmt.Sprintf("%s.env[%d]", key, i), "invalid environment variable %q, expect KEY=VALUE", env)
+			}
+		}
+		for i, mount := range profile.Mounts {
+			if !strings.HasPrefix(mount.HostPath, "/") || !strings.HasPrefix(mount.MountPath, "/") {
+				report(fmt.Sprintf("%s.mounts[%d]", key, i), "the hostPath and mountPath must be absolute")
+			}
+		}
+	}
+	for lang, profiler := range c.Profilers {
+		if _, ok := builtinProfilers[lang]; !ok && len(profiler.Command) < 1 {
+			report(prefix+"profilers."+lang, "the profiler of a new language must have a command")
+		}
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func LoadFile(filename string) (*Config, error) {
 	c, err := ioutil.ReadFile(filename)
 	if err != nil {
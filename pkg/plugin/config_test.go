@@ -0,0 +1,266 @@
+package plugin
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testProfilesConfig = `image: nicolaka/netshoot:latest
+profile: netdebug
+profiles:
+  netdebug:
+    image: nicolaka/netshoot:v0.11
+    command: [tcpdump, -i, any]
+    env: [DEBUG=1]
+    mounts:
+    - hostPath: /var/log
+      mountPath: /host/log
+      readOnly: true
+    securityProfile: netadmin
+    cpuLimits: 500m
+    namespaces: [prod]
+  sysadmin:
+    securityProfile: sysadmin
+    contexts: [admin]
+  badcpu:
+    cpuLimits: lots
+  badenv:
+    env: [DEBUG]
+`
+
+func TestConfigProfile(t *testing.T) {
+	config, err := Load(testProfilesConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		context        string
+		namespace      string
+		wantErr        string
+		wantRestricted bool
+	}{
+		{name: "netdebug", context: "test", namespace: "prod"},
+		{name: "netdebug", context: "test", namespace: "default", wantErr: "debug profile netdebug can't be used in the namespace default", wantRestricted: true},
+		{name: "sysadmin", context: "admin", namespace: "default"},
+		{name: "sysadmin", context: "test", namespace: "default", wantErr: "debug profile sysadmin can't be used in the context test", wantRestricted: true},
+		{name: "badcpu", wantErr: "invalid cpuLimits of debug profile badcpu"},
+		{name: "badenv", wantErr: "invalid env DEBUG of debug profile badenv, expect NAME=VALUE"},
+		{name: "missing", wantErr: "the profiles are [badcpu, badenv, netdebug, sysadmin]"},
+	}
+	for _, tt := range tests {
+		profile, err := config.profile(tt.name, tt.context, tt.namespace)
+		if len(tt.wantErr) < 1 {
+			if err != nil || profile == nil {
+				t.Errorf("profile(%s, %s, %s) = %v, %v", tt.name, tt.context, tt.namespace, profile, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("profile(%s, %s, %s) error = %v, want %q", tt.name, tt.context, tt.namespace, err, tt.wantErr)
+		}
+		if _, restricted := err.(*profileRestrictedError); restricted != tt.wantRestricted {
+			t.Errorf("profile(%s, %s, %s) error = %v is restricted %v, want %v", tt.name, tt.context, tt.namespace, err, restricted, tt.wantRestricted)
+		}
+	}
+}
+
+func TestDefaultProfile(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		wantErr      string
+		wantProfile  string
+		wantImage    string
+		wantCommand  string
+		wantSecurity string
+		wantEnv      string
+		wantCPU      string
+		wantMount    bool
+	}{
+		{
+			name:        "default profile skipped out of its namespaces",
+			args:        []string{"mypod"},
+			wantImage:   "nicolaka/netshoot:latest",
+			wantCommand: "bash",
+		},
+		{
+			name:         "default profile in its namespace",
+			args:         []string{"-n", "prod", "mypod"},
+			wantProfile:  "netdebug",
+			wantImage:    "nicolaka/netshoot:v0.11",
+			wantCommand:  "tcpdump -i any",
+			wantSecurity: "netadmin",
+			wantEnv:      "DEBUG=1",
+			wantCPU:      "500m",
+			wantMount:    true,
+		},
+		{
+			name:         "flags override the profile",
+			args:         []string{"-n", "prod", "--image", "busybox:1.36", "mypod", "--", "sh"},
+			wantProfile:  "netdebug",
+			wantImage:    "busybox:1.36",
+			wantCommand:  "sh",
+			wantSecurity: "netadmin",
+			wantEnv:      "DEBUG=1",
+			wantCPU:      "500m",
+		},
+		{
+			name:    "explicit profile out of its namespaces",
+			args:    []string{"--profile", "netdebug", "mypod"},
+			wantErr: "debug profile netdebug can't be used in the namespace default",
+		},
+		{
+			name:    "invalid explicit profile",
+			args:    []string{"--profile", "badenv", "mypod"},
+			wantErr: "invalid env DEBUG of debug profile badenv",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := completeTestOptions(t, testProfilesConfig, tt.args...)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.ProfileName != tt.wantProfile || opts.Image != tt.wantImage || strings.Join(opts.Command, " ") != tt.wantCommand {
+				t.Errorf("profile %q image %q command %q, want %q %q %q",
+					opts.ProfileName, opts.Image, opts.Command, tt.wantProfile, tt.wantImage, tt.wantCommand)
+			}
+			if opts.SecurityProfile != tt.wantSecurity || strings.Join(opts.Env, ",") != tt.wantEnv || opts.CpuLimits != tt.wantCPU {
+				t.Errorf("security profile %q env %q cpu %q, want %q %q %q",
+					opts.SecurityProfile, opts.Env, opts.CpuLimits, tt.wantSecurity, tt.wantEnv, tt.wantCPU)
+			}
+			if tt.wantMount && (len(opts.Mounts) != 1 || !opts.Mounts[0].ReadOnly || opts.Mounts[0].MountPath != "/host/log") {
+				t.Errorf("mounts = %+v, want /var/log read only", opts.Mounts)
+			}
+		})
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	const content = `image: nicolaka/netshoot:latest
+agentPort: 10027
+forkPodNodeSelector:
+  pool: default
+  zone: eu-1
+forkPodEnv: [A=1, B=2]
+contexts:
+  prod:
+    image: registry.internal/netshoot:latest
+    forkPodNodeSelector:
+      pool: debug
+    forkPodEnv: [C=3]
+    agent_port: 10030
+  broken:
+    imagePullPolcy: Always
+  nested:
+    namespaces:
+      default:
+        image: busybox
+namespaces:
+  kube-system:
+    image: registry.internal/netshoot:system
+`
+	tests := []struct {
+		name         string
+		context      string
+		namespace    string
+		wantImage    string
+		wantSelector map[string]string
+		wantEnv      string
+		wantPort     int
+		wantErr      string
+	}{
+		{
+			name:         "no section",
+			context:      "dev",
+			namespace:    "default",
+			wantImage:    "nicolaka/netshoot:latest",
+			wantSelector: map[string]string{"pool": "default", "zone": "eu-1"},
+			wantEnv:      "A=1,B=2",
+			wantPort:     10027,
+		},
+		{
+			name:         "context section",
+			context:      "prod",
+			namespace:    "default",
+			wantImage:    "registry.internal/netshoot:latest",
+			wantSelector: map[string]string{"pool": "debug", "zone": "eu-1"},
+			wantEnv:      "C=3",
+			wantPort:     10027,
+		},
+		{
+			name:         "namespace section over the context section",
+			context:      "prod",
+			namespace:    "kube-system",
+			wantImage:    "registry.internal/netshoot:system",
+			wantSelector: map[string]string{"pool": "debug", "zone": "eu-1"},
+			wantEnv:      "C=3",
+			wantPort:     10027,
+		},
+		{name: "unknown key", context: "broken", wantErr: "error in contexts.broken of the configuration file"},
+		{name: "nested sections", context: "nested", wantErr: "can't be nested"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := Load(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = config.applyOverrides(tt.context, tt.namespace)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("applyOverrides() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Image != tt.wantImage || strings.Join(config.ForkPodEnv, ",") != tt.wantEnv || config.AgentPort != tt.wantPort {
+				t.Errorf("image %q env %q port %d, want %q %q %d", config.Image, config.ForkPodEnv, config.AgentPort, tt.wantImage, tt.wantEnv, tt.wantPort)
+			}
+			if !reflect.DeepEqual(config.ForkPodNodeSelector, tt.wantSelector) {
+				t.Errorf("node selector = %v, want %v", config.ForkPodNodeSelector, tt.wantSelector)
+			}
+			if config.Contexts != nil || config.Namespaces != nil {
+				t.Errorf("the sections are kept after they are applied")
+			}
+		})
+	}
+}
+
+func TestConfigOverridesComplete(t *testing.T) {
+	const content = `image: nicolaka/netshoot:latest
+contexts:
+  test:
+    image: registry.internal/netshoot:latest
+namespaces:
+  kube-system:
+    image: registry.internal/netshoot:system
+`
+	tests := []struct {
+		args      []string
+		wantImage string
+	}{
+		{args: []string{"mypod"}, wantImage: "registry.internal/netshoot:latest"},
+		{args: []string{"-n", "kube-system", "mypod"}, wantImage: "registry.internal/netshoot:system"},
+		{args: []string{"-n", "kube-system", "--image", "busybox:1.36", "mypod"}, wantImage: "busybox:1.36"},
+	}
+	for _, tt := range tests {
+		opts, err := completeTestOptions(t, content, tt.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.Image != tt.wantImage {
+			t.Errorf("%v: image = %s, want %s", tt.args, opts.Image, tt.wantImage)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+	cmdutil "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+)
+
+const configValidateExample = `
+	# validate ~/.kube/debug-config, or the file of --debug-config
+	kubectl debug config validate
+
+	# validate another config file
+	kubectl debug config validate ./debug-config
+`
+
+func newConfigCmd(opts *DebugOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manage the config file of kubectl debug",
+		Args:  cobra.NoArgs,
+		Run: func(c *cobra.Command, args []string) {
+			c.Help()
+		},
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "validate [FILE]",
+		Short: "Validate the config file",
+		Long: `Validate the config file, ~/.kube/debug-config by default. The unknown keys, the invalid
+values, e.g. quantities, pull policies and ports, and the conflicting settings are
+reported with their line.`,
+		Example: configValidateExample,
+		Args:    cobra.MaximumNArgs(1),
+		Run: func(c *cobra.Command, args []string) {
+			cmdutil.CheckErr(opts.runConfigValidate(args))
+		},
+	})
+	return cmd
+}
+
+func (o *DebugOptions) runConfigValidate(args []string) error {
+	file := o.configFile()
+	if len(args) > 0 {
+		file = args[0]
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	problems := ValidateConfig(content)
+	for _, problem := range problems {
+		fmt.Fprintf(o.Out, "%s: %s\n", file, problem)
+	}
+	if len(problems) == 1 {
+		return fmt.Errorf("1 problem found in %s", file)
+	}
+	if len(problems) > 1 {
+		return fmt.Errorf("%d problems found in %s", len(problems), file)
+	}
+	fmt.Fprintf(o.Out, "%s is valid\n", file)
+	return nil
+}
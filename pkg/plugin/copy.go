@@ -0,0 +1,265 @@
+package plugin
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	cmdutil "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+)
+
+const copyExample = `
+	# copy a heap dump out of the target container
+	kubectl debug cp POD_NAME:/tmp/heap.hprof ./heap.hprof
+
+	# copy a directory into a container of a pod in another namespace
+	kubectl debug cp ./bin NAMESPACE/POD_NAME:/tmp/bin -c CONTAINER_NAME
+`
+
+func newCopyCmd(opts *DebugOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:                   "cp [NAMESPACE/]POD:PATH LOCAL_PATH | LOCAL_PATH [NAMESPACE/]POD:PATH",
+		DisableFlagsInUseLine: true,
+		Short:                 "Copy files from or into a container, the container doesn't need tar",
+		Long: `Copy files from or into a container of a pod. The agent reads and writes the filesystem of
+the container from the node, so the container image doesn't need tar or a shell.
+A directory is copied into an existing local or remote directory, the other paths are
+copied to the destination path. The ownership of the files is not kept: the files copied
+into the container are created as root and an overwritten file keeps its owner, the files
+copied out belong to the local user.`,
+		Example: copyExample,
+		Args:    cobra.ExactArgs(2),
+		Run: func(c *cobra.Command, args []string) {
+			cmdutil.CheckErr(opts.runCopy(c, args))
+		},
+	}
+}
+
+// parseRemotePath parses [NAMESPACE/]POD:PATH, local paths containing a colon
+// must be prefixed with ./
+func parseRemotePath(arg string) (pod, path string, ok bool) {
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) != 2 || len(parts[0]) < 1 || strings.HasPrefix(arg, ".") || strings.HasPrefix(arg, "/") {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func (o *DebugOptions) runCopy(cmd *cobra.Command, args []string) error {
+	srcPod, srcPath, download := parseRemotePath(args[0])
+	dstPod, dstPath, upload := parseRemotePath(args[1])
+	if download == upload {
+		return cmdutil.UsageErrorf(cmd, "one of the paths must be a path in a pod, POD:PATH")
+	}
+	pod, remotePath, localPath := srcPod, srcPath, args[1]
+	if upload {
+		pod, remotePath, localPath = dstPod, dstPath, args[0]
+	}
+	if !path.IsAbs(remotePath) {
+		return fmt.Errorf("the path in the pod must be absolute, got %s", remotePath)
+	}
+	if err := o.completeTool(cmd, pod); err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("path", remotePath)
+	return o.runTool(func(target *toolTarget) error {
+		reader, writer := io.Pipe()
+		result := make(chan error, 1)
+		if download {
+			params.Set("direction", "download")
+			go func() {
+				err := extractLocal(localPath, reader)
+				reader.CloseWithError(err)
+				result <- err
+			}()
+			err := o.toolExecute(target, "/api/v1/cp", params, nil, writer)
+			writer.CloseWithError(err)
+			if extractErr := <-result; err == nil {
+				err = extractErr
+			}
+			return err
+		}
+		params.Set("direction", "upload")
+		go func() {
+			err := archiveLocal(localPath, writer)
+			writer.CloseWithError(err)
+			result <- err
+		}()
+		err := o.toolExecute(target, "/api/v1/cp", params, reader, o.Out)
+		reader.CloseWithError(err)
+		if archiveErr := <-result; archiveErr != nil && archiveErr != io.ErrClosedPipe {
+			return archiveErr
+		}
+		return err
+	})
+}
+
+// archiveLocal writes the local path as a tar stream, the entries are named
+// after the base name of the path and symlinks are archived as is
+func archiveLocal(src string, out io.Writer) error {
+	src = filepath.Clean(src)
+	if _, err := os.Lstat(src); err != nil {
+		return err
+	}
+	base := filepath.Base(src)
+	tw := tar.NewWriter(out)
+	err := filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		var link string
+		switch {
+		case fi.Mode().IsRegular(), fi.IsDir():
+		case fi.Mode()&os.ModeSymlink != 0:
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(filepath.Join(base, rel))
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(tw, f, hdr.Size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// extractLocal extracts the tar stream to the local path, into it if it is a directory.
+// The entries are not written through the symlinks of the archive.
+func extractLocal(dst string, in io.Reader) error {
+	dst = filepath.Clean(dst)
+	into := false
+	if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+		into = true
+	}
+	root := dst
+	if !into {
+		root = filepath.Dir(dst)
+	}
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(entry) || entry == ".." || strings.HasPrefix(entry, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid archive entry %s", hdr.Name)
+		}
+		target := filepath.Join(dst, entry)
+		if !into {
+			parts := strings.SplitN(entry, string(filepath.Separator), 2)
+			target = dst
+			if len(parts) == 2 {
+				target = filepath.Join(dst, parts[1])
+			}
+		}
+		if err := checkNoSymlink(root, filepath.Dir(target)); err != nil {
+			return err
+		}
+		if err := extractLocalEntry(tr, hdr, target); err != nil {
+			return err
+		}
+	}
+}
+
+// checkNoSymlink checks that no directory between root and dir is a symlink
+func checkNoSymlink(root, dir string) error {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return err
+	}
+	current := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		current = filepath.Join(current, part)
+		fi, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to extract through the symlink %s", current)
+		}
+	}
+	return nil
+}
+
+func extractLocalEntry(tr *tar.Reader, hdr *tar.Header, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	mode := os.FileMode(hdr.Mode).Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, mode|0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Symlink(hdr.Linkname, target)
+	default:
+		return errors.New("unsupported archive entry " + hdr.Name)
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testEntry struct {
+	name, content, link string
+}
+
+func testArchive(t *testing.T, entries []testEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.content))}
+		switch {
+		case len(e.link) > 0:
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.link, 0
+		case e.name[len(e.name)-1] == '/':
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractLocal(t *testing.T) {
+	tests := []struct {
+		name    string
+		dst     string
+		entries []testEntry
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "file to a new path",
+			dst:     "new.txt",
+			entries: []testEntry{{name: "a.txt", content: "a"}},
+			want:    map[string]string{"new.txt": "a"},
+		},
+		{
+			name:    "file into a directory",
+			dst:     ".",
+			entries: []testEntry{{name: "a.txt", content: "a"}},
+			want:    map[string]string{"a.txt": "a"},
+		},
+		{
+			name:    "directory renamed",
+			dst:     "out",
+			entries: []testEntry{{name: "dir/"}, {name: "dir/sub/b.txt", content: "b"}},
+			want:    map[string]string{"out/sub/b.txt": "b"},
+		},
+		{
+			name:    "parent entry",
+			dst:     ".",
+			entries: []testEntry{{name: "../escape.txt", content: "x"}},
+			wantErr: true,
+		},
+		{
+			name:    "absolute entry",
+			dst:     ".",
+			entries: []testEntry{{name: "/escape.txt", content: "x"}},
+			wantErr: true,
+		},
+		{
+			name:    "entry through a symlink of the archive",
+			dst:     ".",
+			entries: []testEntry{{name: "dir/"}, {name: "dir/link", link: "../.."}, {name: "dir/link/escape.txt", content: "x"}},
+			wantErr: true,
+		},
+		{
+			name:    "symlink replaced by a file",
+			dst:     ".",
+			entries: []testEntry{{name: "link", link: "../outside.txt"}, {name: "link", content: "x"}},
+			want:    map[string]string{"link": "x"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent, err := ioutil.TempDir("", "extract")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(parent)
+			dir := filepath.Join(parent, "dst")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			err = extractLocal(filepath.Join(dir, tt.dst), testArchive(t, tt.entries))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("extractLocal succeeded, want an error")
+				}
+				if _, err := os.Lstat(filepath.Join(parent, "escape.txt")); err == nil {
+					t.Errorf("extractLocal wrote outside of the destination")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractLocal: %v", err)
+			}
+			for name, want := range tt.want {
+				got, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil || string(got) != want {
+					t.Errorf("%s = %q, %v, want %q", name, got, err, want)
+				}
+			}
+			if _, err := os.Lstat(filepath.Join(parent, "outside.txt")); err == nil {
+				t.Errorf("extractLocal wrote through a symlink")
+			}
+		})
+	}
+}
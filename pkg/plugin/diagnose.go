@@ -0,0 +1,191 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	watchapi "k8s.io/apimachinery/pkg/watch"
+)
+
+// container waiting reasons which mean the image can not be pulled
+var imagePullFailureReasons = map[string]bool{
+	"ErrImagePull":      true,
+	"ImagePullBackOff":  true,
+	"InvalidImageName":  true,
+	"ErrImageNeverPull": true,
+}
+
+// podProgressReporter prints the container waiting reasons of a launching pod
+// each time they change
+type podProgressReporter struct {
+	out     io.Writer
+	reasons map[string]string
+}
+
+func newPodProgressReporter(out io.Writer) *podProgressReporter {
+	return &podProgressReporter{
+		out:     out,
+		reasons: map[string]string{},
+	}
+}
+
+func (r *podProgressReporter) report(event watchapi.Event) {
+	pod, ok := event.Object.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	statuses := append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		if status.State.Waiting == nil {
+			delete(r.reasons, status.Name)
+			continue
+		}
+		reason := status.State.Waiting.Reason
+		if len(reason) < 1 || r.reasons[status.Name] == reason {
+			continue
+		}
+		r.reasons[status.Name] = reason
+		if len(status.State.Waiting.Message) > 0 {
+			fmt.Fprintf(r.out, "container %s is waiting: %s, %s\n", status.Name, reason, status.State.Waiting.Message)
+		} else {
+			fmt.Fprintf(r.out, "container %s is waiting: %s\n", status.Name, reason)
+		}
+	}
+}
+
+// streamPodEvents prints the events of the given pod until ctx is done
+func (o *DebugOptions) streamPodEvents(ctx context.Context, pod *corev1.Pod) {
+	selector := fields.Set{
+		"involvedObject.kind": "Pod",
+		"involvedObject.name": pod.Name,
+		"involvedObject.uid":  string(pod.UID),
+	}.AsSelector().String()
+	watcher, err := o.CoreClient.Events(pod.Namespace).Watch(v1.ListOptions{FieldSelector: selector})
+	if err != nil {
+		if o.Verbosity > 0 {
+			o.Logger.Printf("Failed to watch events of pod %s: %v\r\n", pod.Name, err)
+		}
+		return
+	}
+	defer watcher.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return
+			}
+			e, ok := event.Object.(*corev1.Event)
+			if !ok || event.Type == watchapi.Deleted {
+				continue
+			}
+			fmt.Fprintf(o.Out, "pod %s event: %s %s: %s\n", pod.Name, e.Type, e.Reason, e.Message)
+		}
+	}
+}
+
+// diagnosePodLaunch fetch the latest state of a pod which failed to run
+// and print the probable reasons with remediation hints
+func (o *DebugOptions) diagnosePodLaunch(pod *corev1.Pod) {
+	latest, err := o.CoreClient.Pods(pod.Namespace).Get(pod.Name, v1.GetOptions{})
+	if err != nil {
+		fmt.Fprintf(o.ErrOut, "Failed to get pod %s for diagnosis: %v\n", pod.Name, err)
+		return
+	}
+	hints := diagnosePod(latest)
+	if len(hints) < 1 {
+		fmt.Fprintf(o.ErrOut, "Pod %s is in phase %s, no obvious reason found. Run 'kubectl describe pod %s -n %s' for details.\n",
+			latest.Name, latest.Status.Phase, latest.Name, latest.Namespace)
+		return
+	}
+	fmt.Fprintf(o.ErrOut, "Diagnosis of pod %s:\n", latest.Name)
+	for _, hint := range hints {
+		fmt.Fprintf(o.ErrOut, "  - %s\n", hint)
+	}
+}
+
+// diagnosePod returns the human readable reasons why the pod is not running
+func diagnosePod(pod *corev1.Pod) []string {
+	var hints []string
+	// the pods bound to a node by nodeName skip the scheduler, the kubelet rejects them
+	// at admission with the reason in the status of the failed pod
+	if pod.Status.Phase == corev1.PodFailed && (len(pod.Status.Reason) > 0 || len(pod.Status.Message) > 0) {
+		hint := fmt.Sprintf("pod was rejected by node %s: %s %s", pod.Spec.NodeName, pod.Status.Reason, pod.Status.Message)
+		switch reason := pod.Status.Reason + " " + pod.Status.Message; {
+		case strings.Contains(reason, "Port") || strings.Contains(reason, "free ports"):
+			hint += hostPortHint(pod)
+		case strings.Contains(reason, "OutOf"):
+			hint += ". The node lacks the resources requested by the pod, lower them"
+		case strings.Contains(reason, "Taint"):
+			hint += ". The node has taints the pod doesn't tolerate"
+		}
+		hints = append(hints, hint)
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type != corev1.PodScheduled || cond.Status != corev1.ConditionFalse {
+			continue
+		}
+		hint := fmt.Sprintf("pod can not be scheduled: %s", cond.Message)
+		switch {
+		case strings.Contains(cond.Message, "free ports"):
+			hint += hostPortHint(pod)
+		case strings.Contains(cond.Message, "taint"):
+			hint += ". The node has taints the pod doesn't tolerate"
+		case strings.Contains(cond.Message, "Insufficient"):
+			hint += ". Lower the resource requests of the pod"
+		}
+		hints = append(hints, hint)
+	}
+
+	images := map[string]string{}
+	for _, c := range pod.Spec.InitContainers {
+		images[c.Name] = c.Image
+	}
+	for _, c := range pod.Spec.Containers {
+		images[c.Name] = c.Image
+	}
+	statuses := append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		switch {
+		case status.State.Waiting != nil && imagePullFailureReasons[status.State.Waiting.Reason]:
+			hints = append(hints, fmt.Sprintf("container %s can not pull image %s (%s): %s. Check the image name, the registry access of the node and the image pull secret",
+				status.Name, images[status.Name], status.State.Waiting.Reason, status.State.Waiting.Message))
+		case status.State.Waiting != nil && status.State.Waiting.Reason == "CrashLoopBackOff":
+			hints = append(hints, fmt.Sprintf("container %s keeps crashing, check its logs with 'kubectl logs %s -c %s -n %s --previous'",
+				status.Name, pod.Name, status.Name, pod.Namespace))
+		case status.State.Waiting != nil && len(status.State.Waiting.Reason) > 0 && status.State.Waiting.Reason != "ContainerCreating":
+			hints = append(hints, fmt.Sprintf("container %s is waiting: %s %s",
+				status.Name, status.State.Waiting.Reason, status.State.Waiting.Message))
+		case status.State.Terminated != nil:
+			hints = append(hints, fmt.Sprintf("container %s terminated with exit code %d: %s %s",
+				status.Name, status.State.Terminated.ExitCode, status.State.Terminated.Reason, status.State.Terminated.Message))
+		}
+	}
+	return hints
+}
+
+// hostPortHint explains a conflict on the host ports of the pod
+func hostPortHint(pod *corev1.Pod) string {
+	return fmt.Sprintf(". The host port %s is already in use on the node, probably by a debug agent left behind or the debug agent daemonset. "+
+		"Delete the leftover agent pod, use --agentless=false to reuse the daemonset or choose another --port", hostPorts(pod))
+}
+
+func hostPorts(pod *corev1.Pod) string {
+	var ports []string
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.HostPort > 0 {
+				ports = append(ports, fmt.Sprintf("%d", p.HostPort))
+			}
+		}
+	}
+	return strings.Join(ports, ",")
+}
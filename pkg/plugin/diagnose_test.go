@@ -0,0 +1,171 @@
+package plugin
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	watchapi "k8s.io/apimachinery/pkg/watch"
+)
+
+// testDiagnosedPod returns an agent pod of node-1 using the host port 10027
+func testDiagnosedPod(status corev1.PodStatus) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: "debug-agent-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{{
+				Name:  "debug-agent",
+				Image: "aylei/debug-agent:latest",
+				Ports: []corev1.ContainerPort{{ContainerPort: 10027, HostPort: 10027}},
+			}},
+		},
+		Status: status,
+	}
+}
+
+func waiting(reason, message string) []corev1.ContainerStatus {
+	return []corev1.ContainerStatus{{
+		Name:  "debug-agent",
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason, Message: message}},
+	}}
+}
+
+func TestDiagnosePod(t *testing.T) {
+	tests := []struct {
+		name   string
+		status corev1.PodStatus
+		want   []string
+	}{
+		{
+			name: "host port rejected by the kubelet",
+			status: corev1.PodStatus{
+				Phase:   corev1.PodFailed,
+				Reason:  "OutOfhostPort",
+				Message: "Pod Predicate PodFitsHostPorts failed",
+			},
+			want: []string{"rejected by node node-1", "host port 10027 is already in use", "--agentless=false"},
+		},
+		{
+			name:   "resources rejected by the kubelet",
+			status: corev1.PodStatus{Phase: corev1.PodFailed, Reason: "OutOfmemory"},
+			want:   []string{"rejected by node node-1: OutOfmemory", "lacks the resources"},
+		},
+		{
+			name:   "taint rejected by the kubelet",
+			status: corev1.PodStatus{Phase: corev1.PodFailed, Reason: "Taint", Message: "node had taint"},
+			want:   []string{"taints the pod doesn't tolerate"},
+		},
+		{
+			name: "no free ports to schedule",
+			status: corev1.PodStatus{Conditions: []corev1.PodCondition{{
+				Type:    corev1.PodScheduled,
+				Status:  corev1.ConditionFalse,
+				Message: "0/3 nodes are available: 1 node(s) didn't have free ports for the requested pod ports.",
+			}}},
+			want: []string{"can not be scheduled: 0/3 nodes", "host port 10027 is already in use"},
+		},
+		{
+			name: "insufficient resources to schedule",
+			status: corev1.PodStatus{Conditions: []corev1.PodCondition{{
+				Type:    corev1.PodScheduled,
+				Status:  corev1.ConditionFalse,
+				Message: "0/3 nodes are available: 3 Insufficient cpu.",
+			}}},
+			want: []string{"Lower the resource requests"},
+		},
+		{
+			name:   "image pull failure",
+			status: corev1.PodStatus{ContainerStatuses: waiting("ImagePullBackOff", "Back-off pulling image")},
+			want:   []string{"can not pull image aylei/debug-agent:latest (ImagePullBackOff): Back-off pulling image", "image pull secret"},
+		},
+		{
+			name:   "crash loop",
+			status: corev1.PodStatus{ContainerStatuses: waiting("CrashLoopBackOff", "")},
+			want:   []string{"kubectl logs debug-agent-pod -c debug-agent -n default --previous"},
+		},
+		{
+			name: "terminated",
+			status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				Name:  "debug-agent",
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 2, Reason: "Error"}},
+			}}},
+			want: []string{"terminated with exit code 2: Error"},
+		},
+		{
+			name:   "creating",
+			status: corev1.PodStatus{Phase: corev1.PodPending, ContainerStatuses: waiting("ContainerCreating", "")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hints := diagnosePod(testDiagnosedPod(tt.status))
+			if len(tt.want) < 1 {
+				if len(hints) > 0 {
+					t.Errorf("diagnosePod() = %q, want no hints", hints)
+				}
+				return
+			}
+			if len(hints) != 1 {
+				t.Fatalf("diagnosePod() = %q, want a single hint", hints)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(hints[0], want) {
+					t.Errorf("diagnosePod() = %q, want %q", hints[0], want)
+				}
+			}
+		})
+	}
+}
+
+func TestHostPortHint(t *testing.T) {
+	pod := testDiagnosedPod(corev1.PodStatus{})
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+		Name:  "sidecar",
+		Ports: []corev1.ContainerPort{{ContainerPort: 80}, {ContainerPort: 8080, HostPort: 18080}},
+	})
+	if hint := hostPortHint(pod); !strings.Contains(hint, "host port 10027,18080 is") {
+		t.Errorf("hostPortHint() = %q, want the host ports 10027,18080", hint)
+	}
+}
+
+func TestPodProgressReporter(t *testing.T) {
+	var out bytes.Buffer
+	r := newPodProgressReporter(&out)
+	for _, status := range []corev1.PodStatus{
+		{ContainerStatuses: waiting("ContainerCreating", "")},
+		{ContainerStatuses: waiting("ContainerCreating", "")},
+		{ContainerStatuses: waiting("ErrImagePull", "not found")},
+		{ContainerStatuses: []corev1.ContainerStatus{{Name: "debug-agent", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}}},
+		{ContainerStatuses: waiting("ErrImagePull", "not found")},
+	} {
+		r.report(watchapi.Event{Type: watchapi.Modified, Object: testDiagnosedPod(status)})
+	}
+	want := "container debug-agent is waiting: ContainerCreating\n" +
+		"container debug-agent is waiting: ErrImagePull, not found\n" +
+		"container debug-agent is waiting: ErrImagePull, not found\n"
+	if out.String() != want {
+		t.Errorf("reported %q, want %q", out.String(), want)
+	}
+}
+
+func TestDiagnosePodLaunch(t *testing.T) {
+	pod := testDiagnosedPod(corev1.PodStatus{Phase: corev1.PodPending})
+	opts, _ := newTestAgentOptions(pod)
+	var errOut bytes.Buffer
+	opts.ErrOut = &errOut
+	opts.diagnosePodLaunch(pod)
+	if !strings.Contains(errOut.String(), "no obvious reason found. Run 'kubectl describe pod debug-agent-pod -n default'") {
+		t.Errorf("diagnosis = %q, want the describe hint", errOut.String())
+	}
+
+	errOut.Reset()
+	opts, _ = newTestAgentOptions(testDiagnosedPod(corev1.PodStatus{ContainerStatuses: waiting("InvalidImageName", "")}))
+	opts.ErrOut = &errOut
+	opts.diagnosePodLaunch(pod)
+	if !strings.Contains(errOut.String(), "Diagnosis of pod debug-agent-pod:\n  - container debug-agent can not pull image") {
+		t.Errorf("diagnosis = %q, want the image pull hint of the latest pod", errOut.String())
+	}
+}
@@ -0,0 +1,337 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aylei/kubectl-debug/version"
+	"github.com/spf13/cobra"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	cmdutil "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+	"k8s.io/kubernetes/pkg/util/interrupt"
+)
+
+const (
+	doctorExample = `
+	# check that a pod can be debugged with the current settings
+	kubectl debug doctor POD_NAME
+
+	# check a container with the daemonset agent and a debug profile
+	kubectl debug doctor NAMESPACE/POD_NAME -c CONTAINER_NAME --agentless=false --profile net
+`
+
+	doctorTimeout = 30 * time.Second
+)
+
+// doctorReport is the report of the checks of the agent, see agent.DoctorReport
+type doctorReport struct {
+	Version string `json:"version"`
+	Checks  []struct {
+		Name    string `json:"name"`
+		Passed  bool   `json:"passed"`
+		Message string `json:"message"`
+	} `json:"checks"`
+}
+
+// agentCheckHints are the remediation hints of the failed checks of the agent
+var agentCheckHints = map[string]string{
+	"runtime": "only docker and containerd are supported, check the runtime socket of the node is mounted into the agent " +
+		"and matches docker_endpoint or containerd_endpoint in its config",
+	"lxcfs": "run lxcfs on the node, or disable it with --enable-lxcfs=false",
+	"image": "check the image name, the registry secret (--registry-secret-name) and the registry mirrors of the agent, " +
+		"or pre-pull the image on the node",
+}
+
+// doctor prints the results of the checks
+type doctor struct {
+	out    io.Writer
+	failed int
+}
+
+func (d *doctor) pass(name, format string, args ...interface{}) {
+	fmt.Fprintf(d.out, "[PASS] %s: %s\n", name, fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) warn(name, hint, format string, args ...interface{}) {
+	fmt.Fprintf(d.out, "[WARN] %s: %s\n", name, fmt.Sprintf(format, args...))
+	if len(hint) > 0 {
+		fmt.Fprintf(d.out, "       hint: %s\n", hint)
+	}
+}
+
+func (d *doctor) fail(name, hint, format string, args ...interface{}) {
+	d.failed++
+	fmt.Fprintf(d.out, "[FAIL] %s: %s\n", name, fmt.Sprintf(format, args...))
+	if len(hint) > 0 {
+		fmt.Fprintf(d.out, "       hint: %s\n", hint)
+	}
+}
+
+func newDoctorCmd(opts *DebugOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:                   "doctor [NAMESPACE/]POD",
+		DisableFlagsInUseLine: true,
+		Short:                 "Check that a pod can be debugged",
+		Long: `Check what a debug session of the pod depends on with the current flags and config file,
+and print a report with a hint for each failed check: the RBAC permissions, the target
+container, the agent (the DaemonSet pod of the node, or a launched agent pod in agentless
+mode), its version, and from the agent, the container runtime, the lxcfs mount and the
+resolution of the debug image.`,
+		Example: doctorExample,
+		Args:    cobra.ExactArgs(1),
+		Run: func(c *cobra.Command, args []string) {
+			cmdutil.CheckErr(opts.runDoctor(c, args))
+		},
+	}
+}
+
+func (o *DebugOptions) runDoctor(cmd *cobra.Command, args []string) error {
+	if err := o.completeTool(cmd, args[0]); err != nil {
+		return err
+	}
+	d := &doctor{out: o.Out}
+	o.doctorRBAC(d)
+	if pod, containerID := o.doctorTarget(d); pod != nil {
+		o.doctorAgent(d, pod, containerID)
+	}
+	if d.failed == 1 {
+		return fmt.Errorf("1 check failed")
+	}
+	if d.failed > 1 {
+		return fmt.Errorf("%d checks failed", d.failed)
+	}
+	fmt.Fprintf(o.Out, "%s can be debugged\n", o.PodName)
+	return nil
+}
+
+// doctorRBAC checks the permissions of the current user with SelfSubjectAccessReviews
+func (o *DebugOptions) doctorRBAC(d *doctor) {
+	type permission struct {
+		namespace, verb, group, resource, subresource string
+	}
+	permissions := []permission{
+		{o.Namespace, "get", "", "pods", ""},
+		{o.Namespace, "create", "", "pods", "exec"},
+		{o.RegistrySecretNamespace, "get", "", "secrets", ""},
+	}
+	if o.AgentLess {
+		permissions = append(permissions,
+			permission{o.AgentPodNamespace, "create", "", "pods", ""},
+			permission{o.AgentPodNamespace, "delete", "", "pods", ""})
+		if o.PortForward {
+			permissions = append(permissions, permission{o.AgentPodNamespace, "create", "", "pods", "portforward"})
+		}
+	} else if o.PortForward {
+		permissions = append(permissions,
+			permission{o.DebugAgentNamespace, "get", "apps", "daemonsets", ""},
+			permission{o.DebugAgentNamespace, "list", "", "pods", ""},
+			permission{o.DebugAgentNamespace, "create", "", "pods", "portforward"})
+	}
+	for _, p := range permissions {
+		resource := p.resource
+		if len(p.subresource) > 0 {
+			resource += "/" + p.subresource
+		}
+		if len(p.group) > 0 {
+			resource += "." + p.group
+		}
+		name := fmt.Sprintf("rbac %s %s", p.verb, resource)
+		sar := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   p.namespace,
+					Verb:        p.verb,
+					Group:       p.group,
+					Resource:    p.resource,
+					Subresource: p.subresource,
+				},
+			},
+		}
+		response, err := o.KubeCli.AuthorizationV1().SelfSubjectAccessReviews().Create(sar)
+		if err != nil {
+			d.fail(name, "", "failed to create SelfSubjectAccessReview: %v", err)
+			continue
+		}
+		if !response.Status.Allowed {
+			reason := ""
+			if len(response.Status.Reason) > 0 {
+				reason = ", " + response.Status.Reason
+			}
+			d.fail(name, fmt.Sprintf("ask a cluster admin for a Role granting %s on %s in namespace %s", p.verb, resource, p.namespace),
+				"denied in namespace %s%s", p.namespace, reason)
+			continue
+		}
+		d.pass(name, "allowed in namespace %s", p.namespace)
+	}
+}
+
+// doctorTarget checks the target container, it returns the pod and the container id
+// if the container runs in a supported runtime
+func (o *DebugOptions) doctorTarget(d *doctor) (*corev1.Pod, string) {
+	pod, err := o.CoreClient.Pods(o.Namespace).Get(o.PodName, v1.GetOptions{})
+	if err != nil {
+		d.fail("pod", "", "%v", err)
+		return nil, ""
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		d.fail("pod", "a pod stuck in Pending or CrashLoopBackOff can be debugged in a copy with --fork",
+			"pod %s is %s", pod.Name, pod.Status.Phase)
+		return nil, ""
+	}
+	d.pass("pod", "pod %s runs on node %s", pod.Name, pod.Spec.NodeName)
+	containerName := o.ContainerName
+	if len(containerName) == 0 {
+		containerName = pod.Spec.Containers[0].Name
+	}
+	containerID, err := o.getContainerIDByName(pod, containerName)
+	if err != nil {
+		d.fail("container", "select another container with -c, or debug a copy of the pod with --fork", "%v", err)
+		return nil, ""
+	}
+	scheme := strings.SplitN(containerID, "://", 2)[0]
+	if scheme != "docker" && scheme != "containerd" {
+		d.fail("container", "only the docker and containerd runtimes are supported",
+			"container %s runs in the unsupported runtime %s", containerName, scheme)
+		return nil, ""
+	}
+	d.pass("container", "container %s runs in %s", containerName, scheme)
+	return pod, containerID
+}
+
+// doctorAgent checks the agent serving the pod, the agent pod is launched and cleaned up
+// in agentless mode as for a debug session
+func (o *DebugOptions) doctorAgent(d *doctor, pod *corev1.Pod, containerID string) {
+	// without port-forward, the agent of the node is reached without looking up its DaemonSet
+	if !o.AgentLess && o.PortForward && !o.doctorDaemonSet(d, pod) {
+		return
+	}
+	agentPod, err := o.launchAgent(pod)
+	if err != nil {
+		d.fail("agent", fmt.Sprintf("check the events of the agent pod, e.g. its image %s can't be pulled, "+
+			"or the host port %d is already used on node %s", o.AgentImage, o.AgentPort, pod.Spec.NodeName),
+			"failed to launch the agent pod: %v", err)
+		return
+	}
+	if o.AgentLess {
+		d.pass("agent", "agent pod %s runs on node %s", agentPod.Name, agentPod.Spec.NodeName)
+	}
+	if agentPod, err = o.forwardAgentPort(pod, agentPod); err != nil {
+		o.deleteAgent(agentPod)
+		d.fail("agent reachable", "check the pods/portforward permission and the logs of the agent pod",
+			"failed to forward the agent port: %v", err)
+		return
+	}
+	interrupt.Chain(nil, func() {
+		if o.PortForward && o.StopChannel != nil {
+			close(o.StopChannel)
+		}
+		o.deleteAgent(agentPod)
+	}).Run(func() error {
+		o.doctorAgentChecks(d, pod, containerID)
+		return nil
+	})
+	o.wait.Wait()
+}
+
+// doctorDaemonSet checks the agent DaemonSet has a running pod on the node of the pod
+func (o *DebugOptions) doctorDaemonSet(d *doctor, pod *corev1.Pod) bool {
+	hint := fmt.Sprintf("install the agent DaemonSet in namespace %s, or use the agentless mode with --agentless", o.DebugAgentNamespace)
+	daemonSet, err := o.KubeCli.AppsV1().DaemonSets(o.DebugAgentNamespace).Get(o.DebugAgentDaemonSet, v1.GetOptions{})
+	if err != nil {
+		d.fail("agent", hint, "%v", err)
+		return false
+	}
+	agents, err := o.CoreClient.Pods(o.DebugAgentNamespace).List(v1.ListOptions{
+		LabelSelector: labels.Set(daemonSet.Spec.Selector.MatchLabels).String(),
+	})
+	if err != nil {
+		d.fail("agent", "", "%v", err)
+		return false
+	}
+	for _, agent := range agents.Items {
+		if agent.Spec.NodeName != pod.Spec.NodeName {
+			continue
+		}
+		if agent.Status.Phase != corev1.PodRunning {
+			d.fail("agent", fmt.Sprintf("check the events of the agent pod, e.g. the host port %d is already used on the node", o.AgentPort),
+				"agent pod %s on node %s is %s", agent.Name, agent.Spec.NodeName, agent.Status.Phase)
+			return false
+		}
+		d.pass("agent", "agent pod %s of daemonset %s runs on node %s", agent.Name, daemonSet.Name, agent.Spec.NodeName)
+		return true
+	}
+	d.fail("agent", "check the node selector and the tolerations of the DaemonSet, or use the agentless mode with --agentless",
+		"daemonset %s has no pod on node %s", daemonSet.Name, pod.Spec.NodeName)
+	return false
+}
+
+// doctorAgentChecks reaches the agent and reports its checks of the target container
+func (o *DebugOptions) doctorAgentChecks(d *doctor, pod *corev1.Pod, containerID string) {
+	uri, err := o.agentURL(pod, "/api/v1/doctor")
+	if err != nil {
+		d.fail("agent reachable", "", "%v", err)
+		return
+	}
+	// the request is sent as the json body, the credentials are not part of the url
+	r := o.newDebugRequest(containerID, true)
+	r.Image = o.Image
+	r.Lxcfs = o.IsLxcfsEnabled
+	r.Registry.SkipTLSVerify = o.RegistrySkipTLSVerify
+	r.Registry.Auth, err = o.registryAuthStr(pod)
+	if err != nil {
+		d.fail("registry secret", "", "%v", err)
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		d.fail("agent reachable", "", "%v", err)
+		return
+	}
+
+	hint := "check the logs of the agent pod"
+	if !o.PortForward {
+		hint = fmt.Sprintf("the agent must run on node %s, and its port %d be reachable from here and not used by another "+
+			"process on the node, or use the port-forward mode with --port-forward", pod.Spec.NodeName, o.AgentPort)
+	}
+	client := &http.Client{Timeout: doctorTimeout}
+	resp, err := client.Post(uri.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		d.fail("agent reachable", hint, "%v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		d.fail("agent reachable", "upgrade the agent image to run the agent checks", "the agent doesn't serve /api/v1/doctor")
+		return
+	}
+	var report doctorReport
+	if resp.StatusCode != http.StatusOK {
+		d.fail("agent reachable", hint, "the agent answered %s", resp.Status)
+		return
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		d.fail("agent reachable", hint, "failed to read the report of the agent: %v", err)
+		return
+	}
+	d.pass("agent reachable", "%s", uri.Host)
+	if report.Version != version.Version() {
+		d.warn("agent version", "use the same versions of the agent image and of the plugin",
+			"agent %s, plugin %s", report.Version, version.Version())
+	} else {
+		d.pass("agent version", "%s", report.Version)
+	}
+	for _, check := range report.Checks {
+		if check.Passed {
+			d.pass(check.Name, "%s", check.Message)
+		} else {
+			d.fail(check.Name, agentCheckHints[check.Name], "%s", check.Message)
+		}
+	}
+}
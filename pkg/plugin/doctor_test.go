@@ -0,0 +1,204 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aylei/kubectl-debug/version"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testDoctorPod(phase corev1.PodPhase, containerID string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: "mypod", Namespace: "default"},
+		Spec:       corev1.PodSpec{NodeName: "node-1", Containers: []corev1.Container{{Name: "app"}}},
+		Status: corev1.PodStatus{
+			Phase: phase,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:        "app",
+				ContainerID: containerID,
+				State:       corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+			}},
+		},
+	}
+}
+
+func TestDoctorTarget(t *testing.T) {
+	tests := []struct {
+		name      string
+		pod       *corev1.Pod
+		container string
+		wantID    string
+		want      string
+	}{
+		{
+			name:   "docker container",
+			pod:    testDoctorPod(corev1.PodRunning, "docker://abc"),
+			wantID: "docker://abc",
+			want:   "[PASS] container: container app runs in docker",
+		},
+		{
+			name: "missing pod",
+			want: "[FAIL] pod:",
+		},
+		{
+			name: "pending pod",
+			pod:  testDoctorPod(corev1.PodPending, "docker://abc"),
+			want: "hint: a pod stuck in Pending or CrashLoopBackOff can be debugged in a copy with --fork",
+		},
+		{
+			name:      "missing container",
+			pod:       testDoctorPod(corev1.PodRunning, "docker://abc"),
+			container: "sidecar",
+			want:      "[FAIL] container:",
+		},
+		{
+			name: "unsupported runtime",
+			pod:  testDoctorPod(corev1.PodRunning, "cri-o://abc"),
+			want: "container app runs in the unsupported runtime cri-o",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts *DebugOptions
+			if tt.pod != nil {
+				opts, _ = newTestAgentOptions(tt.pod)
+			} else {
+				opts, _ = newTestAgentOptions()
+			}
+			opts.Namespace, opts.PodName, opts.ContainerName = "default", "mypod", tt.container
+			var out bytes.Buffer
+			d := &doctor{out: &out}
+			pod, containerID := opts.doctorTarget(d)
+			if containerID != tt.wantID || (pod != nil) != (len(tt.wantID) > 0) {
+				t.Errorf("doctorTarget() = %v, %q, want %q", pod, containerID, tt.wantID)
+			}
+			if wantFailed := len(tt.wantID) == 0; (d.failed == 1) != wantFailed {
+				t.Errorf("failed = %d, want a failure %v", d.failed, wantFailed)
+			}
+			if !strings.Contains(out.String(), tt.want) {
+				t.Errorf("report = %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDoctorAgentChecks(t *testing.T) {
+	const checks = `"checks":[{"name":"runtime","passed":true,"message":"docker 19.03"},` +
+		`{"name":"image","passed":false,"message":"pull access denied"}]`
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantFailed int
+		want       []string
+	}{
+		{
+			name:       "report",
+			status:     http.StatusOK,
+			body:       fmt.Sprintf(`{"version":%q,%s}`, version.Version(), checks),
+			wantFailed: 1,
+			want: []string{
+				"[PASS] agent reachable:",
+				"[PASS] agent version: " + version.Version(),
+				"[PASS] runtime: docker 19.03",
+				"[FAIL] image: pull access denied",
+				"hint: " + agentCheckHints["image"],
+			},
+		},
+		{
+			name:   "version skew",
+			status: http.StatusOK,
+			body:   `{"version":"v0.0.1","checks":[]}`,
+			want:   []string{"[WARN] agent version: agent v0.0.1, plugin " + version.Version()},
+		},
+		{
+			name:       "old agent",
+			status:     http.StatusNotFound,
+			wantFailed: 1,
+			want:       []string{"the agent doesn't serve /api/v1/doctor", "hint: upgrade the agent image"},
+		},
+		{
+			name:       "agent error",
+			status:     http.StatusInternalServerError,
+			wantFailed: 1,
+			want:       []string{"the agent answered 500 Internal Server Error", "hint: check the logs of the agent pod"},
+		},
+		{
+			name:       "invalid report",
+			status:     http.StatusOK,
+			body:       "not json",
+			wantFailed: 1,
+			want:       []string{"failed to read the report of the agent"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var request debugSessionRequest
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodPost || req.URL.Path != "/api/v1/doctor" {
+					t.Errorf("request %s %s, want POST /api/v1/doctor", req.Method, req.URL.Path)
+				}
+				if contentType := req.Header.Get("Content-Type"); contentType != "application/json" {
+					t.Errorf("content type %q, want application/json", contentType)
+				}
+				if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+					t.Errorf("failed to decode the request: %v", err)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			uri, _ := url.Parse(server.URL)
+			port, _ := strconv.Atoi(uri.Port())
+
+			opts, _ := newTestAgentOptions()
+			opts.PortForward = true
+			opts.agentLocalPort = port
+			opts.Image = "nicolaka/netshoot:latest"
+			opts.IsLxcfsEnabled = true
+			var out bytes.Buffer
+			d := &doctor{out: &out}
+			opts.doctorAgentChecks(d, testDoctorPod(corev1.PodRunning, "docker://abc"), "docker://abc")
+
+			if request.Target.Container != "docker://abc" || request.Image != opts.Image || !request.Lxcfs || !request.Session.TTY {
+				t.Errorf("request = %+v", request)
+			}
+			if d.failed != tt.wantFailed {
+				t.Errorf("failed = %d, want %d, report:\n%s", d.failed, tt.wantFailed, out.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("report = %q, want %q", out.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestDoctorAgentUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	uri, _ := url.Parse(server.URL)
+	server.Close()
+	port, _ := strconv.Atoi(uri.Port())
+
+	opts, _ := newTestAgentOptions()
+	opts.AgentPort = port
+	pod := testDoctorPod(corev1.PodRunning, "docker://abc")
+	pod.Status.HostIP = "127.0.0.1"
+	var out bytes.Buffer
+	d := &doctor{out: &out}
+	opts.doctorAgentChecks(d, pod, "docker://abc")
+	if d.failed != 1 || !strings.Contains(out.String(), "[FAIL] agent reachable:") ||
+		!strings.Contains(out.String(), "or use the port-forward mode with --port-forward") {
+		t.Errorf("failed = %d, report = %q", d.failed, out.String())
+	}
+}
@@ -0,0 +1,287 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/util/exec"
+	"k8s.io/kubernetes/pkg/util/interrupt"
+)
+
+// podResult is the result of the command run in one of the selected pods
+type podResult struct {
+	pod      *corev1.Pod
+	exitCode int
+	err      error
+}
+
+// nodeAgent is the agent serving the selected pods of a node, it is launched
+// and port-forwarded once for all of them
+type nodeAgent struct {
+	opts     *DebugOptions
+	mu       sync.Mutex
+	launched bool
+	cleaned  bool
+	agentPod *corev1.Pod
+	err      error
+}
+
+// selectedPods returns the running pods matching the selector, by name
+func (o *DebugOptions) selectedPods() ([]*corev1.Pod, error) {
+	list, err := o.CoreClient.Pods(o.Namespace).List(v1.ListOptions{LabelSelector: o.Selector})
+	if err != nil {
+		return nil, err
+	}
+	var pods []*corev1.Pod
+	for i := range list.Items {
+		pod := &list.Items[i]
+		if pod.DeletionTimestamp == nil && pod.Status.Phase == corev1.PodRunning {
+			pods = append(pods, pod)
+		}
+	}
+	if len(pods) < 1 {
+		return nil, fmt.Errorf("no running pod in namespace %s matches the selector %s", o.Namespace, o.Selector)
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	return pods, nil
+}
+
+// selectPod returns the name of the first running pod matching the selector
+func (o *DebugOptions) selectPod() (string, error) {
+	pods, err := o.selectedPods()
+	if err != nil {
+		return "", err
+	}
+	if len(pods) > 1 {
+		fmt.Fprintf(o.ErrOut, "%d pods match the selector, debugging %s, use --all to run the command in all of them\r\n",
+			len(pods), pods[0].Name)
+	}
+	return pods[0].Name, nil
+}
+
+// runAll runs the command non-interactively in all the selected pods, at most
+// Parallel at a time, and summarizes the exit codes
+func (o *DebugOptions) runAll() error {
+	pods, err := o.selectedPods()
+	if err != nil {
+		return err
+	}
+	if err = o.auth(pods[0]); err != nil {
+		return err
+	}
+	if len(o.OutputDir) > 0 {
+		if err = os.MkdirAll(o.OutputDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	agents := map[string]*nodeAgent{}
+	for _, pod := range pods {
+		if _, ok := agents[pod.Spec.NodeName]; !ok {
+			agents[pod.Spec.NodeName] = &nodeAgent{opts: o.nodeOptions()}
+		}
+	}
+	results := make([]podResult, len(pods))
+	var outputLock sync.Mutex
+	err = interrupt.Chain(nil, func() {
+		for _, agent := range agents {
+			agent.cleanup()
+		}
+	}).Run(func() error {
+		var running sync.WaitGroup
+		slots := make(chan struct{}, o.Parallel)
+		for i, pod := range pods {
+			running.Add(1)
+			slots <- struct{}{}
+			go func(i int, pod *corev1.Pod) {
+				defer func() {
+					<-slots
+					running.Done()
+				}()
+				code, err := o.runInPod(agents[pod.Spec.NodeName], pod, &outputLock)
+				results[i] = podResult{pod: pod, exitCode: code, err: err}
+			}(i, pod)
+		}
+		running.Wait()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return o.printResults(results)
+}
+
+// nodeOptions returns a copy of the options for the agent of a node, with its own
+// agent pod and port-forward on a random local port
+func (o *DebugOptions) nodeOptions() *DebugOptions {
+	nodeOpts := *o
+	nodeOpts.wait = &sync.WaitGroup{}
+	nodeOpts.StopChannel = make(chan struct{}, 1)
+	nodeOpts.ReadyChannel = make(chan struct{})
+	nodeOpts.Ports = []string{fmt.Sprintf(":%d", o.AgentPort)}
+	nodeOpts.agentForward = nil
+	nodeOpts.agentLocalPort = 0
+	// the progress of the agents doesn't mix with the output of the command
+	nodeOpts.Out = o.ErrOut
+	nodeOpts.PortForwarder = &defaultPortForwarder{
+		IOStreams: genericclioptions.IOStreams{Out: ioutil.Discard, ErrOut: o.ErrOut},
+	}
+	return &nodeOpts
+}
+
+// launch launches the agent of the node once, for the first of its pods
+func (a *nodeAgent) launch(pod *corev1.Pod) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cleaned {
+		return fmt.Errorf("interrupted")
+	}
+	if a.launched {
+		return a.err
+	}
+	a.launched = true
+	a.agentPod, a.err = a.opts.launchAgent(pod)
+	if a.err != nil {
+		return a.err
+	}
+	if a.agentPod, a.err = a.opts.forwardAgentPort(pod, a.agentPod); a.err != nil {
+		a.opts.deleteAgent(a.agentPod)
+		a.agentPod = nil
+		return a.err
+	}
+	// the agent pod is cleaned up with the port-forward
+	a.err = a.opts.checkAgent(pod)
+	return a.err
+}
+
+// cleanup stops the port-forward and deletes the agent pod of the node
+func (a *nodeAgent) cleanup() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cleaned {
+		return
+	}
+	a.cleaned = true
+	if a.opts.PortForward {
+		close(a.opts.StopChannel)
+	}
+	a.opts.deleteAgent(a.agentPod)
+	a.opts.wait.Wait()
+}
+
+// runInPod runs the command in the pod, a non-zero exit code is not an error
+func (o *DebugOptions) runInPod(agent *nodeAgent, pod *corev1.Pod, outputLock *sync.Mutex) (int, error) {
+	containerName := o.ContainerName
+	if len(containerName) == 0 {
+		containerName = pod.Spec.Containers[0].Name
+	}
+	containerID, err := o.getContainerIDByName(pod, containerName)
+	if err != nil {
+		return 0, err
+	}
+	if err = agent.launch(pod); err != nil {
+		return 0, err
+	}
+	r := agent.opts.newDebugRequest(containerID, false)
+	if err = agent.opts.setDebugContainer(r, pod); err != nil {
+		return 0, err
+	}
+	uri, header, err := agent.opts.debugURL(pod, r)
+	if err != nil {
+		return 0, err
+	}
+
+	var stdout, stderr io.Writer
+	if len(o.OutputDir) > 0 {
+		f, err := os.Create(filepath.Join(o.OutputDir, pod.Name+".log"))
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		stdout, stderr = f, f
+	} else {
+		prefix := fmt.Sprintf("[%s] ", pod.Name)
+		outPrefixer := &linePrefixer{prefix: prefix, out: o.Out, lock: outputLock}
+		errPrefixer := &linePrefixer{prefix: prefix, out: o.ErrOut, lock: outputLock}
+		defer outPrefixer.flush()
+		defer errPrefixer.flush()
+		stdout, stderr = outPrefixer, errPrefixer
+	}
+	err = agent.opts.remoteExecute("POST", uri, header, o.Config, nil, stdout, stderr, false, nil)
+	if exitErr, ok := err.(exec.ExitError); ok && exitErr.Exited() {
+		return exitErr.ExitStatus(), nil
+	}
+	return 0, err
+}
+
+// printResults prints the exit code of each pod, it fails if the command
+// failed in any of them
+func (o *DebugOptions) printResults(results []podResult) error {
+	w := tabwriter.NewWriter(o.Out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "POD\tNODE\tEXIT CODE\tERROR")
+	failed := 0
+	for _, result := range results {
+		code, msg := strconv.Itoa(result.exitCode), ""
+		if result.err != nil {
+			code, msg = "-", result.err.Error()
+		}
+		if result.err != nil || result.exitCode != 0 {
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.pod.Name, result.pod.Spec.NodeName, code, msg)
+	}
+	w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("the command failed in %d of %d pods", failed, len(results))
+	}
+	return nil
+}
+
+// linePrefixer writes the complete lines prefixed, the lines of the pods
+// sharing the lock don't interleave
+type linePrefixer struct {
+	prefix string
+	out    io.Writer
+	lock   *sync.Mutex
+	buf    []byte
+}
+
+func (w *linePrefixer) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if err := w.writeLine(w.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// flush writes the last line if it doesn't end with a newline
+func (w *linePrefixer) flush() {
+	if len(w.buf) > 0 {
+		w.writeLine(append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
+
+func (w *linePrefixer) writeLine(line []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, err := fmt.Fprintf(w.out, "%s%s", w.prefix, line)
+	return err
+}
@@ -0,0 +1,163 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testSelectedPod(name, node string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "api"}},
+		Spec:       corev1.PodSpec{NodeName: node},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+}
+
+func TestSelectedPods(t *testing.T) {
+	deleting := testSelectedPod("api-deleting", "node-1", corev1.PodRunning)
+	now := v1.Now()
+	deleting.DeletionTimestamp = &now
+	other := testSelectedPod("web-0", "node-1", corev1.PodRunning)
+	other.Labels = map[string]string{"app": "web"}
+	opts, _ := newTestAgentOptions(
+		testSelectedPod("api-2", "node-2", corev1.PodRunning),
+		testSelectedPod("api-0", "node-1", corev1.PodRunning),
+		testSelectedPod("api-pending", "node-1", corev1.PodPending),
+		testSelectedPod("api-1", "node-1", corev1.PodRunning),
+		deleting,
+		other,
+	)
+	var errOut bytes.Buffer
+	opts.ErrOut = &errOut
+	opts.Namespace = "default"
+	opts.Selector = "app=api"
+	pods, err := opts.selectedPods()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, pod := range pods {
+		names = append(names, pod.Name)
+	}
+	if strings.Join(names, ",") != "api-0,api-1,api-2" {
+		t.Errorf("selectedPods() = %v, want the running pods by name", names)
+	}
+	name, err := opts.selectPod()
+	if err != nil || name != "api-0" {
+		t.Errorf("selectPod() = %s, %v, want api-0", name, err)
+	}
+	if !strings.Contains(errOut.String(), "3 pods match the selector, debugging api-0") {
+		t.Errorf("selectPod() warned %q", errOut.String())
+	}
+
+	opts.Selector = "app=db"
+	if _, err := opts.selectedPods(); err == nil || !strings.Contains(err.Error(), "no running pod in namespace default matches the selector app=db") {
+		t.Errorf("selectedPods() without a match error = %v", err)
+	}
+}
+
+func TestFanOutValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "all", args: []string{"-l", "app=api", "--all", "--", "ss", "-s"}},
+		{name: "all without a selector", args: []string{"mypod", "--all", "--", "ss"}, wantErr: "--all can only be used together with --selector"},
+		{name: "all without a command", args: []string{"-l", "app=api", "--all"}, wantErr: "--all requires a command"},
+		{name: "all with fork", args: []string{"-l", "app=api", "--all", "--fork", "--", "ss"}, wantErr: "--all can't be used with --fork"},
+		{name: "no parallel session", args: []string{"-l", "app=api", "--all", "--parallel", "0", "--", "ss"}, wantErr: "--parallel must be at least 1"},
+		{name: "output dir without all", args: []string{"-l", "app=api", "--output-dir", "out"}, wantErr: "--output-dir can only be used together with --all"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := completeTestOptions(t, "", tt.args...)
+			if len(tt.wantErr) > 0 != (err != nil) || err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNodeOptions(t *testing.T) {
+	opts, _ := newTestAgentOptions()
+	var errOut bytes.Buffer
+	opts.ErrOut = &errOut
+	first, second := opts.nodeOptions(), opts.nodeOptions()
+	if first.StopChannel == second.StopChannel || first.ReadyChannel == second.ReadyChannel || first.wait == second.wait {
+		t.Errorf("the agents of the nodes share their port-forward")
+	}
+	if len(first.Ports) != 1 || first.Ports[0] != ":10027" {
+		t.Errorf("ports = %v, want a random local port", first.Ports)
+	}
+	if first.Out != opts.ErrOut {
+		t.Errorf("the progress of the agent is written to the output of the command")
+	}
+}
+
+func TestNodeAgentLaunch(t *testing.T) {
+	opts, _ := newTestAgentOptions()
+	failed := errors.New("agent pod is not running")
+	agent := &nodeAgent{opts: opts.nodeOptions(), launched: true, err: failed}
+	// the launch failure of the node is reported to each of its pods
+	for i := 0; i < 2; i++ {
+		if err := agent.launch(testSelectedPod("api-0", "node-1", corev1.PodRunning)); err != failed {
+			t.Errorf("launch() error = %v, want %v", err, failed)
+		}
+	}
+	agent = &nodeAgent{opts: opts.nodeOptions()}
+	agent.cleanup()
+	agent.cleanup()
+	if err := agent.launch(testSelectedPod("api-0", "node-1", corev1.PodRunning)); err == nil || agent.launched {
+		t.Errorf("the agent is launched after the cleanup: %v", err)
+	}
+}
+
+func TestPrintResults(t *testing.T) {
+	opts, _ := newTestAgentOptions()
+	var out bytes.Buffer
+	opts.Out = &out
+	results := []podResult{
+		{pod: testSelectedPod("api-0", "node-1", corev1.PodRunning)},
+		{pod: testSelectedPod("api-1", "node-1", corev1.PodRunning), exitCode: 2},
+		{pod: testSelectedPod("api-2", "node-2", corev1.PodRunning), err: errors.New("agent pod is not running")},
+	}
+	err := opts.printResults(results)
+	if err == nil || err.Error() != "the command failed in 2 of 3 pods" {
+		t.Errorf("printResults() error = %v", err)
+	}
+	want := "POD    NODE    EXIT CODE  ERROR\n" +
+		"api-0  node-1  0          \n" +
+		"api-1  node-1  2          \n" +
+		"api-2  node-2  -          agent pod is not running\n"
+	if out.String() != want {
+		t.Errorf("printResults() printed\n%s\nwant\n%s", out.String(), want)
+	}
+	out.Reset()
+	if err := opts.printResults(results[:1]); err != nil {
+		t.Errorf("printResults() of a success error = %v", err)
+	}
+}
+
+func TestLinePrefixer(t *testing.T) {
+	var out bytes.Buffer
+	var lock sync.Mutex
+	a := &linePrefixer{prefix: "[a] ", out: &out, lock: &lock}
+	b := &linePrefixer{prefix: "[b] ", out: &out, lock: &lock}
+	a.Write([]byte("first "))
+	b.Write([]byte("one\ntw"))
+	a.Write([]byte("line\nsecond\nlast"))
+	b.Write([]byte("o\n"))
+	a.flush()
+	b.flush()
+	want := "[b] one\n[a] first line\n[a] second\n[b] two\n[a] last\n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
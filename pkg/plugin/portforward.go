@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+	cmdutil "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+)
+
+const portForwardExample = `
+	# forward the local port 9000 to the pprof endpoint only listening on localhost in the pod
+	kubectl debug port-forward POD_NAME 9000:localhost:6060
+
+	# forward the local ports 8080 and 9090 to the same ports in the pod
+	kubectl debug port-forward NAMESPACE/POD_NAME 8080 9090
+`
+
+func newPortForwardCmd(opts *DebugOptions) *cobra.Command {
+	var addresses []string
+	cmd := &cobra.Command{
+		Use:                   "port-forward [NAMESPACE/]POD [LOCAL_PORT:][HOST:]REMOTE_PORT [...]",
+		DisableFlagsInUseLine: true,
+		Short:                 "Forward local ports to the network namespace of a pod",
+		Long: `Forward local ports to a host, localhost by default, dialed by the agent in the network
+namespace of a pod. Unlike kubectl port-forward, the ports only bound to the loopback
+interface of the pod are reachable, e.g. admin and debug endpoints. The host is resolved
+by the agent, and all the ports of a command must use the same host.`,
+		Example: portForwardExample,
+		Args:    cobra.MinimumNArgs(2),
+		Run: func(c *cobra.Command, args []string) {
+			cmdutil.CheckErr(opts.runForwardTarget(c, args, addresses))
+		},
+	}
+	cmd.Flags().StringSliceVar(&addresses, "address", []string{"localhost"},
+		"Addresses to listen on (comma separated), localhost or IP addresses")
+	return cmd
+}
+
+// parseForwardSpec parses [LOCAL_PORT:][HOST:]REMOTE_PORT to the host and the
+// LOCAL_PORT:REMOTE_PORT spec of the portforward package
+func parseForwardSpec(spec string) (host, ports string, err error) {
+	parts := strings.Split(spec, ":")
+	local, remote := "", parts[len(parts)-1]
+	switch len(parts) {
+	case 1:
+	case 2:
+		if _, err := strconv.ParseUint(parts[0], 10, 16); err == nil {
+			local = parts[0]
+		} else {
+			host = parts[0]
+		}
+	case 3:
+		local, host = parts[0], parts[1]
+	default:
+		return "", "", fmt.Errorf("invalid port spec %s, expect [LOCAL_PORT:][HOST:]REMOTE_PORT", spec)
+	}
+	if port, err := strconv.ParseUint(remote, 10, 16); err != nil || port == 0 {
+		return "", "", fmt.Errorf("invalid remote port in %s", spec)
+	}
+	if len(local) > 0 {
+		if _, err := strconv.ParseUint(local, 10, 16); err != nil {
+			return "", "", fmt.Errorf("invalid local port in %s", spec)
+		}
+		return host, local + ":" + remote, nil
+	}
+	return host, remote, nil
+}
+
+func (o *DebugOptions) runForwardTarget(cmd *cobra.Command, args []string, addresses []string) error {
+	host := ""
+	var ports []string
+	for _, spec := range args[1:] {
+		specHost, specPorts, err := parseForwardSpec(spec)
+		if err != nil {
+			return cmdutil.UsageErrorf(cmd, "%v", err)
+		}
+		if len(specHost) < 1 {
+			specHost = "localhost"
+		}
+		if len(host) > 0 && specHost != host {
+			return cmdutil.UsageErrorf(cmd, "all the ports must be forwarded to the same host, got %s and %s", host, specHost)
+		}
+		host = specHost
+		ports = append(ports, specPorts)
+	}
+	if err := o.completeTool(cmd, args[0]); err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("host", host)
+	return o.runTool(func(target *toolTarget) error {
+		uri, err := o.toolURL(target, "/api/v1/portforward", params)
+		if err != nil {
+			return err
+		}
+		transport, upgrader, err := spdy.RoundTripperFor(o.Config)
+		if err != nil {
+			return err
+		}
+		dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", uri)
+		fw, err := portforward.NewOnAddresses(dialer, addresses, ports,
+			make(chan struct{}), make(chan struct{}, 1), o.Out, o.ErrOut)
+		if err != nil {
+			return err
+		}
+		// blocks till the plugin is interrupted, the agent is cleaned up by runTool
+		return fw.ForwardPorts()
+	})
+}
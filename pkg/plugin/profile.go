@@ -0,0 +1,192 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/util/exec"
+	cmdutil "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+)
+
+const (
+	profileExample = `
+	# take a 30s cpu profile of a go process serving net/http/pprof on localhost:6060
+	kubectl debug profile POD_NAME --lang go --duration 30s -o cpu.pprof
+
+	# take a thread dump of the JVM of a container
+	kubectl debug profile NAMESPACE/POD_NAME -c CONTAINER_NAME --lang java -o threads.txt
+`
+
+	defaultProfileDuration = 30 * time.Second
+
+	// placeholders of the profiler commands, the duration is replaced by the plugin
+	// and the pid of the target by the agent
+	durationPlaceholder  = "KCTLDBG-DURATION"
+	targetPidPlaceholder = "KCTLDBG-TARGET-PID"
+)
+
+// builtinProfilers are the default profiler definitions, the config file may override
+// their fields or add languages
+var builtinProfilers = map[string]ProfilerConfig{
+	"go": {
+		Image:     "curlimages/curl:latest",
+		Command:   []string{"curl", "-sSf", "http://localhost:6060/debug/pprof/profile?seconds=" + durationPlaceholder},
+		Extension: "pprof",
+	},
+	"java": {
+		Image:     "eclipse-temurin:17-jdk",
+		Command:   []string{"jcmd", targetPidPlaceholder, "Thread.print", "-l"},
+		Extension: "txt",
+	},
+	// no public image ships py-spy, the image must be set in the config file
+	"python": {
+		Command: []string{"sh", "-c", "py-spy record --pid " + targetPidPlaceholder + " --duration " + durationPlaceholder +
+			" --format speedscope --output /tmp/profile.json >&2 && cat /tmp/profile.json"},
+		Extension: "json",
+	},
+}
+
+// profileOptions are the options of kubectl debug profile
+type profileOptions struct {
+	lang     string
+	duration time.Duration
+	output   string
+}
+
+func newProfileCmd(opts *DebugOptions) *cobra.Command {
+	profileOpts := &profileOptions{}
+	cmd := &cobra.Command{
+		Use:                   "profile [NAMESPACE/]POD --lang LANG [-o FILE]",
+		DisableFlagsInUseLine: true,
+		Short:                 "Profile the main process of a container",
+		Long: `Profile the main process of a container with the profiler of its language, run in a debug
+container sharing the namespaces of the target, and write the profile to a file.
+
+The profilers are defined by language in the config file, merged over the builtin ones:
+go takes a cpu profile from net/http/pprof on localhost:6060, java takes a thread dump
+with jcmd, and python records the process with py-spy, whose image must be configured.`,
+		Example: profileExample,
+		Args:    cobra.ExactArgs(1),
+		Run: func(c *cobra.Command, args []string) {
+			cmdutil.CheckErr(opts.runProfile(c, args, profileOpts))
+		},
+	}
+	cmd.Flags().StringVar(&profileOpts.lang, "lang", "",
+		"The language of the target process, e.g. go, java or python")
+	cmd.Flags().DurationVar(&profileOpts.duration, "duration", defaultProfileDuration,
+		"The duration of the profile, for the profilers which take one")
+	cmd.Flags().StringVarP(&profileOpts.output, "output", "o", "",
+		"The file to write the profile to, defaults to POD-LANG-TIMESTAMP.EXTENSION")
+	return cmd
+}
+
+// profiler returns the definition of the language, the fields set in the
+// config file override the builtin ones
+func (o *DebugOptions) profiler(lang string) (ProfilerConfig, error) {
+	profiler, builtin := builtinProfilers[lang]
+	configured, ok := o.Profilers[lang]
+	if !builtin && !ok {
+		var langs []string
+		for name := range builtinProfilers {
+			langs = append(langs, name)
+		}
+		for name := range o.Profilers {
+			if _, ok := builtinProfilers[name]; !ok {
+				langs = append(langs, name)
+			}
+		}
+		sort.Strings(langs)
+		return profiler, fmt.Errorf("no profiler for %s, the profilers are %s", lang, strings.Join(langs, ", "))
+	}
+	if len(configured.Image) > 0 {
+		profiler.Image = configured.Image
+	}
+	if len(configured.Command) > 0 {
+		profiler.Command = configured.Command
+	}
+	if len(configured.Extension) > 0 {
+		profiler.Extension = configured.Extension
+	}
+	if len(profiler.Command) < 1 {
+		return profiler, fmt.Errorf("the profiler of %s has no command, set profilers.%s.command in the config file", lang, lang)
+	}
+	return profiler, nil
+}
+
+// profilerCommand replaces the duration placeholder of the command with the seconds of the duration
+func profilerCommand(command []string, duration time.Duration) []string {
+	seconds := strconv.Itoa(int(duration / time.Second))
+	ret := make([]string, len(command))
+	for i, arg := range command {
+		ret[i] = strings.ReplaceAll(arg, durationPlaceholder, seconds)
+	}
+	return ret
+}
+
+func (o *DebugOptions) runProfile(cmd *cobra.Command, args []string, profileOpts *profileOptions) error {
+	if len(profileOpts.lang) < 1 {
+		return cmdutil.UsageErrorf(cmd, "the language must be specified with --lang")
+	}
+	if profileOpts.duration < time.Second {
+		return cmdutil.UsageErrorf(cmd, "--duration must be at least 1s")
+	}
+	if err := o.completeTool(cmd, args[0]); err != nil {
+		return err
+	}
+	profiler, err := o.profiler(profileOpts.lang)
+	if err != nil {
+		return err
+	}
+	// --image overrides the image of the profiler
+	if !cmd.Flag("image").Changed {
+		if len(profiler.Image) < 1 {
+			return fmt.Errorf("the profiler of %s has no image, set profilers.%s.image in the config file or use --image",
+				profileOpts.lang, profileOpts.lang)
+		}
+		o.Image = profiler.Image
+		if !cmd.Flag("image-pull-policy").Changed {
+			o.ImagePullPolicy = defaultImagePullPolicy(o.Image)
+		}
+	}
+	o.Command = profilerCommand(profiler.Command, profileOpts.duration)
+
+	return o.runTool(func(target *toolTarget) error {
+		output := profileOpts.output
+		if len(output) < 1 {
+			output = fmt.Sprintf("%s-%s-%s", target.pod.Name, profileOpts.lang, time.Now().Format("20060102-150405"))
+			if len(profiler.Extension) > 0 {
+				output += "." + profiler.Extension
+			}
+		}
+		r := o.newDebugRequest(target.containerID, false)
+		if err := o.setDebugContainer(r, target.pod); err != nil {
+			return err
+		}
+		uri, header, err := o.debugURL(target.pod, r)
+		if err != nil {
+			return err
+		}
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(o.ErrOut, "profiling %s with %s for %v...\r\n", target.pod.Name, o.Image, profileOpts.duration)
+		err = o.remoteExecute("POST", uri, header, o.Config, nil, f, o.ErrOut, false, nil)
+		f.Close()
+		if err != nil {
+			// the output of a failed profiler is not a profile
+			os.Remove(output)
+			if exitErr, ok := err.(exec.ExitError); ok && exitErr.Exited() {
+				return fmt.Errorf("the profiler exited with code %d", exitErr.ExitStatus())
+			}
+			return err
+		}
+		fmt.Fprintf(o.Out, "profile written to %s\r\n", output)
+		return nil
+	})
+}
@@ -0,0 +1,90 @@
+package plugin
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+func TestProfiler(t *testing.T) {
+	opts := NewDebugOptions(genericclioptions.IOStreams{In: &bytes.Buffer{}, Out: &bytes.Buffer{}, ErrOut: &bytes.Buffer{}})
+	opts.Profilers = map[string]ProfilerConfig{
+		"go":     {Command: []string{"curl", "-sSf", "http://localhost:8080/debug/pprof/heap"}},
+		"python": {Image: "registry.internal/py-spy:0.3"},
+		"node":   {Image: "node:20", Command: []string{"node", "--cpu-prof"}, Extension: "cpuprofile"},
+		"ruby":   {Image: "ruby:3"},
+	}
+	tests := []struct {
+		lang    string
+		want    ProfilerConfig
+		wantErr string
+	}{
+		{
+			lang: "go",
+			want: ProfilerConfig{Image: "curlimages/curl:latest", Command: []string{"curl", "-sSf", "http://localhost:8080/debug/pprof/heap"}, Extension: "pprof"},
+		},
+		{lang: "java", want: builtinProfilers["java"]},
+		{
+			lang: "python",
+			want: ProfilerConfig{Image: "registry.internal/py-spy:0.3", Command: builtinProfilers["python"].Command, Extension: "json"},
+		},
+		{lang: "node", want: opts.Profilers["node"]},
+		{lang: "ruby", wantErr: "the profiler of ruby has no command, set profilers.ruby.command"},
+		{lang: "php", wantErr: "no profiler for php, the profilers are go, java, node, python, ruby"},
+	}
+	for _, tt := range tests {
+		got, err := opts.profiler(tt.lang)
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("profiler(%s) error = %v, want %q", tt.lang, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("profiler(%s) = %+v, %v, want %+v", tt.lang, got, err, tt.want)
+		}
+	}
+	// the builtin profilers are not modified by the config
+	if builtinProfilers["go"].Command[2] != "http://localhost:6060/debug/pprof/profile?seconds="+durationPlaceholder {
+		t.Errorf("the builtin go profiler is modified: %v", builtinProfilers["go"].Command)
+	}
+}
+
+func TestProfilerCommand(t *testing.T) {
+	got := profilerCommand(builtinProfilers["python"].Command, 90*time.Second+500*time.Millisecond)
+	want := "py-spy record --pid " + targetPidPlaceholder + " --duration 90 --format speedscope"
+	if len(got) != 3 || !strings.HasPrefix(got[2], want) {
+		t.Errorf("profilerCommand() = %q, want %q", got, want)
+	}
+	if got := profilerCommand(builtinProfilers["java"].Command, time.Minute); !reflect.DeepEqual(got, builtinProfilers["java"].Command) {
+		t.Errorf("profilerCommand() without a duration = %q", got)
+	}
+}
+
+func TestRunProfileUsage(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    profileOptions
+		wantErr string
+	}{
+		{name: "no language", opts: profileOptions{duration: time.Minute}, wantErr: "the language must be specified with --lang"},
+		{name: "short duration", opts: profileOptions{lang: "go", duration: 500 * time.Millisecond}, wantErr: "--duration must be at least 1s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := NewDebugOptions(genericclioptions.IOStreams{In: &bytes.Buffer{}, Out: &bytes.Buffer{}, ErrOut: &bytes.Buffer{}})
+			cmd, _, err := newDebugCmd(opts).Find([]string{"profile"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = opts.runProfile(cmd, []string{"mypod"}, &tt.opts)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("runProfile() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// the registry used by docker when the image name has no registry part
+	dockerHubRegistry = "docker.io"
+	// legacy secret key holding a username:password or a docker AuthConfig json
+	authStrKey = "authStr"
+)
+
+// the aliases of docker hub found in docker config files
+var dockerHubAliases = map[string]bool{
+	"docker.io":               true,
+	"index.docker.io":         true,
+	"registry-1.docker.io":    true,
+	"registry.hub.docker.com": true,
+}
+
+// dockerConfigEntry is an entry of .dockercfg or the auths of .dockerconfigjson
+type dockerConfigEntry struct {
+	Auth     string `json:"auth,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+// dockerConfigJSON is the content of .dockerconfigjson
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+type keyringEntry struct {
+	host     string
+	path     string
+	username string
+	password string
+	source   string
+}
+
+// registryKeyring collects the registry credentials of several secrets
+// and picks the one matching an image following the docker normalization rules
+type registryKeyring struct {
+	entries []keyringEntry
+	// authStr found in legacy secrets, used for any registry
+	authStr string
+	// the malformed credentials skipped
+	warnings []string
+}
+
+// addSecret adds the credentials of a dockerconfigjson, dockercfg or
+// legacy authStr secret to the keyring, the malformed ones are skipped with a warning
+func (k *registryKeyring) addSecret(secret *corev1.Secret) {
+	source := fmt.Sprintf("%s/%s", secret.Namespace, secret.Name)
+	if authStr, ok := secret.Data[authStrKey]; ok && len(k.authStr) < 1 {
+		k.authStr = string(authStr)
+	}
+	if dta, ok := secret.Data[corev1.DockerConfigJsonKey]; ok {
+		var cfg dockerConfigJSON
+		if err := json.Unmarshal(dta, &cfg); err != nil {
+			k.warnings = append(k.warnings, fmt.Sprintf("failed to parse %s of secret %s: %v", corev1.DockerConfigJsonKey, source, err))
+		} else {
+			k.addEntries(cfg.Auths, source)
+		}
+	}
+	if dta, ok := secret.Data[corev1.DockerConfigKey]; ok {
+		var cfg map[string]dockerConfigEntry
+		if err := json.Unmarshal(dta, &cfg); err != nil {
+			k.warnings = append(k.warnings, fmt.Sprintf("failed to parse %s of secret %s: %v", corev1.DockerConfigKey, source, err))
+		} else {
+			k.addEntries(cfg, source)
+		}
+	}
+}
+
+// addEntries adds the entries in the order of their keys, so that the choice
+// among equally specific entries doesn't depend on the iteration of the map
+func (k *registryKeyring) addEntries(entries map[string]dockerConfigEntry, source string) {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entry := entries[key]
+		username, password := entry.Username, entry.Password
+		if len(entry.Auth) > 0 {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				k.warnings = append(k.warnings, fmt.Sprintf("failed to base 64 decode auth of registry %s in secret %s: %v", key, source, err))
+				continue
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				k.warnings = append(k.warnings, fmt.Sprintf("invalid auth of registry %s in secret %s, expected username:password", key, source))
+				continue
+			}
+			username, password = parts[0], parts[1]
+		}
+		if len(username) < 1 && len(password) < 1 {
+			continue
+		}
+		host, repoPath := normalizeRegistryKey(key)
+		k.entries = append(k.entries, keyringEntry{
+			host:     host,
+			path:     repoPath,
+			username: username,
+			password: password,
+			source:   source,
+		})
+	}
+}
+
+// lookup returns the credentials of the registry of the image as username:password,
+// the most specific entry wins, and the earliest added one among equally specific entries
+func (k *registryKeyring) lookup(image string) (authStr string, source string) {
+	host, repo := parseImageRegistry(image)
+	var best *keyringEntry
+	for i := range k.entries {
+		entry := &k.entries[i]
+		if !registryHostMatches(entry.host, host) {
+			continue
+		}
+		if len(entry.path) > 0 && repo != entry.path && !strings.HasPrefix(repo, entry.path+"/") {
+			continue
+		}
+		if best == nil || len(entry.path) > len(best.path) ||
+			(len(entry.path) == len(best.path) && !strings.Contains(entry.host, "*") && strings.Contains(best.host, "*")) {
+			best = entry
+		}
+	}
+	if best != nil {
+		return best.username + ":" + best.password, best.source
+	}
+	return k.authStr, ""
+}
+
+// normalizeRegistryKey returns the host and the repository path of a docker config key
+// e.g. https://index.docker.io/v1/ -> docker.io, ""
+func normalizeRegistryKey(key string) (string, string) {
+	key = strings.TrimPrefix(key, "https://")
+	key = strings.TrimPrefix(key, "http://")
+	parts := strings.SplitN(strings.Trim(key, "/"), "/", 2)
+	host := strings.ToLower(parts[0])
+	var repoPath string
+	if len(parts) == 2 {
+		repoPath = parts[1]
+	}
+	if dockerHubAliases[host] {
+		host = dockerHubRegistry
+	}
+	// the api version is part of some legacy keys
+	if repoPath == "v1" || repoPath == "v2" {
+		repoPath = ""
+	}
+	return host, repoPath
+}
+
+// parseImageRegistry returns the registry host and the repository path of an image
+// following the docker normalization, e.g. nicolaka/netshoot:latest -> docker.io, nicolaka/netshoot
+// and docker.io/nginx -> docker.io, library/nginx. An invalid image matches no registry.
+func parseImageRegistry(image string) (string, string) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", ""
+	}
+	host := strings.ToLower(reference.Domain(named))
+	if dockerHubAliases[host] {
+		host = dockerHubRegistry
+	}
+	return host, reference.Path(named)
+}
+
+// registryHostMatches matches the host of a docker config key, which may
+// contain wildcards like *.example.com, against the registry host of the image
+func registryHostMatches(pattern, host string) bool {
+	if pattern == host {
+		return true
+	}
+	if !strings.Contains(pattern, "*") {
+		return false
+	}
+	patternParts := strings.Split(pattern, ".")
+	hostParts := strings.Split(host, ".")
+	if len(patternParts) != len(hostParts) {
+		return false
+	}
+	for i := range patternParts {
+		if ok, _ := path.Match(patternParts[i], hostParts[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// registryAuthStr looks up the credentials of the debug image in the registry secrets,
+// and optionally in the image pull secrets of the target pod and its service account
+func (o *DebugOptions) registryAuthStr(pod *corev1.Pod) (string, error) {
+	keyring := &registryKeyring{}
+	addSecret := func(namespace, name string) error {
+		secret, err := o.CoreClient.Secrets(namespace).Get(name, v1.GetOptions{})
+		if err != nil {
+			if errors.IsNotFound(err) {
+				if o.Verbosity > 0 {
+					o.Logger.Printf("Secret %v not found in namespace %v\r\n", name, namespace)
+				}
+				return nil
+			}
+			return err
+		}
+		if o.Verbosity > 1 {
+			o.Logger.Printf("Found secret %v:%v\r\n", namespace, name)
+		}
+		keyring.addSecret(secret)
+		return nil
+	}
+
+	for _, name := range strings.Split(o.RegistrySecretName, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			if err := addSecret(o.RegistrySecretNamespace, name); err != nil {
+				return "", err
+			}
+		}
+	}
+	if o.RegistryUsePodSecrets {
+		for _, ref := range pod.Spec.ImagePullSecrets {
+			if err := addSecret(pod.Namespace, ref.Name); err != nil {
+				return "", err
+			}
+		}
+		serviceAccount := pod.Spec.ServiceAccountName
+		if len(serviceAccount) < 1 {
+			serviceAccount = "default"
+		}
+		sa, err := o.CoreClient.ServiceAccounts(pod.Namespace).Get(serviceAccount, v1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return "", err
+		}
+		if err == nil {
+			for _, ref := range sa.ImagePullSecrets {
+				if err := addSecret(pod.Namespace, ref.Name); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+
+	for _, warning := range keyring.warnings {
+		fmt.Fprintf(o.ErrOut, "warning: %s, skipped\r\n", warning)
+	}
+	authStr, source := keyring.lookup(o.Image)
+	if o.Verbosity > 0 {
+		host, _ := parseImageRegistry(o.Image)
+		switch {
+		case len(source) > 0:
+			o.Logger.Printf("Using credentials of registry %v from secret %v\r\n", host, source)
+		case len(authStr) > 0:
+			o.Logger.Printf("Using credentials from secret key %v\r\n", authStrKey)
+		default:
+			o.Logger.Printf("No credentials found for registry %v\r\n", host)
+		}
+	}
+	return authStr, nil
+}
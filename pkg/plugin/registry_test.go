@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseImageRegistry(t *testing.T) {
+	tests := []struct {
+		image, wantHost, wantRepo string
+	}{
+		{image: "nginx", wantHost: "docker.io", wantRepo: "library/nginx"},
+		{image: "docker.io/nginx", wantHost: "docker.io", wantRepo: "library/nginx"},
+		{image: "index.docker.io/nginx:1.19", wantHost: "docker.io", wantRepo: "library/nginx"},
+		{image: "registry-1.docker.io/library/nginx", wantHost: "docker.io", wantRepo: "library/nginx"},
+		{image: "nicolaka/netshoot:latest", wantHost: "docker.io", wantRepo: "nicolaka/netshoot"},
+		{image: "localhost/debug", wantHost: "localhost", wantRepo: "debug"},
+		{image: "registry.example.com:5000/team/debug@sha256:" + sha256Zero, wantHost: "registry.example.com:5000", wantRepo: "team/debug"},
+		{image: "Invalid/Image", wantHost: "", wantRepo: ""},
+	}
+	for _, tt := range tests {
+		host, repo := parseImageRegistry(tt.image)
+		if host != tt.wantHost || repo != tt.wantRepo {
+			t.Errorf("parseImageRegistry(%q) = %q, %q, want %q, %q", tt.image, host, repo, tt.wantHost, tt.wantRepo)
+		}
+	}
+}
+
+const sha256Zero = "0000000000000000000000000000000000000000000000000000000000000000"
+
+func dockerConfigSecret(name, config string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: name},
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(config)},
+	}
+}
+
+func basicAuth(credentials string) string {
+	return base64.StdEncoding.EncodeToString([]byte(credentials))
+}
+
+func TestRegistryKeyringLookup(t *testing.T) {
+	keyring := &registryKeyring{}
+	keyring.addSecret(dockerConfigSecret("hub", `{"auths":{
+		"https://index.docker.io/v1/":{"auth":"`+basicAuth("hub:pass")+`"},
+		"docker.io/library/nginx":{"username":"nginx","password":"pass"}}}`))
+	keyring.addSecret(dockerConfigSecret("private", `{"auths":{
+		"*.example.com":{"auth":"`+basicAuth("wildcard:pass")+`"},
+		"registry.example.com":{"auth":"`+basicAuth("exact:pass")+`"},
+		"broken.example.com":{"auth":"not base64!"}}}`))
+	keyring.addSecret(&corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "legacy"},
+		Data:       map[string][]byte{authStrKey: []byte("legacy:pass")},
+	})
+	tests := []struct {
+		image, want, wantSource string
+	}{
+		{image: "docker.io/nginx", want: "nginx:pass", wantSource: "default/hub"},
+		{image: "nginx:1.19", want: "nginx:pass", wantSource: "default/hub"},
+		{image: "nicolaka/netshoot", want: "hub:pass", wantSource: "default/hub"},
+		{image: "registry.example.com/debug", want: "exact:pass", wantSource: "default/private"},
+		{image: "mirror.example.com/debug", want: "wildcard:pass", wantSource: "default/private"},
+		{image: "quay.io/debug", want: "legacy:pass"},
+	}
+	for _, tt := range tests {
+		got, source := keyring.lookup(tt.image)
+		if got != tt.want || source != tt.wantSource {
+			t.Errorf("lookup(%q) = %q from %q, want %q from %q", tt.image, got, source, tt.want, tt.wantSource)
+		}
+	}
+	if len(keyring.warnings) != 1 {
+		t.Errorf("warnings = %q, want the malformed auth of broken.example.com", keyring.warnings)
+	}
+}
@@ -0,0 +1,219 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// debugRequestHeader holds the base64 encoded json of the debug session request
+	debugRequestHeader = "X-Kubectl-Debug-Request"
+	debugRequestV1     = "v1"
+)
+
+// debugSessionRequest is the request of a debug session, see agent.DebugSessionRequest
+type debugSessionRequest struct {
+	APIVersion string `json:"apiVersion"`
+	Target     struct {
+		Container string `json:"container"`
+	} `json:"target"`
+	Client struct {
+		Hostname  string `json:"hostname,omitempty"`
+		Username  string `json:"username,omitempty"`
+		Verbosity int    `json:"verbosity,omitempty"`
+	} `json:"client"`
+	Session struct {
+		TTY          bool   `json:"tty,omitempty"`
+		Reattachable bool   `json:"reattachable,omitempty"`
+		DetachKeys   string `json:"detachKeys,omitempty"`
+		Shareable    bool   `json:"shareable,omitempty"`
+		ShareWrite   bool   `json:"shareWrite,omitempty"`
+		Attach       string `json:"attach,omitempty"`
+		Join         string `json:"join,omitempty"`
+		Write        bool   `json:"write,omitempty"`
+	} `json:"session"`
+	Image      string   `json:"image,omitempty"`
+	PullPolicy string   `json:"pullPolicy,omitempty"`
+	Command    []string `json:"command,omitempty"`
+	Env        []string `json:"env,omitempty"`
+	Mounts     []Mount  `json:"mounts,omitempty"`
+	Security   struct {
+		Profile string `json:"profile,omitempty"`
+	} `json:"security"`
+	Limits struct {
+		CPU    string `json:"cpu,omitempty"`
+		Memory string `json:"memory,omitempty"`
+	} `json:"limits"`
+	Lxcfs    bool `json:"lxcfs,omitempty"`
+	Registry struct {
+		Auth          string `json:"auth,omitempty"`
+		SkipTLSVerify bool   `json:"skipTLSVerify,omitempty"`
+	} `json:"registry"`
+}
+
+// newDebugRequest returns the request of a session on the container
+func (o *DebugOptions) newDebugRequest(containerID string, tty bool) *debugSessionRequest {
+	r := &debugSessionRequest{APIVersion: debugRequestV1}
+	r.Target.Container = containerID
+	r.Client.Hostname, _ = os.Hostname()
+	r.Client.Username = o.UserName
+	r.Client.Verbosity = o.Verbosity
+	r.Session.TTY = tty
+	return r
+}
+
+// setDebugContainer sets the debug container of a new session
+func (o *DebugOptions) setDebugContainer(r *debugSessionRequest, pod *corev1.Pod) error {
+	if err := o.requireDebugFeatures(r); err != nil {
+		return err
+	}
+	r.Image = o.Image
+	if o.agentSupports("pullPolicy") {
+		r.PullPolicy = o.ImagePullPolicy
+	}
+	if o.IsLxcfsEnabled {
+		if o.agentSupports("lxcfs") {
+			r.Lxcfs = true
+		} else {
+			fmt.Fprintf(o.ErrOut, "warning: lxcfs is disabled, the agent doesn't support it\r\n")
+		}
+	}
+	if o.RegistrySkipTLSVerify {
+		if o.agentSupports("registrySkipTLS") {
+			r.Registry.SkipTLSVerify = true
+		} else {
+			fmt.Fprintf(o.ErrOut, "warning: the TLS verification of the registry is enabled, the agent doesn't support skipping it\r\n")
+		}
+	}
+	authStr, err := o.registryAuthStr(pod)
+	if err != nil {
+		return err
+	}
+	r.Registry.Auth = authStr
+	r.Command = o.Command
+	r.Env = o.Env
+	r.Mounts = o.Mounts
+	r.Security.Profile = o.SecurityProfile
+	r.Limits.CPU = o.CpuLimits
+	r.Limits.Memory = o.MemoryLimits
+	return nil
+}
+
+// requireDebugFeatures fails if the agent doesn't support the options of the debug
+// container, which would otherwise be ignored
+func (o *DebugOptions) requireDebugFeatures(r *debugSessionRequest) error {
+	var features []string
+	if !r.Session.TTY {
+		features = append(features, "nonInteractive")
+	}
+	if len(o.Env) > 0 {
+		features = append(features, "env")
+	}
+	if len(o.Mounts) > 0 {
+		features = append(features, "mounts")
+	}
+	if len(o.SecurityProfile) > 0 {
+		features = append(features, "securityProfile")
+	}
+	if len(o.CpuLimits) > 0 || len(o.MemoryLimits) > 0 {
+		features = append(features, "limits")
+	}
+	for _, arg := range o.Command {
+		if strings.Contains(arg, targetPidPlaceholder) {
+			features = append(features, "targetPid")
+			break
+		}
+	}
+	return o.requireAgentFeatures(features...)
+}
+
+// debugURL returns the url and the header of the debug request to the agent serving
+// the pod, the request is sent in the header so that the credentials are not part of
+// the url, or as query parameters to the agents predating it
+func (o *DebugOptions) debugURL(pod *corev1.Pod, r *debugSessionRequest) (*url.URL, http.Header, error) {
+	uri, err := o.agentURL(pod, "/api/v1/debug")
+	if err != nil {
+		return nil, nil, err
+	}
+	if !o.agentSupports("sessionRequestV1") {
+		uri.RawQuery = r.legacyParams().Encode()
+		return uri, nil, nil
+	}
+	content, err := json.Marshal(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := http.Header{}
+	header.Set(debugRequestHeader, base64.StdEncoding.EncodeToString(content))
+	return uri, header, nil
+}
+
+// legacyParams returns the query parameters of the request
+func (r *debugSessionRequest) legacyParams() url.Values {
+	params := url.Values{}
+	params.Add("container", r.Target.Container)
+	params.Add("hostname", r.Client.Hostname)
+	params.Add("username", r.Client.Username)
+	params.Add("verbosity", strconv.Itoa(r.Client.Verbosity))
+	if !r.Session.TTY {
+		params.Add("tty", "false")
+	}
+	if r.Session.Reattachable {
+		params.Add("reattachable", "true")
+	}
+	if len(r.Session.DetachKeys) > 0 {
+		params.Add("detachKeys", r.Session.DetachKeys)
+	}
+	if len(r.Session.Attach) > 0 || len(r.Session.Join) > 0 {
+		if len(r.Session.Attach) > 0 {
+			params.Add("session", r.Session.Attach)
+		} else {
+			params.Add("join", r.Session.Join)
+		}
+		if r.Session.Write {
+			params.Add("write", "true")
+		}
+		return params
+	}
+	if r.Session.Shareable {
+		params.Add("shareable", "true")
+	}
+	if r.Session.ShareWrite {
+		params.Add("shareWrite", "true")
+	}
+	params.Add("image", r.Image)
+	if len(r.PullPolicy) > 0 {
+		params.Add("pullPolicy", r.PullPolicy)
+	}
+	params.Add("lxcfsEnabled", strconv.FormatBool(r.Lxcfs))
+	params.Add("registrySkipTLS", strconv.FormatBool(r.Registry.SkipTLSVerify))
+	params.Add("authStr", r.Registry.Auth)
+	commandBytes, _ := json.Marshal(r.Command)
+	params.Add("command", string(commandBytes))
+	if len(r.Env) > 0 {
+		envBytes, _ := json.Marshal(r.Env)
+		params.Add("env", string(envBytes))
+	}
+	if len(r.Mounts) > 0 {
+		mountsBytes, _ := json.Marshal(r.Mounts)
+		params.Add("mounts", string(mountsBytes))
+	}
+	if len(r.Security.Profile) > 0 {
+		params.Add("securityProfile", r.Security.Profile)
+	}
+	if len(r.Limits.CPU) > 0 {
+		params.Add("cpuLimits", r.Limits.CPU)
+	}
+	if len(r.Limits.Memory) > 0 {
+		params.Add("memoryLimits", r.Limits.Memory)
+	}
+	return params
+}
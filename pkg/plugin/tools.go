@@ -0,0 +1,122 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cmdutil "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+	"k8s.io/kubernetes/pkg/util/interrupt"
+)
+
+// toolTarget is the target container of a tool run by the agent
+type toolTarget struct {
+	pod           *corev1.Pod
+	containerName string
+	containerID   string
+}
+
+// completeTool completes the options of a tool subcommand for the pod, the
+// namespace may be given with the pod as NAMESPACE/POD
+func (o *DebugOptions) completeTool(cmd *cobra.Command, pod string) error {
+	namespace := ""
+	if parts := strings.SplitN(pod, "/", 2); len(parts) == 2 {
+		namespace, pod = parts[0], parts[1]
+	}
+	if len(pod) < 1 {
+		return cmdutil.UsageErrorf(cmd, "a pod must be specified")
+	}
+	if len(o.Selector) > 0 {
+		return cmdutil.UsageErrorf(cmd, "%s can't be used with --selector", cmd.Name())
+	}
+	// the namespace is resolved by Complete, e.g. for the debug profiles
+	if len(namespace) > 0 {
+		o.Flags.Namespace = &namespace
+	}
+	if err := o.Complete(cmd, []string{pod}, -1); err != nil {
+		return err
+	}
+	if o.Fork || o.joinsSession() {
+		return fmt.Errorf("%s can't be used with --fork, --attach or --join", cmd.Name())
+	}
+	return o.Validate()
+}
+
+// runTool runs fn against the agent serving the target container, the agent
+// is launched and cleaned up the same way as for a debug session
+func (o *DebugOptions) runTool(fn func(target *toolTarget) error) error {
+	pod, err := o.CoreClient.Pods(o.Namespace).Get(o.PodName, v1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	containerName := o.ContainerName
+	if len(containerName) == 0 {
+		containerName = pod.Spec.Containers[0].Name
+	}
+	if err = o.auth(pod); err != nil {
+		return err
+	}
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return fmt.Errorf("cannot debug in a completed pod; current phase is %s", pod.Status.Phase)
+	}
+	containerID, err := o.getContainerIDByName(pod, containerName)
+	if err != nil {
+		return err
+	}
+	agentPod, err := o.launchAgent(pod)
+	if err != nil {
+		return err
+	}
+	if agentPod, err = o.forwardAgentPort(pod, agentPod); err != nil {
+		o.deleteAgent(agentPod)
+		return err
+	}
+	err = interrupt.Chain(nil, func() {
+		if o.PortForward && o.StopChannel != nil {
+			close(o.StopChannel)
+		}
+		o.deleteAgent(agentPod)
+	}).Run(func() error {
+		if err := o.checkAgent(pod); err != nil {
+			return err
+		}
+		return fn(&toolTarget{pod: pod, containerName: containerName, containerID: containerID})
+	})
+	o.wait.Wait()
+	return err
+}
+
+// toolExecute streams a tool request to the agent, the streams of the tools are not
+// interactive and stdin is only streamed if it is set
+func (o *DebugOptions) toolExecute(target *toolTarget, path string, params url.Values,
+	stdin io.Reader, stdout io.Writer) error {
+	uri, err := o.toolURL(target, path, params)
+	if err != nil {
+		return err
+	}
+	return o.remoteExecute("POST", uri, nil, o.Config, stdin, stdout, o.ErrOut, false, nil)
+}
+
+// toolURL returns the url of a tool request on the target container
+func (o *DebugOptions) toolURL(target *toolTarget, path string, params url.Values) (*url.URL, error) {
+	// the tools are named after their api
+	if err := o.requireAgentFeatures(strings.TrimPrefix(path, "/api/v1/")); err != nil {
+		return nil, err
+	}
+	uri, err := o.agentURL(target.pod, path)
+	if err != nil {
+		return nil, err
+	}
+	params.Set("container", target.containerID)
+	hstNm, _ := os.Hostname()
+	params.Set("hostname", hstNm)
+	params.Set("username", o.UserName)
+	params.Set("verbosity", fmt.Sprintf("%v", o.Verbosity))
+	uri.RawQuery = params.Encode()
+	return uri, nil
+}
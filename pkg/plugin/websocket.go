@@ -0,0 +1,248 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	remoteapi "k8s.io/apimachinery/pkg/util/remotecommand"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/exec"
+)
+
+const (
+	webSocketProtocolV5 = "v5.channel.k8s.io"
+	webSocketProtocolV4 = "v4.channel.k8s.io"
+
+	// the first byte of a websocket message is the channel of its data
+	stdinChannel  = 0
+	stdoutChannel = 1
+	stderrChannel = 2
+	errorChannel  = 3
+	resizeChannel = 4
+	// a close message of the v5 protocol holds the channel to close
+	closeChannel = 255
+)
+
+// webSocketExecutor streams a debug session over the channel websocket protocols,
+// v5.channel.k8s.io is preferred since it signals the end of the stdin
+type webSocketExecutor struct {
+	ws       *websocket.Conn
+	protocol string
+	mu       sync.Mutex
+}
+
+// upgradeRejectedError tells that the agent or a proxy in front of it doesn't speak websocket,
+// the caller falls back to SPDY only on this error
+type upgradeRejectedError struct {
+	reason string
+}
+
+func (e *upgradeRejectedError) Error() string {
+	return "websocket upgrade rejected: " + e.reason
+}
+
+// handshakeConn records the bytes read during the handshake, the response of a rejected upgrade
+type handshakeConn struct {
+	net.Conn
+	handshake bool
+	buf       bytes.Buffer
+}
+
+func (c *handshakeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.handshake && c.buf.Len() < 4096 {
+		c.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// rejection returns the error of a failed handshake, a bad handshake or a 4xx response
+// means the upgrade is rejected, an authorization failure or a server error is returned as is
+func (c *handshakeConn) rejection(err error) error {
+	resp, rerr := http.ReadResponse(bufio.NewReader(bytes.NewReader(c.buf.Bytes())), nil)
+	if rerr != nil {
+		return &upgradeRejectedError{reason: err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusBadRequest {
+		return &upgradeRejectedError{reason: err.Error()}
+	}
+	msg := resp.Status
+	if body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024)); len(bytes.TrimSpace(body)) > 0 {
+		msg = strings.TrimSpace(string(body))
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("agent denied the debug session: %s", msg)
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return fmt.Errorf("agent failed the debug session: %s", msg)
+	}
+	return &upgradeRejectedError{reason: msg}
+}
+
+// newWebSocketExecutor dials the agent with the header, an *upgradeRejectedError tells
+// the caller to fall back to SPDY, the other errors are returned as is
+func newWebSocketExecutor(u *url.URL, header http.Header) (*webSocketExecutor, error) {
+	wsURL := *u
+	switch wsURL.Scheme {
+	case "https":
+		wsURL.Scheme = "wss"
+	default:
+		wsURL.Scheme = "ws"
+	}
+	// the agent only accepts its own origin
+	config, err := websocket.NewConfig(wsURL.String(), (&url.URL{Scheme: u.Scheme, Host: u.Host}).String())
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{webSocketProtocolV5, webSocketProtocolV4}
+	config.Header = header
+
+	host := wsURL.Host
+	if len(wsURL.Port()) == 0 {
+		port := "80"
+		if wsURL.Scheme == "wss" {
+			port = "443"
+		}
+		host = net.JoinHostPort(wsURL.Hostname(), port)
+	}
+	var conn net.Conn
+	if wsURL.Scheme == "wss" {
+		conn, err = tls.Dial("tcp", host, config.TlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	hc := &handshakeConn{Conn: conn, handshake: true}
+	ws, err := websocket.NewClient(config, hc)
+	if err != nil {
+		conn.Close()
+		if _, ok := err.(*websocket.ProtocolError); ok {
+			return nil, hc.rejection(err)
+		}
+		return nil, err
+	}
+	hc.handshake = false
+	protocol := webSocketProtocolV4
+	if len(ws.Config().Protocol) == 1 {
+		protocol = ws.Config().Protocol[0]
+	}
+	return &webSocketExecutor{ws: ws, protocol: protocol}, nil
+}
+
+func (e *webSocketExecutor) write(channel byte, data []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	frame := make([]byte, len(data)+1)
+	frame[0] = channel
+	copy(frame[1:], data)
+	return websocket.Message.Send(e.ws, frame)
+}
+
+// Stream pipes the streams till the agent sends the status of the session,
+// a failure status is returned as error with the exit code if any
+func (e *webSocketExecutor) Stream(options remotecommand.StreamOptions) error {
+	defer e.ws.Close()
+
+	if options.Stdin != nil {
+		go func() {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := options.Stdin.Read(buf)
+				if n > 0 {
+					if werr := e.write(stdinChannel, buf[:n]); werr != nil {
+						return
+					}
+				}
+				if err != nil {
+					if err == io.EOF && e.protocol == webSocketProtocolV5 {
+						e.write(closeChannel, []byte{stdinChannel})
+					}
+					return
+				}
+			}
+		}()
+	}
+	if options.TerminalSizeQueue != nil {
+		go func() {
+			for size := options.TerminalSizeQueue.Next(); size != nil; size = options.TerminalSizeQueue.Next() {
+				data, err := json.Marshal(size)
+				if err != nil {
+					continue
+				}
+				if err := e.write(resizeChannel, data); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(e.ws, &data); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if len(data) < 1 {
+			continue
+		}
+		var out io.Writer
+		switch data[0] {
+		case stdoutChannel:
+			out = options.Stdout
+		case stderrChannel:
+			out = options.Stderr
+		case errorChannel:
+			return decodeStatus(data[1:])
+		}
+		if out != nil && len(data) > 1 {
+			if _, err := out.Write(data[1:]); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// decodeStatus decodes the status written on the error channel the same way as SPDY does
+func decodeStatus(data []byte) error {
+	var status metav1.Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		return fmt.Errorf("error stream protocol error: %v in %q", err, string(data))
+	}
+	if status.Status == metav1.StatusSuccess {
+		return nil
+	}
+	if status.Reason == remoteapi.NonZeroExitCodeReason && status.Details != nil {
+		for _, cause := range status.Details.Causes {
+			if cause.Type != remoteapi.ExitCodeCauseType {
+				continue
+			}
+			rc, err := strconv.ParseUint(cause.Message, 10, 8)
+			if err != nil {
+				return fmt.Errorf("error parsing exit code from status %q: %v", cause.Message, err)
+			}
+			return exec.CodeExitError{
+				Err:  fmt.Errorf("command terminated with exit code %d", rc),
+				Code: int(rc),
+			}
+		}
+	}
+	return fmt.Errorf("error executing remote command: %s", status.Message)
+}
@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestNewWebSocketExecutor(t *testing.T) {
+	wsServer := websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			config.Protocol = []string{webSocketProtocolV5}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) { ws.Close() },
+	}
+	tests := []struct {
+		name         string
+		handler      http.Handler
+		tls          bool
+		closed       bool
+		wantProtocol string
+		wantRejected bool
+		wantErr      string
+	}{
+		{name: "websocket", handler: wsServer, wantProtocol: webSocketProtocolV5},
+		{
+			name:         "not found",
+			handler:      http.NotFoundHandler(),
+			wantRejected: true,
+		},
+		{
+			name: "upgrade ignored",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			}),
+			wantRejected: true,
+		},
+		{
+			name: "forbidden",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "invalid attach token of debug session abc, join it instead", http.StatusForbidden)
+			}),
+			wantErr: "invalid attach token",
+		},
+		{
+			name: "unauthorized",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+			}),
+			wantErr: "401 Unauthorized",
+		},
+		{
+			name: "server error",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "failed to find container", http.StatusInternalServerError)
+			}),
+			wantErr: "failed to find container",
+		},
+		{name: "untrusted certificate", handler: wsServer, tls: true, wantErr: "certificate"},
+		{name: "connection refused", handler: wsServer, closed: true, wantErr: "refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var server *httptest.Server
+			if tt.tls {
+				server = httptest.NewTLSServer(tt.handler)
+			} else {
+				server = httptest.NewServer(tt.handler)
+			}
+			defer server.Close()
+			u, err := url.Parse(server.URL + "/api/v1/debug")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.closed {
+				server.Close()
+			}
+			exec, err := newWebSocketExecutor(u, http.Header{})
+			if len(tt.wantProtocol) > 0 {
+				if err != nil {
+					t.Fatalf("newWebSocketExecutor() error = %v", err)
+				}
+				exec.ws.Close()
+				if exec.protocol != tt.wantProtocol {
+					t.Errorf("protocol = %s, want %s", exec.protocol, tt.wantProtocol)
+				}
+				return
+			}
+			if err == nil {
+				exec.ws.Close()
+				t.Fatalf("newWebSocketExecutor() succeeded, want an error")
+			}
+			_, rejected := err.(*upgradeRejectedError)
+			if rejected != tt.wantRejected {
+				t.Errorf("newWebSocketExecutor() error = %v, falls back to SPDY: %v, want %v", err, rejected, tt.wantRejected)
+			}
+			if len(tt.wantErr) > 0 && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("newWebSocketExecutor() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package term
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigProblem is a problem found in a config file, at a line if known
+type ConfigProblem struct {
+	Line    int
+	Message string
+}
+
+func (p ConfigProblem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("line %d: %s", p.Line, p.Message)
+	}
+	return p.Message
+}
+
+var (
+	yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	yamlKey       = regexp.MustCompile(`^(\s*)(- +)?("[^"]*"|'[^']*'|[^\s#'"][^:#]*?)\s*:(\s|$)`)
+)
+
+// YAMLProblems converts the error of a strict yaml decoding to problems, the type
+// errors and unknown keys are all reported
+func YAMLProblems(err error) []ConfigProblem {
+	var messages []string
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	} else {
+		messages = []string{err.Error()}
+	}
+	var problems []ConfigProblem
+	for _, msg := range messages {
+		if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			problems = append(problems, ConfigProblem{Line: line, Message: m[2]})
+		} else {
+			problems = append(problems, ConfigProblem{Message: msg})
+		}
+	}
+	return problems
+}
+
+// YAMLLines are the lines of the keys of a yaml document by path
+type YAMLLines map[string]int
+
+// Line returns the line of the key, or of its closest ancestor if the key is
+// not in block style, 0 if none is found
+func (l YAMLLines) Line(path string) int {
+	for len(path) > 0 {
+		if line, ok := l[path]; ok {
+			return line
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0
+}
+
+// YAMLKeyLines returns the line of each key of a block style yaml document by its path,
+// e.g. profiles.net.image, the items of the sequences are indexed, e.g. collectors[0].name
+func YAMLKeyLines(content []byte) YAMLLines {
+	type level struct {
+		indent int
+		path   string
+		item   bool
+		// number of the sequence items of the key
+		items int
+	}
+	lines := YAMLLines{}
+	var stack []level
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lineNo := 0
+	blockIndent := -1
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		// the lines of a block scalar are not keys
+		if blockIndent >= 0 {
+			if len(trimmed) < 1 || indent > blockIndent {
+				continue
+			}
+			blockIndent = -1
+		}
+		if len(trimmed) < 1 || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		m := yamlKey.FindStringSubmatch(line)
+		parent := ""
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			// the item belongs to the sequence of the closest key at the same or a lower indentation
+			for len(stack) > 0 && (stack[len(stack)-1].indent > indent ||
+				stack[len(stack)-1].indent == indent && stack[len(stack)-1].item) {
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) > 0 {
+				owner := &stack[len(stack)-1]
+				parent = fmt.Sprintf("%s[%d]", owner.path, owner.items)
+				owner.items++
+				lines[parent] = lineNo
+			}
+			stack = append(stack, level{indent: indent, path: parent, item: true})
+			if m == nil || len(m[2]) < 1 {
+				continue
+			}
+			indent += len(m[2])
+		} else {
+			for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1].path
+			}
+			if m == nil {
+				continue
+			}
+		}
+		path := strings.Trim(m[3], `"'`)
+		if len(parent) > 0 {
+			path = parent + "." + path
+		}
+		if _, ok := lines[path]; !ok {
+			lines[path] = lineNo
+		}
+		stack = append(stack, level{indent: indent, path: path})
+		value := strings.TrimSpace(line[len(m[0]):])
+		if strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">") {
+			blockIndent = indent
+		}
+	}
+	return lines
+}
@@ -0,0 +1,127 @@
+package term
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestYAMLKeyLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    YAMLLines
+	}{
+		{
+			name: "nested maps",
+			content: `image: busybox
+# a comment
+profiles:
+  net:
+    image: nicolaka/netshoot
+
+    command: [bash]
+agent_port: 10027
+`,
+			want: YAMLLines{"image": 1, "profiles": 3, "profiles.net": 4, "profiles.net.image": 5,
+				"profiles.net.command": 7, "agent_port": 8},
+		},
+		{
+			name: "sequences of maps",
+			content: `collectors:
+- name: ss
+  command: [ss, -tnp]
+- name: "ip"
+  namespaces:
+    - net
+allowed_mount_paths:
+  - /sys
+  - /lib/modules
+`,
+			want: YAMLLines{"collectors": 1, "collectors[0]": 2, "collectors[0].name": 2,
+				"collectors[0].command": 3, "collectors[1]": 4, "collectors[1].name": 4,
+				"collectors[1].namespaces": 5, "collectors[1].namespaces[0]": 6,
+				"allowed_mount_paths": 7, "allowed_mount_paths[0]": 8, "allowed_mount_paths[1]": 9},
+		},
+		{
+			name: "block scalars and quoted keys",
+			content: `script: |
+  key: not a key
+  - not an item
+'quoted key': 1
+"other": >
+  folded: text
+last: true
+`,
+			want: YAMLLines{"script": 1, "quoted key": 4, "other": 5, "last": 7},
+		},
+		{
+			name: "documents and urls",
+			content: `---
+registries:
+  "docker.io":
+    mirrors: [https://mirror.example.com]
+url: http://example.com # trailing comment
+`,
+			want: YAMLLines{"registries": 2, "registries.docker.io": 3,
+				"registries.docker.io.mirrors": 4, "url": 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := YAMLKeyLines([]byte(tt.content))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("YAMLKeyLines() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestYAMLLinesLine(t *testing.T) {
+	lines := YAMLLines{"profiles": 3, "profiles.net": 4, "collectors[0]": 8}
+	tests := []struct {
+		path string
+		want int
+	}{
+		{path: "profiles.net", want: 4},
+		// a flow style key is reported at its closest ancestor
+		{path: "profiles.net.env[2]", want: 4},
+		{path: "collectors[0].name", want: 8},
+		{path: "collectors[1].name", want: 0},
+		{path: "unknown", want: 0},
+		{path: "", want: 0},
+	}
+	for _, tt := range tests {
+		if got := lines.Line(tt.path); got != tt.want {
+			t.Errorf("Line(%q) = %d, want %d", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestYAMLProblems(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want []ConfigProblem
+	}{
+		{
+			name: "type errors",
+			err:  &yaml.TypeError{Errors: []string{"line 3: field foo not found in type agent.Config", "cannot unmarshal"}},
+			want: []ConfigProblem{{Line: 3, Message: "field foo not found in type agent.Config"}, {Message: "cannot unmarshal"}},
+		},
+		{
+			name: "syntax error",
+			err:  errors.New("yaml: line 7: mapping values are not allowed in this context"),
+			want: []ConfigProblem{{Line: 7, Message: "mapping values are not allowed in this context"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := YAMLProblems(tt.err); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("YAMLProblems() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package term
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	units "github.com/docker/go-units"
+)
+
+// PullProgress renders the progress of an image pull on a single terminal line
+type PullProgress struct {
+	out   io.Writer
+	ref   string
+	start time.Time
+	drawn time.Time
+}
+
+// NewPullProgress returns a renderer of the pull progress of ref to out
+func NewPullProgress(out io.Writer, ref string) *PullProgress {
+	return &PullProgress{out: out, ref: ref, start: time.Now()}
+}
+
+// Update redraws the line, at most every 100ms unless force is set
+func (p *PullProgress) Update(doneLayers, layers int, current, total int64, force bool) {
+	if !force && time.Since(p.drawn) < 100*time.Millisecond {
+		return
+	}
+	p.drawn = time.Now()
+	line := fmt.Sprintf("pulling %s: %d/%d layers", p.ref, doneLayers, layers)
+	if total > 0 {
+		line += fmt.Sprintf(", %s/%s", units.HumanSize(float64(current)), units.HumanSize(float64(total)))
+	}
+	// clear the previous line and go back to its beginning
+	fmt.Fprintf(p.out, "\r\x1b[K%s, %.1fs", line, time.Since(p.start).Seconds())
+}
+
+// Done ends the progress line
+func (p *PullProgress) Done() {
+	fmt.Fprint(p.out, "\r\n")
+}
+
+type layerProgress struct {
+	current int64
+	total   int64
+	done    bool
+}
+
+// DisplayJSONMessagesCompact reads a docker pull json message stream till the end
+// and renders the progress of all the layers on a single line
+func DisplayJSONMessagesCompact(in io.Reader, out io.Writer, ref string) error {
+	var (
+		dec      = json.NewDecoder(in)
+		progress = NewPullProgress(out, ref)
+		layers   = map[string]*layerProgress{}
+		started  bool
+	)
+	for {
+		var jm JSONMessage
+		if err := dec.Decode(&jm); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if jm.Error != nil {
+			if started {
+				progress.Done()
+			}
+			if jm.Error.Code == 401 {
+				return fmt.Errorf("authentication is required")
+			}
+			return jm.Error
+		}
+		if jm.ID == "" {
+			continue
+		}
+		layer, ok := layers[jm.ID]
+		switch jm.Status {
+		case "Pulling fs layer", "Waiting":
+			if !ok {
+				layers[jm.ID] = &layerProgress{}
+			}
+		case "Downloading":
+			if ok && jm.Progress != nil {
+				layer.current, layer.total = jm.Progress.Current, jm.Progress.Total
+			}
+		case "Download complete":
+			if ok {
+				layer.current = layer.total
+			}
+		case "Pull complete", "Already exists":
+			if !ok {
+				layer = &layerProgress{}
+				layers[jm.ID] = layer
+			}
+			layer.current = layer.total
+			layer.done = true
+		default:
+			// the status of the tag, e.g. "latest: Pulling from nicolaka/netshoot"
+			continue
+		}
+		var doneLayers int
+		var current, total int64
+		for _, l := range layers {
+			if l.done {
+				doneLayers++
+			}
+			current += l.current
+			total += l.total
+		}
+		started = true
+		progress.Update(doneLayers, len(layers), current, total, doneLayers == len(layers))
+	}
+	if started {
+		progress.Done()
+	}
+	return nil
+}